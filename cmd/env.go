@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/TykTechnologies/gromit/env"
 	"github.com/spf13/cobra"
@@ -27,15 +31,28 @@ var envCmd = &cobra.Command{
 // exposeCmd adds r53 entries for Fargate clusters
 var exposeCmd = &cobra.Command{
 	Use:   "expose",
-	Short: "Upsert a record in Route53 for the given ECS cluster",
+	Short: "Reconcile the records in Route53 for the given ECS cluster",
 	Long: `Given an ECS cluster, looks for all tasks with a public IP and 
-makes A records in Route53 accessible as <task>.<cluster>.<domain>.`,
+makes A records in Route53 accessible as <container>.<cluster>.<domain>.
+Records made for the cluster whose tasks have gone away are deleted.
+
+The container is named by the task tag given by --tag. Without the tag,
+the container named after the service of the task is used, or the only
+container of the task. All tasks exposed as the same container share
+a record.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		zone, err := cmd.Flags().GetString("zone")
 		if err != nil || zone == "" {
 			return fmt.Errorf("expose requires zoneid")
 		}
-		return EnvClient.Expose(envName, zone)
+		if envName == "" {
+			return fmt.Errorf("expose requires --env")
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		var rule env.ExposeRule
+		rule.Tag, _ = cmd.Flags().GetString("tag")
+		rule.AllENIs, _ = cmd.Flags().GetBool("all-enis")
+		return expose(cmd, envName, zone, rule, dryRun)
 	},
 }
 
@@ -64,15 +81,173 @@ Supports:
 	},
 }
 
+// upCmd creates or updates the stack for an environment
+var upCmd = &cobra.Command{
+	Use:   "up <name>",
+	Short: "Create or update an environment from the embedded CloudFormation template",
+	Long: `Deploys the template named in the env section of the config file as
+the stack <name>, with the parameters from the config file. Events are
+streamed as the stack is deployed. Once it is complete, records are
+made for its tasks as in expose and the trial licenses in the config
+are stored in SSM. Licenses need the auth token in LICENSER_TOKEN.
+
+Stacks are created with the tag managed-by=gromit. An existing stack
+without it is not updated unless --force is given.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		sc, err := env.LoadStackConfig()
+		if err != nil {
+			return fmt.Errorf("loading env config: %w", err)
+		}
+		params, _ := cmd.Flags().GetStringArray("param")
+		sc.Parameters = mergeParams(sc.Parameters, params)
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		force, _ := cmd.Flags().GetBool("force")
+		if err := EnvClient.Up(name, sc, force, timeout, cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		if err := expose(cmd, name, sc.Zone, sc.Expose, false); err != nil {
+			return err
+		}
+		if noLicenses, _ := cmd.Flags().GetBool("no-licenses"); noLicenses {
+			return nil
+		}
+		return storeLicenses(sc)
+	},
+}
+
+// statusCmd shows the stack and tasks of an environment
+var statusCmd = &cobra.Command{
+	Use:   "status <name>",
+	Short: "Show the stack, tasks, IPs and DNS names of an environment",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sc, err := env.LoadStackConfig()
+		if err != nil {
+			return fmt.Errorf("loading env config: %w", err)
+		}
+		es, err := EnvClient.Status(args[0], sc.Zone, sc.Expose)
+		if err != nil {
+			return err
+		}
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			out, err := json.MarshalIndent(es, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(out))
+			return nil
+		}
+		if es.Stack.Status == "" {
+			fmt.Fprintf(cmd.OutOrStdout(), "stack %s does not exist\n", es.Stack.Name)
+		} else {
+			fmt.Fprintf(cmd.OutOrStdout(), "stack %s is %s %s\n", es.Stack.Name, es.Stack.Status, es.Stack.Reason)
+		}
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TASK\tIPS\tDNS")
+		for _, ts := range es.Tasks {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ts.Name, strings.Join(ts.IPs, ","), ts.DNS)
+		}
+		return tw.Flush()
+	},
+}
+
+// downCmd deletes the stack for an environment
+var downCmd = &cobra.Command{
+	Use:   "down <name>",
+	Short: "Delete an environment and the records for its tasks",
+	Long: `Deletes the stack <name> and the records for its tasks. A stack
+without the tag managed-by=gromit is not deleted unless --force is given.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sc, err := env.LoadStackConfig()
+		if err != nil {
+			return fmt.Errorf("loading env config: %w", err)
+		}
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		force, _ := cmd.Flags().GetBool("force")
+		if err := EnvClient.Down(args[0], force, timeout, cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		// with the cluster gone, this deletes all its records
+		return expose(cmd, args[0], sc.Zone, sc.Expose, false)
+	},
+}
+
+// expose reconciles the records for the cluster and prints the changes
+func expose(cmd *cobra.Command, cluster, zone string, rule env.ExposeRule, dryRun bool) error {
+	changes, err := EnvClient.Expose(cluster, zone, rule, dryRun)
+	for _, rc := range changes {
+		fmt.Fprintln(cmd.OutOrStdout(), rc)
+	}
+	return err
+}
+
+// storeLicenses fetches the trial licenses in the config and stores
+// them in SSM
+func storeLicenses(sc env.StackConfig) error {
+	l := env.Licenser{
+		Client: http.DefaultClient,
+	}
+	for _, pp := range sc.Licenses {
+		product, path, found := strings.Cut(pp, "=")
+		if !found {
+			return fmt.Errorf("license %s is not of the form product=path", pp)
+		}
+		license, err := l.Fetch(sc.Licenser, product, os.Getenv("LICENSER_TOKEN"))
+		if err != nil {
+			return fmt.Errorf("Could not fetch licenses for %s from %s: %w", product, sc.Licenser, err)
+		}
+		if err := EnvClient.StoreLicense(license, path, sc.KMSKey); err != nil {
+			return fmt.Errorf("storing %s license in %s: %w", product, path, err)
+		}
+	}
+	return nil
+}
+
+// mergeParams overrides the Key=Value pairs in params with those in
+// overrides
+func mergeParams(params, overrides []string) []string {
+	merged := append([]string{}, params...)
+	for _, o := range overrides {
+		k, _, _ := strings.Cut(o, "=")
+		replaced := false
+		for i, p := range merged {
+			if pk, _, _ := strings.Cut(p, "="); pk == k {
+				merged[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
 func init() {
 	licenserCmd.Flags().String("baseurl", "https://bots.cluster.internal.tyk.technology/license-bot/", "base url for the licenser endpoint")
 	licenserCmd.Flags().String("token", os.Getenv("GROMIT_LICENSER_TOKEN"), "Auth token for fetching trial license")
 	licenserCmd.Flags().String("key", "215a7274-5652-4521-8a88-b18e02b8f13e", "KMS key id used to encrypt the license")
 
 	exposeCmd.Flags().String("zone", "dev.tyk.technology", "Name of the Route53 hosted zone in which to make entries in")
+	exposeCmd.Flags().Bool("dry-run", false, "Only print the changes that would be made")
+	exposeCmd.Flags().String("tag", env.DefaultExposeTag, "Task tag whose value is the container to make a record for")
+	exposeCmd.Flags().Bool("all-enis", false, "Put the IPs of every network interface of a task in its record")
 	envCmd.AddCommand(exposeCmd)
 	envCmd.AddCommand(licenserCmd)
 
+	upCmd.Flags().StringArray("param", nil, "Key=Value template parameter, overriding the config file, can be repeated")
+	upCmd.Flags().Duration("timeout", 30*time.Minute, "How long to wait for the stack")
+	upCmd.Flags().Bool("no-licenses", false, "Do not store trial licenses")
+	upCmd.Flags().Bool("force", false, "Update the stack even if it was not created by gromit")
+	envCmd.AddCommand(upCmd)
+	statusCmd.Flags().Bool("json", false, "Print the status as JSON")
+	envCmd.AddCommand(statusCmd)
+	downCmd.Flags().Duration("timeout", 30*time.Minute, "How long to wait for the stack to be deleted")
+	downCmd.Flags().Bool("force", false, "Delete the stack even if it was not created by gromit")
+	envCmd.AddCommand(downCmd)
+
 	envCmd.PersistentFlags().StringVar(&envName, "env", "", "ECS Cluster to operate on")
 	rootCmd.AddCommand(envCmd)
 }
@@ -21,11 +21,20 @@ limitations under the License.
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/TykTechnologies/gromit/orgs"
+	"github.com/TykTechnologies/gromit/util"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -53,43 +62,555 @@ var orgsDumpCmd = &cobra.Command{
 	Use:   "dump org0 org1 ...",
 	Short: "Concurrently dump mongo and redis",
 	Long: `Dumps keys from redis that match patterns in -p.
-Dumps mongo records from collections in -u -v -a.
+Dumps mongo records from the collections in --collections if --mongo is set.
 Writes collections in {orgid}_colls/{db}/*.bson and keys in {orgid}.keys.jl. Existing files are clobbered.
-Uses SCAN with COUNT to dump redis keys so can be run in prod.`,
+The count of documents dumped from each collection is written to {orgid}_colls/manifest.json after all the collections.
+Uses SCAN with COUNT to dump redis keys so can be run in prod. Each pattern is scanned
+once, on every master of a cluster, however many orgs are dumped.
+
+Strings, hashes, lists, sets and sorted sets are dumped with their type.
+String keys holding JSON belong to the org in their org_id or
+UserData.org_id field. Other keys need a rule, given with --attribute as
+pattern=kind:arg, where kind is one of
+  json   a dotted path to the org id in a JSON string value
+  key    a regexp for the key name, the org id is the group named org or the first group
+  field  the hash field that holds the org id
+For example: --attribute 'quota-*=key:^quota-([0-9a-f]{24})' --attribute 'rl-*=field:org_id'
+
+Dumps hold API keys and sessions, so every file is compressed with zstd
+and encrypted to the public keys in the --recipient files, as
+{file}.zst.gpg. The SHA-256 of every file is written to dump-manifest.json,
+which is signed with --sign-key from ~/.gnupg/secring.gpg, using
+gpg-agent for the passphrase. Writing plaintext needs --insecure-plaintext.
+Files from earlier dumps in --dir stay in dump-manifest.json if its
+signature is by the same --sign-key, or if neither is signed.`,
 	Args: cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if redisHosts == "" {
+			return errRedisRequired
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 
 		os.MkdirAll(dir, 0755)
+		sealer, err := newSealer(cmd, dir)
+		if err != nil {
+			return err
+		}
 
-		// Redis
 		patterns, _ := cmd.Flags().GetString("patterns")
 		count, _ := cmd.Flags().GetInt64("count")
+		attrs, _ := cmd.Flags().GetStringSlice("attribute")
+		rules, err := orgs.ParseAttributionRules(attrs)
+		if err != nil {
+			return err
+		}
+
+		// Mongo
+		mongoErr := make(chan error, 1)
+		if mongoURL != "" {
+			mdb, err := newMongoClient(ctx, cmd, mongoURL, sealer, nil)
+			if err != nil {
+				return err
+			}
+			defer mdb.Close()
+			go func() {
+				for _, org := range args {
+					if _, err := mdb.DumpOrg(org); err != nil {
+						mongoErr <- err
+						return
+					}
+				}
+				mongoErr <- nil
+			}()
+		} else {
+			mongoErr <- nil
+		}
+
+		// Redis
+		rOpts := orgs.RedisOptions{
+			Addrs:      strings.Split(redisHosts, ","),
+			MasterName: redisMasterName,
+			MaxRetries: redisMaxRetries,
+			BatchSize:  count,
+			Rules:      rules,
+			Sealer:     sealer,
+		}
+
+		rdb := orgs.NewRedisClient(ctx, &rOpts, args, dir)
+		stats, redisErr := rdb.DumpOrgKeys(strings.Split(patterns, ","), count)
+		for _, org := range args {
+			log.Info().Str("org", org).Int("keys", stats.Orgs[org]).Msg("dumped keys")
+		}
+		// the mongo dump must finish before its client is closed
+		if err := errors.Join(redisErr, <-mongoErr); err != nil {
+			return err
+		}
+		return sealer.WriteManifest()
+	},
+}
+
+// orgsRestoreCmd writes dumped keys back to redis
+var orgsRestoreCmd = &cobra.Command{
+	Use:   "restore org0 org1 ...",
+	Short: "Restore redis keys from a dump",
+	Long: `Restores the keys in {orgid}.keys.jl, as written by dump, with the TTL that
+they had when they were dumped. Keys that already exist are handled
+according to --conflict:
+  skip      leave the existing key alone
+  overwrite replace the existing key
+  fail      write nothing if any key exists
+Keys are written in pipelines of --count keys.
+
+If --mongo is set, the collections in {orgid}_colls/manifest.json are
+restored too. Documents are upserted by _id, replacing any existing
+document with the same _id.
+
+Encrypted dumps are decrypted with the secret keys in --keyring, which
+must also hold the public key that signed dump-manifest.json. Every file
+is checked against the manifest before it is read. Passphrases for the
+secret keys come from gpg-agent.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if redisHosts == "" {
+			return errRedisRequired
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		count, _ := cmd.Flags().GetInt64("count")
+		conflict, _ := cmd.Flags().GetString("conflict")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		opener, err := newOpener(cmd, dir)
+		if err != nil {
+			return err
+		}
 
 		rOpts := orgs.RedisOptions{
 			Addrs:      strings.Split(redisHosts, ","),
 			MasterName: redisMasterName,
 			MaxRetries: redisMaxRetries,
 			BatchSize:  count,
+			Opener:     opener,
 		}
 
 		rdb := orgs.NewRedisClient(ctx, &rOpts, args, dir)
-		rdb.DumpOrgKeys(args, strings.Split(patterns, ","), count)
+		err = rdb.RestoreOrgKeys(args, orgs.RestoreOptions{
+			Conflict: conflict,
+			DryRun:   dryRun,
+		})
+		if err != nil || mongoURL == "" {
+			return err
+		}
+		mdb, err := newMongoClient(ctx, cmd, mongoURL, nil, opener)
+		if err != nil {
+			return err
+		}
+		defer mdb.Close()
+		for _, org := range args {
+			if _, err := mdb.RestoreOrg(org, dryRun); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// orgsMigrateCmd copies an org between environments
+var orgsMigrateCmd = &cobra.Command{
+	Use:   "migrate org --from <redis|mongo> --to <redis|mongo>",
+	Short: "Copy an org directly from one environment to another",
+	Long: `Streams the keys and documents of an org from the servers in --from to
+the servers in --to, without writing them to disk. --from and --to are
+given once for redis, as a comma-separated list of hosts, and once for
+mongo, as a mongodb:// URL. Either can be left out to migrate only redis
+or only mongo. Keys are found with -p and --attribute as for dump and
+documents in the collections in --collections.
+
+Keys can be renamed with --rewrite old=new, which replaces the prefix old,
+for example to move from hashed to plain key prefixes. The TTL of keys
+that expire can be extended by --ttl-add, which can be negative, and
+capped by --ttl-max. Keys that would be left with less than a second are
+not copied. Existing keys are handled according to --conflict, skip or
+overwrite. Documents are upserted by _id.
+
+Progress is saved to the --checkpoint file after every batch and an
+interrupted migration resumes from it when run again. Remove it to
+migrate the org from the start.
+
+Afterwards, the number of keys and documents of the org is compared on
+both sides and --sample keys and documents from each collection are
+compared by value. The migration fails if they differ.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		org := args[0]
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		from, _ := cmd.Flags().GetStringArray("from")
+		to, _ := cmd.Flags().GetStringArray("to")
+		srcRedis, srcMongo := splitEndpoints(from)
+		dstRedis, dstMongo := splitEndpoints(to)
+		if (len(srcRedis) == 0) != (len(dstRedis) == 0) || (srcMongo == "") != (dstMongo == "") {
+			return errors.New("--from and --to must both have redis, mongo or both")
+		}
+		if len(srcRedis) == 0 && srcMongo == "" {
+			return errors.New("nothing to migrate, use --from and --to")
+		}
+		cpPath, _ := cmd.Flags().GetString("checkpoint")
+		if cpPath == "" {
+			cpPath = filepath.Join(dir, org+".migrate.json")
+		}
+		cp, err := orgs.LoadCheckpoint(cpPath, org)
+		if err != nil {
+			return err
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		sample, _ := cmd.Flags().GetInt("sample")
+		var reports []orgs.VerifyReport
+
+		if len(srcRedis) > 0 {
+			patterns, _ := cmd.Flags().GetString("patterns")
+			count, _ := cmd.Flags().GetInt64("count")
+			attrs, _ := cmd.Flags().GetStringSlice("attribute")
+			rules, err := orgs.ParseAttributionRules(attrs)
+			if err != nil {
+				return err
+			}
+			specs, _ := cmd.Flags().GetStringSlice("rewrite")
+			rewrites, err := orgs.ParsePrefixRewrites(specs)
+			if err != nil {
+				return err
+			}
+			mOpts := orgs.MigrateOptions{Patterns: strings.Split(patterns, ","), Rewrites: rewrites}
+			mOpts.Conflict, _ = cmd.Flags().GetString("conflict")
+			mOpts.TTLAdd, _ = cmd.Flags().GetDuration("ttl-add")
+			mOpts.TTLMax, _ = cmd.Flags().GetDuration("ttl-max")
+
+			src := orgs.NewRedisClient(ctx, &orgs.RedisOptions{
+				Addrs:      srcRedis,
+				MaxRetries: redisMaxRetries,
+				BatchSize:  count,
+				Rules:      rules,
+			}, args, "")
+			dst := orgs.NewRedisClient(ctx, &orgs.RedisOptions{
+				Addrs:      dstRedis,
+				MaxRetries: redisMaxRetries,
+				BatchSize:  count,
+			}, args, "")
+			if _, err := orgs.MigrateKeys(org, &src, &dst, mOpts, cp); err != nil {
+				return err
+			}
+			if verify {
+				report, err := orgs.VerifyKeys(org, &src, &dst, mOpts, sample)
+				if err != nil {
+					return err
+				}
+				reports = append(reports, report)
+			}
+		}
+
+		if srcMongo != "" {
+			src, err := newMongoClient(ctx, cmd, srcMongo, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			dst, err := newMongoClient(ctx, cmd, dstMongo, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer dst.Close()
+			if _, err := orgs.MigrateDocs(org, &src, &dst, cp); err != nil {
+				return err
+			}
+			if verify {
+				docReports, err := orgs.VerifyDocs(org, &src, &dst, sample)
+				if err != nil {
+					return err
+				}
+				reports = append(reports, docReports...)
+			}
+		}
+
+		failed := 0
+		for _, r := range reports {
+			ev := log.Info()
+			if !r.OK() {
+				ev = log.Error()
+				failed++
+			}
+			ev.Str("org", org).Str("what", r.What).Int("source", r.Source).Int("dest", r.Dest).
+				Int("sampled", r.Sampled).Strs("mismatches", r.Mismatches).Msg("verified")
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d verifications of %s failed", failed, len(reports), org)
+		}
+		return nil
+	},
+}
+
+// orgsAnonymiseCmd rewrites a dump so that it can leave prod
+var orgsAnonymiseCmd = &cobra.Command{
+	Use:   "anonymise <dump> --out <dir>",
+	Short: "Anonymise a dump to take it into a test environment",
+	Long: `Rewrites every org in the dump dir, as written by dump, into --out. Fields of
+redis values and mongo documents are rewritten by the --rule they match,
+given as path=action. A path without dots matches a field of that name
+anywhere, otherwise the dotted path must match from the top. Actions are
+  key     replace the key id, as in key names
+  email   replace with an address at example.com
+  ip      replace IPv4 and IPv6 addresses, keeping CIDR prefixes
+  secret  replace with hex of the same length
+  redact  replace free text
+  drop    remove the field
+  keep    leave the field alone
+Strings that no rule matches are scanned for emails and IPv4 addresses.
+
+Key names that start with a --key-prefix end in a key id, which is
+replaced in the same way wherever it is found, so keys still match the
+documents and sessions that refer to them. --key-names is hash, for the
+hex of an HMAC, or regenerate, for an id that looks like the original
+and keeps the org id at its start.
+
+Every replacement is derived from a seed, so anonymising the same dump
+with the same seed gives the same output. The seed is --seed or the
+contents of --seed-file. If --seed-file does not exist, a seed is
+chosen and written to it, readable only by you. The seed is never
+logged as anyone with it can check guesses at the original values.
+
+The dump is read with --keyring if it is encrypted and the output is
+encrypted with --recipient and --sign-key as for dump.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		inDir := args[0]
+		outDir, _ := cmd.Flags().GetString("out")
+		if outDir == "" {
+			return errors.New("--out is required")
+		}
+		if absPath(inDir) == absPath(outDir) {
+			return errors.New("--out must not be the dump dir")
+		}
+		seed, err := anonSeed(cmd)
+		if err != nil {
+			return err
+		}
+		specs, _ := cmd.Flags().GetStringSlice("rule")
+		rules, err := orgs.ParseAnonRules(specs)
+		if err != nil {
+			return err
+		}
+		keyMode, _ := cmd.Flags().GetString("key-names")
+		prefixes, _ := cmd.Flags().GetStringSlice("key-prefix")
+		anon, err := orgs.NewAnonymiser(seed, rules, keyMode, prefixes)
+		if err != nil {
+			return err
+		}
+
+		dumped, err := orgs.DumpOrgs(inDir)
+		if err != nil {
+			return err
+		}
+		if len(dumped) == 0 {
+			return fmt.Errorf("no dumps found in %s", inDir)
+		}
+		opener, err := newOpener(cmd, inDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return err
+		}
+		sealer, err := newSealer(cmd, outDir)
+		if err != nil {
+			return err
+		}
+		for _, org := range dumped {
+			if _, err := anon.AnonymiseOrg(org, opener, inDir, sealer, outDir); err != nil {
+				return fmt.Errorf("anonymising %s: %w", org, err)
+			}
+		}
+		return sealer.WriteManifest()
 	},
 }
 
+// anonSeed returns the seed from --seed or --seed-file, creating the
+// file with a new seed if it does not exist
+func anonSeed(cmd *cobra.Command) (string, error) {
+	seed, _ := cmd.Flags().GetString("seed")
+	seedFile, _ := cmd.Flags().GetString("seed-file")
+	switch {
+	case seed != "" && seedFile != "":
+		return "", errors.New("only one of --seed and --seed-file can be used")
+	case seed != "":
+		return seed, nil
+	case seedFile == "":
+		return "", errors.New("one of --seed or --seed-file is required")
+	}
+	b, err := os.ReadFile(seedFile)
+	if err == nil {
+		seed = strings.TrimSpace(string(b))
+		if seed == "" {
+			return "", fmt.Errorf("seed file %s is empty", seedFile)
+		}
+		return seed, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	b = make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	seed = hex.EncodeToString(b)
+	f, err := os.OpenFile(seedFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(f, seed); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	log.Info().Str("file", seedFile).Msg("wrote a new seed, use --seed-file to anonymise the same way again")
+	return seed, nil
+}
+
+func absPath(path string) string {
+	abs, _ := filepath.Abs(path)
+	return abs
+}
+
+// splitEndpoints separates mongo URLs from comma-separated redis hosts
+func splitEndpoints(endpoints []string) (redisAddrs []string, mongo string) {
+	for _, e := range endpoints {
+		if strings.HasPrefix(e, "mongodb://") || strings.HasPrefix(e, "mongodb+srv://") {
+			mongo = e
+			continue
+		}
+		redisAddrs = append(redisAddrs, strings.Split(e, ",")...)
+	}
+	return redisAddrs, mongo
+}
+
+// errRedisRequired is returned by the commands that need --redis
+var errRedisRequired = errors.New(`required flag(s) "redis" not set`)
+
+// newMongoClient connects to url for the collections in --collections
+func newMongoClient(ctx context.Context, cmd *cobra.Command, url string, sealer *orgs.Sealer, opener *orgs.Opener) (orgs.MongoClient, error) {
+	specs, _ := cmd.Flags().GetStringSlice("collections")
+	colls, err := orgs.ParseCollections(specs)
+	if err != nil {
+		return orgs.MongoClient{}, err
+	}
+	return orgs.NewMongoClient(ctx, &orgs.MongoOptions{
+		URL:         url,
+		Collections: colls,
+		Sealer:      sealer,
+		Opener:      opener,
+	}, dir)
+}
+
+// newSealer writes to dumpDir, encrypted to the keys in --recipient and
+// signed with --sign-key, unless --insecure-plaintext is set
+func newSealer(cmd *cobra.Command, dumpDir string) (*orgs.Sealer, error) {
+	files, _ := cmd.Flags().GetStringSlice("recipient")
+	signKey, _ := cmd.Flags().GetString("sign-key")
+	plaintext, _ := cmd.Flags().GetBool("insecure-plaintext")
+	if plaintext {
+		if len(files) > 0 {
+			return nil, errors.New("--insecure-plaintext and --recipient are exclusive")
+		}
+		log.Warn().Str("dir", dumpDir).Msg("writing keys in plaintext")
+		return orgs.NewSealer(dumpDir, nil, nil)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("dumps are encrypted, use --recipient or --insecure-plaintext")
+	}
+	var recipients openpgp.EntityList
+	for _, f := range files {
+		kr, err := util.ReadKeyRing(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading recipients from %s: %w", f, err)
+		}
+		recipients = append(recipients, kr...)
+	}
+	if signKey == "" {
+		return nil, errors.New("encrypted dumps are signed, use --sign-key")
+	}
+	kid, err := strconv.ParseUint(strings.TrimPrefix(signKey, "0x"), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing --sign-key %s: %w", signKey, err)
+	}
+	signer, err := util.GetSigningEntity(kid)
+	if err != nil {
+		return nil, err
+	}
+	return orgs.NewSealer(dumpDir, recipients, signer)
+}
+
+// newOpener reads the dump in dumpDir with the keys in --keyring
+func newOpener(cmd *cobra.Command, dumpDir string) (*orgs.Opener, error) {
+	var keyring openpgp.EntityList
+	if path, _ := cmd.Flags().GetString("keyring"); path != "" {
+		var err error
+		if keyring, err = util.ReadKeyRing(path); err != nil {
+			return nil, err
+		}
+	}
+	return orgs.NewOpener(dumpDir, keyring, util.AgentPrompt)
+}
+
 func init() {
 	rootCmd.AddCommand(orgsCmd)
 	orgsCmd.AddCommand(orgsDumpCmd)
+	orgsCmd.AddCommand(orgsRestoreCmd)
+	orgsCmd.AddCommand(orgsMigrateCmd)
+	orgsCmd.AddCommand(orgsAnonymiseCmd)
 
-	orgsCmd.PersistentFlags().StringVarP(&redisHosts, "redis", "r", os.Getenv("REDIS_HOSTS"), "Redis hosts (required), uses REDISCLI_AUTH if set. A comma-separated list will be used as a cluster.")
+	orgsCmd.PersistentFlags().StringVarP(&redisHosts, "redis", "r", os.Getenv("REDIS_HOSTS"), "Redis hosts (required except for migrate), uses REDISCLI_AUTH if set. A comma-separated list will be used as a cluster.")
 	orgsCmd.PersistentFlags().StringVarP(&redisMasterName, "name", "n", os.Getenv("REDIS_MASTER"), "Sentinel master name, failover clients only.")
 	orgsCmd.PersistentFlags().IntVar(&redisMaxRetries, "redis-max-retries", 50, "Maximum Redis failure retries")
 	orgsCmd.PersistentFlags().DurationVarP(&timeout, "timeout", "t", 15*time.Minute, "Timeout for the whole dump/restore process in minutes.")
 	orgsCmd.PersistentFlags().StringVarP(&dir, "dir", "d", ".", "Directory to read/write files")
-	orgsCmd.MarkFlagRequired("redis")
+	orgsCmd.PersistentFlags().StringVarP(&mongoURL, "mongo", "m", os.Getenv("MONGO_URL"), "Mongo connection string, mongo is skipped if not set")
+	orgsCmd.PersistentFlags().StringSlice("collections", orgs.DefaultCollections, "Collections to dump as db.collection[:field], where field holds the org id and defaults to org_id")
 
 	orgsDumpCmd.Flags().StringP("patterns", "p", "apikey-*,tyk-admin-api-*", "Comma separated list of patterns to SCAN for")
 	orgsDumpCmd.PersistentFlags().Int64P("count", "c", 1000, "Passed as COUNT to SCAN, effectively batchsize")
+	orgsDumpCmd.Flags().StringSlice("attribute", nil, "Rule to find the org of keys matching a pattern, see the long help")
+	orgsDumpCmd.Flags().StringSlice("recipient", nil, "File with public keys to encrypt the dump to, can be repeated")
+	orgsDumpCmd.Flags().String("sign-key", "", "Key ID in hex of the secret key that signs the manifest")
+	orgsDumpCmd.Flags().Bool("insecure-plaintext", false, "Write the dump unencrypted")
+
+	orgsRestoreCmd.Flags().Int64P("count", "c", 100, "Number of keys written in each pipeline")
+	orgsRestoreCmd.Flags().String("conflict", orgs.ConflictSkip, "What to do with keys that exist: skip, overwrite or fail")
+	orgsRestoreCmd.Flags().Bool("dry-run", false, "Only count the keys that would be written")
+	orgsMigrateCmd.Flags().StringArray("from", nil, "Source redis hosts or mongo URL, give it once for each")
+	orgsMigrateCmd.Flags().StringArray("to", nil, "Destination redis hosts or mongo URL, give it once for each")
+	orgsMigrateCmd.Flags().StringP("patterns", "p", "apikey-*,tyk-admin-api-*", "Comma separated list of patterns to SCAN for")
+	orgsMigrateCmd.Flags().Int64P("count", "c", 1000, "Passed as COUNT to SCAN and the number of keys written in each pipeline")
+	orgsMigrateCmd.Flags().StringSlice("attribute", nil, "Rule to find the org of keys matching a pattern, see dump")
+	orgsMigrateCmd.Flags().StringSlice("rewrite", nil, "Replace the key prefix old with new, as old=new")
+	orgsMigrateCmd.Flags().Duration("ttl-add", 0, "Added to the TTL of keys that expire")
+	orgsMigrateCmd.Flags().Duration("ttl-max", 0, "Longest TTL for keys that expire, 0 for no limit")
+	orgsMigrateCmd.Flags().String("conflict", orgs.ConflictSkip, "What to do with keys that exist: skip or overwrite")
+	orgsMigrateCmd.Flags().String("checkpoint", "", "Progress file, defaults to {org}.migrate.json in --dir")
+	orgsMigrateCmd.Flags().Bool("verify", true, "Compare the source and destination after migrating")
+	orgsMigrateCmd.Flags().Int("sample", 100, "Number of keys and of documents in each collection compared by value")
+
+	orgsAnonymiseCmd.Flags().String("out", "", "Directory to write the anonymised dump to (required)")
+	orgsAnonymiseCmd.Flags().String("seed", "", "Secret that every replacement is derived from")
+	orgsAnonymiseCmd.Flags().String("seed-file", "", "File with the seed, created with a new seed if it does not exist")
+	orgsAnonymiseCmd.Flags().StringSlice("rule", orgs.DefaultAnonRules, "Rule as path=action, see the long help")
+	orgsAnonymiseCmd.Flags().String("key-names", orgs.KeysRegenerate, "How key ids are replaced: hash or regenerate")
+	orgsAnonymiseCmd.Flags().StringSlice("key-prefix", orgs.DefaultKeyPrefixes, "Prefixes of key names that end in a key id")
+	orgsAnonymiseCmd.Flags().String("keyring", "", "Keyring with the secret keys to decrypt the dump and the public key that signed it")
+	orgsAnonymiseCmd.Flags().StringSlice("recipient", nil, "File with public keys to encrypt the output to, can be repeated")
+	orgsAnonymiseCmd.Flags().String("sign-key", "", "Key ID in hex of the secret key that signs the manifest")
+	orgsAnonymiseCmd.Flags().Bool("insecure-plaintext", false, "Write the output unencrypted")
+
+	orgsRestoreCmd.Flags().String("keyring", "", "Keyring with the secret keys to decrypt the dump and the public key that signed it")
 }
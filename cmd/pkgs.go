@@ -16,12 +16,21 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/TykTechnologies/gromit/pkgs"
+	"github.com/TykTechnologies/gromit/policy"
+	"github.com/TykTechnologies/gromit/util"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -36,30 +45,55 @@ var pkgsCmd = &cobra.Command{
 	Short: "Interact with package repositories",
 	Long: `Binary packages are stored in packcloud.io.
 
-You can perform maintenance using this command tree.`,
+You can perform maintenance using this command tree. With --local, the
+same operations work offline against repo trees on disk.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		pcToken := os.Getenv("PACKAGECLOUD_TOKEN")
-		if pcToken == "" {
-			log.Fatal().Msg("Working with packagecloud.io requires PACKAGECLOUD_TOKEN")
-		}
-		owner, _ := cmd.Flags().GetString("owner")
-		rps, _ := cmd.Flags().GetFloat64("rps")
-		burst, _ := cmd.Flags().GetInt("burst")
-		pkgClient = pkgs.NewClient(pcToken, owner, rps, burst)
+		if localDir, _ := cmd.Flags().GetString("local"); localDir != "" {
+			pkgClient = pkgs.NewStoreClient(pkgs.NewLocalStore(localDir))
+		} else {
+			pcToken := os.Getenv("PACKAGECLOUD_TOKEN")
+			if pcToken == "" {
+				log.Fatal().Msg("Working with packagecloud.io requires PACKAGECLOUD_TOKEN")
+			}
+			owner, _ := cmd.Flags().GetString("owner")
+			rps, _ := cmd.Flags().GetFloat64("rps")
+			burst, _ := cmd.Flags().GetInt("burst")
+			pkgClient = pkgs.NewClient(interruptContext(cmd.Context()), pcToken, owner, rps, burst)
+		}
 		var err error
 		repos, err = pkgs.LoadConfig()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Could not load repo config")
 		}
+		if err := policy.LoadRepoPolicies(&configPolicies); err != nil {
+			log.Fatal().Err(err).Msg("Could not load policy config")
+		}
 	},
 }
 
+// interruptContext returns a context that is cancelled by the first
+// interrupt or SIGTERM, so that requests and retries stop and the
+// command can finish what it was recording. Another signal exits.
+func interruptContext(parent context.Context) context.Context {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Warn().Msg("interrupted, stopping requests to packagecloud")
+	}()
+	return ctx
+}
+
 // pkgsCmd represents the pkgs command
 var cleanSubCmd = &cobra.Command{
 	Use:   "clean <repo>",
 	Args:  cobra.MinimumNArgs(1),
 	Short: "Cleanup packages from the repository",
 	Long: `The packages are removed from the repository. The removed pacakges are downloaded before being removed.
+The packages removed are exactly the ones that 'pkgs plan' reports as pruned, including for repos that use a track.
+A package is only deleted once its backup has been verified against the repo sha256 and recorded in the index in --savedir, see 'pkgs backup'.
+With --keyring, the signature of the backup must also verify against the keyring, and the signing key is recorded in the index.
+Every package listed, skipped as protected, downloaded, verified, deleted or failed is written as a JSON line to --events, followed by a summary line for each repo. The summaries are also written to --summary and sent to statsd as pkgs.clean.<repo>.<action>.
 Each repo is processed sequentially, Deletions within a repo are processed concurrently, limited by the rps and burst parameters. The concurrency level affects the run time by controlling the number of concurrent downloads. 4 downloads `,
 	Run: func(cmd *cobra.Command, args []string) {
 		concurrency, _ := cmd.Flags().GetInt("concurrency")
@@ -68,36 +102,83 @@ Each repo is processed sequentially, Deletions within a repo are processed concu
 		if err != nil {
 			log.Fatal().Err(err).Msg("parsing -delete flag")
 		}
+		kr, err := pkgsKeyring(cmd)
+		if err != nil {
+			log.Fatal().Err(err).Msg("loading keyring")
+		}
+		eventsFile, _ := cmd.Flags().GetString("events")
+		summaryFile, _ := cmd.Flags().GetString("summary")
+		var events io.Writer
+		if eventsFile != "" {
+			f, err := os.Create(eventsFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("creating event log")
+			}
+			defer f.Close()
+			events = f
+		}
 		cc := pkgs.CleanConfig{
 			Concurrency: concurrency,
 			Savedir:     savedir,
 			Delete:      delete,
 			Progress:    true,
+			Keyring:     kr,
+			Events:      pkgs.NewEventLog(events),
 		}
 		ll := zerolog.GlobalLevel()
 		if ll < zerolog.InfoLevel {
 			cc.Progress = false
 			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, NoColor: true, PartsExclude: []string{zerolog.TimestampFieldName}})
 		}
+		tracks, err := pkgs.LoadTracks()
+		if err != nil {
+			log.Fatal().Err(err).Msg("loading tracks config")
+		}
+		var summaries []pkgs.CleanSummary
 		for _, repoName := range args {
 			log.Logger = log.With().Str("repo", repoName).Logger()
 			cc.RepoName = repoName
 			cc.Backup = repos.ShouldBackup(repoName)
-			filter, err := repos.MakeFilter(repoName)
-			if err != nil {
-				log.Warn().Err(err).Msg("making filter")
+			cfg, found := (*repos)[repoName]
+			if !found {
+				log.Warn().Msgf("%s not present in pkgs config", repoName)
 				break
 			}
-			pkgChan, pkgs := pkgClient.AllPackages(repoName, filter)
-			cleanErr := pkgClient.Clean(pkgChan, cc)
-			if err := pkgs.Wait(); err != nil {
+			items, err := pkgClient.ListPackages(repoName)
+			if err != nil {
 				log.Warn().Err(err).Msg("fetching all packages")
 				break
 			}
-			if cleanErr != nil {
-				log.Warn().Err(cleanErr).Msg("cleaning up packages")
+			prot, err := pkgs.PolicyProtections(&configPolicies, repoName, cfg, tracks)
+			if err != nil {
+				log.Warn().Err(err).Msg("deriving protected versions from policy")
+				break
+			}
+			plan, pruned, err := pkgs.Retain(repoName, cfg, tracks, prot, items, time.Now())
+			if err != nil {
+				log.Warn().Err(err).Msg("applying retention policy")
+				break
+			}
+			cc.Events.Plan(plan, items)
+			if err := pkgClient.Clean(pruned, cc); err != nil {
+				log.Warn().Err(err).Msg("cleaning up packages")
+			}
+			summary := cc.Events.Summary(repoName)
+			summary.SendStats()
+			summaries = append(summaries, summary)
+			fmt.Print(plan.Render())
+		}
+		if err := cc.Events.Err(); err != nil {
+			log.Error().Err(err).Msg("event log is incomplete")
+		}
+		if summaryFile != "" {
+			out, err := json.MarshalIndent(summaries, "", "  ")
+			if err != nil {
+				log.Fatal().Err(err).Msg("encoding summary")
+			}
+			if err := os.WriteFile(summaryFile, out, 0644); err != nil {
+				log.Fatal().Err(err).Msg("writing summary")
 			}
-			fmt.Println(repoName, filter)
 		}
 	},
 }
@@ -113,8 +194,13 @@ Repos with a track in the config derive their cutoff from the tracks
 section; other repos use their static versioncutoff/agecutoff, making
 the plan a preview of what 'pkgs clean' would do.
 
+Besides the exceptions in the pkgs config, versions are protected if
+they are the upgradefromver of a policy repo or branch that publishes
+to the repo, the newest patch of a configured release branch or pinned
+in the track. The plan lists the reasons for every protected version.
+
 The JSON output carries the full prune-eligible package list with
-checksums, which later execution stages verify before deleting.`,
+checksums, which 'pkgs apply' verifies before deleting.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		asJSON, _ := cmd.Flags().GetBool("json")
 		tracks, err := pkgs.LoadTracks()
@@ -131,7 +217,11 @@ checksums, which later execution stages verify before deleting.`,
 			if err != nil {
 				return fmt.Errorf("listing %s: %w", repoName, err)
 			}
-			plan, err := pkgs.BuildPlan(repoName, cfg, tracks, items, time.Now())
+			prot, err := pkgs.PolicyProtections(&configPolicies, repoName, cfg, tracks)
+			if err != nil {
+				return fmt.Errorf("deriving protected versions for %s: %w", repoName, err)
+			}
+			plan, err := pkgs.BuildPlan(repoName, cfg, tracks, prot, items, time.Now())
 			if err != nil {
 				return fmt.Errorf("planning %s: %w", repoName, err)
 			}
@@ -151,18 +241,329 @@ checksums, which later execution stages verify before deleting.`,
 	},
 }
 
+var applySubCmd = &cobra.Command{
+	Use:   "apply <plan.json>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Execute a plan made by 'pkgs plan --json'",
+	Long: `Each repo in the plan is listed again and a package is only backed up and
+deleted if its filename and sha256 still match the plan. Plans older than
+--max-age are refused.
+
+Packages are backed up to --savedir unless the repo is configured with
+notbackup. With --keyring, a package whose backup is not signed by a key
+in the keyring is not deleted. Nothing is deleted without --delete. A report of the outcome
+for every package in the plan is written to --report.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		plans, err := pkgs.LoadPlans(args[0])
+		if err != nil {
+			return err
+		}
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		savedir, _ := cmd.Flags().GetString("savedir")
+		delete, _ := cmd.Flags().GetBool("delete")
+		maxAge, _ := cmd.Flags().GetDuration("max-age")
+		reportFile, _ := cmd.Flags().GetString("report")
+		kr, err := pkgsKeyring(cmd)
+		if err != nil {
+			return err
+		}
+
+		var reports []pkgs.ApplyReport
+		var applyErr error
+		for _, plan := range plans {
+			ac := pkgs.ApplyConfig{
+				Concurrency: concurrency,
+				Savedir:     savedir,
+				Backup:      repos.ShouldBackup(plan.Repo),
+				Delete:      delete,
+				MaxAge:      maxAge,
+				Keyring:     kr,
+			}
+			report, err := pkgClient.Apply(plan, ac, time.Now())
+			reports = append(reports, report)
+			if err != nil {
+				applyErr = fmt.Errorf("applying plan for %s: %w", plan.Repo, err)
+				break
+			}
+			cmd.Println(plan.Repo, report.Outcomes)
+		}
+		out, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(reportFile, out, 0644); err != nil {
+			return fmt.Errorf("writing report: %w", err)
+		}
+		return applyErr
+	},
+}
+
+var reportSubCmd = &cobra.Command{
+	Use:   "report <repo>...",
+	Args:  cobra.MinimumNArgs(1),
+	Short: "Inventory of the storage used by each repo",
+	Long: `Every package in each repo is counted, with its size, by minor series,
+distro version, arch and edition. The edition is ee or fips if the
+package name ends in -ee or -fips and ce otherwise. The same version
+uploaded more than once for the same distro and arch is reported as a
+duplicate.
+
+Save the JSON output and pass it to --compare later to see the growth.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		compare, _ := cmd.Flags().GetString("compare")
+		report := pkgs.Report{GeneratedAt: time.Now()}
+		for _, repoName := range args {
+			items, err := pkgClient.ListPackages(repoName)
+			if err != nil {
+				return fmt.Errorf("listing %s: %w", repoName, err)
+			}
+			report.Inventories = append(report.Inventories, pkgs.BuildInventory(repoName, items))
+		}
+		if compare != "" {
+			prev, err := pkgs.LoadReport(compare)
+			if err != nil {
+				return err
+			}
+			report.Growth = report.Compare(prev)
+		}
+		switch format {
+		case "json":
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(out))
+		case "csv":
+			return report.WriteCSV(cmd.OutOrStdout())
+		case "text":
+			for _, inv := range report.Inventories {
+				fmt.Fprint(cmd.OutOrStdout(), inv.Render())
+			}
+			if compare != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "\nGrowth since %s:\n", compare)
+				fmt.Fprint(cmd.OutOrStdout(), pkgs.RenderGrowth(report.Growth))
+			}
+		default:
+			return fmt.Errorf("unknown format %q, expected text, json or csv", format)
+		}
+		return nil
+	},
+}
+
+var restoreSubCmd = &cobra.Command{
+	Use:   "restore <repo>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Upload packages from a backup dir into a repository",
+	Long: `Packages saved by clean or apply are uploaded back into the repo, using
+the distro version that they were saved under. Filters select what is
+restored, for example
+  --filter name=tyk-gateway --filter 'version>=5.0' --filter 'version<5.3' --filter 'distro=el/*'
+
+Terms with the same key are alternatives, different keys must all match.
+The list of what would be done is always printed first. Packages that
+are already in the repo with the same sha256 are skipped.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo := args[0]
+		savedir, _ := cmd.Flags().GetString("from")
+		terms, _ := cmd.Flags().GetStringSlice("filter")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		filter, err := pkgs.ParseRestoreFilter(terms)
+		if err != nil {
+			return err
+		}
+		items, err := pkgClient.PlanRestore(repo, savedir, filter)
+		if err != nil {
+			return err
+		}
+		counts := make(map[string]int)
+		for _, ri := range items {
+			counts[ri.Action]++
+			fmt.Fprintf(cmd.OutOrStdout(), "%s %s/%s %s\n", ri.Action, ri.DistroVersion, ri.Filename, ri.Reason)
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), repo, counts)
+		if dryRun {
+			return nil
+		}
+		items, err = pkgClient.Restore(repo, savedir, items)
+		counts = make(map[string]int)
+		for _, ri := range items {
+			counts[ri.Action]++
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), repo, counts)
+		return err
+	},
+}
+
+var backupSubCmd = &cobra.Command{
+	Use:   "backup <subcmd>",
+	Short: "Inspect the packages saved by clean and apply",
+	Long: `Packages are backed up into --savedir/<name>/<distro>/<version>/ and
+recorded in --savedir/index.json along with the sha256 they were verified
+against. These commands work only on the local backup dir.`,
+	// the backup dir does not need packagecloud
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+}
+
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Args:  cobra.NoArgs,
+	Short: "List the packages in the backup index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		savedir, _ := cmd.Flags().GetString("savedir")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		idx, err := pkgs.OpenBackupIndex(savedir)
+		if err != nil {
+			return err
+		}
+		entries := idx.Entries()
+		if asJSON {
+			out, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(out))
+			return nil
+		}
+		for _, e := range entries {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s %s %s %s %s\n", e.DistroVersion, e.Name, e.Version, e.Arch, e.Path)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%d packages in %s\n", len(entries), savedir)
+		return nil
+	},
+}
+
+var backupVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Args:  cobra.NoArgs,
+	Short: "Check the sha256 of every package in the backup index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		savedir, _ := cmd.Flags().GetString("savedir")
+		idx, err := pkgs.OpenBackupIndex(savedir)
+		if err != nil {
+			return err
+		}
+		problems := idx.Verify()
+		for _, p := range problems {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", p.Path, p.Problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d of %d backups in %s failed verification", len(problems), len(idx.Entries()), savedir)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%d backups in %s verified\n", len(idx.Entries()), savedir)
+		return nil
+	},
+}
+
+var verifySubCmd = &cobra.Command{
+	Use:   "verify <savedir>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Check the signatures of every package in a backup dir",
+	Long: `Every deb and rpm under savedir is checked against --keyring. A detached
+signature in <package>.asc or <package>.sig is used if present, otherwise
+the signature embedded in the package: the _gpgorigin member added by
+debsigs for debs and the header signature for rpms.
+
+Packages that are unsigned, signed by a key that is not in the keyring
+or whose signature does not verify are reported.`,
+	// the backup dir does not need packagecloud
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		kr, err := pkgsKeyring(cmd)
+		if err != nil {
+			return err
+		}
+		if kr == nil {
+			return fmt.Errorf("verify needs --keyring")
+		}
+		var checks []pkgs.SignatureCheck
+		total := 0
+		err = filepath.WalkDir(args[0], func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if ext := filepath.Ext(path); ext != ".deb" && ext != ".rpm" {
+				return nil
+			}
+			total++
+			if sc := pkgs.CheckSignature(kr, path); sc.Status != pkgs.SigValid {
+				checks = append(checks, sc)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			out, err := json.MarshalIndent(checks, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(out))
+		} else {
+			for _, sc := range checks {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s %s %s %s\n", sc.Path, sc.Status, sc.KeyID, sc.Err)
+			}
+		}
+		if len(checks) > 0 {
+			return fmt.Errorf("%d of %d packages in %s are not signed by the keyring", len(checks), total, args[0])
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%d packages in %s verified\n", total, args[0])
+		return nil
+	},
+}
+
+// pkgsKeyring loads the --keyring flag, nil if it was not given
+func pkgsKeyring(cmd *cobra.Command) (openpgp.EntityList, error) {
+	path, _ := cmd.Flags().GetString("keyring")
+	if path == "" {
+		return nil, nil
+	}
+	return util.ReadKeyRing(path)
+}
+
 func init() {
 	pkgsCmd.AddCommand(cleanSubCmd)
 	pkgsCmd.AddCommand(planSubCmd)
+	pkgsCmd.AddCommand(applySubCmd)
+	pkgsCmd.AddCommand(restoreSubCmd)
+	pkgsCmd.AddCommand(reportSubCmd)
+	pkgsCmd.AddCommand(verifySubCmd)
+	backupSubCmd.AddCommand(backupListCmd)
+	backupSubCmd.AddCommand(backupVerifyCmd)
+	pkgsCmd.AddCommand(backupSubCmd)
 	rootCmd.AddCommand(pkgsCmd)
 
 	pkgsCmd.PersistentFlags().String("owner", "tyk", "PackageCloud repo owner")
 	pkgsCmd.PersistentFlags().Float64("rps", 10.0, "Requests per second (see burst also)")
 	pkgsCmd.PersistentFlags().Int("burst", 20, "rps burst rate (see rps also)")
+	pkgsCmd.PersistentFlags().String("local", "", "Use the apt/yum repo trees in this dir instead of packagecloud.io, laid out as <repo>/<distro>/<version>/")
+	pkgsCmd.PersistentFlags().String("keyring", "", "Public keyring that backed up packages must be signed with, armored or binary")
 
 	cleanSubCmd.Flags().Int("concurrency", 3, "Cleanup concurrency level")
 	cleanSubCmd.Flags().String("savedir", "./backup", "Local directory root to save packages before deleting")
 	cleanSubCmd.Flags().Bool("delete", false, "Actually delete the package from the repo")
+	cleanSubCmd.Flags().String("events", "", "File to write a JSON line to for every action taken")
+	cleanSubCmd.Flags().String("summary", "", "File to write the JSON summary of each repo to")
 
 	planSubCmd.Flags().Bool("json", false, "Emit the plan as JSON, including the prune-eligible package list")
+
+	applySubCmd.Flags().Int("concurrency", 3, "Number of packages processed concurrently")
+	applySubCmd.Flags().String("savedir", "./backup", "Local directory root to save packages before deleting")
+	applySubCmd.Flags().Bool("delete", false, "Actually delete the package from the repo")
+	applySubCmd.Flags().Duration("max-age", 24*time.Hour, "Refuse plans generated longer ago than this, 0 accepts any plan")
+	applySubCmd.Flags().String("report", "apply-report.json", "File to write the execution report to")
+
+	reportSubCmd.Flags().String("format", "text", "Output format: text, json or csv")
+	reportSubCmd.Flags().String("compare", "", "Previous JSON report to show growth against")
+
+	restoreSubCmd.Flags().String("from", "./backup", "Local directory root that packages were saved to")
+	restoreSubCmd.Flags().StringSlice("filter", nil, "Restrict the packages restored, see the long help for the syntax")
+	restoreSubCmd.Flags().Bool("dry-run", false, "Only list what would be uploaded")
+
+	verifySubCmd.Flags().Bool("json", false, "Emit the packages that failed as JSON")
+
+	backupSubCmd.PersistentFlags().String("savedir", "./backup", "Local directory root that packages were saved to")
+	backupListCmd.Flags().Bool("json", false, "Emit the index as JSON")
 }
@@ -17,14 +17,17 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/TykTechnologies/gromit/policy"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // polBranch so that it does not conflict with PrBranch
@@ -270,7 +273,91 @@ var generateTuiCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		configDir, _ := cmd.Flags().GetString("config-dir")
 		outDir, _ := cmd.Flags().GetString("out-dir")
-		return policy.GenerateStatic(configDir, outDir)
+		fallbacks, _ := cmd.Flags().GetStringSlice("fallbacks")
+		return policy.GenerateStatic(&configPolicies, configDir, outDir, fallbacks)
+	},
+}
+
+var matrixSubCmd = &cobra.Command{
+	Use:   "matrix <tsv> <repo> <branch> <trigger> <testsuite>",
+	Args:  cobra.ExactArgs(5),
+	Short: "Expand a test variation into the jobs that github will run",
+	Long: `Computes the strategy.matrix for the test job from <tsv>, which is the name of a file in --config-dir without the trailing s.yml, eg. prod-variation.
+The combinations left after applying the exclusions are printed one per line as JSON, followed by the job count.
+Warns if the number of jobs exceeds the github limit or if there are duplicate combinations.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configDir, _ := cmd.Flags().GetString("config-dir")
+		e, err := policy.ExpandMatrix(configDir, args[0], args[1], args[2], args[3], args[4])
+		if err != nil {
+			return err
+		}
+		for _, job := range e.Jobs {
+			j, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), string(j))
+		}
+		cmd.Printf("%d jobs from %s using the %s rule, %d excluded\n", len(e.Jobs), e.Path, e.Rule, len(e.Excluded))
+		for _, w := range e.Warnings() {
+			log.Warn().Msg(w)
+		}
+		return nil
+	},
+}
+
+// variationsCmd groups the commands that work on the test variation files
+var variationsCmd = &cobra.Command{
+	Use:   "variations",
+	Short: "Work with the test variation files used by the TUI",
+}
+
+var variationsLintCmd = &cobra.Command{
+	Use:   "lint [files...]",
+	Short: "Check test variation files for problems",
+	Long: `Checks that the repos and branches in the variation files are managed in the policy config, that every level can be looked up, that no envfile is repeated in a path and that all the files cover the same set of paths.
+The default and master branch levels are fallbacks, so they are allowed for any repo, and a path is covered by another file if that file resolves it through its fallback chain.
+Findings for paths that match a glob in variations.lintallow in the config or in --allow are accepted.
+If no files are given, all the yaml files in --config-dir are linted. Fails if there are any findings.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files := args
+		if len(files) == 0 {
+			configDir, _ := cmd.Flags().GetString("config-dir")
+			var err error
+			files, err = filepath.Glob(filepath.Join(configDir, "*.y*ml"))
+			if err != nil {
+				return err
+			}
+		}
+		allow := viper.GetStringSlice("variations.lintallow")
+		extra, _ := cmd.Flags().GetStringSlice("allow")
+		findings, err := policy.LintVariations(&configPolicies, append(allow, extra...), files...)
+		if err != nil {
+			return err
+		}
+		for _, f := range findings {
+			cmd.Println(f)
+		}
+		if len(findings) > 0 {
+			return fmt.Errorf("%d findings in %v", len(findings), files)
+		}
+		return nil
+	},
+}
+
+var variationsDiffCmd = &cobra.Command{
+	Use:   "diff <old.yml> <new.yml>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Show how the matrix changes for each path between two variation files",
+	Long: `Both files are loaded and inheritance is resolved before comparing, so the output shows the effective change to envfiles, pump and sink images and distros for each (repo, branch, trigger, testsuite).
+Use --markdown to produce output suitable for a PR comment.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		markdown, _ := cmd.Flags().GetBool("markdown")
+		deltas, err := policy.DiffVariations(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return policy.WriteVariationsDiff(cmd.OutOrStdout(), deltas, markdown)
 	},
 }
 
@@ -289,11 +376,21 @@ func init() {
 
 	generateTuiCmd.Flags().String("config-dir", "config/tui", "Directory containing TUI configuration files")
 	generateTuiCmd.Flags().String("out-dir", "public", "Output directory for static files")
+	generateTuiCmd.Flags().StringSlice("fallbacks", policy.DefaultFallbacks, "Rules to try in order when a variation is not known, from exact, glob, default, master")
+
+	matrixSubCmd.Flags().String("config-dir", "config/tui", "Directory containing the test variation files")
+	variationsLintCmd.Flags().String("config-dir", "config/tui", "Directory containing the test variation files")
+	variationsLintCmd.Flags().StringSlice("allow", nil, "Glob of repo/branch/trigger/testsuite paths whose findings are accepted, added to variations.lintallow in the config")
+	variationsDiffCmd.Flags().Bool("markdown", false, "Format the output as markdown")
 
 	matchSubCmd.Flags().String("config", "$HOME/.docker/config.json", "Config file to read authentication token from")
 	matchSubCmd.Flags().String("repos", "tyk-ee,tyk-analytics,tyk-pump,tyk-sink", "Config file to read authentication token from")
 
 	policyCmd.AddCommand(matchSubCmd)
+	policyCmd.AddCommand(matrixSubCmd)
+	variationsCmd.AddCommand(variationsLintCmd)
+	variationsCmd.AddCommand(variationsDiffCmd)
+	policyCmd.AddCommand(variationsCmd)
 	policyCmd.AddCommand(syncSubCmd)
 	policyCmd.AddCommand(controllerSubCmd)
 	policyCmd.AddCommand(diffSubCmd)
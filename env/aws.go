@@ -3,21 +3,41 @@ package env
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
-	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/aws/aws-sdk-go-v2/service/route53"
 	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/rs/zerolog/log"
 )
 
+// Route53API is the part of the Route53 API that is used to manage
+// records for tasks
+type Route53API interface {
+	route53.ListResourceRecordSetsAPIClient
+	ListHostedZonesByName(context.Context, *route53.ListHostedZonesByNameInput, ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error)
+	ChangeResourceRecordSets(context.Context, *route53.ChangeResourceRecordSetsInput, ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error)
+}
+
+// Client talks to the AWS APIs behind the interfaces above. Setting
+// AWS_ENDPOINT_URL makes it use a local stand-in like LocalStack.
 type Client struct {
 	cfg aws.Config
+	ecs ECSAPI
+	ec2 EC2API
+	r53 Route53API
+	cfn CFNAPI
+	ssm SSMAPI
+	// poll is how often a stack is checked while waiting for it
+	poll time.Duration
 }
 
 // NewClientFromProfile returns an object that can be used to control the
@@ -40,64 +60,138 @@ func NewClientFromProfile(profile string) (*Client, error) {
 	}
 	log.Debug().Str("acct", *identity.Account).Str("arn", *identity.Arn).Str("user", *identity.UserId).Msg("identity")
 	return &Client{
-		cfg: cfg,
+		cfg:  cfg,
+		ecs:  ecs.NewFromConfig(cfg),
+		ec2:  ec2.NewFromConfig(cfg),
+		r53:  route53.NewFromConfig(cfg),
+		cfn:  cloudformation.NewFromConfig(cfg),
+		ssm:  ssm.NewFromConfig(cfg),
+		poll: 10 * time.Second,
 	}, nil
 }
 
-// clusterMap contains taskname.clustername -> ENI
-type clusterMap map[string]string
+// Actions in a RecordChange
+const (
+	RecordCreate = "CREATE"
+	RecordUpdate = "UPDATE"
+	RecordDelete = "DELETE"
+)
+
+// RecordChange is a change made to the A record of a task by Expose
+type RecordChange struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	// From is the comma separated IPs in the record before the change
+	From string `json:"from,omitempty"`
+	// To is the comma separated IPs in the record after the change
+	To string `json:"to,omitempty"`
+}
+
+func (rc RecordChange) String() string {
+	switch rc.Action {
+	case RecordCreate:
+		return fmt.Sprintf("%s %s → %s", rc.Action, rc.Name, rc.To)
+	case RecordDelete:
+		return fmt.Sprintf("%s %s (%s)", rc.Action, rc.Name, rc.From)
+	}
+	return fmt.Sprintf("%s %s %s → %s", rc.Action, rc.Name, rc.From, rc.To)
+}
+
+// recordName normalises the name of a record for comparison
+func recordName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
 
-// ExposeCluster will upsert A records with the public IPs for all
-// tasks in the cluster that have public IPs. The records will have
-// the form taskname.clustername.domain.
-func (c *Client) Expose(cluster, zone string) error {
-	log.Logger = log.With().Str("cluster", cluster).Logger()
+// Expose reconciles the A records in zone that have the cluster as
+// their SetIdentifier with the running tasks of the cluster that have
+// public IPs. Records are of the form container.clustername.zone for
+// the container chosen by rule, with the IPs of every task exposed as
+// that container. Records for tasks that are gone are deleted and
+// tasks without a public IP are skipped. With dryRun, the changes are
+// only returned.
+func (c *Client) Expose(cluster, zone string, rule ExposeRule, dryRun bool) ([]RecordChange, error) {
+	// without a cluster, there are no tasks and every record would go
+	if cluster == "" {
+		return nil, fmt.Errorf("a cluster is needed to expose its tasks")
+	}
+	log := log.With().Str("cluster", cluster).Logger()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
-	r53c := route53.NewFromConfig(c.cfg)
-	lhzi := &route53.ListHostedZonesByNameInput{
-		DNSName: aws.String(zone),
+	zid, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
 	}
-	lhzo, err := r53c.ListHostedZonesByName(ctx, lhzi)
+
+	clusterMap, err := getClusterMap(ctx, c.ecs, c.ec2, cluster, rule)
 	if err != nil {
-		return fmt.Errorf("could not find zone for %s: %w", zone, err)
+		return nil, err
 	}
-	var zid string
-	if len(lhzo.HostedZones) > 0 {
-		zid = *lhzo.HostedZones[0].Id
+	desired := make(map[string][]string)
+	for name, enis := range clusterMap {
+		ips, err := getPublicIPs(ctx, c.ec2, name, enis)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			log.Warn().Msgf("skipping %s, it has no public ip", name)
+			continue
+		}
+		desired[recordName(fmt.Sprintf("%s.%s", name, zone))] = ips
 	}
 
-	ecsc := ecs.NewFromConfig(c.cfg)
-	clusterMap, err := getClusterMap(ctx, ecsc, cluster)
+	existing, err := c.clusterRecords(ctx, zid, cluster)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ec2c := ec2.NewFromConfig(c.cfg)
+
 	var changes []r53types.Change
-	for name, eni := range clusterMap {
-		ip, err := getPublicIP(ctx, ec2c, eni)
-		if err != nil {
-			log.Warn().Err(err).Msgf("could not get ip for %s", name)
+	var planned []RecordChange
+	for name, ips := range desired {
+		rc := RecordChange{Action: RecordCreate, Name: name, To: strings.Join(ips, ",")}
+		if rrs, found := existing[name]; found {
+			rc.Action, rc.From = RecordUpdate, recordIPs(rrs)
+			if rc.From == rc.To {
+				continue
+			}
+		}
+		planned = append(planned, rc)
+		var records []r53types.ResourceRecord
+		for _, ip := range ips {
+			records = append(records, r53types.ResourceRecord{Value: aws.String(ip)})
 		}
 		changes = append(changes, r53types.Change{
 			Action: r53types.ChangeActionUpsert,
 			ResourceRecordSet: &r53types.ResourceRecordSet{
-				Name:          aws.String(fmt.Sprintf("%s.%s", name, zone)),
-				Region:        r53types.ResourceRecordSetRegion(c.cfg.Region),
-				TTL:           aws.Int64(10),
-				Type:          r53types.RRType("A"),
-				SetIdentifier: aws.String(cluster),
-				ResourceRecords: []r53types.ResourceRecord{
-					{
-						Value: aws.String(ip),
-					},
-				},
+				Name:            aws.String(name),
+				Region:          r53types.ResourceRecordSetRegion(c.cfg.Region),
+				TTL:             aws.Int64(10),
+				Type:            r53types.RRTypeA,
+				SetIdentifier:   aws.String(cluster),
+				ResourceRecords: records,
 			},
 		})
-		log.Info().Msgf("adding change %s → %s", name, ip)
 	}
+	for name, rrs := range existing {
+		if _, found := desired[name]; found {
+			continue
+		}
+		planned = append(planned, RecordChange{Action: RecordDelete, Name: name, From: recordIPs(rrs)})
+		// a delete must match the record exactly
+		changes = append(changes, r53types.Change{
+			Action:            r53types.ChangeActionDelete,
+			ResourceRecordSet: &rrs,
+		})
+	}
+	sort.Slice(planned, func(i, j int) bool { return planned[i].Name < planned[j].Name })
+	for _, rc := range planned {
+		log.Info().Bool("dryrun", dryRun).Msg(rc.String())
+	}
+	if dryRun || len(changes) == 0 {
+		return planned, nil
+	}
+
 	r53i := &route53.ChangeResourceRecordSetsInput{
 		ChangeBatch: &r53types.ChangeBatch{
 			Changes: changes,
@@ -105,76 +199,59 @@ func (c *Client) Expose(cluster, zone string) error {
 		},
 		HostedZoneId: aws.String(zid),
 	}
-	r53o, err := r53c.ChangeResourceRecordSets(ctx, r53i)
-	log.Trace().Interface("r53o", r53o).Msg("route53 upsert")
+	r53o, err := c.r53.ChangeResourceRecordSets(ctx, r53i)
+	log.Trace().Interface("r53o", r53o).Msg("route53 change")
 	if err != nil {
-		return err
+		return planned, err
 	}
-	return nil
+	return planned, nil
 }
 
-// getClusterMap assumes that there is only one container per task. If
-// there are more than one container in a task, the first one returned
-// by the API will be used. Only Fargate™ tasks are supported as the
-// rest of the processing only works for this case.
-func getClusterMap(ctx context.Context, svc *ecs.Client, cluster string) (clusterMap, error) {
-	cm := make(clusterMap)
-	lti := &ecs.ListTasksInput{
-		Cluster:       aws.String(cluster),
-		DesiredStatus: ecstypes.DesiredStatus("RUNNING"),
-		LaunchType:    ecstypes.LaunchType("FARGATE"),
-	}
-
-	lto, err := svc.ListTasks(ctx, lti)
+// zoneID finds the hosted zone named zone
+func (c *Client) zoneID(ctx context.Context, zone string) (string, error) {
+	lhzo, err := c.r53.ListHostedZonesByName(ctx, &route53.ListHostedZonesByNameInput{
+		DNSName: aws.String(zone),
+	})
 	if err != nil {
-		return cm, err
+		return "", fmt.Errorf("could not find zone for %s: %w", zone, err)
 	}
-	log.Trace().Interface("lto", lto).Msg("found tasks")
-
-	dti := &ecs.DescribeTasksInput{
-		Tasks:   lto.TaskArns,
-		Cluster: aws.String(cluster),
+	// zones are listed from DNSName on, so the first may be another zone
+	for _, hz := range lhzo.HostedZones {
+		if recordName(aws.ToString(hz.Name)) == recordName(zone) {
+			return aws.ToString(hz.Id), nil
+		}
 	}
+	return "", fmt.Errorf("no hosted zone named %s", zone)
+}
 
-	dto, err := svc.DescribeTasks(ctx, dti)
-	if err != nil {
-		return cm, err
-	}
-	log.Trace().Interface("dto", dto)
-	if len(dto.Tasks) < 1 {
-		return cm, fmt.Errorf("no tasks in cluster %s", cluster)
-	}
-	for _, task := range dto.Tasks {
-		if *task.LastStatus == "RUNNING" {
-			for _, d := range task.Attachments[0].Details {
-				if *d.Name == "networkInterfaceId" {
-					cm[fmt.Sprintf("%s.%s", *task.Containers[0].Name, cluster)] = *d.Value
-				}
+// clusterRecords returns the A records in the zone that were made for
+// the cluster by their normalised name. Records without a SetIdentifier
+// were not made by gromit and are never returned.
+func (c *Client) clusterRecords(ctx context.Context, zid, cluster string) (map[string]r53types.ResourceRecordSet, error) {
+	records := make(map[string]r53types.ResourceRecordSet)
+	p := route53.NewListResourceRecordSetsPaginator(c.r53, &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(zid),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing records in %s: %w", zid, err)
+		}
+		for _, rrs := range page.ResourceRecordSets {
+			if rrs.Type == r53types.RRTypeA && rrs.SetIdentifier != nil && *rrs.SetIdentifier == cluster {
+				records[recordName(aws.ToString(rrs.Name))] = rrs
 			}
 		}
 	}
-	return cm, nil
+	return records, nil
 }
 
-// getPublicIP will return the IP associated with the network
-// interface that is returned first
-func getPublicIP(ctx context.Context, svc *ec2.Client, eni string) (string, error) {
-	dnii := &ec2.DescribeNetworkInterfacesInput{
-		NetworkInterfaceIds: []string{
-			eni,
-		},
-	}
-	dnio, err := svc.DescribeNetworkInterfaces(ctx, dnii)
-	if err != nil {
-		return "", err
-	}
-	log.Trace().Interface("netifaces", dnio)
-
-	if len(dnio.NetworkInterfaces) > 0 {
-		assoc := dnio.NetworkInterfaces[0].Association
-		if assoc != nil && assoc.PublicIp != nil {
-			return *assoc.PublicIp, nil
-		}
+// recordIPs lists the sorted values of an A record
+func recordIPs(rrs r53types.ResourceRecordSet) string {
+	ips := make([]string, 0, len(rrs.ResourceRecords))
+	for _, rr := range rrs.ResourceRecords {
+		ips = append(ips, aws.ToString(rr.Value))
 	}
-	return "", fmt.Errorf("no public IP")
+	sort.Strings(ips)
+	return strings.Join(ips, ",")
 }
@@ -0,0 +1,444 @@
+package env
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cfntypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/route53"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeECS lists its tasks two per page
+type fakeECS struct {
+	tasks     []ecstypes.Task
+	instances []ecstypes.ContainerInstance
+	describes int
+}
+
+// fargateTask runs container on eni, any other containers are sidecars
+func fargateTask(container, eni string, sidecars ...string) ecstypes.Task {
+	task := ecstypes.Task{
+		TaskArn:    aws.String("arn:task/" + container + "/" + eni),
+		LastStatus: aws.String("RUNNING"),
+		Containers: []ecstypes.Container{{Name: aws.String(container)}},
+		Attachments: []ecstypes.Attachment{{
+			Type: aws.String("ElasticNetworkInterface"),
+			Details: []ecstypes.KeyValuePair{
+				{Name: aws.String("subnetId"), Value: aws.String("subnet-1")},
+				{Name: aws.String("networkInterfaceId"), Value: aws.String(eni)},
+			},
+		}},
+	}
+	for _, sc := range sidecars {
+		task.Containers = append(task.Containers, ecstypes.Container{Name: aws.String(sc)})
+	}
+	return task
+}
+
+func (f *fakeECS) ListTasks(ctx context.Context, in *ecs.ListTasksInput, _ ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	if in.LaunchType != "" {
+		return nil, fmt.Errorf("tasks of every launch type must be listed")
+	}
+	i := 0
+	if in.NextToken != nil {
+		fmt.Sscan(*in.NextToken, &i)
+	}
+	out := &ecs.ListTasksOutput{}
+	for j := i; j < i+2 && j < len(f.tasks); j++ {
+		out.TaskArns = append(out.TaskArns, aws.ToString(f.tasks[j].TaskArn))
+	}
+	if i+2 < len(f.tasks) {
+		out.NextToken = aws.String(fmt.Sprint(i + 2))
+	}
+	return out, nil
+}
+
+func (f *fakeECS) DescribeTasks(ctx context.Context, in *ecs.DescribeTasksInput, _ ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	f.describes++
+	if len(in.Tasks) == 0 || len(in.Tasks) > 100 {
+		return nil, fmt.Errorf("can describe 1 to 100 tasks, not %d", len(in.Tasks))
+	}
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range in.Tasks {
+		for _, task := range f.tasks {
+			if aws.ToString(task.TaskArn) != arn {
+				continue
+			}
+			if !slices.Contains(in.Include, ecstypes.TaskFieldTags) {
+				task.Tags = nil
+			}
+			out.Tasks = append(out.Tasks, task)
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeECS) DescribeContainerInstances(ctx context.Context, in *ecs.DescribeContainerInstancesInput, _ ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error) {
+	out := &ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range in.ContainerInstances {
+		for _, ci := range f.instances {
+			if aws.ToString(ci.ContainerInstanceArn) == arn {
+				out.ContainerInstances = append(out.ContainerInstances, ci)
+			}
+		}
+	}
+	return out, nil
+}
+
+// fakeEC2 has ENIs with the public IP that is the value, an empty IP
+// is an ENI without a public IP. Describing an ENI in errs fails.
+type fakeEC2 struct {
+	ips       map[string]string
+	errs      map[string]error
+	instances []ec2types.Instance
+}
+
+func (f *fakeEC2) DescribeNetworkInterfaces(ctx context.Context, in *ec2.DescribeNetworkInterfacesInput, _ ...func(*ec2.Options)) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if err := f.errs[in.NetworkInterfaceIds[0]]; err != nil {
+		return nil, err
+	}
+	ip, found := f.ips[in.NetworkInterfaceIds[0]]
+	if !found {
+		return nil, fmt.Errorf("no such eni %s", in.NetworkInterfaceIds[0])
+	}
+	ni := ec2types.NetworkInterface{}
+	if ip != "" {
+		ni.Association = &ec2types.NetworkInterfaceAssociation{PublicIp: aws.String(ip)}
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: []ec2types.NetworkInterface{ni}}, nil
+}
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	r := ec2types.Reservation{}
+	for _, i := range f.instances {
+		if slices.Contains(in.InstanceIds, aws.ToString(i.InstanceId)) {
+			r.Instances = append(r.Instances, i)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{r}}, nil
+}
+
+// fakeR53 lists its records one per page
+type fakeR53 struct {
+	zones   []r53types.HostedZone
+	records []r53types.ResourceRecordSet
+	changes []r53types.Change
+}
+
+func (f *fakeR53) ListHostedZonesByName(ctx context.Context, in *route53.ListHostedZonesByNameInput, _ ...func(*route53.Options)) (*route53.ListHostedZonesByNameOutput, error) {
+	return &route53.ListHostedZonesByNameOutput{HostedZones: f.zones}, nil
+}
+
+func (f *fakeR53) ListResourceRecordSets(ctx context.Context, in *route53.ListResourceRecordSetsInput, _ ...func(*route53.Options)) (*route53.ListResourceRecordSetsOutput, error) {
+	i := 0
+	if in.StartRecordName != nil {
+		fmt.Sscan(*in.StartRecordName, &i)
+	}
+	out := &route53.ListResourceRecordSetsOutput{}
+	if i < len(f.records) {
+		out.ResourceRecordSets = f.records[i : i+1]
+	}
+	if i+1 < len(f.records) {
+		out.IsTruncated = true
+		out.NextRecordName = aws.String(fmt.Sprint(i + 1))
+		out.NextRecordType = r53types.RRTypeA
+	}
+	return out, nil
+}
+
+func (f *fakeR53) ChangeResourceRecordSets(ctx context.Context, in *route53.ChangeResourceRecordSetsInput, _ ...func(*route53.Options)) (*route53.ChangeResourceRecordSetsOutput, error) {
+	if aws.ToString(in.HostedZoneId) != "/hostedzone/Z2" {
+		return nil, fmt.Errorf("wrong zone %s", aws.ToString(in.HostedZoneId))
+	}
+	f.changes = append(f.changes, in.ChangeBatch.Changes...)
+	return &route53.ChangeResourceRecordSetsOutput{}, nil
+}
+
+func aRecord(name, cluster, ip string) r53types.ResourceRecordSet {
+	return r53types.ResourceRecordSet{
+		Name:            aws.String(name),
+		Type:            r53types.RRTypeA,
+		SetIdentifier:   aws.String(cluster),
+		TTL:             aws.Int64(10),
+		ResourceRecords: []r53types.ResourceRecord{{Value: aws.String(ip)}},
+	}
+}
+
+// testClient has a task for every container name -> ENI in tasks
+func testClient(tasks, ips map[string]string) (*Client, *fakeR53) {
+	ecsc := &fakeECS{}
+	for container, eni := range tasks {
+		ecsc.tasks = append(ecsc.tasks, fargateTask(container, eni))
+	}
+	r53 := &fakeR53{
+		zones: []r53types.HostedZone{
+			{Id: aws.String("/hostedzone/Z1"), Name: aws.String("dev.tyk.technology.example.")},
+			{Id: aws.String("/hostedzone/Z2"), Name: aws.String("dev.tyk.technology.")},
+		},
+		records: []r53types.ResourceRecordSet{
+			aRecord("gw.test.dev.tyk.technology.", "test", "1.1.1.1"),
+			aRecord("db.test.dev.tyk.technology.", "test", "2.2.2.2"),
+			aRecord("old.test.dev.tyk.technology.", "test", "3.3.3.3"),
+			aRecord("gw.other.dev.tyk.technology.", "other", "4.4.4.4"),
+			{Name: aws.String("dev.tyk.technology."), Type: r53types.RRTypeNs},
+		},
+	}
+	return &Client{
+		cfg: aws.Config{Region: "eu-central-1"},
+		ecs: ecsc,
+		ec2: &fakeEC2{ips: ips},
+		r53: r53,
+	}, r53
+}
+
+var testRule = ExposeRule{Tag: DefaultExposeTag}
+
+func TestExpose(t *testing.T) {
+	c, r53 := testClient(
+		map[string]string{"gw": "eni-gw", "db": "eni-db", "dash": "eni-dash", "pump": "eni-pump"},
+		map[string]string{"eni-gw": "1.1.1.1", "eni-db": "5.5.5.5", "eni-dash": "6.6.6.6", "eni-pump": ""},
+	)
+	want := []RecordChange{
+		{Action: RecordCreate, Name: "dash.test.dev.tyk.technology", To: "6.6.6.6"},
+		{Action: RecordUpdate, Name: "db.test.dev.tyk.technology", From: "2.2.2.2", To: "5.5.5.5"},
+		{Action: RecordDelete, Name: "old.test.dev.tyk.technology", From: "3.3.3.3"},
+	}
+
+	changes, err := c.Expose("test", "dev.tyk.technology", testRule, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("dry run: got %v, want %v", changes, want)
+	}
+	if len(r53.changes) > 0 {
+		t.Errorf("dry run made changes: %v", r53.changes)
+	}
+
+	changes, err = c.Expose("test", "dev.tyk.technology", testRule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %v, want %v", changes, want)
+	}
+	actions := make(map[string]r53types.Change)
+	for _, ch := range r53.changes {
+		actions[aws.ToString(ch.ResourceRecordSet.Name)] = ch
+	}
+	if len(actions) != 3 {
+		t.Fatalf("expected 3 changes, got %v", r53.changes)
+	}
+	for name, action := range map[string]r53types.ChangeAction{
+		"dash.test.dev.tyk.technology": r53types.ChangeActionUpsert,
+		"db.test.dev.tyk.technology":   r53types.ChangeActionUpsert,
+		"old.test.dev.tyk.technology.": r53types.ChangeActionDelete,
+	} {
+		ch, found := actions[name]
+		if !found || ch.Action != action {
+			t.Errorf("expected %s for %s, got %v", action, name, ch)
+		}
+	}
+	del := actions["old.test.dev.tyk.technology."].ResourceRecordSet
+	if !reflect.DeepEqual(*del, r53.records[2]) {
+		t.Errorf("delete must match the existing record, got %v", *del)
+	}
+	if ups := actions["db.test.dev.tyk.technology"].ResourceRecordSet; aws.ToString(ups.SetIdentifier) != "test" || ups.Region != "eu-central-1" {
+		t.Errorf("upsert is not for the cluster: %v", ups)
+	}
+}
+
+func TestExposeEC2Error(t *testing.T) {
+	c, r53 := testClient(
+		map[string]string{"gw": "eni-gw", "db": "eni-db"},
+		map[string]string{"eni-gw": "1.1.1.1", "eni-db": "2.2.2.2"},
+	)
+	c.ec2.(*fakeEC2).errs = map[string]error{
+		"eni-db": &smithy.GenericAPIError{Code: "RequestLimitExceeded", Message: "Request limit exceeded."},
+	}
+	changes, err := c.Expose("test", "dev.tyk.technology", testRule, false)
+	if err == nil {
+		t.Fatal("expected the EC2 error to abort expose")
+	}
+	if len(changes) > 0 || len(r53.changes) > 0 {
+		t.Errorf("no changes expected when the cluster could not be seen, got %v and %v", changes, r53.changes)
+	}
+	c.cfn = &fakeCFN{status: cfntypes.StackStatusCreateComplete}
+	if _, err := c.Status("test", "dev.tyk.technology", testRule); err == nil {
+		t.Error("expected the EC2 error from status")
+	}
+}
+
+func TestExposeNoTasks(t *testing.T) {
+	c, r53 := testClient(nil, nil)
+	changes, err := c.Expose("test", "dev.tyk.technology", testRule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || len(r53.changes) != 3 {
+		t.Fatalf("expected all records of the cluster to be deleted, got %v", changes)
+	}
+	for _, ch := range r53.changes {
+		if ch.Action != r53types.ChangeActionDelete || aws.ToString(ch.ResourceRecordSet.SetIdentifier) != "test" {
+			t.Errorf("unexpected change %v", ch)
+		}
+	}
+
+	_, err = c.Expose("test", "tyk.technology", testRule, false)
+	if err == nil {
+		t.Error("expected an error for a zone that does not exist")
+	}
+}
+
+// TestExposePlainRecords keeps records that were not made for a cluster
+func TestExposePlainRecords(t *testing.T) {
+	c, r53 := testClient(nil, nil)
+	plain := aRecord("www.dev.tyk.technology.", "", "7.7.7.7")
+	plain.SetIdentifier = nil
+	r53.records = append(r53.records, plain)
+
+	if _, err := c.Expose("", "dev.tyk.technology", testRule, false); err == nil {
+		t.Error("expected an error without a cluster")
+	}
+	if len(r53.changes) > 0 {
+		t.Fatalf("no changes expected without a cluster, got %v", r53.changes)
+	}
+	if _, err := c.Expose("test", "dev.tyk.technology", testRule, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range r53.changes {
+		if aws.ToString(ch.ResourceRecordSet.Name) == "www.dev.tyk.technology." {
+			t.Errorf("a plain record was changed: %v", ch)
+		}
+	}
+	if len(r53.changes) != 3 {
+		t.Errorf("expected only the records of the cluster to be deleted, got %v", r53.changes)
+	}
+	records, err := c.clusterRecords(context.Background(), "/hostedzone/Z2", "")
+	if err != nil || len(records) > 0 {
+		t.Errorf("records without a SetIdentifier belong to no cluster, got %v, %v", records, err)
+	}
+}
+
+func TestExposeInSync(t *testing.T) {
+	c, r53 := testClient(
+		map[string]string{"gw": "eni-gw", "db": "eni-db"},
+		map[string]string{"eni-gw": "1.1.1.1", "eni-db": "2.2.2.2"},
+	)
+	r53.records = r53.records[:2]
+	changes, err := c.Expose("test", "dev.tyk.technology", testRule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 || len(r53.changes) > 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	ecsc := &fakeECS{}
+	for i := range 250 {
+		ecsc.tasks = append(ecsc.tasks, fargateTask("worker", fmt.Sprintf("eni-w%03d", i)))
+	}
+	svc := fargateTask("gw", "eni-gw", "envoy")
+	svc.Group = aws.String("service:gw")
+	tagged := fargateTask("dash", "eni-dash", "logrouter")
+	tagged.Tags = []ecstypes.Tag{{Key: aws.String(DefaultExposeTag), Value: aws.String("dash")}}
+	hidden := fargateTask("pump", "eni-pump")
+	hidden.Tags = []ecstypes.Tag{{Key: aws.String(DefaultExposeTag), Value: aws.String("")}}
+	ambiguous := fargateTask("a", "eni-a", "b")
+	stopped := fargateTask("old", "eni-old")
+	stopped.LastStatus = aws.String("STOPPED")
+	multi := fargateTask("mdcb", "eni-mdcb")
+	multi.Attachments = append(multi.Attachments, ecstypes.Attachment{
+		Type:    aws.String("ElasticNetworkInterface"),
+		Details: []ecstypes.KeyValuePair{{Name: aws.String("networkInterfaceId"), Value: aws.String("eni-mdcb2")}},
+	})
+	// an EC2 task in bridge mode
+	bridge := ecstypes.Task{
+		TaskArn:              aws.String("arn:task/redis"),
+		LastStatus:           aws.String("RUNNING"),
+		Containers:           []ecstypes.Container{{Name: aws.String("redis")}},
+		ContainerInstanceArn: aws.String("arn:ci/1"),
+	}
+	ecsc.tasks = append(ecsc.tasks, svc, tagged, hidden, ambiguous, stopped, multi, bridge)
+	ecsc.instances = []ecstypes.ContainerInstance{
+		{ContainerInstanceArn: aws.String("arn:ci/1"), Ec2InstanceId: aws.String("i-1")},
+	}
+	ec2c := &fakeEC2{instances: []ec2types.Instance{{
+		InstanceId: aws.String("i-1"),
+		NetworkInterfaces: []ec2types.InstanceNetworkInterface{
+			{NetworkInterfaceId: aws.String("eni-i1-1"), Attachment: &ec2types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(1)}},
+			{NetworkInterfaceId: aws.String("eni-i1-0"), Attachment: &ec2types.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int32(0)}},
+		},
+	}}}
+
+	cm, err := getClusterMap(context.Background(), ecsc, ec2c, "test", testRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecsc.describes != 3 {
+		t.Errorf("expected tasks to be described in batches of 100, got %d calls", ecsc.describes)
+	}
+	if len(cm["worker.test"]) != 250 {
+		t.Errorf("expected every worker task, got %d", len(cm["worker.test"]))
+	}
+	delete(cm, "worker.test")
+	want := clusterMap{
+		"gw.test":    {"eni-gw"},
+		"dash.test":  {"eni-dash"},
+		"mdcb.test":  {"eni-mdcb"},
+		"redis.test": {"eni-i1-0"},
+	}
+	if !reflect.DeepEqual(cm, want) {
+		t.Errorf("got %v, want %v", cm, want)
+	}
+
+	cm, err = getClusterMap(context.Background(), ecsc, ec2c, "test", ExposeRule{Tag: DefaultExposeTag, AllENIs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cm["mdcb.test"], []string{"eni-mdcb", "eni-mdcb2"}) || !reflect.DeepEqual(cm["redis.test"], []string{"eni-i1-0", "eni-i1-1"}) {
+		t.Errorf("expected every ENI, got %v and %v", cm["mdcb.test"], cm["redis.test"])
+	}
+
+	// a tag that names a container that is not in the task
+	tagged.Tags[0].Value = aws.String("gw")
+	if _, expose := testRule.containerName(tagged); expose {
+		t.Error("a task must not be exposed as a container it does not have")
+	}
+	if name, expose := (ExposeRule{}).containerName(svc); !expose || name != "gw" {
+		t.Errorf("a service task is exposed as the service container, got %s", name)
+	}
+}
+
+func TestExposeMultipleTasks(t *testing.T) {
+	c, r53 := testClient(nil, map[string]string{"eni-gw1": "9.9.9.9", "eni-gw2": "1.1.1.1", "eni-gw3": ""})
+	c.ecs.(*fakeECS).tasks = []ecstypes.Task{
+		fargateTask("gw", "eni-gw1"),
+		fargateTask("gw", "eni-gw2"),
+		fargateTask("gw", "eni-gw3"),
+	}
+	changes, err := c.Expose("test", "dev.tyk.technology", testRule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[1].Name != "gw.test.dev.tyk.technology" || changes[1].To != "1.1.1.1,9.9.9.9" {
+		t.Errorf("expected one record with the IPs of both tasks, got %v", changes)
+	}
+	for _, ch := range r53.changes {
+		if aws.ToString(ch.ResourceRecordSet.Name) == "gw.test.dev.tyk.technology" && len(ch.ResourceRecordSet.ResourceRecords) != 2 {
+			t.Errorf("expected two values, got %v", ch.ResourceRecordSet.ResourceRecords)
+		}
+	}
+}
@@ -10,14 +10,18 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// SSMAPI is the part of the SSM API that is used to store licenses
+type SSMAPI interface {
+	PutParameter(context.Context, *ssm.PutParameterInput, ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+}
+
 // PutSecureParameter will store the given string in the supplied path as a SecureString.
 // The parameter will be created if needed.
 func (c *Client) StoreLicense(value, path, keyid string) error {
-	ssmc := ssm.NewFromConfig(c.cfg)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	op, err := ssmc.PutParameter(ctx, &ssm.PutParameterInput{
+	op, err := c.ssm.PutParameter(ctx, &ssm.PutParameterInput{
 		Name:      aws.String(path),
 		Value:     aws.String(value),
 		Type:      ssmtypes.ParameterTypeSecureString,
@@ -0,0 +1,368 @@
+package env
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cfntypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	r53types "github.com/aws/aws-sdk-go-v2/service/route53/types"
+	"github.com/aws/smithy-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+//go:embed cft/*.yaml
+var templates embed.FS
+
+// CFNAPI is the part of the CloudFormation API that is used to manage
+// the stack of an environment
+type CFNAPI interface {
+	cloudformation.DescribeStacksAPIClient
+	cloudformation.DescribeStackEventsAPIClient
+	CreateStack(context.Context, *cloudformation.CreateStackInput, ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error)
+	UpdateStack(context.Context, *cloudformation.UpdateStackInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error)
+	DeleteStack(context.Context, *cloudformation.DeleteStackInput, ...func(*cloudformation.Options)) (*cloudformation.DeleteStackOutput, error)
+}
+
+// StackConfig models the env section of the config file
+type StackConfig struct {
+	// Template is the name of an embedded template in env/cft
+	Template string
+	// Zone is the Route53 zone in which records are made for tasks
+	Zone string
+	// Parameters are Key=Value pairs passed to the template, the name
+	// of the environment is always passed as the Name parameter
+	Parameters []string
+	// Licenses are product=path pairs, the trial license for the
+	// product is stored in SSM at path once the stack is up
+	Licenses []string
+	// Licenser is the base url of the licenser
+	Licenser string
+	// KMSKey is the key used to encrypt the licenses
+	KMSKey string
+	// Expose decides which containers of the tasks get records
+	Expose ExposeRule
+}
+
+// LoadStackConfig returns the env section of the embedded or supplied
+// config file
+func LoadStackConfig() (StackConfig, error) {
+	var sc StackConfig
+	if err := viper.UnmarshalKey("env", &sc); err != nil {
+		return sc, err
+	}
+	if sc.Template == "" {
+		return sc, fmt.Errorf("env.template is not set")
+	}
+	if sc.Expose.Tag == "" {
+		sc.Expose.Tag = DefaultExposeTag
+	}
+	return sc, nil
+}
+
+// managedTag marks the stacks that gromit created, only those are
+// updated or deleted without being forced
+var managedTag = cfntypes.Tag{Key: aws.String("managed-by"), Value: aws.String("gromit")}
+
+// StackStatus is the state of the stack of an environment, a stack
+// that does not exist has an empty Status
+type StackStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	// Managed is true if the stack has the managed-by=gromit tag
+	Managed bool `json:"managed"`
+}
+
+// checkManaged refuses to change a stack that gromit did not create,
+// unless forced
+func (ss StackStatus) checkManaged(force bool) error {
+	if ss.Managed || force {
+		return nil
+	}
+	return fmt.Errorf("stack %s does not have the tag %s=%s so it was not made by gromit, use --force to change it anyway",
+		ss.Name, aws.ToString(managedTag.Key), aws.ToString(managedTag.Value))
+}
+
+// Stack statuses that do not change without another operation
+var (
+	stackSucceeded = []cfntypes.StackStatus{
+		cfntypes.StackStatusCreateComplete,
+		cfntypes.StackStatusUpdateComplete,
+		cfntypes.StackStatusImportComplete,
+		cfntypes.StackStatusDeleteComplete,
+	}
+	stackFailed = []cfntypes.StackStatus{
+		cfntypes.StackStatusCreateFailed,
+		cfntypes.StackStatusRollbackComplete,
+		cfntypes.StackStatusRollbackFailed,
+		cfntypes.StackStatusDeleteFailed,
+		cfntypes.StackStatusUpdateFailed,
+		cfntypes.StackStatusUpdateRollbackComplete,
+		cfntypes.StackStatusUpdateRollbackFailed,
+		cfntypes.StackStatusImportRollbackComplete,
+		cfntypes.StackStatusImportRollbackFailed,
+	}
+)
+
+// stackParameters returns the template parameters for the environment
+// name from Key=Value pairs
+func stackParameters(name string, kvs []string) ([]cfntypes.Parameter, error) {
+	params := []cfntypes.Parameter{
+		{ParameterKey: aws.String("Name"), ParameterValue: aws.String(name)},
+	}
+	for _, kv := range kvs {
+		k, v, found := strings.Cut(kv, "=")
+		if !found || k == "" {
+			return nil, fmt.Errorf("parameter %s is not of the form Key=Value", kv)
+		}
+		if k == "Name" {
+			return nil, fmt.Errorf("the Name parameter is the name of the environment")
+		}
+		params = append(params, cfntypes.Parameter{ParameterKey: aws.String(k), ParameterValue: aws.String(v)})
+	}
+	return params, nil
+}
+
+// notFound is true if err is CloudFormation saying that the stack does
+// not exist
+func notFound(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "ValidationError" && strings.Contains(ae.ErrorMessage(), "does not exist")
+}
+
+// noUpdates is true if err is CloudFormation refusing an update that
+// would not change the stack
+func noUpdates(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "ValidationError" && strings.Contains(ae.ErrorMessage(), "No updates are to be performed")
+}
+
+// StackStatus describes the stack of the environment name
+func (c *Client) StackStatus(ctx context.Context, name string) (StackStatus, error) {
+	ss := StackStatus{Name: name}
+	dso, err := c.cfn.DescribeStacks(ctx, &cloudformation.DescribeStacksInput{StackName: aws.String(name)})
+	if notFound(err) {
+		return ss, nil
+	}
+	if err != nil {
+		return ss, err
+	}
+	if len(dso.Stacks) > 0 {
+		ss.Status = string(dso.Stacks[0].StackStatus)
+		ss.Reason = aws.ToString(dso.Stacks[0].StackStatusReason)
+		ss.Managed = slices.ContainsFunc(dso.Stacks[0].Tags, func(t cfntypes.Tag) bool {
+			return aws.ToString(t.Key) == aws.ToString(managedTag.Key) && aws.ToString(t.Value) == aws.ToString(managedTag.Value)
+		})
+	}
+	return ss, nil
+}
+
+// Up creates the stack for the environment name from the template in
+// the config, or updates it if it exists. A stack that gromit did not
+// create is only updated with force. It waits for the stack to be
+// complete, writing its events to w as they happen.
+func (c *Client) Up(name string, sc StackConfig, force bool, timeout time.Duration, w io.Writer) error {
+	body, err := templates.ReadFile("cft/" + sc.Template)
+	if err != nil {
+		return fmt.Errorf("no embedded template %s: %w", sc.Template, err)
+	}
+	params, err := stackParameters(name, sc.Parameters)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ss, err := c.StackStatus(ctx, name)
+	if err != nil {
+		return err
+	}
+	if ss.Status != "" {
+		if err := ss.checkManaged(force); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	switch ss.Status {
+	case "":
+		log.Info().Str("stack", name).Str("template", sc.Template).Msg("creating")
+		_, err = c.cfn.CreateStack(ctx, &cloudformation.CreateStackInput{
+			StackName:    aws.String(name),
+			TemplateBody: aws.String(string(body)),
+			Parameters:   params,
+			Tags:         []cfntypes.Tag{managedTag},
+		})
+	case string(cfntypes.StackStatusRollbackComplete):
+		// a stack that failed to create cannot be updated
+		return fmt.Errorf("stack %s failed to create (%s), it must be brought down first", name, ss.Reason)
+	default:
+		log.Info().Str("stack", name).Str("status", ss.Status).Msg("updating")
+		_, err = c.cfn.UpdateStack(ctx, &cloudformation.UpdateStackInput{
+			StackName:    aws.String(name),
+			TemplateBody: aws.String(string(body)),
+			Parameters:   params,
+		})
+		if noUpdates(err) {
+			log.Info().Str("stack", name).Msg("stack is up to date")
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("deploying stack %s: %w", name, err)
+	}
+	return c.waitStack(ctx, name, start, w)
+}
+
+// Down deletes the stack of the environment name and waits for it to
+// be gone, writing its events to w as they happen. A stack that gromit
+// did not create is only deleted with force.
+func (c *Client) Down(name string, force bool, timeout time.Duration, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ss, err := c.StackStatus(ctx, name)
+	if err != nil {
+		return err
+	}
+	if ss.Status == "" {
+		log.Info().Str("stack", name).Msg("stack does not exist")
+		return nil
+	}
+	if err := ss.checkManaged(force); err != nil {
+		return err
+	}
+	start := time.Now()
+	if _, err := c.cfn.DeleteStack(ctx, &cloudformation.DeleteStackInput{StackName: aws.String(name)}); err != nil {
+		return fmt.Errorf("deleting stack %s: %w", name, err)
+	}
+	return c.waitStack(ctx, name, start, w)
+}
+
+// waitStack polls the stack until it is no longer in progress, writing
+// the events since start to w. A stack that is gone has been deleted.
+func (c *Client) waitStack(ctx context.Context, name string, start time.Time, w io.Writer) error {
+	seen := make(map[string]bool)
+	for {
+		ss, err := c.StackStatus(ctx, name)
+		if err != nil {
+			return err
+		}
+		// a deleted stack has no events to describe
+		if err := c.streamEvents(ctx, name, start, seen, w); err != nil && !notFound(err) {
+			return err
+		}
+		status := cfntypes.StackStatus(ss.Status)
+		switch {
+		case ss.Status == "" || slices.Contains(stackSucceeded, status):
+			log.Info().Str("stack", name).Str("status", ss.Status).Msg("stack complete")
+			return nil
+		case slices.Contains(stackFailed, status):
+			return fmt.Errorf("stack %s is %s: %s", name, ss.Status, ss.Reason)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for stack %s, last status %s: %w", name, ss.Status, ctx.Err())
+		case <-time.After(c.poll):
+		}
+	}
+}
+
+// streamEvents writes the events of the stack since start that are not
+// in seen to w, oldest first
+func (c *Client) streamEvents(ctx context.Context, name string, start time.Time, seen map[string]bool, w io.Writer) error {
+	var events []cfntypes.StackEvent
+	p := cloudformation.NewDescribeStackEventsPaginator(c.cfn, &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(name),
+	})
+	// events are listed newest first
+pages:
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range page.StackEvents {
+			if seen[aws.ToString(e.EventId)] || aws.ToTime(e.Timestamp).Before(start) {
+				break pages
+			}
+			events = append(events, e)
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		seen[aws.ToString(e.EventId)] = true
+		fmt.Fprintf(w, "%s %-30s %-30s %s %s\n",
+			aws.ToTime(e.Timestamp).Format(time.TimeOnly),
+			aws.ToString(e.LogicalResourceId),
+			aws.ToString(e.ResourceType),
+			e.ResourceStatus,
+			aws.ToString(e.ResourceStatusReason))
+	}
+	return nil
+}
+
+// TaskStatus is a name that tasks of an environment are exposed as
+type TaskStatus struct {
+	Name string   `json:"name"`
+	IPs  []string `json:"ips,omitempty"`
+	// DNS is the name of the record for the tasks, if there is one
+	DNS string `json:"dns,omitempty"`
+}
+
+// EnvStatus is the state of an environment
+type EnvStatus struct {
+	Stack StackStatus  `json:"stack"`
+	Tasks []TaskStatus `json:"tasks"`
+}
+
+// Status describes the stack of the environment name, its running
+// tasks as exposed by rule and the records for them in zone
+func (c *Client) Status(name, zone string, rule ExposeRule) (EnvStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var es EnvStatus
+	var err error
+	es.Stack, err = c.StackStatus(ctx, name)
+	if err != nil {
+		return es, err
+	}
+	cm, err := getClusterMap(ctx, c.ecs, c.ec2, name, rule)
+	if err != nil {
+		return es, err
+	}
+	var records map[string]r53types.ResourceRecordSet
+	if zone != "" {
+		zid, err := c.zoneID(ctx, zone)
+		if err != nil {
+			return es, err
+		}
+		records, err = c.clusterRecords(ctx, zid, name)
+		if err != nil {
+			return es, err
+		}
+	}
+	for task, enis := range cm {
+		ips, err := getPublicIPs(ctx, c.ec2, task, enis)
+		if err != nil {
+			return es, err
+		}
+		ts := TaskStatus{Name: task, IPs: ips}
+		dns := recordName(fmt.Sprintf("%s.%s", task, zone))
+		if _, found := records[dns]; found {
+			ts.DNS = dns
+		}
+		es.Tasks = append(es.Tasks, ts)
+	}
+	slices.SortFunc(es.Tasks, func(a, b TaskStatus) int { return strings.Compare(a.Name, b.Name) })
+	return es, nil
+}
@@ -0,0 +1,310 @@
+package env
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/gromit/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cfntypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+// fakeCFN has one stack that moves from in progress to final after
+// steps polls, unless it is stuck. The final status of a create is in
+// createStatus.
+type fakeCFN struct {
+	stuck        bool
+	status       cfntypes.StackStatus
+	final        cfntypes.StackStatus
+	createStatus cfntypes.StackStatus
+	steps        int
+	events       []cfntypes.StackEvent
+	params       []cfntypes.Parameter
+	tags         []cfntypes.Tag
+	calls        []string
+}
+
+func (f *fakeCFN) event(resource string, status cfntypes.ResourceStatus) {
+	f.events = append(f.events, cfntypes.StackEvent{
+		EventId:           aws.String(fmt.Sprint(len(f.events))),
+		LogicalResourceId: aws.String(resource),
+		ResourceType:      aws.String("AWS::ECS::Cluster"),
+		ResourceStatus:    status,
+		Timestamp:         aws.Time(time.Now()),
+	})
+}
+
+func (f *fakeCFN) start(status, final cfntypes.StackStatus) {
+	f.status, f.final, f.steps = status, final, 2
+	if f.stuck {
+		f.steps = 0
+	}
+	f.event("ProCluster", cfntypes.ResourceStatus(status))
+}
+
+func (f *fakeCFN) DescribeStacks(ctx context.Context, in *cloudformation.DescribeStacksInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	if f.steps > 0 {
+		f.steps--
+		if f.steps == 0 {
+			f.status = f.final
+			f.event("ProCluster", cfntypes.ResourceStatus(f.final))
+		}
+	}
+	if f.status == "" || f.status == cfntypes.StackStatusDeleteComplete {
+		return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "Stack with id " + *in.StackName + " does not exist"}
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []cfntypes.Stack{{
+		StackName:   in.StackName,
+		StackStatus: f.status,
+		Tags:        f.tags,
+	}}}, nil
+}
+
+// DescribeStackEvents lists the events newest first, one per page
+func (f *fakeCFN) DescribeStackEvents(ctx context.Context, in *cloudformation.DescribeStackEventsInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	i := 0
+	if in.NextToken != nil {
+		fmt.Sscan(*in.NextToken, &i)
+	}
+	out := &cloudformation.DescribeStackEventsOutput{}
+	if i < len(f.events) {
+		out.StackEvents = []cfntypes.StackEvent{f.events[len(f.events)-1-i]}
+	}
+	if i+1 < len(f.events) {
+		out.NextToken = aws.String(fmt.Sprint(i + 1))
+	}
+	return out, nil
+}
+
+func (f *fakeCFN) CreateStack(ctx context.Context, in *cloudformation.CreateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error) {
+	f.calls = append(f.calls, "create")
+	f.params = in.Parameters
+	f.tags = in.Tags
+	if !strings.Contains(aws.ToString(in.TemplateBody), "AWS::ECS::Cluster") {
+		return nil, fmt.Errorf("not the pro template")
+	}
+	f.start(cfntypes.StackStatusCreateInProgress, f.createStatus)
+	return &cloudformation.CreateStackOutput{}, nil
+}
+
+func (f *fakeCFN) UpdateStack(ctx context.Context, in *cloudformation.UpdateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	f.calls = append(f.calls, "update")
+	if paramString(in.Parameters) == paramString(f.params) {
+		return nil, &smithy.GenericAPIError{Code: "ValidationError", Message: "No updates are to be performed."}
+	}
+	f.params = in.Parameters
+	f.start(cfntypes.StackStatusUpdateInProgress, cfntypes.StackStatusUpdateComplete)
+	return &cloudformation.UpdateStackOutput{}, nil
+}
+
+func (f *fakeCFN) DeleteStack(ctx context.Context, in *cloudformation.DeleteStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.DeleteStackOutput, error) {
+	f.calls = append(f.calls, "delete")
+	f.start(cfntypes.StackStatusDeleteInProgress, cfntypes.StackStatusDeleteComplete)
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+func paramString(params []cfntypes.Parameter) string {
+	var kvs []string
+	for _, p := range params {
+		kvs = append(kvs, aws.ToString(p.ParameterKey)+"="+aws.ToString(p.ParameterValue))
+	}
+	return strings.Join(kvs, ",")
+}
+
+type fakeSSM struct {
+	params map[string]string
+}
+
+func (f *fakeSSM) PutParameter(ctx context.Context, in *ssm.PutParameterInput, _ ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	f.params[aws.ToString(in.Name)] = aws.ToString(in.Value)
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func TestStackLifecycle(t *testing.T) {
+	c, _ := testClient(nil, nil)
+	cfn := &fakeCFN{createStatus: cfntypes.StackStatusCreateComplete}
+	c.cfn = cfn
+	sc := StackConfig{Template: "pro.yaml", Parameters: []string{"gwTag=v5.3.0", "EnvFiles=redis60,mongo44"}}
+
+	var events bytes.Buffer
+	if err := c.Up("test", sc, false, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(cfn.calls); got != "[create]" {
+		t.Errorf("expected a create, got %s", got)
+	}
+	if len(cfn.params) != 3 || aws.ToString(cfn.params[0].ParameterKey) != "Name" || aws.ToString(cfn.params[0].ParameterValue) != "test" {
+		t.Errorf("Name is not passed to the template: %v", cfn.params)
+	}
+	if aws.ToString(cfn.params[2].ParameterValue) != "redis60,mongo44" {
+		t.Errorf("values are split at the first =: %v", aws.ToString(cfn.params[2].ParameterValue))
+	}
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "CREATE_IN_PROGRESS") || !strings.Contains(lines[1], "CREATE_COMPLETE") {
+		t.Errorf("events are not streamed once each in order: %q", lines)
+	}
+
+	ss, err := c.StackStatus(context.Background(), "test")
+	if err != nil || ss.Status != "CREATE_COMPLETE" {
+		t.Errorf("expected a complete stack, got %v, %v", ss, err)
+	}
+
+	// the same parameters do not change the stack
+	events.Reset()
+	if err := c.Up("test", sc, false, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	if events.Len() > 0 {
+		t.Errorf("no events expected, got %s", events.String())
+	}
+	sc.Parameters = []string{"gwTag=v5.3.1"}
+	if err := c.Up("test", sc, false, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(events.String(), "UPDATE_COMPLETE") || strings.Contains(events.String(), "CREATE") {
+		t.Errorf("expected only the update events, got %s", events.String())
+	}
+
+	if err := c.Down("test", false, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	ss, err = c.StackStatus(context.Background(), "test")
+	if err != nil || ss.Status != "" {
+		t.Errorf("expected the stack to be gone, got %v, %v", ss, err)
+	}
+	if got := fmt.Sprint(cfn.calls); got != "[create update update delete]" {
+		t.Errorf("unexpected calls %s", got)
+	}
+	// a stack that is gone is not deleted again
+	if err := c.Down("test", false, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfn.calls) != 4 {
+		t.Errorf("unexpected calls %v", cfn.calls)
+	}
+}
+
+func TestStackFailures(t *testing.T) {
+	c, _ := testClient(nil, nil)
+	cfn := &fakeCFN{createStatus: cfntypes.StackStatusRollbackComplete}
+	c.cfn = cfn
+	sc := StackConfig{Template: "pro.yaml"}
+	var events bytes.Buffer
+
+	if err := c.Up("test", sc, false, time.Minute, &events); err == nil || !strings.Contains(err.Error(), "ROLLBACK_COMPLETE") {
+		t.Errorf("expected a failed create, got %v", err)
+	}
+	if err := c.Up("test", sc, false, time.Minute, &events); err == nil || !strings.Contains(err.Error(), "brought down") {
+		t.Errorf("a rolled back stack cannot be updated, got %v", err)
+	}
+
+	if err := c.Up("other", StackConfig{Template: "nope.yaml"}, false, time.Minute, &events); err == nil {
+		t.Error("expected an error for a template that is not embedded")
+	}
+	if err := c.Up("other", StackConfig{Template: "pro.yaml", Parameters: []string{"Name=x"}}, false, time.Minute, &events); err == nil {
+		t.Error("Name must not be overridden")
+	}
+	if err := c.Up("other", StackConfig{Template: "pro.yaml", Parameters: []string{"gwTag"}}, false, time.Minute, &events); err == nil {
+		t.Error("expected an error for a parameter without a value")
+	}
+
+	// a stack that never finishes
+	c.cfn = &fakeCFN{status: cfntypes.StackStatusCreateComplete, tags: []cfntypes.Tag{managedTag}, stuck: true}
+	c.poll = 10 * time.Millisecond
+	if err := c.Down("test", false, 50*time.Millisecond, &events); err == nil || !strings.Contains(err.Error(), "DELETE_IN_PROGRESS") {
+		t.Errorf("expected to time out, got %v", err)
+	}
+}
+
+// TestStackNotManaged leaves stacks that gromit did not create alone
+func TestStackNotManaged(t *testing.T) {
+	c, _ := testClient(nil, nil)
+	cfn := &fakeCFN{status: cfntypes.StackStatusUpdateComplete}
+	c.cfn = cfn
+	sc := StackConfig{Template: "pro.yaml", Parameters: []string{"gwTag=v5.3.1"}}
+	var events bytes.Buffer
+
+	if err := c.Up("prod", sc, false, time.Minute, &events); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected the update to be refused, got %v", err)
+	}
+	if err := c.Down("prod", false, time.Minute, &events); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected the delete to be refused, got %v", err)
+	}
+	if len(cfn.calls) > 0 {
+		t.Fatalf("an unmanaged stack was changed: %v", cfn.calls)
+	}
+	ss, err := c.StackStatus(context.Background(), "prod")
+	if err != nil || ss.Managed {
+		t.Errorf("expected an unmanaged stack, got %v, %v", ss, err)
+	}
+
+	if err := c.Down("prod", true, time.Minute, &events); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(cfn.calls); got != "[delete]" {
+		t.Errorf("expected a forced delete, got %s", got)
+	}
+}
+
+func TestEnvStatus(t *testing.T) {
+	c, _ := testClient(
+		map[string]string{"gw": "eni-gw", "pump": "eni-pump"},
+		map[string]string{"eni-gw": "1.1.1.1", "eni-pump": ""},
+	)
+	c.cfn = &fakeCFN{status: cfntypes.StackStatusCreateComplete}
+	es, err := c.Status("test", "dev.tyk.technology", testRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := EnvStatus{
+		Stack: StackStatus{Name: "test", Status: "CREATE_COMPLETE"},
+		Tasks: []TaskStatus{
+			{Name: "gw.test", IPs: []string{"1.1.1.1"}, DNS: "gw.test.dev.tyk.technology"},
+			{Name: "pump.test"},
+		},
+	}
+	if fmt.Sprint(es) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", es, want)
+	}
+}
+
+func TestStoreLicense(t *testing.T) {
+	c, _ := testClient(nil, nil)
+	s := &fakeSSM{params: make(map[string]string)}
+	c.ssm = s
+	if err := c.StoreLicense("license", "/cd/dashboard_license", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if s.params["/cd/dashboard_license"] != "license" {
+		t.Errorf("license not stored: %v", s.params)
+	}
+}
+
+func TestLoadStackConfig(t *testing.T) {
+	config.LoadConfig("")
+	sc, err := LoadStackConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Expose.Tag != DefaultExposeTag || sc.Expose.AllENIs {
+		t.Errorf("unexpected expose rule %v", sc.Expose)
+	}
+	if _, err := templates.ReadFile("cft/" + sc.Template); err != nil {
+		t.Errorf("template %s is not embedded: %v", sc.Template, err)
+	}
+	params, err := stackParameters("test", sc.Parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// viper must not lowercase the keys
+	if paramString(params[1:2]) != "EnvFiles=redis60,mongo44" {
+		t.Errorf("unexpected parameters %s", paramString(params))
+	}
+}
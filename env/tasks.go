@@ -0,0 +1,276 @@
+package env
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/rs/zerolog/log"
+)
+
+// ECSAPI is the part of the ECS API that is used to find tasks
+type ECSAPI interface {
+	ecs.ListTasksAPIClient
+	ecs.DescribeTasksAPIClient
+	DescribeContainerInstances(context.Context, *ecs.DescribeContainerInstancesInput, ...func(*ecs.Options)) (*ecs.DescribeContainerInstancesOutput, error)
+}
+
+// EC2API is the part of the EC2 API that is used to find public IPs
+type EC2API interface {
+	ec2.DescribeNetworkInterfacesAPIClient
+	ec2.DescribeInstancesAPIClient
+}
+
+// describeBatch is the most tasks or container instances that ECS will
+// describe in one call
+const describeBatch = 100
+
+// DefaultExposeTag is the task tag that names the container to expose
+const DefaultExposeTag = "gromit:expose"
+
+// ExposeRule decides which container of a task a record is made for
+// and which of its network interfaces are in the record. Without the
+// tag, a task that belongs to a service is exposed as the container
+// with the name of the service and a task with one container as that
+// container. Other tasks are not exposed.
+type ExposeRule struct {
+	// Tag is a task tag whose value is the name of the container to
+	// expose, a task with an empty value is not exposed
+	Tag string
+	// AllENIs puts the IPs of every network interface of a task in its
+	// record instead of only those of the first
+	AllENIs bool
+}
+
+// clusterMap contains containername.clustername -> ENIs of every task
+// that is exposed as that name
+type clusterMap map[string][]string
+
+// containerName returns the name that the task is exposed as
+func (rule ExposeRule) containerName(task ecstypes.Task) (string, bool) {
+	hasContainer := func(name string) bool {
+		return slices.ContainsFunc(task.Containers, func(c ecstypes.Container) bool {
+			return aws.ToString(c.Name) == name
+		})
+	}
+	for _, t := range task.Tags {
+		if rule.Tag == "" || aws.ToString(t.Key) != rule.Tag {
+			continue
+		}
+		name := aws.ToString(t.Value)
+		if name != "" && !hasContainer(name) {
+			log.Warn().Str("task", aws.ToString(task.TaskArn)).Msgf("tag %s names container %s which is not in the task", rule.Tag, name)
+			return "", false
+		}
+		return name, name != ""
+	}
+	if service, found := strings.CutPrefix(aws.ToString(task.Group), "service:"); found && hasContainer(service) {
+		return service, true
+	}
+	if len(task.Containers) == 1 {
+		return aws.ToString(task.Containers[0].Name), true
+	}
+	log.Warn().Str("task", aws.ToString(task.TaskArn)).Msgf("not exposing a task with %d containers, tag it with %s", len(task.Containers), rule.Tag)
+	return "", false
+}
+
+// taskENIs returns the network interfaces attached to an awsvpc task
+func taskENIs(task ecstypes.Task) []string {
+	var enis []string
+	for _, a := range task.Attachments {
+		if aws.ToString(a.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, d := range a.Details {
+			if aws.ToString(d.Name) == "networkInterfaceId" {
+				enis = append(enis, aws.ToString(d.Value))
+			}
+		}
+	}
+	return enis
+}
+
+// getClusterMap finds the running tasks of the cluster and the network
+// interfaces they are reachable on according to rule. Fargate and EC2
+// tasks in awsvpc mode have their own interfaces, other EC2 tasks use
+// those of the instance that they run on.
+func getClusterMap(ctx context.Context, ecsc ECSAPI, ec2c EC2API, cluster string, rule ExposeRule) (clusterMap, error) {
+	cm := make(clusterMap)
+	var arns []string
+	p := ecs.NewListTasksPaginator(ecsc, &ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		var cnf *ecstypes.ClusterNotFoundException
+		if errors.As(err, &cnf) {
+			// a cluster that is gone has no tasks
+			return cm, nil
+		}
+		if err != nil {
+			return cm, err
+		}
+		arns = append(arns, page.TaskArns...)
+	}
+	log.Trace().Strs("arns", arns).Msg("found tasks")
+
+	var tasks []ecstypes.Task
+	for batch := range slices.Chunk(arns, describeBatch) {
+		dto, err := ecsc.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Tasks:   batch,
+			Cluster: aws.String(cluster),
+			Include: []ecstypes.TaskField{ecstypes.TaskFieldTags},
+		})
+		if err != nil {
+			return cm, err
+		}
+		log.Trace().Interface("dto", dto).Msg("described tasks")
+		for _, task := range dto.Tasks {
+			if aws.ToString(task.LastStatus) == "RUNNING" {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	var instances []string
+	for _, task := range tasks {
+		if len(taskENIs(task)) == 0 && task.ContainerInstanceArn != nil {
+			instances = append(instances, aws.ToString(task.ContainerInstanceArn))
+		}
+	}
+	instanceENIs, err := getInstanceENIs(ctx, ecsc, ec2c, cluster, instances)
+	if err != nil {
+		return cm, err
+	}
+
+	for _, task := range tasks {
+		name, expose := rule.containerName(task)
+		if !expose {
+			continue
+		}
+		enis := taskENIs(task)
+		if len(enis) == 0 {
+			enis = instanceENIs[aws.ToString(task.ContainerInstanceArn)]
+		}
+		if len(enis) == 0 {
+			log.Warn().Str("task", aws.ToString(task.TaskArn)).Msgf("no network interface for %s", name)
+			continue
+		}
+		if !rule.AllENIs {
+			enis = enis[:1]
+		}
+		key := fmt.Sprintf("%s.%s", name, cluster)
+		cm[key] = append(cm[key], enis...)
+	}
+	return cm, nil
+}
+
+// getInstanceENIs maps the container instances to the network
+// interfaces of their EC2 instances, primary first
+func getInstanceENIs(ctx context.Context, ecsc ECSAPI, ec2c EC2API, cluster string, arns []string) (map[string][]string, error) {
+	enis := make(map[string][]string)
+	slices.Sort(arns)
+	arns = slices.Compact(arns)
+	if len(arns) == 0 {
+		return enis, nil
+	}
+	instances := make(map[string]string)
+	for batch := range slices.Chunk(arns, describeBatch) {
+		dcio, err := ecsc.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{
+			ContainerInstances: batch,
+			Cluster:            aws.String(cluster),
+		})
+		if err != nil {
+			return enis, err
+		}
+		for _, ci := range dcio.ContainerInstances {
+			instances[aws.ToString(ci.Ec2InstanceId)] = aws.ToString(ci.ContainerInstanceArn)
+		}
+	}
+	var ids []string
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	p := ec2.NewDescribeInstancesPaginator(ec2c, &ec2.DescribeInstancesInput{InstanceIds: ids})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return enis, err
+		}
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				nis := i.NetworkInterfaces
+				slices.SortFunc(nis, func(a, b ec2types.InstanceNetworkInterface) int {
+					return int(deviceIndex(a) - deviceIndex(b))
+				})
+				arn := instances[aws.ToString(i.InstanceId)]
+				for _, ni := range nis {
+					enis[arn] = append(enis[arn], aws.ToString(ni.NetworkInterfaceId))
+				}
+			}
+		}
+	}
+	return enis, nil
+}
+
+func deviceIndex(ni ec2types.InstanceNetworkInterface) int32 {
+	if ni.Attachment == nil {
+		return 0
+	}
+	return aws.ToInt32(ni.Attachment.DeviceIndex)
+}
+
+// errNoPublicIP is returned for a network interface that has no public
+// IP associated with it
+var errNoPublicIP = errors.New("no public IP")
+
+// getPublicIP will return the IP associated with the network
+// interface that is returned first
+func getPublicIP(ctx context.Context, svc EC2API, eni string) (string, error) {
+	dnii := &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []string{
+			eni,
+		},
+	}
+	dnio, err := svc.DescribeNetworkInterfaces(ctx, dnii)
+	if err != nil {
+		return "", err
+	}
+	log.Trace().Interface("netifaces", dnio)
+
+	if len(dnio.NetworkInterfaces) > 0 {
+		assoc := dnio.NetworkInterfaces[0].Association
+		if assoc != nil && assoc.PublicIp != nil {
+			return *assoc.PublicIp, nil
+		}
+	}
+	return "", errNoPublicIP
+}
+
+// getPublicIPs returns the public IPs of the ENIs, sorted, skipping
+// those without one. Any other error is returned so that records are
+// not changed on a partial view of the cluster.
+func getPublicIPs(ctx context.Context, svc EC2API, name string, enis []string) ([]string, error) {
+	var ips []string
+	for _, eni := range enis {
+		ip, err := getPublicIP(ctx, svc, eni)
+		if errors.Is(err, errNoPublicIP) {
+			log.Debug().Str("eni", eni).Msgf("skipping an interface of %s, it has no public ip", name)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting the ip of %s for %s: %w", eni, name, err)
+		}
+		ips = append(ips, ip)
+	}
+	slices.Sort(ips)
+	return slices.Compact(ips), nil
+}
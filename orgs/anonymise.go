@@ -0,0 +1,500 @@
+package orgs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Anonymisation actions, applied to every string under a matching path
+const (
+	// AnonKey replaces a key id in the same way as the key names that
+	// hold it, so that references between keys and documents survive
+	AnonKey = "key"
+	// AnonEmail replaces an email address with one at example.com
+	AnonEmail = "email"
+	// AnonIP replaces IP addresses, including those in CIDRs
+	AnonIP = "ip"
+	// AnonSecret replaces a secret with hex of the same length
+	AnonSecret = "secret"
+	// AnonRedact replaces free text
+	AnonRedact = "redact"
+	// AnonDrop removes the field
+	AnonDrop = "drop"
+	// AnonKeep leaves the field alone, even if it looks like an email
+	// or an IP
+	AnonKeep = "keep"
+)
+
+// How key ids are replaced
+const (
+	// KeysHash replaces key ids with the hex of their HMAC
+	KeysHash = "hash"
+	// KeysRegenerate replaces key ids with ones that look like them,
+	// keeping the org id that Tyk puts at the start of keys
+	KeysRegenerate = "regenerate"
+)
+
+// DefaultAnonRules cover the fields of Tyk sessions, dashboard users and
+// OAuth clients that hold keys or personal data
+var DefaultAnonRules = []string{
+	"access_key=key",
+	"key_id=key",
+	"oauth_client_id=key",
+	"client_id=key",
+	"secret=secret",
+	"client_secret=secret",
+	"password=secret",
+	"hmac_string=secret",
+	"email_address=email",
+	"email=email",
+	"first_name=redact",
+	"last_name=redact",
+	"allowed_ips=ip",
+	"blacklisted_ips=ip",
+	"last_login_ip=ip",
+}
+
+// DefaultKeyPrefixes are the redis key names that end in a key id
+var DefaultKeyPrefixes = []string{"apikey-", "tyk-admin-api-", "oauth-clientid."}
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	ipv4Re  = regexp.MustCompile(`\b(?:[0-9]{1,3}\.){3}[0-9]{1,3}\b`)
+)
+
+// AnonRule applies Action to the field at Path. A path without dots
+// matches a field of that name at any depth, otherwise the whole
+// dotted path from the top of the document must match.
+type AnonRule struct {
+	Path   string
+	Action string
+}
+
+// ParseAnonRules parses rules in the form path=action
+func ParseAnonRules(specs []string) ([]AnonRule, error) {
+	rules := make([]AnonRule, 0, len(specs))
+	for _, spec := range specs {
+		path, action, found := strings.Cut(spec, "=")
+		if !found || path == "" {
+			return nil, fmt.Errorf("anonymisation rule %q is not in the form path=action", spec)
+		}
+		switch action {
+		case AnonKey, AnonEmail, AnonIP, AnonSecret, AnonRedact, AnonDrop, AnonKeep:
+		default:
+			return nil, fmt.Errorf("anonymisation rule %q has unknown action %q", spec, action)
+		}
+		rules = append(rules, AnonRule{path, action})
+	}
+	return rules, nil
+}
+
+// AnonStats counts what was anonymised for an org
+type AnonStats struct {
+	Keys int
+	// Renamed keys had a key id in their name
+	Renamed int
+	Docs    int
+}
+
+// Anonymiser rewrites dumps so that they can be taken out of prod. Every
+// replacement is derived from an HMAC of the original keyed by the
+// seed, so the same value is replaced in the same way wherever it is
+// and the output only depends on the dump and the seed.
+type Anonymiser struct {
+	seed     []byte
+	rules    []AnonRule
+	keyMode  string
+	prefixes []string
+}
+
+// NewAnonymiser replaces key ids according to keyMode in the fields
+// given by rules and in key names that start with one of prefixes.
+// Strings that no rule applies to are scanned for emails and IPv4
+// addresses.
+func NewAnonymiser(seed string, rules []AnonRule, keyMode string, prefixes []string) (*Anonymiser, error) {
+	if seed == "" {
+		return nil, errors.New("anonymising needs a seed")
+	}
+	switch keyMode {
+	case KeysHash, KeysRegenerate:
+	default:
+		return nil, fmt.Errorf("unknown key mode %q, expected %s or %s", keyMode, KeysHash, KeysRegenerate)
+	}
+	return &Anonymiser{[]byte(seed), rules, keyMode, prefixes}, nil
+}
+
+// stream returns n bytes derived from kind and s
+func (a *Anonymiser) stream(kind, s string, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	var ctr [4]byte
+	for i := uint32(0); len(out) < n; i++ {
+		mac := hmac.New(sha256.New, a.seed)
+		binary.BigEndian.PutUint32(ctr[:], i)
+		mac.Write(ctr[:])
+		mac.Write([]byte(kind))
+		mac.Write([]byte{0})
+		mac.Write([]byte(s))
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// ID replaces the key id, keeping org at the start of it when
+// regenerating
+func (a *Anonymiser) ID(org, id string) string {
+	if id == "" {
+		return id
+	}
+	if a.keyMode == KeysHash {
+		return hex.EncodeToString(a.stream(AnonKey, id, sha256.Size))
+	}
+	prefix := ""
+	if org != "" && strings.HasPrefix(id, org) {
+		prefix, id = org, id[len(org):]
+	}
+	isHex := strings.Trim(id, "0123456789abcdef") == ""
+	b := a.stream(AnonKey, prefix+id, len(id))
+	out := []byte(id)
+	for i, c := range out {
+		switch {
+		case isHex:
+			out[i] = "0123456789abcdef"[b[i]%16]
+		case c >= '0' && c <= '9':
+			out[i] = '0' + b[i]%10
+		case c >= 'a' && c <= 'z':
+			out[i] = 'a' + b[i]%26
+		case c >= 'A' && c <= 'Z':
+			out[i] = 'A' + b[i]%26
+		}
+	}
+	return prefix + string(out)
+}
+
+// KeyName replaces the key id in name if it starts with one of the
+// prefixes
+func (a *Anonymiser) KeyName(org, name string) string {
+	for _, p := range a.prefixes {
+		if id, found := strings.CutPrefix(name, p); found {
+			return p + a.ID(org, id)
+		}
+	}
+	return name
+}
+
+// Email replaces an email address
+func (a *Anonymiser) Email(s string) string {
+	return "user-" + hex.EncodeToString(a.stream(AnonEmail, strings.ToLower(s), 5)) + "@example.com"
+}
+
+// IP replaces an address with one in 10.0.0.0/8 or fd00::/8, keeping
+// the prefix length of a CIDR. IPv4 addresses in other strings are
+// replaced too.
+func (a *Anonymiser) IP(s string) string {
+	addr, bits, isCIDR := strings.Cut(s, "/")
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ipv4Re.ReplaceAllStringFunc(s, a.ipv4)
+	}
+	var fake net.IP
+	if ip.To4() != nil {
+		fake = append(net.IP{10}, a.stream(AnonIP, ip.String(), 3)...)
+	} else {
+		fake = append(net.IP{0xfd}, a.stream(AnonIP, ip.String(), 15)...)
+	}
+	if isCIDR {
+		return fake.String() + "/" + bits
+	}
+	return fake.String()
+}
+
+// ipv4 replaces a match of ipv4Re if it is an address
+func (a *Anonymiser) ipv4(s string) string {
+	if net.ParseIP(s) == nil {
+		return s
+	}
+	return a.IP(s)
+}
+
+// Secret replaces s with hex of the same length
+func (a *Anonymiser) Secret(s string) string {
+	h := hex.EncodeToString(a.stream(AnonSecret, s, len(s)/2+1))
+	return h[:len(s)]
+}
+
+// scan replaces the emails and IPv4 addresses in s
+func (a *Anonymiser) scan(s string) string {
+	s = emailRe.ReplaceAllStringFunc(s, a.Email)
+	return ipv4Re.ReplaceAllStringFunc(s, a.ipv4)
+}
+
+func (a *Anonymiser) apply(org, action, s string) string {
+	switch action {
+	case AnonKey:
+		return a.ID(org, s)
+	case AnonEmail:
+		return a.Email(s)
+	case AnonIP:
+		return a.IP(s)
+	case AnonSecret:
+		return a.Secret(s)
+	case AnonRedact:
+		return "redacted-" + hex.EncodeToString(a.stream(AnonRedact, s, 3))
+	case AnonKeep:
+		return s
+	}
+	return a.scan(s)
+}
+
+// ruleFor returns the action for the field at path, or "" if no rule
+// applies
+func (a *Anonymiser) ruleFor(path string) string {
+	field := path[strings.LastIndexByte(path, '.')+1:]
+	for _, r := range a.rules {
+		if r.Path == path || (!strings.Contains(r.Path, ".") && r.Path == field) {
+			return r.Action
+		}
+	}
+	return ""
+}
+
+// value rewrites v, which is at path, under the action of the nearest
+// enclosing rule. It reports false if the field should be dropped.
+func (a *Anonymiser) value(org, path, action string, v any) (any, bool) {
+	if path != "" {
+		if rule := a.ruleFor(path); rule != "" {
+			action = rule
+		}
+	}
+	if action == AnonDrop {
+		return nil, false
+	}
+	join := func(field string) string {
+		if path == "" {
+			return field
+		}
+		return path + "." + field
+	}
+	switch val := v.(type) {
+	case string:
+		return a.apply(org, action, val), true
+	case map[string]any:
+		for f, fv := range val {
+			if nv, keep := a.value(org, join(f), action, fv); keep {
+				val[f] = nv
+			} else {
+				delete(val, f)
+			}
+		}
+	case bson.D:
+		out := val[:0]
+		for _, e := range val {
+			if nv, keep := a.value(org, join(e.Key), action, e.Value); keep {
+				out = append(out, bson.E{Key: e.Key, Value: nv})
+			}
+		}
+		return out, true
+	case []any:
+		for i := range val {
+			val[i], _ = a.value(org, path, action, val[i])
+		}
+	case bson.A:
+		for i := range val {
+			val[i], _ = a.value(org, path, action, val[i])
+		}
+	}
+	return v, true
+}
+
+// Key anonymises the name and value of k. The fields of hashes are
+// treated like those of a JSON object.
+func (a *Anonymiser) Key(org string, k *redisKey) {
+	k.Name = a.KeyName(org, k.Name)
+	if k.Value != nil {
+		a.value(org, "", "", k.Value)
+	}
+	if k.String != nil {
+		*k.String = a.scan(*k.String)
+	}
+	if k.Hash != nil {
+		h := make(map[string]string, len(k.Hash))
+		for f, v := range k.Hash {
+			if nv, keep := a.value(org, f, "", v); keep {
+				h[f] = nv.(string)
+			}
+		}
+		k.Hash = h
+	}
+	for _, l := range [][]string{k.List, k.Set} {
+		for i := range l {
+			l[i] = a.scan(l[i])
+		}
+	}
+	for i := range k.ZSet {
+		k.ZSet[i].Member = a.scan(k.ZSet[i].Member)
+	}
+}
+
+// Doc anonymises a mongo document
+func (a *Anonymiser) Doc(org string, raw bson.Raw) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	v, _ := a.value(org, "", "", doc)
+	return bson.Marshal(v)
+}
+
+// AnonymiseOrg rewrites the dump of org in inDir, read with in, into
+// outDir, created with out. Either half of the dump can be missing.
+func (a *Anonymiser) AnonymiseOrg(org string, in *Opener, inDir string, out *Sealer, outDir string) (AnonStats, error) {
+	var stats AnonStats
+	keysFile := org + ".keys.jl"
+	if dumpExists(filepath.Join(inDir, keysFile)) {
+		f, err := out.Create(filepath.Join(outDir, keysFile))
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		err = streamKeys(in, filepath.Join(inDir, keysFile), batchSize, func(keys []redisKey) error {
+			for _, k := range keys {
+				name := k.Name
+				a.Key(org, &k)
+				if k.Name != name {
+					stats.Renamed++
+				}
+				k.encode()
+				line, err := json.Marshal(&k)
+				if err != nil {
+					return fmt.Errorf("encoding %s: %w", k.Name, err)
+				}
+				if _, err := w.Write(append(line, '\n')); err != nil {
+					return err
+				}
+				stats.Keys++
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		if err := w.Flush(); err != nil {
+			return stats, err
+		}
+		if err := f.Close(); err != nil {
+			return stats, err
+		}
+	}
+
+	collsDir := org + "_colls"
+	if !dumpExists(filepath.Join(inDir, collsDir, MongoManifestFile)) {
+		return stats, nil
+	}
+	manifest, err := LoadMongoManifest(in, inDir, org)
+	if err != nil {
+		return stats, err
+	}
+	for _, cs := range manifest.Collections {
+		if !filepath.IsLocal(cs.File) {
+			return stats, fmt.Errorf("refusing to read %s from the manifest of %s", cs.File, org)
+		}
+		n, err := a.anonymiseDocs(org, in, filepath.Join(inDir, collsDir, cs.File), out, filepath.Join(outDir, collsDir, cs.File))
+		stats.Docs += n
+		if err != nil {
+			return stats, err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return stats, err
+	}
+	f, err := out.Create(filepath.Join(outDir, collsDir, MongoManifestFile))
+	if err != nil {
+		return stats, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return stats, err
+	}
+	log.Info().Str("org", org).Int("keys", stats.Keys).Int("renamed", stats.Renamed).Int("docs", stats.Docs).Msg("anonymised")
+	return stats, f.Close()
+}
+
+func (a *Anonymiser) anonymiseDocs(org string, in *Opener, inPath string, out *Sealer, outPath string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return 0, err
+	}
+	f, err := out.Create(outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	n := 0
+	err = readDocs(in, inPath, upsertBatchSize, func(docs []bson.Raw) error {
+		for _, doc := range docs {
+			anon, err := a.Doc(org, doc)
+			if err != nil {
+				return fmt.Errorf("%s: %w", inPath, err)
+			}
+			if _, err := w.Write(anon); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// dumpExists reports whether there is a plain or sealed dump of path
+func dumpExists(path string) bool {
+	for _, p := range []string{path, path + SealedExt} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// DumpOrgs lists the orgs that have a dump in dir
+func DumpOrgs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var orgs []string
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), SealedExt)
+		org, found := strings.CutSuffix(name, ".keys.jl")
+		if !found && e.IsDir() {
+			org, found = strings.CutSuffix(name, "_colls")
+		}
+		if found && org != "" && !seen[org] {
+			seen[org] = true
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs, nil
+}
@@ -0,0 +1,141 @@
+package orgs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func testAnonymiser(t *testing.T, seed, keyMode string) *Anonymiser {
+	t.Helper()
+	rules, err := ParseAnonRules(append([]string{"meta.notes=drop", "meta.owner=keep"}, DefaultAnonRules...))
+	require.NoError(t, err)
+	a, err := NewAnonymiser(seed, rules, keyMode, DefaultKeyPrefixes)
+	require.NoError(t, err)
+	return a
+}
+
+func TestAnonymiser(t *testing.T) {
+	a := testAnonymiser(t, "seed", KeysRegenerate)
+	key := org1 + "0123456789abcdef0123456789abcdef"
+	id := a.ID(org1, key)
+	assert.True(t, strings.HasPrefix(id, org1))
+	assert.Len(t, id, len(key))
+	assert.NotEqual(t, key, id)
+	assert.Equal(t, id, a.ID(org1, key))
+	assert.Equal(t, "apikey-"+id, a.KeyName(org1, "apikey-"+key))
+	assert.Equal(t, "quota-"+key, a.KeyName(org1, "quota-"+key))
+	assert.Regexp(t, `^[A-Z][a-z][0-9]-$`, a.ID("", "Ab1-"))
+
+	assert.NotEqual(t, id, testAnonymiser(t, "other", KeysRegenerate).ID(org1, key))
+	assert.Regexp(t, `^[0-9a-f]{64}$`, testAnonymiser(t, "seed", KeysHash).ID(org1, key))
+
+	assert.Regexp(t, `^user-[0-9a-f]{10}@example\.com$`, a.Email("Jo@Customer.com"))
+	assert.Equal(t, a.Email("jo@customer.com"), a.Email("Jo@Customer.com"))
+	assert.Regexp(t, `^10\.\d+\.\d+\.\d+/24$`, a.IP("203.0.113.0/24"))
+	assert.Regexp(t, `^fd`, a.IP("2001:db8::1"))
+	assert.Len(t, a.Secret("abc"), 3)
+	assert.Regexp(t, `^version 1\.2\.3 from 10\.\d+\.\d+\.\d+ for user-[0-9a-f]{10}@example\.com$`, a.scan("version 1.2.3 from 192.168.1.1 for jo@customer.com"))
+
+	_, err := ParseAnonRules([]string{"email"})
+	assert.Error(t, err)
+	_, err = ParseAnonRules([]string{"email=fake"})
+	assert.Error(t, err)
+	_, err = NewAnonymiser("", nil, KeysHash, nil)
+	assert.Error(t, err)
+	_, err = NewAnonymiser("s", nil, "plain", nil)
+	assert.Error(t, err)
+}
+
+func TestAnonymiseOrg(t *testing.T) {
+	access := "5f0c0bfc2b5a4a0001f24f71b9f5b2a2"
+	mr := miniredis.RunT(t)
+	require.NoError(t, mr.Set("tyk-admin-api-"+access, `{"UserData":{"org_id":"`+org1+`","email_address":"jo@customer.com"}}`))
+	require.NoError(t, mr.Set("apikey-"+org1+"abc123", `{"org_id":"`+org1+`","allowed_ips":["203.0.113.7"],"meta":{"notes":"call jo","owner":"ops@tyk.io"},"expires":1700000000}`))
+	mr.HSet("rl-1", "org_id", org1, "email", "jo@customer.com")
+	rules, err := ParseAttributionRules([]string{"rl-*=field:org_id"})
+	require.NoError(t, err)
+
+	inDir, outDir := t.TempDir(), t.TempDir()
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, Rules: rules}, []string{org1}, inDir)
+	_, err = r.DumpOrgKeys([]string{"*"}, 10)
+	require.NoError(t, err)
+
+	// a mongo dump, as written by DumpOrg
+	users, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: bson.NewObjectID()},
+		{Key: "org_id", Value: org1},
+		{Key: "access_key", Value: access},
+		{Key: "email_address", Value: "jo@customer.com"},
+		{Key: "user_permissions", Value: bson.D{{Key: "IsAdmin", Value: "admin"}}},
+	})
+	require.NoError(t, err)
+	collsDir := filepath.Join(inDir, org1+"_colls")
+	require.NoError(t, os.MkdirAll(filepath.Join(collsDir, "tyk_analytics"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(collsDir, "tyk_analytics", "tyk_analytics_users.bson"), users, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(collsDir, MongoManifestFile),
+		[]byte(`{"org":"`+org1+`","collections":[{"db":"tyk_analytics","collection":"tyk_analytics_users","field":"org_id","file":"tyk_analytics/tyk_analytics_users.bson","count":1}]}`), 0644))
+
+	orgs, err := DumpOrgs(inDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{org1}, orgs)
+
+	anonymise := func(seed, dir string) (map[string]redisKey, []bson.Raw) {
+		sealer, err := NewSealer(dir, nil, nil)
+		require.NoError(t, err)
+		stats, err := testAnonymiser(t, seed, KeysRegenerate).AnonymiseOrg(org1, nil, inDir, sealer, dir)
+		require.NoError(t, err)
+		assert.Equal(t, AnonStats{Keys: 3, Renamed: 2, Docs: 1}, stats)
+		keys := make(map[string]redisKey)
+		require.NoError(t, streamKeys(nil, filepath.Join(dir, org1+".keys.jl"), 10, func(batch []redisKey) error {
+			for _, k := range batch {
+				keys[k.Name] = k
+			}
+			return nil
+		}))
+		var docs []bson.Raw
+		require.NoError(t, readDocs(nil, filepath.Join(dir, org1+"_colls", "tyk_analytics", "tyk_analytics_users.bson"), 10, func(batch []bson.Raw) error {
+			docs = append(docs, batch...)
+			return nil
+		}))
+		_, err = LoadMongoManifest(nil, dir, org1)
+		require.NoError(t, err)
+		return keys, docs
+	}
+	keys, docs := anonymise("seed", outDir)
+
+	// the access key of the user still names their admin key
+	newAccess := docs[0].Lookup("access_key").StringValue()
+	assert.NotEqual(t, access, newAccess)
+	admin, found := keys["tyk-admin-api-"+newAccess]
+	require.True(t, found)
+	assert.Equal(t, docs[0].Lookup("email_address").StringValue(), admin.Value["UserData"].(map[string]any)["email_address"])
+	assert.Equal(t, "admin", docs[0].Lookup("user_permissions", "IsAdmin").StringValue())
+
+	var session redisKey
+	for name, k := range keys {
+		if strings.HasPrefix(name, "apikey-") {
+			session = k
+		}
+	}
+	assert.True(t, strings.HasPrefix(session.Name, "apikey-"+org1))
+	assert.NotEqual(t, "apikey-"+org1+"abc123", session.Name)
+	assert.NotContains(t, session.Value["allowed_ips"], "203.0.113.7")
+	assert.Equal(t, map[string]any{"owner": "ops@tyk.io"}, session.Value["meta"])
+	assert.Equal(t, json.Number("1700000000"), session.Value["expires"])
+	assert.NotEqual(t, "jo@customer.com", keys["rl-1"].Hash["email"])
+	assert.Equal(t, org1, keys["rl-1"].Hash["org_id"])
+
+	again, _ := anonymise("seed", t.TempDir())
+	assert.Equal(t, keys, again)
+	other, _ := anonymise("other", t.TempDir())
+	assert.NotEqual(t, keys, other)
+}
@@ -0,0 +1,189 @@
+package orgs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kinds of attribution rule
+const (
+	// AttrJSON finds the org id at a dotted path in a JSON string value
+	AttrJSON = "json"
+	// AttrKey finds the org id in the key name with a regexp, using the
+	// group named org or else the first group
+	AttrKey = "key"
+	// AttrField finds the org id in a field of a hash
+	AttrField = "field"
+)
+
+// AttributionRule says how to find the org that owns the keys that
+// match a SCAN pattern
+type AttributionRule struct {
+	Pattern string
+	Kind    string
+	Arg     string
+	match   *regexp.Regexp
+	re      *regexp.Regexp
+}
+
+// ParseAttributionRules parses rules in the form pattern=kind:arg, for
+// example
+//
+//	apikey-*=json:UserData.org_id
+//	quota-*=key:^quota-(?P<org>[0-9a-f]{24})
+//	rl-*=field:org_id
+//
+// Rules are tried in order and the first rule whose pattern matches the
+// key name is used.
+func ParseAttributionRules(specs []string) ([]AttributionRule, error) {
+	rules := make([]AttributionRule, 0, len(specs))
+	for _, spec := range specs {
+		pattern, rest, found := strings.Cut(spec, "=")
+		kind, arg, found2 := strings.Cut(rest, ":")
+		if !found || !found2 || pattern == "" || arg == "" {
+			return nil, fmt.Errorf("attribution rule %q is not in the form pattern=kind:arg", spec)
+		}
+		rule := AttributionRule{Pattern: pattern, Kind: kind, Arg: arg, match: globRegexp(pattern)}
+		switch kind {
+		case AttrJSON, AttrField:
+		case AttrKey:
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("attribution rule %q: %w", spec, err)
+			}
+			if re.NumSubexp() == 0 {
+				return nil, fmt.Errorf("attribution rule %q needs a group for the org id", spec)
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("attribution rule %q has unknown kind %q, expected %s, %s or %s", spec, kind, AttrJSON, AttrKey, AttrField)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// globRegexp converts a redis glob into an anchored regexp
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + strings.ReplaceAll(class[1:], `\`, `\\`)
+			} else {
+				class = strings.ReplaceAll(class, `\`, `\\`)
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		// an odd character class, match it literally instead
+		return regexp.MustCompile("^" + regexp.QuoteMeta(glob) + "$")
+	}
+	return re
+}
+
+// ruleFor returns the first rule that matches name, or nil
+func ruleFor(rules []AttributionRule, name string) *AttributionRule {
+	for i := range rules {
+		if rules[i].match.MatchString(name) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// orgFromName returns the org that owns name if a key rule applies,
+// without needing the value
+func orgFromName(rules []AttributionRule, name string) (string, bool, error) {
+	rule := ruleFor(rules, name)
+	if rule == nil || rule.Kind != AttrKey {
+		return "", false, nil
+	}
+	m := rule.re.FindStringSubmatch(name)
+	if m == nil {
+		return "", true, fmt.Errorf("%s does not match %s", name, rule.Arg)
+	}
+	if i := rule.re.SubexpIndex("org"); i > 0 {
+		return m[i], true, nil
+	}
+	return m[1], true, nil
+}
+
+// orgOf finds the org that owns k. Without a rule, string keys holding
+// JSON are attributed by their org_id or UserData.org_id field.
+func orgOf(rules []AttributionRule, k redisKey) (string, error) {
+	if org, found, err := orgFromName(rules, k.Name); found {
+		return org, err
+	}
+	rule := ruleFor(rules, k.Name)
+	if rule == nil {
+		if k.Value == nil {
+			return "", fmt.Errorf("no attribution rule for %s key %s", k.keyType(), k.Name)
+		}
+		return getOrgId(k.Value)
+	}
+	switch rule.Kind {
+	case AttrJSON:
+		if k.Value == nil {
+			return "", fmt.Errorf("%s key %s has no JSON value", k.keyType(), k.Name)
+		}
+		return jsonPath(k.Value, rule.Arg)
+	case AttrField:
+		if k.Type != typeHash {
+			return "", fmt.Errorf("%s key %s is not a hash", k.keyType(), k.Name)
+		}
+		org, found := k.Hash[rule.Arg]
+		if !found {
+			return "", fmt.Errorf("hash %s has no field %s", k.Name, rule.Arg)
+		}
+		return org, nil
+	}
+	return "", fmt.Errorf("unknown attribution rule kind %q", rule.Kind)
+}
+
+// jsonPath returns the string at a dotted path in v
+func jsonPath(v map[string]interface{}, path string) (string, error) {
+	var cur interface{} = v
+	for _, field := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%s: %s is not an object", path, field)
+		}
+		if cur, ok = m[field]; !ok {
+			return "", fmt.Errorf("%s: %s not found", path, field)
+		}
+	}
+	switch s := cur.(type) {
+	case string:
+		return s, nil
+	case json.Number:
+		return s.String(), nil
+	}
+	return "", errors.New(path + " is not a string")
+}
@@ -5,38 +5,47 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	getKeysTimeout = 10 * time.Second
+	// fetchWorkers is the number of batches of keys being fetched at once
+	fetchWorkers = 4
 )
 
-type redisKey struct {
-	Name  string                 `json:"name"`
-	TTL   int64                  `json:"ttl"`
-	Value map[string]interface{} `json:"value"`
-}
-
 type RedisOptions struct {
 	Addrs      []string
 	MasterName string
 	MaxRetries int
 	BatchSize  int64
+	// Rules attribute keys to orgs, see ParseAttributionRules
+	Rules []AttributionRule
+	// Sealer creates the dump files and Opener reads them, both can be
+	// nil for plain files
+	Sealer *Sealer
+	Opener *Opener
 }
 
 type RedisClient struct {
 	rdb       redis.UniversalClient
 	ctx       context.Context
-	keysChans map[string]chan []string
 	opFiles   map[string]string
+	batchSize int64
+	rules     []AttributionRule
+	sealer    *Sealer
+	opener    *Opener
 }
 
 func NewRedisClient(ctx context.Context, opts *RedisOptions, orgs []string, dir string) RedisClient {
@@ -57,116 +66,264 @@ func NewRedisClient(ctx context.Context, opts *RedisOptions, orgs []string, dir
 
 	rdb.Ping(ctx)
 
-	keysChans := make(map[string]chan []string)
 	opFiles := make(map[string]string)
-
 	for _, org := range orgs {
-		log.Debug().Str("org", org).Msg("setting up channels")
-		keysChans[org] = make(chan []string, opts.BatchSize)
 		opFiles[org] = filepath.Join(dir, org+".keys.jl")
 	}
 
 	return RedisClient{
 		rdb,
 		ctx,
-		keysChans,
 		opFiles,
+		opts.BatchSize,
+		opts.Rules,
+		opts.Sealer,
+		opts.Opener,
 	}
 }
 
-// filterOrg will MGET the block of keys and write out all those belonging to org
-func (r *RedisClient) filterOrg(org string) {
-	f, err := os.Create(r.opFiles[org])
-	if err != nil {
-		log.Fatal().Err(err).Str("opfile", r.opFiles[org]).Msg("cannot create")
-	}
-	defer f.Close()
-	log.Info().Str("opfile", r.opFiles[org]).Msg("truncated")
-	w := bufio.NewWriter(f)
-	defer w.Flush()
+// DumpStats counts the keys seen by DumpOrgKeys
+type DumpStats struct {
+	Scanned int
+	// Skipped keys could not be fetched or attributed to an org
+	Skipped int
+	// Orgs is the number of keys written for each org
+	Orgs map[string]int
+}
 
-	found := 0
-	for keys := range r.keysChans[org] {
-		values, err := r.rdb.MGet(r.ctx, keys...).Result()
+// scanFrom SCANs one node for pattern starting at cursor and calls fn
+// with each batch of names found and the cursor that follows it, until
+// the cursor is 0 again
+func scanFrom(ctx context.Context, node redis.Cmdable, pattern string, count int64, cursor uint64, fn func(names []string, next uint64) error) error {
+	for {
+		keys, next, err := node.Scan(ctx, cursor, pattern, count).Result()
 		if err != nil {
-			log.Error().Err(err).Msg("mget")
+			return fmt.Errorf("scanning %s at cursor %d: %w", pattern, cursor, err)
 		}
-		log.Debug().Int("keys", len(values)).Msg("mget")
-		for i, val := range values {
-			if val == nil || val == "0" {
-				log.Trace().Str("key", keys[i]).Msg("nil/zero value")
-				continue
-			}
-			jsonVal := make(map[string]interface{})
-			err = json.Unmarshal([]byte(val.(string)), &jsonVal)
-			if err != nil {
-				log.Error().Err(err).Interface("val", val).Msg("cannot decode")
-				continue
-			}
-
-			orgIdValue := ""
+		log.Debug().Int("keys", len(keys)).Uint64("cursor", next).Msg("scanned in this block")
+		if err := fn(keys, next); err != nil {
+			return err
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
 
-			var goiErr error
-			if orgIdValue, goiErr = getOrgId(jsonVal); goiErr != nil {
-				log.Error().Err(goiErr).Interface("val", jsonVal).
-					Msg("couldn't find the org_id field, skipping")
-				continue
-			}
+// scanKeys SCANs one node for pattern and sends the names found in
+// batches. Names that match one of the earlier patterns have already
+// been sent when that pattern was scanned, so they are left out. It
+// returns the number of names scanned.
+func scanKeys(ctx context.Context, node redis.Cmdable, pattern string, earlier []*regexp.Regexp, count int64, batches chan<- []string) (int, error) {
+	scanned := 0
+	err := scanFrom(ctx, node, pattern, count, 0, func(keys []string, _ uint64) error {
+		scanned += len(keys)
+		keys = slices.DeleteFunc(keys, func(name string) bool {
+			return slices.ContainsFunc(earlier, func(re *regexp.Regexp) bool {
+				return re.MatchString(name)
+			})
+		})
+		if len(keys) == 0 {
+			return nil
+		}
+		select {
+		case batches <- keys:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	return scanned, err
+}
 
-			if orgIdValue == org {
-				found++
-				ttl, _ := r.getTTL(keys[i])
+// forEachNode calls fn for every master in a cluster, or just for the
+// one server otherwise
+func (r *RedisClient) forEachNode(ctx context.Context, fn func(ctx context.Context, node redis.Cmdable) error) error {
+	if cc, isCluster := r.rdb.(*redis.ClusterClient); isCluster {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return fn(ctx, c)
+		})
+	}
+	return fn(ctx, r.rdb)
+}
 
-				output, err := json.Marshal(&redisKey{
-					Name:  keys[i],
-					TTL:   ttl,
-					Value: jsonVal,
-				})
-				if err != nil {
-					log.Error().Err(err).Bytes("output", output).Msg("could not marshal")
-					continue
-				}
-				// Add a newline
-				w.Write(append(output, byte(10)))
-			}
+// orgKeys fetches a batch of names and calls fn with the keys that
+// belong to the orgs in wanted. Keys whose name gives their org are
+// only fetched if they belong to one of them.
+func (r *RedisClient) orgKeys(ctx context.Context, names []string, wanted func(org string) bool, fn func(org string, key redisKey) error) (skipped int, err error) {
+	fetch := make([]string, 0, len(names))
+	for _, name := range names {
+		owner, known, err := orgFromName(r.rules, name)
+		if err != nil {
+			log.Debug().Err(err).Msg("couldn't attribute key, skipping")
+			skipped++
+			continue
+		}
+		if !known || wanted(owner) {
+			fetch = append(fetch, name)
 		}
 	}
-	log.Info().Int("found", found).Str("org", org).Msg("done")
+	if len(fetch) == 0 {
+		return skipped, nil
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, getKeysTimeout)
+	defer cancel()
+	keys, unfetched, err := r.fetchKeys(fetchCtx, fetch)
+	if err != nil {
+		return skipped, err
+	}
+	for name, reason := range unfetched {
+		log.Warn().Str("key", name).Str("reason", reason).Msg("skipping")
+	}
+	skipped += len(unfetched)
+	for _, key := range keys {
+		owner, err := orgOf(r.rules, key)
+		if err != nil {
+			log.Debug().Err(err).Str("key", key.Name).Msg("couldn't find the org, skipping")
+			skipped++
+			continue
+		}
+		if !wanted(owner) {
+			continue
+		}
+		if err := fn(owner, key); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
 }
 
-func (r *RedisClient) scanKeys(org string, pattern string, batchSize int64) int {
-	scanned := 0
-	var cursor uint64 = 0
-	for {
-		var (
-			keys []string
-			err  error
-		)
-		keys, cursor, err = r.rdb.Scan(r.ctx, cursor, pattern, batchSize).Result()
-		if err != nil {
-			log.Error().Err(err).Uint64("cursor", cursor).Msg("scan failure")
+// route fetches a batch of names and sends the keys that belong to the
+// orgs being dumped to their writers
+func (r *RedisClient) route(ctx context.Context, names []string, writers map[string]chan redisKey) (int, error) {
+	wanted := func(org string) bool {
+		_, dumping := writers[org]
+		return dumping
+	}
+	return r.orgKeys(ctx, names, wanted, func(org string, key redisKey) error {
+		select {
+		case writers[org] <- key:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		nKeys := len(keys)
-		scanned += nKeys
-		log.Debug().Int("keys", nKeys).Uint64("cursor", cursor).Msg("scanned in this block")
-		r.keysChans[org] <- keys
+	})
+}
+
+// writeOrg writes the keys received for org to its dump file and
+// returns the number written
+func (r *RedisClient) writeOrg(org string, keys <-chan redisKey) (int, error) {
+	f, err := r.sealer.Create(r.opFiles[org])
+	if err != nil {
+		return 0, fmt.Errorf("creating dump for %s: %w", org, err)
+	}
+	defer f.Close()
+	log.Info().Str("opfile", r.opFiles[org]).Msg("truncated")
+	w := bufio.NewWriter(f)
 
-		if cursor == 0 {
-			break
+	// Overlapping patterns are taken care of by scanKeys. SCAN can
+	// still return a key again if the keyspace is rehashed during the
+	// dump, which restores the same key twice.
+	found := 0
+	var werr error
+	for key := range keys {
+		if werr != nil {
+			continue
 		}
+		key.encode()
+		output, err := json.Marshal(&key)
+		if err != nil {
+			log.Error().Err(err).Str("key", key.Name).Msg("could not marshal")
+			continue
+		}
+		// Add a newline
+		if _, werr = w.Write(append(output, byte(10))); werr == nil {
+			found++
+		}
+	}
+	if werr == nil {
+		werr = w.Flush()
+	}
+	if werr != nil {
+		return found, fmt.Errorf("writing dump for %s: %w", org, werr)
 	}
-	return scanned
+	log.Info().Int("found", found).Str("org", org).Msg("done")
+	return found, f.Close()
 }
 
-func (r *RedisClient) getTTL(keyName string) (int64, error) {
-	var duration time.Duration
-	var err error
+// DumpOrgKeys is suited to run in prod. Each pattern is SCANned once on
+// every master, with batchSize as the COUNT. The keys found are fetched
+// by a few workers and routed to one writer per org. The channels
+// between them are bounded, so a slow writer slows down the scan
+// instead of buffering the keyspace in memory.
+func (r *RedisClient) DumpOrgKeys(patterns []string, batchSize int64) (DumpStats, error) {
+	start := time.Now()
+	stats := DumpStats{Orgs: make(map[string]int)}
+	var mu sync.Mutex
 
-	if duration, err = r.rdb.TTL(r.ctx, keyName).Result(); err != nil {
-		return 0, err
+	g, ctx := errgroup.WithContext(r.ctx)
+	writers := make(map[string]chan redisKey)
+	for org := range r.opFiles {
+		keys := make(chan redisKey, max(batchSize, 1))
+		writers[org] = keys
+		g.Go(func() error {
+			n, err := r.writeOrg(org, keys)
+			mu.Lock()
+			stats.Orgs[org] = n
+			mu.Unlock()
+			return err
+		})
 	}
 
-	return int64(duration.Seconds()), nil
+	globs := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		globs[i] = globRegexp(pattern)
+	}
+	batches := make(chan []string, fetchWorkers)
+	var fetchers sync.WaitGroup
+	for range fetchWorkers {
+		fetchers.Add(1)
+		g.Go(func() error {
+			defer fetchers.Done()
+			for names := range batches {
+				skipped, err := r.route(ctx, names, writers)
+				mu.Lock()
+				stats.Skipped += skipped
+				mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(batches)
+		return r.forEachNode(ctx, func(ctx context.Context, node redis.Cmdable) error {
+			for i, pattern := range patterns {
+				log.Info().Str("pattern", pattern).Msg("processing")
+				n, err := scanKeys(ctx, node, pattern, globs[:i], batchSize, batches)
+				mu.Lock()
+				stats.Scanned += n
+				mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	// the writers finish once nothing more can be routed to them
+	go func() {
+		fetchers.Wait()
+		for _, keys := range writers {
+			close(keys)
+		}
+	}()
+
+	err := g.Wait()
+	log.Info().Dur("time", time.Since(start)).Int("scanned", stats.Scanned).Int("skipped", stats.Skipped).Msg("done with keys")
+	return stats, err
 }
 
 // A simple hack to work around lack of generics in logging an array to zerolog
@@ -204,27 +361,3 @@ func getOrgId(jsonVal map[string]interface{}) (string, error) {
 
 	return orgIdValue, nil
 }
-
-// DumpOrgKeys is suited to run in prod. Just one goroutine per org to write the output file.
-// The run time is about 3x that of the threaded version
-func (r *RedisClient) DumpOrgKeys(orgs []string, patterns []string, batchSize int64) {
-	scanned := 0
-	start := time.Now()
-
-	var wg sync.WaitGroup
-	for _, org := range orgs {
-		go func() {
-			wg.Add(1)
-			log.Debug().Str("org", org).Msg("spawning filterOrg")
-			r.filterOrg(org)
-			wg.Done()
-		}()
-		for _, pattern := range patterns {
-			log.Info().Str("org", org).Str("pattern", pattern).Msg("processing")
-			scanned += r.scanKeys(org, pattern, batchSize)
-		}
-		close(r.keysChans[org])
-	}
-	wg.Wait()
-	log.Info().Dur("time", time.Since(start)).Int("scanned", scanned).Msg("done with keys")
-}
@@ -0,0 +1,142 @@
+package orgs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seed adds perOrg apikeys for each of orgs and returns the names by org
+func seed(t testing.TB, rdb redis.Cmdable, orgs int, perOrg int) map[string][]string {
+	t.Helper()
+	ctx := context.Background()
+	names := make(map[string][]string)
+	pipe := rdb.Pipeline()
+	for o := range orgs {
+		org := fmt.Sprintf("org%03d", o)
+		for k := range perOrg {
+			name := fmt.Sprintf("apikey-bench-%s-%d", org, k)
+			pipe.Set(ctx, name, fmt.Sprintf(`{"org_id":%q,"n":%d}`, org, k), 0)
+			names[org] = append(names[org], name)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	require.NoError(t, err)
+	return names
+}
+
+func dumpedNames(t *testing.T, fpath string) []string {
+	t.Helper()
+	f, err := os.Open(fpath)
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		name, _, _ := strings.Cut(strings.TrimPrefix(sc.Text(), `{"name":"`), `"`)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestDumpOrgKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	names := seed(t, rdb, 20, 30)
+	require.NoError(t, mr.Set("unrelated", "0"))
+	dir := t.TempDir()
+	orgs := []string{"org001", "org007", "org019", "org404"}
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 7}, orgs, dir)
+
+	// overlapping patterns must not duplicate keys
+	stats, err := r.DumpOrgKeys([]string{"apikey-*", "apikey-bench-org00*", "*"}, 7)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"org001": 30, "org007": 30, "org019": 30, "org404": 0}, stats.Orgs)
+	assert.Equal(t, 600+300+601, stats.Scanned)
+	assert.Equal(t, 1, stats.Skipped)
+	for _, org := range orgs {
+		assert.ElementsMatch(t, names[org], dumpedNames(t, filepath.Join(dir, org+".keys.jl")), org)
+	}
+}
+
+// TestScanKeysEarlier checks that names matching an earlier pattern are
+// not sent again
+func TestScanKeysEarlier(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	seed(t, rdb, 2, 10)
+	batches := make(chan []string, 100)
+	n, err := scanKeys(context.Background(), rdb, "*", []*regexp.Regexp{globRegexp("apikey-*-org000-*")}, 5, batches)
+	require.NoError(t, err)
+	close(batches)
+	assert.Equal(t, 20, n, "every name is scanned")
+	var sent []string
+	for names := range batches {
+		sent = append(sent, names...)
+	}
+	assert.Len(t, sent, 10)
+	for _, name := range sent {
+		assert.Contains(t, name, "org001")
+	}
+}
+
+func TestDumpOrgKeysCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	names := seed(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}), 3, 10)
+	dir := t.TempDir()
+	r := NewRedisClient(context.Background(), &RedisOptions{BatchSize: 5}, []string{"org001"}, dir)
+	r.rdb = redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+
+	stats, err := r.DumpOrgKeys([]string{"apikey-*"}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 30, stats.Scanned)
+	assert.Equal(t, 10, stats.Orgs["org001"])
+	assert.ElementsMatch(t, names["org001"], dumpedNames(t, filepath.Join(dir, "org001.keys.jl")))
+}
+
+func TestDumpOrgKeysFails(t *testing.T) {
+	mr := miniredis.RunT(t)
+	seed(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}), 2, 10)
+	// the dump dir does not exist
+	dir := filepath.Join(t.TempDir(), "missing")
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 1}, []string{"org000", "org001"}, dir)
+	_, err := r.DumpOrgKeys([]string{"*"}, 1)
+	assert.Error(t, err)
+}
+
+// BenchmarkDumpOrgKeys dumps 10 of 200 orgs from 40k keys. Set
+// GROMIT_BENCH_REDIS to the address of a scratch redis to run it
+// against a real server instead of miniredis; its keys are flushed.
+func BenchmarkDumpOrgKeys(b *testing.B) {
+	addr := os.Getenv("GROMIT_BENCH_REDIS")
+	if addr == "" {
+		addr = miniredis.RunT(b).Addr()
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	require.NoError(b, rdb.FlushDB(context.Background()).Err())
+	defer rdb.FlushDB(context.Background())
+	seed(b, rdb, 200, 200)
+
+	var orgs []string
+	for o := range 10 {
+		orgs = append(orgs, fmt.Sprintf("org%03d", o*20))
+	}
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{addr}, BatchSize: 1000}, orgs, b.TempDir())
+	b.ResetTimer()
+	for range b.N {
+		stats, err := r.DumpOrgKeys([]string{"apikey-*"}, 1000)
+		require.NoError(b, err)
+		require.Equal(b, 200, stats.Orgs[orgs[0]])
+	}
+	b.ReportMetric(float64(40000*b.N)/b.Elapsed().Seconds(), "keys/s")
+}
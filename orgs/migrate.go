@@ -0,0 +1,541 @@
+package orgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// maxMismatches is the number of differences listed in a VerifyReport
+const maxMismatches = 20
+
+// PrefixRewrite renames keys that start with Old to start with New
+type PrefixRewrite struct {
+	Old string
+	New string
+}
+
+// ParsePrefixRewrites parses rewrites in the form old=new, new can be
+// empty to strip a prefix. The first rewrite whose prefix matches a key
+// is used.
+func ParsePrefixRewrites(specs []string) ([]PrefixRewrite, error) {
+	rws := make([]PrefixRewrite, 0, len(specs))
+	for _, spec := range specs {
+		old, repl, found := strings.Cut(spec, "=")
+		if !found || old == "" {
+			return nil, fmt.Errorf("rewrite %q is not in the form old=new", spec)
+		}
+		rws = append(rws, PrefixRewrite{old, repl})
+	}
+	return rws, nil
+}
+
+func rewriteName(rws []PrefixRewrite, name string) string {
+	for _, rw := range rws {
+		if rest, found := strings.CutPrefix(name, rw.Old); found {
+			return rw.New + rest
+		}
+	}
+	return name
+}
+
+// MigrateOptions control how keys are copied between redis servers
+type MigrateOptions struct {
+	// Patterns are SCANned for in the source
+	Patterns []string
+	Rewrites []PrefixRewrite
+	// Conflict is ConflictSkip or ConflictOverwrite, as keys are
+	// written while the source is being scanned
+	Conflict string
+	// TTLAdd is added to the TTL of keys that expire, keys that would
+	// expire in less than a second are not copied
+	TTLAdd time.Duration
+	// TTLMax caps the TTL of keys that expire, if set
+	TTLMax time.Duration
+}
+
+// adjustTTL applies TTLAdd and TTLMax to k and reports whether it
+// should still be copied
+func (o MigrateOptions) adjustTTL(k *redisKey) bool {
+	if k.TTL <= 0 {
+		return true
+	}
+	ttl := time.Duration(k.TTL)*time.Second + o.TTLAdd
+	if ttl < time.Second {
+		return false
+	}
+	if o.TTLMax > 0 && ttl > o.TTLMax {
+		ttl = o.TTLMax
+	}
+	k.TTL = int64(ttl / time.Second)
+	return true
+}
+
+// MigrateStats counts the keys seen by MigrateKeys
+type MigrateStats struct {
+	Scanned int
+	// Skipped keys could not be fetched or attributed to an org
+	Skipped int
+	// Expired keys would have no TTL left after adjusting it
+	Expired int
+	Written int
+	// Existing keys were left alone in the destination
+	Existing int
+}
+
+// ScanProgress is where the SCAN of a pattern on a node got to
+type ScanProgress struct {
+	Cursor  uint64 `json:"cursor"`
+	Done    bool   `json:"done"`
+	Written int    `json:"written"`
+}
+
+// DocProgress is the last _id copied from a collection, documents are
+// copied in _id order
+type DocProgress struct {
+	LastID json.RawMessage `json:"last_id,omitempty"`
+	Done   bool            `json:"done"`
+	Copied int             `json:"copied"`
+}
+
+// Checkpoint records the progress of a migration after every batch, so
+// that it can be resumed where it stopped. SCAN cursors can only be
+// resumed on the same servers, if the source has failed over or been
+// resharded in between, start again with a new checkpoint.
+type Checkpoint struct {
+	Org  string                  `json:"org"`
+	Keys map[string]ScanProgress `json:"keys"`
+	Docs map[string]DocProgress  `json:"docs"`
+	path string
+	mu   sync.Mutex
+}
+
+// LoadCheckpoint reads the checkpoint for org from path, or starts a new
+// one if there is none. With an empty path, progress is not saved.
+func LoadCheckpoint(path, org string) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		Org:  org,
+		Keys: make(map[string]ScanProgress),
+		Docs: make(map[string]DocProgress),
+		path: path,
+	}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %w", path, err)
+	}
+	if cp.Org != org {
+		return nil, fmt.Errorf("checkpoint %s is for org %s, not %s", path, cp.Org, org)
+	}
+	return cp, nil
+}
+
+// save replaces the checkpoint file, the caller holds mu
+func (c *Checkpoint) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *Checkpoint) scan(pattern, addr string) ScanProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Keys[pattern+"@"+addr]
+}
+
+func (c *Checkpoint) setScan(pattern, addr string, p ScanProgress) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Keys[pattern+"@"+addr] = p
+	return c.save()
+}
+
+func (c *Checkpoint) docs(coll string) DocProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Docs[coll]
+}
+
+func (c *Checkpoint) setDocs(coll string, p DocProgress) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Docs[coll] = p
+	return c.save()
+}
+
+// nodeAddr identifies a node in a checkpoint
+func nodeAddr(node redis.Cmdable) string {
+	if c, ok := node.(*redis.Client); ok {
+		return c.Options().Addr
+	}
+	return ""
+}
+
+// count is the COUNT for SCAN and the size of a pipeline
+func (r *RedisClient) count() int64 {
+	if r.batchSize <= 0 {
+		return batchSize
+	}
+	return r.batchSize
+}
+
+// MigrateKeys copies the keys of org that match opts.Patterns from src
+// to dst, batch by batch as they are scanned, with no intermediate
+// files. The progress is saved in cp after every batch and patterns
+// that are done in cp are not scanned again.
+func MigrateKeys(org string, src, dst *RedisClient, opts MigrateOptions, cp *Checkpoint) (MigrateStats, error) {
+	var stats MigrateStats
+	switch opts.Conflict {
+	case ConflictSkip, ConflictOverwrite:
+	default:
+		return stats, fmt.Errorf("unknown conflict policy %q for a migration, expected %s or %s", opts.Conflict, ConflictSkip, ConflictOverwrite)
+	}
+	var mu sync.Mutex
+	wanted := func(o string) bool { return o == org }
+	err := src.forEachNode(src.ctx, func(ctx context.Context, node redis.Cmdable) error {
+		addr := nodeAddr(node)
+		for _, pattern := range opts.Patterns {
+			p := cp.scan(pattern, addr)
+			if p.Done {
+				log.Info().Str("pattern", pattern).Str("node", addr).Msg("already migrated")
+				continue
+			}
+			log.Info().Str("pattern", pattern).Str("node", addr).Uint64("cursor", p.Cursor).Msg("migrating")
+			err := scanFrom(ctx, node, pattern, src.count(), p.Cursor, func(names []string, next uint64) error {
+				var keys []redisKey
+				expired := 0
+				skipped, err := src.orgKeys(ctx, names, wanted, func(_ string, k redisKey) error {
+					if !opts.adjustTTL(&k) {
+						expired++
+						return nil
+					}
+					k.Name = rewriteName(opts.Rewrites, k.Name)
+					keys = append(keys, k)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				n := 0
+				if len(keys) > 0 {
+					err = dst.inBatch(func(ctx context.Context) error {
+						n, err = dst.writeKeys(ctx, keys, opts.Conflict == ConflictOverwrite)
+						return err
+					})
+					if err != nil {
+						return fmt.Errorf("writing to the destination: %w", err)
+					}
+				}
+				mu.Lock()
+				stats.Scanned += len(names)
+				stats.Skipped += skipped
+				stats.Expired += expired
+				stats.Written += n
+				stats.Existing += len(keys) - n
+				mu.Unlock()
+				p.Cursor, p.Done = next, next == 0
+				p.Written += n
+				return cp.setScan(pattern, addr, p)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	log.Info().Str("org", org).Int("scanned", stats.Scanned).Int("written", stats.Written).Int("existing", stats.Existing).
+		Int("expired", stats.Expired).Int("skipped", stats.Skipped).Msg("migrated keys")
+	return stats, err
+}
+
+// MigrateDocs upserts the documents of org in the collections of src
+// into the same collections in dst, in batches in _id order. The last
+// _id copied is saved in cp after every batch.
+func MigrateDocs(org string, src, dst *MongoClient, cp *Checkpoint) (int, error) {
+	copied := 0
+	for _, c := range src.colls {
+		name := c.DB + "." + c.Name
+		p := cp.docs(name)
+		if p.Done {
+			log.Info().Str("collection", name).Msg("already migrated")
+			continue
+		}
+		filter := c.filter(org)
+		if p.LastID != nil {
+			var last bson.D
+			if err := bson.UnmarshalExtJSON(p.LastID, true, &last); err != nil || len(last) != 1 {
+				return copied, fmt.Errorf("last _id of %s in the checkpoint: %s", name, p.LastID)
+			}
+			filter = bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: last[0].Value}}}}}}}
+		}
+		cur, err := src.client.Database(c.DB).Collection(c.Name).Find(src.ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return copied, fmt.Errorf("reading %s: %w", name, err)
+		}
+		coll := dst.client.Database(c.DB).Collection(c.Name)
+		batch := make([]bson.Raw, 0, upsertBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := upsertDocs(dst.ctx, coll, batch); err != nil {
+				return fmt.Errorf("writing %s: %w", name, err)
+			}
+			last, err := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: batch[len(batch)-1].Lookup("_id")}}, true, false)
+			if err != nil {
+				return err
+			}
+			p.LastID = last
+			p.Copied += len(batch)
+			copied += len(batch)
+			batch = batch[:0]
+			return cp.setDocs(name, p)
+		}
+		for cur.Next(src.ctx) {
+			// the cursor reuses Current
+			batch = append(batch, slices.Clone(cur.Current))
+			if len(batch) == upsertBatchSize {
+				if err := flush(); err != nil {
+					cur.Close(src.ctx)
+					return copied, err
+				}
+			}
+		}
+		err = cur.Err()
+		cur.Close(src.ctx)
+		if err != nil {
+			return copied, fmt.Errorf("reading %s: %w", name, err)
+		}
+		if err := flush(); err != nil {
+			return copied, err
+		}
+		p.Done = true
+		if err := cp.setDocs(name, p); err != nil {
+			return copied, err
+		}
+		log.Info().Str("org", org).Str("collection", name).Int("docs", p.Copied).Msg("migrated")
+	}
+	return copied, nil
+}
+
+// VerifyReport compares what belongs to an org in the source and in the
+// destination of a migration
+type VerifyReport struct {
+	// What is keys or db.collection
+	What    string
+	Source  int
+	Dest    int
+	Sampled int
+	// Mismatches lists the first keys or documents that differ
+	Mismatches []string
+}
+
+// OK is true if the counts match and every sample was the same
+func (v VerifyReport) OK() bool {
+	return v.Source == v.Dest && len(v.Mismatches) == 0
+}
+
+func (v *VerifyReport) mismatch(format string, args ...any) {
+	if len(v.Mismatches) < maxMismatches {
+		v.Mismatches = append(v.Mismatches, fmt.Sprintf(format, args...))
+	}
+}
+
+// sameKey compares the values of keys, ignoring their names and TTLs
+func sameKey(a, b redisKey) bool {
+	for _, k := range []*redisKey{&a, &b} {
+		k.Name, k.TTL = "", 0
+		// SMEMBERS has no order
+		k.Set = slices.Clone(k.Set)
+		slices.Sort(k.Set)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// VerifyKeys scans src for the keys of org that MigrateKeys copies and
+// counts how many of them are in dst. The values of up to sample keys,
+// chosen at random, are compared.
+func VerifyKeys(org string, src, dst *RedisClient, opts MigrateOptions, sample int) (VerifyReport, error) {
+	report := VerifyReport{What: "keys"}
+	var mu sync.Mutex
+	names := make(map[string]bool)
+	var samples []redisKey
+	wanted := func(o string) bool { return o == org }
+	err := src.forEachNode(src.ctx, func(ctx context.Context, node redis.Cmdable) error {
+		for _, pattern := range opts.Patterns {
+			err := scanFrom(ctx, node, pattern, src.count(), 0, func(batch []string, _ uint64) error {
+				_, err := src.orgKeys(ctx, batch, wanted, func(_ string, k redisKey) error {
+					if !opts.adjustTTL(&k) {
+						return nil
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if names[k.Name] {
+						return nil
+					}
+					names[k.Name] = true
+					// reservoir sampling
+					if len(samples) < sample {
+						samples = append(samples, k)
+					} else if i := rand.IntN(len(names)); i < sample {
+						samples[i] = k
+					}
+					return nil
+				})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Source = len(names)
+
+	batch := make([]redisKey, 0, src.count())
+	check := func() error {
+		return dst.inBatch(func(ctx context.Context) error {
+			found, err := dst.existingKeys(ctx, batch)
+			report.Dest += len(found)
+			if len(found) < len(batch) {
+				present := make(map[string]bool, len(found))
+				for _, name := range found {
+					present[name] = true
+				}
+				for _, k := range batch {
+					if !present[k.Name] {
+						report.mismatch("%s is missing", k.Name)
+					}
+				}
+			}
+			batch = batch[:0]
+			return err
+		})
+	}
+	for name := range names {
+		batch = append(batch, redisKey{Name: rewriteName(opts.Rewrites, name)})
+		if len(batch) == cap(batch) {
+			if err := check(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := check(); err != nil {
+			return report, err
+		}
+	}
+
+	if len(samples) == 0 {
+		return report, nil
+	}
+	sampled := make([]string, len(samples))
+	for i, k := range samples {
+		sampled[i] = rewriteName(opts.Rewrites, k.Name)
+	}
+	var copies []redisKey
+	err = dst.inBatch(func(ctx context.Context) error {
+		copies, _, err = dst.fetchKeys(ctx, sampled)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	byName := make(map[string]redisKey, len(copies))
+	for _, k := range copies {
+		byName[k.Name] = k
+	}
+	report.Sampled = len(samples)
+	for i, k := range samples {
+		if c, found := byName[sampled[i]]; found && !sameKey(k, c) {
+			report.mismatch("%s differs from %s", sampled[i], k.Name)
+		}
+	}
+	return report, nil
+}
+
+// VerifyDocs counts the documents of org in every collection of src and
+// dst and compares up to sample documents from each, chosen by $sample
+func VerifyDocs(org string, src, dst *MongoClient, sample int) ([]VerifyReport, error) {
+	var reports []VerifyReport
+	for _, c := range src.colls {
+		report := VerifyReport{What: c.DB + "." + c.Name}
+		srcColl := src.client.Database(c.DB).Collection(c.Name)
+		dstColl := dst.client.Database(c.DB).Collection(c.Name)
+		n, err := srcColl.CountDocuments(src.ctx, c.filter(org))
+		if err != nil {
+			return reports, fmt.Errorf("counting %s: %w", report.What, err)
+		}
+		report.Source = int(n)
+		if n, err = dstColl.CountDocuments(dst.ctx, c.filter(org)); err != nil {
+			return reports, fmt.Errorf("counting %s in the destination: %w", report.What, err)
+		}
+		report.Dest = int(n)
+
+		if sample > 0 {
+			cur, err := srcColl.Aggregate(src.ctx, mongo.Pipeline{
+				{{Key: "$match", Value: c.filter(org)}},
+				{{Key: "$sample", Value: bson.D{{Key: "size", Value: sample}}}},
+			})
+			if err != nil {
+				return reports, fmt.Errorf("sampling %s: %w", report.What, err)
+			}
+			for cur.Next(src.ctx) {
+				report.Sampled++
+				id := cur.Current.Lookup("_id")
+				dup, err := dstColl.FindOne(dst.ctx, bson.D{{Key: "_id", Value: id}}).Raw()
+				switch {
+				case errors.Is(err, mongo.ErrNoDocuments):
+					report.mismatch("%s %s is missing", report.What, id)
+				case err != nil:
+					cur.Close(src.ctx)
+					return reports, err
+				case !bytes.Equal(dup, cur.Current):
+					report.mismatch("%s %s differs", report.What, id)
+				}
+			}
+			err = cur.Err()
+			cur.Close(src.ctx)
+			if err != nil {
+				return reports, fmt.Errorf("sampling %s: %w", report.What, err)
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
@@ -0,0 +1,195 @@
+package orgs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func migrateClients(t *testing.T, src, dst *miniredis.Miniredis, count int64) (*RedisClient, *RedisClient) {
+	t.Helper()
+	ctx := context.Background()
+	s := NewRedisClient(ctx, &RedisOptions{Addrs: []string{src.Addr()}, BatchSize: count}, []string{"org001"}, "")
+	d := NewRedisClient(ctx, &RedisOptions{Addrs: []string{dst.Addr()}, BatchSize: count}, []string{"org001"}, "")
+	return &s, &d
+}
+
+func TestMigrateKeys(t *testing.T) {
+	src, dst := miniredis.RunT(t), miniredis.RunT(t)
+	names := seed(t, redis.NewClient(&redis.Options{Addr: src.Addr()}), 3, 25)
+	src.SetTTL("apikey-bench-org001-0", time.Hour)
+	src.SetTTL("apikey-bench-org001-1", 10*time.Second)
+	require.NoError(t, dst.Set("plain-org001-2", "kept"))
+	s, d := migrateClients(t, src, dst, 10)
+
+	opts := MigrateOptions{
+		Patterns: []string{"apikey-*"},
+		Rewrites: []PrefixRewrite{{Old: "apikey-bench-", New: "plain-"}},
+		Conflict: ConflictSkip,
+		TTLAdd:   -30 * time.Second,
+		TTLMax:   time.Minute,
+	}
+	cpPath := filepath.Join(t.TempDir(), "org001.migrate.json")
+	cp, err := LoadCheckpoint(cpPath, "org001")
+	require.NoError(t, err)
+	stats, err := MigrateKeys("org001", s, d, opts, cp)
+	require.NoError(t, err)
+	assert.Equal(t, MigrateStats{Scanned: 75, Expired: 1, Written: 23, Existing: 1}, stats)
+
+	assert.Equal(t, time.Minute, dst.TTL("plain-org001-0"))
+	assert.False(t, dst.Exists("plain-org001-1"))
+	assert.Zero(t, dst.TTL("plain-org001-3"))
+	v, err := dst.Get("plain-org001-2")
+	require.NoError(t, err)
+	assert.Equal(t, "kept", v)
+	assert.False(t, dst.Exists(names["org000"][0]))
+
+	report, err := VerifyKeys("org001", s, d, opts, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 24, report.Source)
+	assert.Equal(t, 24, report.Dest)
+	assert.Equal(t, 5, report.Sampled)
+	// plain-org001-2 may not be sampled
+	require.NoError(t, dst.Set("plain-org001-2", `{"org_id":"org001","n":2}`))
+	report, err = VerifyKeys("org001", s, d, opts, 100)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), report.Mismatches)
+
+	// a finished migration is not scanned again
+	cp, err = LoadCheckpoint(cpPath, "org001")
+	require.NoError(t, err)
+	stats, err = MigrateKeys("org001", s, d, opts, cp)
+	require.NoError(t, err)
+	assert.Zero(t, stats.Scanned)
+
+	_, err = LoadCheckpoint(cpPath, "org002")
+	assert.Error(t, err)
+
+	dst.Del("plain-org001-3")
+	require.NoError(t, dst.Set("plain-org001-4", "changed"))
+	report, err = VerifyKeys("org001", s, d, opts, 100)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 23, report.Dest)
+	assert.Contains(t, report.Mismatches, "plain-org001-3 is missing")
+	assert.Contains(t, report.Mismatches, "plain-org001-4 differs from apikey-bench-org001-4")
+}
+
+func TestMigrateKeysResumes(t *testing.T) {
+	src, dst := miniredis.RunT(t), miniredis.RunT(t)
+	seed(t, redis.NewClient(&redis.Options{Addr: src.Addr()}), 2, 30)
+	s, d := migrateClients(t, src, dst, 10)
+	opts := MigrateOptions{Patterns: []string{"apikey-bench-org001-1*", "apikey-bench-org001-2*"}, Conflict: ConflictOverwrite}
+	cpPath := filepath.Join(t.TempDir(), "cp.json")
+
+	// the destination goes away during the migration
+	dst.Close()
+	cp, err := LoadCheckpoint(cpPath, "org001")
+	require.NoError(t, err)
+	_, err = MigrateKeys("org001", s, d, opts, cp)
+	require.Error(t, err)
+	assert.False(t, cp.scan(opts.Patterns[0], src.Addr()).Done)
+
+	// as if the first pattern had been copied when it stopped
+	require.NoError(t, cp.setScan(opts.Patterns[0], src.Addr(), ScanProgress{Done: true, Written: 11}))
+	require.NoError(t, dst.Restart())
+	cp, err = LoadCheckpoint(cpPath, "org001")
+	require.NoError(t, err)
+	stats, err := MigrateKeys("org001", s, d, opts, cp)
+	require.NoError(t, err)
+	assert.Equal(t, 11, stats.Written)
+	assert.False(t, dst.Exists("apikey-bench-org001-1"))
+	assert.True(t, dst.Exists("apikey-bench-org001-2"))
+	data, err := os.ReadFile(cpPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"apikey-bench-org001-2*@`+src.Addr())
+
+	report, err := VerifyKeys("org001", s, d, opts, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 22, report.Source)
+	assert.Equal(t, 11, report.Dest)
+	assert.Len(t, report.Mismatches, 11)
+}
+
+func TestMigrateOptions(t *testing.T) {
+	_, err := ParsePrefixRewrites([]string{"apikey-"})
+	assert.Error(t, err)
+	rws, err := ParsePrefixRewrites([]string{"apikey-=", "a=b"})
+	require.NoError(t, err)
+	assert.Equal(t, "123", rewriteName(rws, "apikey-123"))
+	assert.Equal(t, "bpikey", rewriteName(rws, "apikey"))
+	assert.Equal(t, "c", rewriteName(rws, "c"))
+
+	s, d := migrateClients(t, miniredis.RunT(t), miniredis.RunT(t), 10)
+	cp, err := LoadCheckpoint("", "org001")
+	require.NoError(t, err)
+	_, err = MigrateKeys("org001", s, d, MigrateOptions{Conflict: ConflictFail}, cp)
+	assert.Error(t, err)
+}
+
+// TestMongoMigrate needs two mongods that it can write to, see the
+// test-mongo target in the Makefile
+func TestMongoMigrate(t *testing.T) {
+	from, to := os.Getenv("MONGO_URL"), os.Getenv("MONGO_TO_URL")
+	if from == "" || to == "" {
+		t.Skip("Requires MONGO_URL and MONGO_TO_URL to be set to scratch mongods to run this test.")
+	}
+	ctx := context.Background()
+	colls, err := ParseCollections([]string{"gromit_test.apis"})
+	require.NoError(t, err)
+	src, err := NewMongoClient(ctx, &MongoOptions{URL: from, Collections: colls}, "")
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := NewMongoClient(ctx, &MongoOptions{URL: to, Collections: colls}, "")
+	require.NoError(t, err)
+	defer dst.Close()
+	for _, m := range []MongoClient{src, dst} {
+		db := m.client.Database("gromit_test")
+		require.NoError(t, db.Drop(ctx))
+		defer db.Drop(ctx)
+	}
+	var docs []any
+	for i := range 1200 {
+		org := "org1"
+		if i%3 == 0 {
+			org = "other"
+		}
+		docs = append(docs, bson.D{{Key: "_id", Value: i}, {Key: "org_id", Value: org}})
+	}
+	_, err = src.client.Database("gromit_test").Collection("apis").InsertMany(ctx, docs)
+	require.NoError(t, err)
+
+	cpPath := filepath.Join(t.TempDir(), "cp.json")
+	cp, err := LoadCheckpoint(cpPath, "org1")
+	require.NoError(t, err)
+	// resume after the first 500 documents of org1
+	last, err := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: 749}}, true, false)
+	require.NoError(t, err)
+	require.NoError(t, cp.setDocs("gromit_test.apis", DocProgress{LastID: last, Copied: 500}))
+	n, err := MigrateDocs("org1", &src, &dst, cp)
+	require.NoError(t, err)
+	assert.Equal(t, 300, n)
+
+	reports, err := VerifyDocs("org1", &src, &dst, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 800, reports[0].Source)
+	assert.Equal(t, 300, reports[0].Dest)
+	assert.False(t, reports[0].OK())
+
+	cp, err = LoadCheckpoint("", "org1")
+	require.NoError(t, err)
+	n, err = MigrateDocs("org1", &src, &dst, cp)
+	require.NoError(t, err)
+	assert.Equal(t, 800, n)
+	reports, err = VerifyDocs("org1", &src, &dst, 10)
+	require.NoError(t, err)
+	assert.True(t, reports[0].OK(), reports[0].Mismatches)
+}
@@ -0,0 +1,312 @@
+package orgs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// MongoManifestFile is written last into the dump dir of an org
+	MongoManifestFile = "manifest.json"
+	// DefaultOrgField is the field that holds the org id in most collections
+	DefaultOrgField = "org_id"
+	upsertBatchSize = 500
+)
+
+// DefaultCollections are the dashboard collections that hold org data
+var DefaultCollections = []string{
+	"tyk_analytics.tyk_apis",
+	"tyk_analytics.tyk_policies",
+	"tyk_analytics.tyk_analytics_users",
+	"tyk_analytics.tyk_organizations:_id",
+}
+
+// Collection is a mongo collection that is filtered by the org id in Field
+type Collection struct {
+	DB    string `json:"db"`
+	Name  string `json:"collection"`
+	Field string `json:"field"`
+}
+
+// ParseCollections parses specs in the form db.collection[:field]. The
+// field defaults to org_id.
+func ParseCollections(specs []string) ([]Collection, error) {
+	colls := make([]Collection, 0, len(specs))
+	for _, spec := range specs {
+		spec, field, found := strings.Cut(spec, ":")
+		if !found {
+			field = DefaultOrgField
+		}
+		db, name, found := strings.Cut(spec, ".")
+		if !found || db == "" || name == "" || field == "" {
+			return nil, fmt.Errorf("collection %q is not in the form db.collection[:field]", spec)
+		}
+		colls = append(colls, Collection{DB: db, Name: name, Field: field})
+	}
+	return colls, nil
+}
+
+// filter selects the documents of org. An _id field is compared as an
+// ObjectID when org looks like one.
+func (c Collection) filter(org string) bson.D {
+	if c.Field == "_id" {
+		if oid, err := bson.ObjectIDFromHex(org); err == nil {
+			return bson.D{{Key: "_id", Value: oid}}
+		}
+	}
+	return bson.D{{Key: c.Field, Value: org}}
+}
+
+// file is where the collection is saved, relative to the dump dir of the org
+func (c Collection) file() string {
+	return filepath.Join(c.DB, c.Name+".bson")
+}
+
+// MongoManifest records what was dumped for an org
+type MongoManifest struct {
+	Org         string              `json:"org"`
+	DumpedAt    time.Time           `json:"dumped_at"`
+	Collections []CollectionSummary `json:"collections"`
+}
+
+// CollectionSummary is the number of documents dumped from a collection
+type CollectionSummary struct {
+	Collection
+	File  string `json:"file"`
+	Count int    `json:"count"`
+}
+
+// MongoOptions configure the mongo half of dump and restore
+type MongoOptions struct {
+	URL         string
+	Collections []Collection
+	// Sealer creates the dump files and Opener reads them, both can be
+	// nil for plain files
+	Sealer *Sealer
+	Opener *Opener
+}
+
+// MongoClient dumps and restores the documents of orgs
+type MongoClient struct {
+	client *mongo.Client
+	ctx    context.Context
+	colls  []Collection
+	dir    string
+	sealer *Sealer
+	opener *Opener
+}
+
+// NewMongoClient connects to opts.URL, dumps are read from and written
+// to {dir}/{org}_colls
+func NewMongoClient(ctx context.Context, opts *MongoOptions, dir string) (MongoClient, error) {
+	client, err := mongo.Connect(options.Client().ApplyURI(opts.URL))
+	if err != nil {
+		return MongoClient{}, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return MongoClient{}, fmt.Errorf("connecting to mongo: %w", err)
+	}
+	return MongoClient{
+		client,
+		ctx,
+		opts.Collections,
+		dir,
+		opts.Sealer,
+		opts.Opener,
+	}, nil
+}
+
+// Close disconnects from mongo
+func (m *MongoClient) Close() error {
+	return m.client.Disconnect(m.ctx)
+}
+
+// orgDir is the dump dir for org
+func (m *MongoClient) orgDir(org string) string {
+	return filepath.Join(m.dir, org+"_colls")
+}
+
+// DumpOrg streams the documents of org in each collection to
+// {db}/{collection}.bson in the dump dir of org, in the format used by
+// mongodump. The manifest is written last, so a dump without one is
+// incomplete.
+func (m *MongoClient) DumpOrg(org string) (MongoManifest, error) {
+	manifest := MongoManifest{Org: org, DumpedAt: time.Now()}
+	dir := m.orgDir(org)
+	os.Remove(filepath.Join(dir, MongoManifestFile))
+	os.Remove(filepath.Join(dir, MongoManifestFile+SealedExt))
+	for _, c := range m.colls {
+		n, err := m.dumpCollection(org, c, filepath.Join(dir, c.file()))
+		if err != nil {
+			return manifest, fmt.Errorf("dumping %s.%s: %w", c.DB, c.Name, err)
+		}
+		log.Info().Str("org", org).Str("db", c.DB).Str("collection", c.Name).Int("docs", n).Msg("dumped")
+		manifest.Collections = append(manifest.Collections, CollectionSummary{c, c.file(), n})
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	f, err := m.sealer.Create(filepath.Join(dir, MongoManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return manifest, err
+	}
+	return manifest, f.Close()
+}
+
+func (m *MongoClient) dumpCollection(org string, c Collection, fpath string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return 0, err
+	}
+	f, err := m.sealer.Create(fpath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	cur, err := m.client.Database(c.DB).Collection(c.Name).Find(m.ctx, c.filter(org))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(m.ctx)
+	n := 0
+	for cur.Next(m.ctx) {
+		if _, err := w.Write(cur.Current); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := cur.Err(); err != nil {
+		return n, err
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// readDocs calls fn with batches of up to size documents from the BSON
+// stream in fpath, which is read with o
+func readDocs(o *Opener, fpath string, size int, fn func([]bson.Raw) error) error {
+	f, err := o.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	batch := make([]bson.Raw, 0, size)
+	for {
+		doc, err := bson.ReadDocument(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", fpath, err)
+		}
+		batch = append(batch, doc)
+		if len(batch) == size {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = make([]bson.Raw, 0, size)
+		}
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// LoadMongoManifest reads the manifest of the dump of org in dir with o
+func LoadMongoManifest(o *Opener, dir, org string) (MongoManifest, error) {
+	var manifest MongoManifest
+	f, err := o.Open(filepath.Join(dir, org+"_colls", MongoManifestFile))
+	if err != nil {
+		return manifest, fmt.Errorf("dump of %s is incomplete: %w", org, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return manifest, fmt.Errorf("reading manifest of %s: %w", org, err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("parsing manifest of %s: %w", org, err)
+	}
+	return manifest, nil
+}
+
+// RestoreOrg upserts every document in the dump of org by _id, so that
+// a restore can be repeated. The collections restored are the ones in
+// the manifest and the number of documents read from each must match
+// it. With dryRun, the dump is only read. The number of documents
+// read from each collection is returned.
+func (m *MongoClient) RestoreOrg(org string, dryRun bool) (MongoManifest, error) {
+	manifest, err := LoadMongoManifest(m.opener, m.dir, org)
+	if err != nil {
+		return manifest, err
+	}
+	restored := MongoManifest{Org: org, DumpedAt: manifest.DumpedAt}
+	for _, cs := range manifest.Collections {
+		if !filepath.IsLocal(cs.File) {
+			return restored, fmt.Errorf("refusing to read %s from the manifest of %s", cs.File, org)
+		}
+		coll := m.client.Database(cs.DB).Collection(cs.Name)
+		n := 0
+		err := readDocs(m.opener, filepath.Join(m.orgDir(org), cs.File), upsertBatchSize, func(docs []bson.Raw) error {
+			n += len(docs)
+			if dryRun {
+				return nil
+			}
+			if err := upsertDocs(m.ctx, coll, docs); err != nil {
+				return fmt.Errorf("%s: %w", cs.File, err)
+			}
+			return nil
+		})
+		restored.Collections = append(restored.Collections, CollectionSummary{cs.Collection, cs.File, n})
+		if err != nil {
+			return restored, fmt.Errorf("restoring %s.%s: %w", cs.DB, cs.Name, err)
+		}
+		if n != cs.Count {
+			return restored, fmt.Errorf("%s has %d documents, the manifest has %d", cs.File, n, cs.Count)
+		}
+		log.Info().Str("org", org).Str("db", cs.DB).Str("collection", cs.Name).Int("docs", n).Bool("dryrun", dryRun).Msg("restored")
+	}
+	return restored, nil
+}
+
+// upsertDocs replaces the documents in coll with the same _id as docs,
+// inserting the ones that are missing
+func upsertDocs(ctx context.Context, coll *mongo.Collection, docs []bson.Raw) error {
+	models := make([]mongo.WriteModel, 0, len(docs))
+	for _, doc := range docs {
+		id, err := doc.LookupErr("_id")
+		if err != nil {
+			return fmt.Errorf("document without an _id: %w", err)
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: id}}).
+			SetReplacement(doc).
+			SetUpsert(true))
+	}
+	_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
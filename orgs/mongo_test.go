@@ -0,0 +1,111 @@
+package orgs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestParseCollections(t *testing.T) {
+	colls, err := ParseCollections(DefaultCollections)
+	require.NoError(t, err)
+	assert.Equal(t, Collection{"tyk_analytics", "tyk_apis", "org_id"}, colls[0])
+	assert.Equal(t, Collection{"tyk_analytics", "tyk_organizations", "_id"}, colls[3])
+
+	for _, bad := range []string{"tyk_apis", ".tyk_apis", "tyk_analytics.", "tyk_analytics.tyk_apis:"} {
+		_, err := ParseCollections([]string{bad})
+		assert.Error(t, err, bad)
+	}
+
+	oid := bson.NewObjectID()
+	assert.Equal(t, bson.D{{Key: "_id", Value: oid}}, colls[3].filter(oid.Hex()))
+	assert.Equal(t, bson.D{{Key: "_id", Value: "org1"}}, colls[3].filter("org1"))
+	assert.Equal(t, bson.D{{Key: "org_id", Value: "org1"}}, colls[0].filter("org1"))
+}
+
+func TestReadDocs(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "tyk_apis.bson")
+	var stream []byte
+	for i := range 5 {
+		doc, err := bson.Marshal(bson.D{{Key: "_id", Value: i}, {Key: "org_id", Value: "org1"}})
+		require.NoError(t, err)
+		stream = append(stream, doc...)
+	}
+	require.NoError(t, os.WriteFile(fpath, stream, 0644))
+
+	var sizes []int
+	var ids []int32
+	require.NoError(t, readDocs(nil, fpath, 2, func(docs []bson.Raw) error {
+		sizes = append(sizes, len(docs))
+		for _, doc := range docs {
+			ids = append(ids, doc.Lookup("_id").Int32())
+		}
+		return nil
+	}))
+	assert.Equal(t, []int{2, 2, 1}, sizes)
+	assert.Equal(t, []int32{0, 1, 2, 3, 4}, ids)
+
+	require.NoError(t, os.WriteFile(fpath, stream[:len(stream)-3], 0644))
+	assert.Error(t, readDocs(nil, fpath, 2, func([]bson.Raw) error { return nil }))
+}
+
+// TestMongoDumpRestore needs a mongod that it can write to, see the
+// test-mongo target in the Makefile
+func TestMongoDumpRestore(t *testing.T) {
+	url := os.Getenv("MONGO_URL")
+	if url == "" {
+		t.Skip("Requires MONGO_URL to be set to a scratch mongod to run this test.")
+	}
+	ctx := context.Background()
+	colls, err := ParseCollections([]string{"gromit_test.apis", "gromit_test.orgs:_id"})
+	require.NoError(t, err)
+	dir := t.TempDir()
+	m, err := NewMongoClient(ctx, &MongoOptions{URL: url, Collections: colls}, dir)
+	require.NoError(t, err)
+	defer m.Close()
+	db := m.client.Database("gromit_test")
+	require.NoError(t, db.Drop(ctx))
+	defer db.Drop(ctx)
+
+	org := bson.NewObjectID()
+	_, err = db.Collection("orgs").InsertMany(ctx, []any{
+		bson.D{{Key: "_id", Value: org}, {Key: "owner_name", Value: "org1"}},
+		bson.D{{Key: "_id", Value: bson.NewObjectID()}, {Key: "owner_name", Value: "other"}},
+	})
+	require.NoError(t, err)
+	_, err = db.Collection("apis").InsertMany(ctx, []any{
+		bson.D{{Key: "_id", Value: 1}, {Key: "org_id", Value: org.Hex()}, {Key: "name", Value: "one"}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "org_id", Value: org.Hex()}, {Key: "name", Value: "two"}},
+		bson.D{{Key: "_id", Value: 3}, {Key: "org_id", Value: "other"}, {Key: "name", Value: "three"}},
+	})
+	require.NoError(t, err)
+
+	manifest, err := m.DumpOrg(org.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, 2, manifest.Collections[0].Count)
+	assert.Equal(t, 1, manifest.Collections[1].Count)
+	assert.FileExists(t, filepath.Join(dir, org.Hex()+"_colls", "gromit_test", "apis.bson"))
+
+	// one document changed and one lost
+	_, err = db.Collection("apis").UpdateByID(ctx, 1, bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "changed"}}}})
+	require.NoError(t, err)
+	_, err = db.Collection("apis").DeleteOne(ctx, bson.D{{Key: "_id", Value: 2}})
+	require.NoError(t, err)
+
+	for range 2 {
+		restored, err := m.RestoreOrg(org.Hex(), false)
+		require.NoError(t, err)
+		assert.Equal(t, manifest.Collections, restored.Collections)
+	}
+	n, err := db.Collection("apis").CountDocuments(ctx, bson.D{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+	var api struct{ Name string }
+	require.NoError(t, db.Collection("apis").FindOne(ctx, bson.D{{Key: "_id", Value: 1}}).Decode(&api))
+	assert.Equal(t, "one", api.Name)
+}
@@ -2,92 +2,244 @@ package orgs
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
-	"os"
+	"fmt"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog/log"
 )
 
 const (
 	batchSize        = 100
 	writeKeysTimeout = 10 * time.Second
+	// maxKeySize is the longest line accepted in a dump
+	maxKeySize = 64 << 20
 )
 
-func streamKeys(filepath string, keyChan chan<- []redisKey, batchSize int) {
-	file, openErr := os.Open(filepath)
-	if openErr != nil {
-		panic(openErr)
-	}
+// Conflict policies for keys that already exist when restoring
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+	ConflictFail      = "fail"
+)
 
+// RestoreOptions control how keys are written back to redis
+type RestoreOptions struct {
+	// Conflict is one of ConflictSkip, ConflictOverwrite or ConflictFail.
+	// With ConflictFail, nothing is written if any key exists.
+	Conflict string
+	// DryRun only counts what would be written
+	DryRun bool
+}
+
+// RestoreStats counts the keys in a dump by what happened to them
+type RestoreStats struct {
+	Read int
+	// Existing keys were already in redis before the restore
+	Existing int
+	Written  int
+	Skipped  int
+}
+
+// streamKeys reads the dump in filepath with o and calls fn with
+// batches of up to batchSize keys. Numbers in values are kept as they
+// were dumped.
+func streamKeys(o *Opener, filepath string, batchSize int, fn func([]redisKey) error) error {
+	file, err := o.Open(filepath)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	redisKeys := make([]redisKey, 0, batchSize)
-
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxKeySize)
+	line := 0
 	for scanner.Scan() {
+		line++
 		key := redisKey{}
-
-		if err := json.Unmarshal(scanner.Bytes(), &key); err != nil {
-			log.Error().Err(err).Msg("error unmarshalling redis key")
-			continue
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		if err := dec.Decode(&key); err != nil {
+			return fmt.Errorf("%s:%d: %w", filepath, line, err)
+		}
+		if key.Name == "" {
+			return fmt.Errorf("%s:%d: key has no name", filepath, line)
+		}
+		if err := key.decode(); err != nil {
+			return fmt.Errorf("%s:%d: %w", filepath, line, err)
 		}
-
 		redisKeys = append(redisKeys, key)
-
 		if len(redisKeys) == batchSize {
-			keyChan <- redisKeys
+			if err := fn(redisKeys); err != nil {
+				return err
+			}
 			redisKeys = make([]redisKey, 0, batchSize)
 		}
 	}
-
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s:%d: %w", filepath, line, err)
+	}
 	if len(redisKeys) > 0 {
-		keyChan <- redisKeys
+		return fn(redisKeys)
 	}
-
-	close(keyChan)
+	return nil
 }
 
-func (r *RedisClient) writeKeys(ctx context.Context, keys []redisKey) error {
-	// _, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-	// 	for _, key := range keys {
-	// 		ttl := time.Duration(0)
-	// 		if key.TTL > 0 {
-	// 			ttl = time.Duration(key.TTL) * time.Second
-	// 		}
-
-	// 		keyValue, jsonErr := json.Marshal(key.Value)
-	// 		if jsonErr != nil {
-	// 			return jsonErr
-	// 		}
-
-	// 		pipe.Set(key.Name, keyValue, ttl)
-	// 	}
-
-	// 	return nil
-	// })
+// existingKeys returns the keys in the batch that are already in redis
+func (r *RedisClient) existingKeys(ctx context.Context, keys []redisKey) ([]string, error) {
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Exists(ctx, key.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var existing []string
+	for i, cmd := range cmds {
+		if cmd.Val() > 0 {
+			existing = append(existing, keys[i].Name)
+		}
+	}
+	return existing, nil
+}
 
-	// return err
-	return nil
+// writeKeys recreates every key in one pipeline with its saved TTL, a
+// TTL of 0 means that the key does not expire. Unless overwrite is set,
+// keys that exist are left alone. It returns the number of keys written.
+func (r *RedisClient) writeKeys(ctx context.Context, keys []redisKey, overwrite bool) (int, error) {
+	exists := make(map[string]bool)
+	if !overwrite {
+		// strings use SET NX, other types have to be checked first
+		var others []redisKey
+		for _, k := range keys {
+			if k.keyType() != typeString {
+				others = append(others, k)
+			}
+		}
+		if len(others) > 0 {
+			found, err := r.existingKeys(ctx, others)
+			if err != nil {
+				return 0, err
+			}
+			for _, name := range found {
+				exists[name] = true
+			}
+		}
+	}
+	written := 0
+	var setNXs []*redis.BoolCmd
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			if exists[key.Name] || key.empty() {
+				continue
+			}
+			setNX, err := writeKey(ctx, pipe, key, overwrite)
+			if err != nil {
+				return err
+			}
+			if setNX != nil {
+				setNXs = append(setNXs, setNX)
+			} else {
+				written++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, cmd := range setNXs {
+		if cmd.Val() {
+			written++
+		}
+	}
+	return written, nil
 }
 
-func (r *RedisClient) RestoreKeys(dumpFile string) {
-	keyChan := make(chan []redisKey, 2)
+// inBatch runs fn with a context that times out after writeKeysTimeout
+func (r *RedisClient) inBatch(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(r.ctx, writeKeysTimeout)
+	defer cancel()
+	return fn(ctx)
+}
 
-	go streamKeys(dumpFile, keyChan, batchSize)
+// RestoreKeys writes the keys in dumpFile, made by DumpOrgKeys, back
+// to redis as the type and with the TTL that they had when they were
+// dumped. Keys are written in pipelines of BatchSize keys.
+func (r *RedisClient) RestoreKeys(dumpFile string, opts RestoreOptions) (RestoreStats, error) {
+	var stats RestoreStats
+	switch opts.Conflict {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+	default:
+		return stats, fmt.Errorf("unknown conflict policy %q, expected %s, %s or %s", opts.Conflict, ConflictSkip, ConflictOverwrite, ConflictFail)
+	}
+	bs := int(r.batchSize)
+	if bs <= 0 {
+		bs = batchSize
+	}
 
-	nWrote := 0
+	// check every key first, so that a failing restore writes nothing
+	if opts.DryRun || opts.Conflict == ConflictFail {
+		var existing []string
+		err := streamKeys(r.opener, dumpFile, bs, func(keys []redisKey) error {
+			stats.Read += len(keys)
+			return r.inBatch(func(ctx context.Context) error {
+				found, err := r.existingKeys(ctx, keys)
+				existing = append(existing, found...)
+				return err
+			})
+		})
+		if err != nil {
+			return stats, err
+		}
+		stats.Existing = len(existing)
+		if opts.Conflict == ConflictFail && len(existing) > 0 {
+			return stats, fmt.Errorf("%d keys from %s already exist, including %s", len(existing), dumpFile, existing[0])
+		}
+		if opts.DryRun {
+			if opts.Conflict == ConflictOverwrite {
+				stats.Written = stats.Read
+			} else {
+				stats.Written, stats.Skipped = stats.Read-stats.Existing, stats.Existing
+			}
+			return stats, nil
+		}
+		stats.Read = 0
+	}
 
-	for redisKeys := range keyChan {
-		writeCtx, writeCancel := context.WithTimeout(context.Background(), writeKeysTimeout)
+	err := streamKeys(r.opener, dumpFile, bs, func(keys []redisKey) error {
+		stats.Read += len(keys)
+		return r.inBatch(func(ctx context.Context) error {
+			n, err := r.writeKeys(ctx, keys, opts.Conflict == ConflictOverwrite)
+			if err != nil {
+				return fmt.Errorf("writing to redis: %w", err)
+			}
+			stats.Written += n
+			stats.Skipped += len(keys) - n
+			log.Info().Int("keys", stats.Written).Str("file", dumpFile).Msg("wrote to redis")
+			return nil
+		})
+	})
+	return stats, err
+}
 
-		if err := r.writeKeys(writeCtx, redisKeys); err != nil {
-			writeCancel()
-			log.Fatal().Err(err).Msg("could not write to redis")
+// RestoreOrgKeys restores the keys dumped for each org from its file in
+// the dump dir
+func (r *RedisClient) RestoreOrgKeys(orgs []string, opts RestoreOptions) error {
+	for _, org := range orgs {
+		stats, err := r.RestoreKeys(r.opFiles[org], opts)
+		log.Info().Str("org", org).Bool("dryrun", opts.DryRun).Int("read", stats.Read).Int("existing", stats.Existing).
+			Int("written", stats.Written).Int("skipped", stats.Skipped).Msg("restored keys")
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", org, err)
 		}
-
-		nWrote += len(redisKeys)
-		log.Info().Int("keys", nWrote).Msg("wrote to redis")
 	}
+	return nil
 }
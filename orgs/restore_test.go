@@ -0,0 +1,94 @@
+package orgs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDump has 5 keys, one of which does not expire
+const testDump = `{"name":"apikey-1","ttl":3600,"value":{"org_id":"org1","expires":9007199254740993}}
+{"name":"apikey-2","ttl":60,"value":{"org_id":"org1"}}
+{"name":"apikey-3","ttl":0,"value":{"org_id":"org1","alias":"forever"}}
+{"name":"tyk-admin-api-4","ttl":120,"value":{"UserData":{"org_id":"org1"}}}
+{"name":"apikey-5","ttl":30,"value":{"org_id":"org1"}}
+`
+
+func testClient(t *testing.T) (*miniredis.Miniredis, RedisClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "org1.keys.jl"), []byte(testDump), 0644))
+	// batches of 2 make the 5 keys span 3 pipelines
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 2}, []string{"org1"}, dir)
+	return mr, r
+}
+
+func TestRestoreKeys(t *testing.T) {
+	mr, r := testClient(t)
+	stats, err := r.RestoreKeys(r.opFiles["org1"], RestoreOptions{Conflict: ConflictSkip})
+	require.NoError(t, err)
+	assert.Equal(t, RestoreStats{Read: 5, Written: 5}, stats)
+
+	assert.Equal(t, 3600*time.Second, mr.TTL("apikey-1"))
+	assert.Equal(t, 120*time.Second, mr.TTL("tyk-admin-api-4"))
+	assert.Zero(t, mr.TTL("apikey-3"))
+	v, err := mr.Get("apikey-1")
+	require.NoError(t, err)
+	// numbers beyond float64 precision survive
+	assert.JSONEq(t, `{"org_id":"org1","expires":9007199254740993}`, v)
+	assert.Contains(t, v, "9007199254740993")
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	cases := []struct {
+		opts    RestoreOptions
+		stats   RestoreStats
+		err     bool
+		apikey1 string
+		apikey2 bool
+	}{
+		{RestoreOptions{Conflict: ConflictSkip}, RestoreStats{Read: 5, Written: 4, Skipped: 1}, false, "existing", true},
+		{RestoreOptions{Conflict: ConflictOverwrite}, RestoreStats{Read: 5, Written: 5}, false, "", true},
+		{RestoreOptions{Conflict: ConflictFail}, RestoreStats{Read: 5, Existing: 1}, true, "existing", false},
+		{RestoreOptions{Conflict: ConflictSkip, DryRun: true}, RestoreStats{Read: 5, Existing: 1, Written: 4, Skipped: 1}, false, "existing", false},
+		{RestoreOptions{Conflict: ConflictOverwrite, DryRun: true}, RestoreStats{Read: 5, Existing: 1, Written: 5}, false, "existing", false},
+		{RestoreOptions{Conflict: "merge"}, RestoreStats{}, true, "existing", false},
+	}
+	for _, tc := range cases {
+		mr, r := testClient(t)
+		require.NoError(t, mr.Set("apikey-1", "existing"))
+
+		stats, err := r.RestoreKeys(r.opFiles["org1"], tc.opts)
+		if tc.err {
+			assert.Error(t, err, tc.opts)
+		} else {
+			assert.NoError(t, err, tc.opts)
+		}
+		assert.Equal(t, tc.stats, stats, tc.opts)
+		v, _ := mr.Get("apikey-1")
+		if tc.apikey1 != "" {
+			assert.Equal(t, tc.apikey1, v, tc.opts)
+		} else {
+			assert.JSONEq(t, `{"org_id":"org1","expires":9007199254740993}`, v, tc.opts)
+		}
+		assert.Equal(t, tc.apikey2, mr.Exists("apikey-2"), tc.opts)
+	}
+}
+
+func TestRestoreBadDump(t *testing.T) {
+	_, r := testClient(t)
+	bad := filepath.Join(t.TempDir(), "bad.keys.jl")
+	require.NoError(t, os.WriteFile(bad, []byte(testDump+"{not json\n"), 0644))
+	_, err := r.RestoreKeys(bad, RestoreOptions{Conflict: ConflictSkip})
+	assert.ErrorContains(t, err, "bad.keys.jl:6")
+
+	_, err = r.RestoreKeys(filepath.Join(t.TempDir(), "missing.keys.jl"), RestoreOptions{Conflict: ConflictSkip})
+	assert.Error(t, err)
+}
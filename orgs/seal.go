@@ -0,0 +1,412 @@
+package orgs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/TykTechnologies/gromit/util"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// SealedExt is appended to the name of every file in a sealed dump
+	SealedExt = ".zst.gpg"
+	// DumpManifestFile lists the SHA-256 of every file in a dump, it is
+	// signed in DumpManifestFile.asc
+	DumpManifestFile = "dump-manifest.json"
+)
+
+// DumpManifest records the files written for a dump, relative to the
+// dump dir, so that restore can detect files that were changed or
+// swapped after the dump
+type DumpManifest struct {
+	CreatedAt time.Time `json:"created_at"`
+	Sealed    bool      `json:"sealed"`
+	// Recipients are the key IDs that the files were encrypted to
+	Recipients []string `json:"recipients,omitempty"`
+	// Signer is the key ID that signed the manifest
+	Signer string            `json:"signer,omitempty"`
+	Files  map[string]string `json:"files"`
+}
+
+// Sealer creates the files of a dump. With recipients, every file is
+// compressed with zstd and encrypted to all of them, otherwise files
+// are written in plaintext. The hash of every file is kept for the
+// manifest, along with those of earlier dumps in the same dir.
+type Sealer struct {
+	dir        string
+	recipients openpgp.EntityList
+	signer     *openpgp.Entity
+	signKeyID  uint64
+	mu         sync.Mutex
+	files      map[string]string
+	// prior is the manifest of earlier dumps in dir that is merged
+	// into this one
+	prior DumpManifest
+}
+
+// NewSealer seals files in dir to recipients and signs the manifest with
+// signer. A sealed dump must be signed, or restore could not tell it
+// from one made by anybody holding the public keys.
+func NewSealer(dir string, recipients openpgp.EntityList, signer *openpgp.Entity) (*Sealer, error) {
+	if len(recipients) > 0 && signer == nil {
+		return nil, errors.New("encrypted dumps need a key to sign the manifest")
+	}
+	var signKeyID uint64
+	if signer != nil {
+		key, ok := decryptedSigningKey(signer)
+		if !ok {
+			return nil, fmt.Errorf("no signing key of %016X is decrypted", signer.PrimaryKey.KeyId)
+		}
+		signKeyID = key.PublicKey.KeyId
+	}
+	s := &Sealer{
+		dir:        dir,
+		recipients: recipients,
+		signer:     signer,
+		signKeyID:  signKeyID,
+		files:      make(map[string]string),
+	}
+	if err := s.loadPrior(); err != nil {
+		return nil, err
+	}
+	for f, sum := range s.prior.Files {
+		s.files[f] = sum
+	}
+	return s, nil
+}
+
+// loadPrior reads the manifest of an earlier dump in the dir, so that
+// dumping another org does not make the orgs already there
+// unrestorable. Its files are only carried over if this sealer can
+// vouch for them: the manifest is unsigned and so is this one, or it
+// is signed by the same signer.
+func (s *Sealer) loadPrior() error {
+	mpath := filepath.Join(s.dir, DumpManifestFile)
+	data, err := os.ReadFile(mpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m DumpManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("parsing %s: %w", mpath, err)
+	}
+	sig, err := os.ReadFile(mpath + ".asc")
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if s.signer != nil || m.Sealed {
+			log.Warn().Str("manifest", mpath).Msg("unsigned, earlier dumps in this dir will not be in the new manifest")
+			return nil
+		}
+	case err != nil:
+		return err
+	case s.signer == nil:
+		log.Warn().Str("manifest", mpath).Msg("signed, earlier dumps in this dir will not be in the new unsigned manifest")
+		return nil
+	default:
+		if _, err := util.VerifyDetachedSignature(openpgp.EntityList{s.signer}, bytes.NewReader(data), sig); err != nil {
+			log.Warn().Err(err).Str("manifest", mpath).Msg("not signed by this signer, earlier dumps in this dir will not be in the new manifest")
+			return nil
+		}
+	}
+	s.prior = m
+	return nil
+}
+
+// decryptedSigningKey returns a valid signing key of e, the primary key
+// or a subkey, whose private key has been decrypted
+func decryptedSigningKey(e *openpgp.Entity) (openpgp.Key, bool) {
+	ids := []uint64{e.PrimaryKey.KeyId}
+	for _, sk := range e.Subkeys {
+		ids = append(ids, sk.PublicKey.KeyId)
+	}
+	now := time.Now()
+	for _, id := range ids {
+		key, ok := e.SigningKeyById(now, id)
+		if ok && key.PrivateKey != nil && !key.PrivateKey.Encrypted {
+			return key, true
+		}
+	}
+	return openpgp.Key{}, false
+}
+
+// sealedFile is the chain file ← hash ← openpgp ← zstd, which is closed
+// from the outside in
+type sealedFile struct {
+	io.Writer
+	closers []io.Closer
+	f       *os.File
+	sum     hash.Hash
+	done    func(sum string)
+	closed  bool
+}
+
+// Close can be called more than once, as with *os.File
+func (s *sealedFile) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.done(hex.EncodeToString(s.sum.Sum(nil)))
+	return nil
+}
+
+// Create truncates the file for path, which must be in the dump dir,
+// adding SealedExt if the dump is sealed. The counterpart of the file
+// in the other format is removed, so that an older dump cannot be read
+// in place of this one. The file is only in the manifest once it has
+// been closed without error. A nil Sealer creates plain files.
+func (s *Sealer) Create(path string) (io.WriteCloser, error) {
+	if s == nil {
+		return os.Create(path)
+	}
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("%s is not in the dump dir %s", path, s.dir)
+	}
+	stale, staleRel := path+SealedExt, rel+SealedExt
+	if s.sealed() {
+		stale, staleRel, path, rel = path, rel, path+SealedExt, rel+SealedExt
+	}
+	if err := os.Remove(stale); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s.mu.Lock()
+	delete(s.files, filepath.ToSlash(staleRel))
+	s.mu.Unlock()
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	sf := &sealedFile{f: f, sum: sha256.New()}
+	sf.done = func(sum string) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.files[filepath.ToSlash(rel)] = sum
+	}
+	sf.Writer = io.MultiWriter(f, sf.sum)
+	if !s.sealed() {
+		return sf, nil
+	}
+
+	plain, err := openpgp.Encrypt(sf.Writer, s.recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("encrypting %s: %w", path, err)
+	}
+	zw, err := zstd.NewWriter(plain)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sf.Writer = zw
+	sf.closers = []io.Closer{zw, plain}
+	return sf, nil
+}
+
+func (s *Sealer) sealed() bool {
+	return len(s.recipients) > 0
+}
+
+// WriteManifest writes the hashes of the files created so far, merged
+// with those of earlier dumps in the dir, to DumpManifestFile in the
+// dump dir and signs it, if there is a signer. It is written last, so
+// that a dump without one is incomplete.
+func (s *Sealer) WriteManifest() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	m := DumpManifest{
+		CreatedAt: time.Now(),
+		Sealed:    s.sealed() || s.prior.Sealed,
+		Files:     make(map[string]string, len(s.files)),
+	}
+	for f, sum := range s.files {
+		m.Files[f] = sum
+	}
+	s.mu.Unlock()
+	m.Recipients = append(m.Recipients, s.prior.Recipients...)
+	for _, r := range s.recipients {
+		if id := fmt.Sprintf("%016X", r.PrimaryKey.KeyId); !slices.Contains(m.Recipients, id) {
+			m.Recipients = append(m.Recipients, id)
+		}
+	}
+	sort.Strings(m.Recipients)
+	if s.signer != nil {
+		m.Signer = fmt.Sprintf("%016X", s.signKeyID)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	mpath := filepath.Join(s.dir, DumpManifestFile)
+	if err := os.Remove(mpath + ".asc"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.WriteFile(mpath, data, 0644); err != nil {
+		return err
+	}
+	if s.signer == nil {
+		return nil
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, s.signer, bytes.NewReader(data), &packet.Config{SigningKeyId: s.signKeyID}); err != nil {
+		return fmt.Errorf("signing %s: %w", mpath, err)
+	}
+	return os.WriteFile(mpath+".asc", sig.Bytes(), 0644)
+}
+
+// Opener reads the files of a dump made by a Sealer, decrypting sealed
+// files transparently
+type Opener struct {
+	dir     string
+	keyring openpgp.EntityList
+	prompt  openpgp.PromptFunction
+	// files is nil for dumps without a manifest
+	files map[string]string
+}
+
+// NewOpener checks the signature of the manifest in dir with keyring,
+// which also holds the private keys to decrypt the dump. prompt is
+// called to decrypt private keys that are encrypted. Without a keyring,
+// dumps without a manifest or with an unsigned one can be opened, as
+// long as they are in plaintext.
+func NewOpener(dir string, keyring openpgp.EntityList, prompt openpgp.PromptFunction) (*Opener, error) {
+	o := &Opener{dir: dir, keyring: keyring, prompt: prompt}
+	mpath := filepath.Join(dir, DumpManifestFile)
+	data, err := os.ReadFile(mpath)
+	if errors.Is(err, os.ErrNotExist) && len(keyring) == 0 {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m DumpManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", mpath, err)
+	}
+	sig, err := os.ReadFile(mpath + ".asc")
+	switch {
+	case err == nil:
+		keyID, err := util.VerifyDetachedSignature(keyring, bytes.NewReader(data), sig)
+		if err != nil {
+			return nil, fmt.Errorf("signature of %s by %016X: %w", mpath, keyID, err)
+		}
+		log.Info().Str("signer", fmt.Sprintf("%016X", keyID)).Str("manifest", mpath).Msg("verified")
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case m.Sealed || len(keyring) > 0:
+		return nil, fmt.Errorf("%s is not signed", mpath)
+	}
+	o.files = m.Files
+	if o.files == nil {
+		o.files = make(map[string]string)
+	}
+	return o, nil
+}
+
+// check compares the hash of the file at path with the manifest
+func (o *Opener) check(path string) error {
+	rel, err := filepath.Rel(o.dir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s is not in the dump dir %s", path, o.dir)
+	}
+	want, found := o.files[filepath.ToSlash(rel)]
+	if !found {
+		return fmt.Errorf("%s is not in the manifest", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != want {
+		return fmt.Errorf("%s has SHA-256 %s, the manifest has %s", path, got, want)
+	}
+	return nil
+}
+
+// openedFile closes the zstd decoder as well as the file
+type openedFile struct {
+	io.Reader
+	dec *zstd.Decoder
+	f   *os.File
+}
+
+func (o *openedFile) Close() error {
+	o.dec.Close()
+	return o.f.Close()
+}
+
+// Open opens the dump of path, preferring the sealed file if there is
+// one. Files in a dump with a manifest must match their hash in it. A
+// nil Opener opens path as it is.
+func (o *Opener) Open(path string) (io.ReadCloser, error) {
+	if o == nil {
+		return os.Open(path)
+	}
+	sealed := path + SealedExt
+	if _, err := os.Stat(sealed); err != nil {
+		if o.files != nil {
+			if err := o.check(path); err != nil {
+				return nil, err
+			}
+		}
+		return os.Open(path)
+	}
+
+	if o.files == nil {
+		return nil, fmt.Errorf("%s has no %s to check it against", sealed, DumpManifestFile)
+	}
+	if err := o.check(sealed); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(bufio.NewReader(f), o.keyring, o.prompt, nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decrypting %s: %w", sealed, err)
+	}
+	dec, err := zstd.NewReader(md.UnverifiedBody)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &openedFile{dec, dec, f}, nil
+}
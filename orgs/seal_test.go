@@ -0,0 +1,236 @@
+package orgs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	require.NoError(t, err)
+	return e
+}
+
+// sealedDump dumps org001 to a new dir, sealed to recipient
+func sealedDump(t *testing.T, mr *miniredis.Miniredis, recipient, signer *openpgp.Entity) string {
+	t.Helper()
+	dir := t.TempDir()
+	sealer, err := NewSealer(dir, openpgp.EntityList{recipient}, signer)
+	require.NoError(t, err)
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 10, Sealer: sealer}, []string{"org001"}, dir)
+	stats, err := r.DumpOrgKeys([]string{"apikey-*"}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 20, stats.Orgs["org001"])
+	require.NoError(t, sealer.WriteManifest())
+	return dir
+}
+
+func TestSealedDump(t *testing.T) {
+	mr := miniredis.RunT(t)
+	seed(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}), 3, 20)
+	recipient, signer := testEntity(t, "ops"), testEntity(t, "dumper")
+	dir := sealedDump(t, mr, recipient, signer)
+	keys := filepath.Join(dir, "org001.keys.jl")
+
+	assert.NoFileExists(t, keys)
+	sealed, err := os.ReadFile(keys + SealedExt)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "org001")
+	assert.FileExists(t, filepath.Join(dir, DumpManifestFile+".asc"))
+
+	opener, err := NewOpener(dir, openpgp.EntityList{recipient, signer}, nil)
+	require.NoError(t, err)
+	mr.FlushAll()
+	r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, Opener: opener}, []string{"org001"}, dir)
+	stats, err := r.RestoreKeys(keys, RestoreOptions{Conflict: ConflictFail})
+	require.NoError(t, err)
+	assert.Equal(t, 20, stats.Written)
+	v, err := mr.Get("apikey-bench-org001-7")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"org_id":"org001","n":7}`, v)
+
+	// a plaintext dump replaces the sealed files
+	sealer, err := NewSealer(dir, nil, nil)
+	require.NoError(t, err)
+	r = NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, Sealer: sealer}, []string{"org001"}, dir)
+	_, err = r.DumpOrgKeys([]string{"apikey-*"}, 10)
+	require.NoError(t, err)
+	require.NoError(t, sealer.WriteManifest())
+	assert.NoFileExists(t, keys+SealedExt)
+	assert.NoFileExists(t, filepath.Join(dir, DumpManifestFile+".asc"))
+	assert.Len(t, dumpedNames(t, keys), 20)
+	opener, err = NewOpener(dir, nil, nil)
+	require.NoError(t, err)
+	f, err := opener.Open(keys)
+	require.NoError(t, err)
+	f.Close()
+	// but it is not trusted when a keyring is given
+	_, err = NewOpener(dir, openpgp.EntityList{recipient, signer}, nil)
+	assert.Error(t, err)
+}
+
+func TestSealedDumpTampering(t *testing.T) {
+	mr := miniredis.RunT(t)
+	seed(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}), 2, 20)
+	recipient, signer := testEntity(t, "ops"), testEntity(t, "dumper")
+	keyring := openpgp.EntityList{recipient, signer}
+	keys := func(dir string) string { return filepath.Join(dir, "org001.keys.jl") }
+	open := func(o *Opener, dir string) error {
+		f, err := o.Open(keys(dir))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.ReadAll(f)
+		return err
+	}
+
+	t.Run("file", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, signer)
+		b, err := os.ReadFile(keys(dir) + SealedExt)
+		require.NoError(t, err)
+		b[len(b)-1] ^= 1
+		require.NoError(t, os.WriteFile(keys(dir)+SealedExt, b, 0644))
+		o, err := NewOpener(dir, keyring, nil)
+		require.NoError(t, err)
+		assert.ErrorContains(t, open(o, dir), "SHA-256")
+	})
+	t.Run("swapped", func(t *testing.T) {
+		dir, other := sealedDump(t, mr, recipient, signer), sealedDump(t, mr, recipient, signer)
+		b, err := os.ReadFile(keys(other) + SealedExt)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keys(dir)+SealedExt, b, 0644))
+		o, err := NewOpener(dir, keyring, nil)
+		require.NoError(t, err)
+		assert.Error(t, open(o, dir))
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, signer)
+		require.NoError(t, os.Rename(keys(dir)+SealedExt, keys(dir)))
+		o, err := NewOpener(dir, keyring, nil)
+		require.NoError(t, err)
+		assert.ErrorContains(t, open(o, dir), "not in the manifest")
+	})
+	t.Run("manifest", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, signer)
+		mpath := filepath.Join(dir, DumpManifestFile)
+		b, err := os.ReadFile(mpath)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(mpath, append(b, ' '), 0644))
+		_, err = NewOpener(dir, keyring, nil)
+		assert.Error(t, err)
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, signer)
+		require.NoError(t, os.Remove(filepath.Join(dir, DumpManifestFile+".asc")))
+		_, err := NewOpener(dir, nil, nil)
+		assert.ErrorContains(t, err, "not signed")
+	})
+	t.Run("unknown signer", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, testEntity(t, "mallory"))
+		_, err := NewOpener(dir, keyring, nil)
+		assert.Error(t, err)
+	})
+	t.Run("no decryption key", func(t *testing.T) {
+		dir := sealedDump(t, mr, recipient, signer)
+		o, err := NewOpener(dir, openpgp.EntityList{signer}, nil)
+		require.NoError(t, err)
+		assert.ErrorContains(t, open(o, dir), "decrypting")
+	})
+}
+
+// TestTwoDumps dumps two orgs, one after the other, into the same dir
+// and restores the first
+func TestTwoDumps(t *testing.T) {
+	mr := miniredis.RunT(t)
+	seed(t, redis.NewClient(&redis.Options{Addr: mr.Addr()}), 3, 20)
+	recipient, signer := testEntity(t, "ops"), testEntity(t, "dumper")
+	dump := func(dir, org string, recipients openpgp.EntityList, signer *openpgp.Entity) {
+		t.Helper()
+		sealer, err := NewSealer(dir, recipients, signer)
+		require.NoError(t, err)
+		r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 10, Sealer: sealer}, []string{org}, dir)
+		_, err = r.DumpOrgKeys([]string{"apikey-*"}, 10)
+		require.NoError(t, err)
+		require.NoError(t, sealer.WriteManifest())
+	}
+	restore := func(o *Opener, dir, org string) (int, error) {
+		r := NewRedisClient(context.Background(), &RedisOptions{Addrs: []string{mr.Addr()}, Opener: o}, []string{org}, dir)
+		stats, err := r.RestoreKeys(filepath.Join(dir, org+".keys.jl"), RestoreOptions{Conflict: ConflictOverwrite})
+		return stats.Written, err
+	}
+
+	t.Run("sealed", func(t *testing.T) {
+		dir := t.TempDir()
+		dump(dir, "org001", openpgp.EntityList{recipient}, signer)
+		dump(dir, "org002", openpgp.EntityList{recipient}, signer)
+		o, err := NewOpener(dir, openpgp.EntityList{recipient, signer}, nil)
+		require.NoError(t, err)
+		for _, org := range []string{"org001", "org002"} {
+			n, err := restore(o, dir, org)
+			require.NoError(t, err, org)
+			assert.Equal(t, 20, n)
+		}
+	})
+	t.Run("plaintext", func(t *testing.T) {
+		dir := t.TempDir()
+		dump(dir, "org001", nil, nil)
+		dump(dir, "org002", nil, nil)
+		o, err := NewOpener(dir, nil, nil)
+		require.NoError(t, err)
+		n, err := restore(o, dir, "org001")
+		require.NoError(t, err)
+		assert.Equal(t, 20, n)
+	})
+	t.Run("redumped", func(t *testing.T) {
+		// the plaintext org001 replaces its sealed dump in the manifest
+		dir := t.TempDir()
+		dump(dir, "org001", openpgp.EntityList{recipient}, signer)
+		dump(dir, "org002", openpgp.EntityList{recipient}, signer)
+		dump(dir, "org001", nil, signer)
+		o, err := NewOpener(dir, openpgp.EntityList{recipient, signer}, nil)
+		require.NoError(t, err)
+		require.Contains(t, o.files, "org001.keys.jl")
+		assert.NotContains(t, o.files, "org001.keys.jl"+SealedExt)
+		for _, org := range []string{"org001", "org002"} {
+			n, err := restore(o, dir, org)
+			require.NoError(t, err, org)
+			assert.Equal(t, 20, n)
+		}
+	})
+	t.Run("other signer", func(t *testing.T) {
+		// files signed by somebody else are not vouched for
+		dir := t.TempDir()
+		dump(dir, "org001", openpgp.EntityList{recipient}, testEntity(t, "mallory"))
+		dump(dir, "org002", openpgp.EntityList{recipient}, signer)
+		o, err := NewOpener(dir, openpgp.EntityList{recipient, signer}, nil)
+		require.NoError(t, err)
+		_, err = restore(o, dir, "org001")
+		assert.ErrorContains(t, err, "not in the manifest")
+	})
+}
+
+func TestNewSealer(t *testing.T) {
+	recipient := testEntity(t, "ops")
+	_, err := NewSealer(t.TempDir(), openpgp.EntityList{recipient}, nil)
+	assert.Error(t, err, "encrypted dumps must be signed")
+	signer := testEntity(t, "release")
+	require.NoError(t, signer.EncryptPrivateKeys([]byte("sekrit"), nil))
+	_, err = NewSealer(t.TempDir(), openpgp.EntityList{recipient}, signer)
+	assert.Error(t, err, "the signing key must be decrypted")
+
+	sealer, err := NewSealer(t.TempDir(), nil, nil)
+	require.NoError(t, err)
+	_, err = sealer.Create(filepath.Join(t.TempDir(), "elsewhere"))
+	assert.Error(t, err)
+}
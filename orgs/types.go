@@ -0,0 +1,320 @@
+package orgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis types that can be dumped, as returned by TYPE
+const (
+	typeString = "string"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeSet    = "set"
+	typeZSet   = "zset"
+	typeNone   = "none"
+)
+
+// encodingBase64 marks a key whose strings are base64 encoded as they
+// are not valid UTF-8
+const encodingBase64 = "base64"
+
+// redisKey is a line in a keys dump. Exactly one of the value fields is
+// set, according to Type. String keys that hold a JSON object have it
+// in Value, as all keys did in dumps made before types were recorded.
+type redisKey struct {
+	Name string `json:"name"`
+	// Type is empty in old dumps, where every key is a string
+	Type     string                 `json:"type,omitempty"`
+	TTL      int64                  `json:"ttl"`
+	Encoding string                 `json:"encoding,omitempty"`
+	Value    map[string]interface{} `json:"value,omitempty"`
+	String   *string                `json:"string,omitempty"`
+	Hash     map[string]string      `json:"hash,omitempty"`
+	List     []string               `json:"list,omitempty"`
+	Set      []string               `json:"set,omitempty"`
+	ZSet     []zMember              `json:"zset,omitempty"`
+}
+
+// zMember is a member of a sorted set. The score is a string so that
+// infinite scores survive JSON.
+type zMember struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+func (k redisKey) keyType() string {
+	if k.Type == "" {
+		return typeString
+	}
+	return k.Type
+}
+
+// strings calls fn with a pointer to every string in the value of k
+func (k *redisKey) strings(fn func(*string) error) error {
+	if k.String != nil {
+		if err := fn(k.String); err != nil {
+			return err
+		}
+	}
+	if k.Hash != nil {
+		h := make(map[string]string, len(k.Hash))
+		for f, v := range k.Hash {
+			if err := fn(&f); err != nil {
+				return err
+			}
+			if err := fn(&v); err != nil {
+				return err
+			}
+			h[f] = v
+		}
+		k.Hash = h
+	}
+	for _, l := range [][]string{k.List, k.Set} {
+		for i := range l {
+			if err := fn(&l[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range k.ZSet {
+		if err := fn(&k.ZSet[i].Member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode base64 encodes the strings in k if any of them is not UTF-8,
+// as JSON would mangle them
+func (k *redisKey) encode() {
+	binary := false
+	k.strings(func(s *string) error {
+		if !utf8.ValidString(*s) {
+			binary = true
+		}
+		return nil
+	})
+	if !binary {
+		return
+	}
+	k.Encoding = encodingBase64
+	k.strings(func(s *string) error {
+		*s = base64.StdEncoding.EncodeToString([]byte(*s))
+		return nil
+	})
+}
+
+// decode reverses encode
+func (k *redisKey) decode() error {
+	switch k.Encoding {
+	case "":
+		return nil
+	case encodingBase64:
+	default:
+		return fmt.Errorf("%s has unknown encoding %q", k.Name, k.Encoding)
+	}
+	err := k.strings(func(s *string) error {
+		b, err := base64.StdEncoding.DecodeString(*s)
+		*s = string(b)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", k.Name, err)
+	}
+	k.Encoding = ""
+	return nil
+}
+
+// setString stores a string value, as a JSON object if it is one
+func (k *redisKey) setString(val string) {
+	if bytes.HasPrefix(bytes.TrimSpace([]byte(val)), []byte("{")) {
+		dec := json.NewDecoder(bytes.NewReader([]byte(val)))
+		dec.UseNumber()
+		var v map[string]interface{}
+		if dec.Decode(&v) == nil && !dec.More() {
+			k.Value = v
+			return
+		}
+	}
+	k.String = &val
+}
+
+// fetchKeys reads the type, TTL and value of every key in names using
+// two pipelines. Keys that vanished since they were scanned and types
+// that cannot be dumped, like streams, are left out with a reason in
+// skipped.
+func (r *RedisClient) fetchKeys(ctx context.Context, names []string) (keys []redisKey, skipped map[string]string, err error) {
+	skipped = make(map[string]string)
+	typeCmds := make([]*redis.StatusCmd, len(names))
+	_, err = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			typeCmds[i] = pipe.Type(ctx, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("type: %w", err)
+	}
+
+	valCmds := make([]redis.Cmder, len(names))
+	ttlCmds := make([]*redis.DurationCmd, len(names))
+	// Pipelined returns the first error of any command, like WRONGTYPE
+	// for a key that changed type since TYPE. Each command keeps its own
+	// error, so such keys are skipped below instead of failing the batch.
+	_, _ = r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			switch typeCmds[i].Val() {
+			case typeString:
+				valCmds[i] = pipe.Get(ctx, name)
+			case typeHash:
+				valCmds[i] = pipe.HGetAll(ctx, name)
+			case typeList:
+				valCmds[i] = pipe.LRange(ctx, name, 0, -1)
+			case typeSet:
+				valCmds[i] = pipe.SMembers(ctx, name)
+			case typeZSet:
+				valCmds[i] = pipe.ZRangeWithScores(ctx, name, 0, -1)
+			default:
+				continue
+			}
+			ttlCmds[i] = pipe.TTL(ctx, name)
+		}
+		return nil
+	})
+
+	for i, name := range names {
+		t := typeCmds[i].Val()
+		if valCmds[i] == nil {
+			if t != typeNone {
+				skipped[name] = "cannot dump " + t
+			}
+			continue
+		}
+		if err := valCmds[i].Err(); err != nil {
+			if err != redis.Nil {
+				skipped[name] = err.Error()
+			}
+			continue
+		}
+		k := redisKey{Name: name, Type: t}
+		// -1 (no expiry) and -2 (gone) are not whole seconds
+		if ttl := ttlCmds[i].Val(); ttl > 0 {
+			k.TTL = int64(ttl / time.Second)
+		}
+		switch c := valCmds[i].(type) {
+		case *redis.StringCmd:
+			k.setString(c.Val())
+		case *redis.StringStringMapCmd:
+			k.Hash = c.Val()
+		case *redis.StringSliceCmd:
+			if t == typeList {
+				k.List = c.Val()
+			} else {
+				k.Set = c.Val()
+			}
+		case *redis.ZSliceCmd:
+			for _, z := range c.Val() {
+				k.ZSet = append(k.ZSet, zMember{
+					Member: fmt.Sprint(z.Member),
+					Score:  strconv.FormatFloat(z.Score, 'g', -1, 64),
+				})
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, skipped, nil
+}
+
+// writeKey queues the commands to recreate k in pipe. Unless overwrite
+// is set, string keys are only set if they do not exist and the
+// returned command reports whether they were.
+func writeKey(ctx context.Context, pipe redis.Pipeliner, k redisKey, overwrite bool) (*redis.BoolCmd, error) {
+	ttl := time.Duration(0)
+	if k.TTL > 0 {
+		ttl = time.Duration(k.TTL) * time.Second
+	}
+	if k.keyType() == typeString {
+		var val interface{}
+		switch {
+		case k.Value != nil:
+			b, err := json.Marshal(k.Value)
+			if err != nil {
+				return nil, fmt.Errorf("encoding %s: %w", k.Name, err)
+			}
+			val = b
+		case k.String != nil:
+			val = *k.String
+		default:
+			return nil, fmt.Errorf("string key %s has no value", k.Name)
+		}
+		if overwrite {
+			pipe.Set(ctx, k.Name, val, ttl)
+			return nil, nil
+		}
+		return pipe.SetNX(ctx, k.Name, val, ttl), nil
+	}
+
+	if overwrite {
+		pipe.Del(ctx, k.Name)
+	}
+	switch k.Type {
+	case typeHash:
+		vals := make([]interface{}, 0, 2*len(k.Hash))
+		for f, v := range k.Hash {
+			vals = append(vals, f, v)
+		}
+		pipe.HSet(ctx, k.Name, vals...)
+	case typeList:
+		pipe.RPush(ctx, k.Name, stringArgs(k.List)...)
+	case typeSet:
+		pipe.SAdd(ctx, k.Name, stringArgs(k.Set)...)
+	case typeZSet:
+		members := make([]*redis.Z, 0, len(k.ZSet))
+		for _, m := range k.ZSet {
+			score, err := strconv.ParseFloat(m.Score, 64)
+			if err != nil {
+				return nil, fmt.Errorf("score of %s in %s: %w", m.Member, k.Name, err)
+			}
+			members = append(members, &redis.Z{Score: score, Member: m.Member})
+		}
+		pipe.ZAdd(ctx, k.Name, members...)
+	default:
+		return nil, fmt.Errorf("%s has unknown type %q", k.Name, k.Type)
+	}
+	if ttl > 0 {
+		pipe.Expire(ctx, k.Name, ttl)
+	}
+	return nil, nil
+}
+
+// empty reports whether k has no members, redis cannot store such a key
+func (k redisKey) empty() bool {
+	switch k.Type {
+	case typeHash:
+		return len(k.Hash) == 0
+	case typeList:
+		return len(k.List) == 0
+	case typeSet:
+		return len(k.Set) == 0
+	case typeZSet:
+		return len(k.ZSet) == 0
+	}
+	return false
+}
+
+func stringArgs(ss []string) []interface{} {
+	args := make([]interface{}, len(ss))
+	for i, s := range ss {
+		args[i] = s
+	}
+	return args
+}
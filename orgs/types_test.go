@@ -0,0 +1,184 @@
+package orgs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const org1 = "5e9d9544a1dcd60001d0ed20"
+
+// populate adds keys of every type for org1 and for another org
+func populate(t *testing.T, mr *miniredis.Miniredis) {
+	t.Helper()
+	require.NoError(t, mr.Set("apikey-1", `{"org_id":"`+org1+`","expires":9007199254740993}`))
+	mr.SetTTL("apikey-1", time.Hour)
+	require.NoError(t, mr.Set("apikey-2", `{"org_id":"other"}`))
+	require.NoError(t, mr.Set("session-1", `{"meta":{"org":"`+org1+`"}}`))
+	require.NoError(t, mr.Set("quota-"+org1+"-1", "42"))
+	require.NoError(t, mr.Set("quota-other-1", "7"))
+	require.NoError(t, mr.Set("quota-"+org1+"-bin", "\xff\xfe\x00"))
+	mr.HSet("rl-1", "org_id", org1, "limit", "100")
+	mr.SetTTL("rl-1", time.Minute)
+	mr.HSet("rl-2", "org_id", "other")
+	_, err := mr.Push("analytics-"+org1, "b", "a", "b")
+	require.NoError(t, err)
+	_, err = mr.SetAdd("members-"+org1, "x", "y")
+	require.NoError(t, err)
+	_, err = mr.ZAdd("zrate-"+org1, 1.5, "first")
+	require.NoError(t, err)
+	_, err = mr.ZAdd("zrate-"+org1, 3, "second")
+	require.NoError(t, err)
+}
+
+func TestDumpRestoreTypes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	populate(t, mr)
+	rules, err := ParseAttributionRules([]string{
+		"session-*=json:meta.org",
+		"quota-*=key:^quota-(?P<org>[^-]+)-",
+		"rl-*=field:org_id",
+		"analytics-*=key:^analytics-(.*)$",
+		"members-*=key:^members-(.*)$",
+		"zrate-*=key:^zrate-(.*)$",
+	})
+	require.NoError(t, err)
+	dir := t.TempDir()
+	ctx := context.Background()
+	r := NewRedisClient(ctx, &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 3, Rules: rules}, []string{org1}, dir)
+
+	_, err = r.DumpOrgKeys([]string{"*"}, 3)
+	require.NoError(t, err)
+
+	dump, err := os.ReadFile(filepath.Join(dir, org1+".keys.jl"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(dump), "other")
+	assert.Contains(t, string(dump), `"encoding":"base64"`)
+
+	mr.FlushAll()
+	stats, err := r.RestoreKeys(filepath.Join(dir, org1+".keys.jl"), RestoreOptions{Conflict: ConflictFail})
+	require.NoError(t, err)
+	assert.Equal(t, 8, stats.Written)
+
+	for _, name := range []string{"apikey-2", "quota-other-1", "rl-2"} {
+		assert.False(t, mr.Exists(name), name)
+	}
+	assert.Equal(t, time.Hour, mr.TTL("apikey-1"))
+	assert.Equal(t, time.Minute, mr.TTL("rl-1"))
+	assert.Zero(t, mr.TTL("quota-"+org1+"-1"))
+	assert.Equal(t, "hash", mr.Type("rl-1"))
+	assert.Equal(t, "100", mr.HGet("rl-1", "limit"))
+	list, err := mr.List("analytics-" + org1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "a", "b"}, list)
+	members, err := mr.Members("members-" + org1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, members)
+	score, err := mr.ZScore("zrate-"+org1, "first")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, score)
+	bin, err := mr.Get("quota-" + org1 + "-bin")
+	require.NoError(t, err)
+	assert.Equal(t, "\xff\xfe\x00", bin)
+	v, err := mr.Get("apikey-1")
+	require.NoError(t, err)
+	assert.Contains(t, v, "9007199254740993")
+
+	// existing keys of every type are left alone when skipping
+	mr.HSet("rl-1", "limit", "5")
+	stats, err = r.RestoreKeys(filepath.Join(dir, org1+".keys.jl"), RestoreOptions{Conflict: ConflictSkip})
+	require.NoError(t, err)
+	assert.Equal(t, RestoreStats{Read: 8, Skipped: 8}, stats)
+	assert.Equal(t, "5", mr.HGet("rl-1", "limit"))
+
+	stats, err = r.RestoreKeys(filepath.Join(dir, org1+".keys.jl"), RestoreOptions{Conflict: ConflictOverwrite})
+	require.NoError(t, err)
+	assert.Equal(t, 8, stats.Written)
+	assert.Equal(t, "100", mr.HGet("rl-1", "limit"))
+	list, err = mr.List("analytics-" + org1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "a", "b"}, list)
+}
+
+func TestAttributionRules(t *testing.T) {
+	for _, bad := range []string{"apikey-*", "apikey-*=json", "=json:org_id", "q-*=key:(", "q-*=key:^q-", "q-*=path:x"} {
+		_, err := ParseAttributionRules([]string{bad})
+		assert.Error(t, err, bad)
+	}
+	rules, err := ParseAttributionRules([]string{"a[bc]?-*=json:x.y", "h-*=field:org"})
+	require.NoError(t, err)
+	assert.NotNil(t, ruleFor(rules, "ab1-anything"))
+	assert.Nil(t, ruleFor(rules, "ad1-anything"))
+
+	s := "plain"
+	cases := []struct {
+		key redisKey
+		org string
+		err bool
+	}{
+		{redisKey{Name: "apikey-1", Value: map[string]interface{}{"org_id": "o"}}, "o", false},
+		{redisKey{Name: "apikey-1", Value: map[string]interface{}{"UserData": map[string]interface{}{"org_id": "o"}}}, "o", false},
+		{redisKey{Name: "apikey-1", String: &s}, "", true},
+		{redisKey{Name: "ab1-1", Value: map[string]interface{}{"x": map[string]interface{}{"y": "o"}}}, "o", false},
+		{redisKey{Name: "ab1-1", Value: map[string]interface{}{"x": "o"}}, "", true},
+		{redisKey{Name: "h-1", Type: typeHash, Hash: map[string]string{"org": "o"}}, "o", false},
+		{redisKey{Name: "h-1", Type: typeHash, Hash: map[string]string{}}, "", true},
+		{redisKey{Name: "h-1", Type: typeSet, Set: []string{"o"}}, "", true},
+	}
+	for _, tc := range cases {
+		org, err := orgOf(rules, tc.key)
+		if tc.err {
+			assert.Error(t, err, tc.key.Name)
+		} else {
+			assert.NoError(t, err, tc.key.Name)
+			assert.Equal(t, tc.org, org, tc.key.Name)
+		}
+	}
+}
+
+// flipHook changes the type of a key after its TYPE was read and before
+// its value is fetched
+type flipHook struct {
+	mr  *miniredis.Miniredis
+	key string
+}
+
+func (h flipHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h flipHook) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h flipHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if cmds[0].Name() != "type" && h.mr.Type(h.key) == "string" {
+		h.mr.Del(h.key)
+		h.mr.HSet(h.key, "org_id", org1)
+	}
+	return ctx, nil
+}
+
+func (h flipHook) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func TestFetchKeysChangedType(t *testing.T) {
+	mr := miniredis.RunT(t)
+	populate(t, mr)
+	ctx := context.Background()
+	r := NewRedisClient(ctx, &RedisOptions{Addrs: []string{mr.Addr()}, BatchSize: 3}, []string{org1}, t.TempDir())
+	r.rdb.AddHook(flipHook{mr: mr, key: "apikey-1"})
+
+	keys, skipped, err := r.fetchKeys(ctx, []string{"apikey-1", "apikey-2", "rl-1"})
+	require.NoError(t, err)
+	assert.Contains(t, skipped["apikey-1"], "WRONGTYPE")
+	var names []string
+	for _, k := range keys {
+		names = append(names, k.Name)
+	}
+	assert.Equal(t, []string{"apikey-2", "rl-1"}, names)
+}
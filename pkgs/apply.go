@@ -0,0 +1,194 @@
+package pkgs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/rs/zerolog/log"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// Outcomes recorded for each package in an ApplyReport
+const (
+	OutcomeDeleted  = "deleted"
+	OutcomeBackedUp = "backed_up"
+	OutcomeMissing  = "missing"
+	OutcomeMismatch = "mismatch"
+	OutcomeFailed   = "failed"
+	OutcomeDryRun   = "dry_run"
+)
+
+// ApplyConfig is the consolidated options that can be passed to the Apply method
+type ApplyConfig struct {
+	Concurrency int
+	Savedir     string
+	Backup      bool
+	Delete      bool
+	// MaxAge is the oldest plan that will be executed
+	MaxAge time.Duration
+	// Keyring, if set, must have signed every package that is backed up
+	Keyring openpgp.EntityList
+}
+
+// ApplyResult is the outcome of executing the plan for one package
+type ApplyResult struct {
+	PlanPackage
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ApplyReport records what was done when a plan was executed
+type ApplyReport struct {
+	Repo            string         `json:"repo"`
+	PlanGeneratedAt time.Time      `json:"plan_generated_at"`
+	AppliedAt       time.Time      `json:"applied_at"`
+	Outcomes        map[string]int `json:"outcomes"`
+	Results         []ApplyResult  `json:"results"`
+}
+
+func (r *ApplyReport) add(res ApplyResult) {
+	r.Outcomes[res.Outcome]++
+	r.Results = append(r.Results, res)
+}
+
+// LoadPlans reads the output of `pkgs plan --json`
+func LoadPlans(planFile string) ([]Plan, error) {
+	data, err := os.ReadFile(planFile)
+	if err != nil {
+		return nil, err
+	}
+	var plans []Plan
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", planFile, err)
+	}
+	return plans, nil
+}
+
+// CheckAge refuses plans that were generated more than maxAge before
+// now, a zero maxAge accepts any plan
+func (p Plan) CheckAge(maxAge time.Duration, now time.Time) error {
+	if p.GeneratedAt.IsZero() {
+		return fmt.Errorf("plan for %s has no generation time", p.Repo)
+	}
+	if age := now.Sub(p.GeneratedAt); maxAge > 0 && age > maxAge {
+		return fmt.Errorf("plan for %s was generated %s ago, older than the maximum of %s", p.Repo, age.Round(time.Minute), maxAge)
+	}
+	return nil
+}
+
+// planKey identifies a package within a repo
+func planKey(distroVersion, filename string) string {
+	return distroVersion + "/" + filename
+}
+
+// VerifyPlan matches every package in the plan against the live
+// listing of the repo. Only packages whose filename, name, version and
+// checksum are unchanged since the plan was made are returned in
+// matched, the rest are returned as results explaining the refusal.
+func VerifyPlan(plan Plan, live []pc.PackageDetail) ([]pc.PackageDetail, []ApplyResult) {
+	index := make(map[string]pc.PackageDetail, len(live))
+	for _, item := range live {
+		index[planKey(item.DistroVersion, item.Filename)] = item
+	}
+	var matched []pc.PackageDetail
+	var rejected []ApplyResult
+	for _, pp := range plan.Packages {
+		item, found := index[planKey(pp.DistroVersion, pp.Filename)]
+		switch {
+		case !found:
+			rejected = append(rejected, ApplyResult{pp, OutcomeMissing, "not in the repo any more"})
+		case item.Sha256Sum != pp.Sha256Sum:
+			rejected = append(rejected, ApplyResult{pp, OutcomeMismatch, fmt.Sprintf("sha256 is now %s", item.Sha256Sum)})
+		case item.Name != pp.Name || item.Version != pp.Version:
+			rejected = append(rejected, ApplyResult{pp, OutcomeMismatch, fmt.Sprintf("now %s %s", item.Name, item.Version)})
+		default:
+			matched = append(matched, item)
+		}
+	}
+	return matched, rejected
+}
+
+// Apply executes a plan made by BuildPlan. The repo is listed again and
+// only packages that still match the plan are backed up and deleted.
+// Every package in the plan has a result in the returned report.
+func (c *Client) Apply(plan Plan, ac ApplyConfig, now time.Time) (ApplyReport, error) {
+	report := ApplyReport{
+		Repo:            plan.Repo,
+		PlanGeneratedAt: plan.GeneratedAt,
+		AppliedAt:       now,
+		Outcomes:        make(map[string]int),
+	}
+	if err := plan.CheckAge(ac.MaxAge, now); err != nil {
+		return report, err
+	}
+	live, err := c.ListPackages(plan.Repo)
+	if err != nil {
+		return report, fmt.Errorf("listing %s: %w", plan.Repo, err)
+	}
+	matched, rejected := VerifyPlan(plan, live)
+	for _, res := range rejected {
+		log.Warn().Str("outcome", res.Outcome).Msgf("refusing %s/%s: %s", res.DistroVersion, res.Filename, res.Reason)
+		report.add(res)
+	}
+
+	var idx *BackupIndex
+	if ac.Backup {
+		idx, err = OpenBackupIndex(ac.Savedir)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	var mu sync.Mutex
+	pkgs := new(errgroup.Group)
+	pkgs.SetLimit(max(ac.Concurrency, 1))
+	for _, item := range matched {
+		pkgs.Go(func() error {
+			res := ApplyResult{PlanPackage: planPackage(item)}
+			if ac.Backup {
+				if _, err := c.backup(item, idx, ac.Keyring); err != nil {
+					res.Outcome, res.Reason = OutcomeFailed, fmt.Sprintf("backup: %v", err)
+				} else {
+					res.Outcome = OutcomeBackedUp
+				}
+			}
+			if ac.Delete && res.Outcome != OutcomeFailed {
+				if err := c.delete(item); err != nil {
+					res.Outcome, res.Reason = OutcomeFailed, fmt.Sprintf("delete: %v", err)
+				} else {
+					res.Outcome = OutcomeDeleted
+				}
+			}
+			if res.Outcome == "" {
+				res.Outcome = OutcomeDryRun
+			}
+			if res.Outcome == OutcomeFailed {
+				log.Error().Msgf("%s/%s: %s", item.DistroVersion, item.Filename, res.Reason)
+			}
+			mu.Lock()
+			report.add(res)
+			mu.Unlock()
+			return nil
+		})
+	}
+	return report, errors.Join(pkgs.Wait(), idx.Close())
+}
+
+// planPackage is the identity of item as recorded in a plan
+func planPackage(item pc.PackageDetail) PlanPackage {
+	return PlanPackage{
+		Name:          item.Name,
+		Version:       item.Version,
+		Arch:          item.Arch,
+		DistroVersion: item.DistroVersion,
+		Filename:      item.Filename,
+		Sha256Sum:     item.Sha256Sum,
+		CreateTime:    item.CreateTime,
+	}
+}
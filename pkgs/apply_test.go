@@ -0,0 +1,125 @@
+package pkgs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+func TestVerifyPlan(t *testing.T) {
+	cfg := pkgConfig{VersionCutoff: "v2.0"}
+	items := []pc.PackageDetail{
+		pkg("1.0.0", 0),
+		pkg("1.1.0", 0),
+		pkg("1.2.0", 0),
+		pkg("2.0.0", 0),
+	}
+	plan, err := BuildPlan("tyk-test", cfg, nil, Protections{}, items, planNow)
+	require.NoError(t, err)
+	require.Len(t, plan.Packages, 3)
+
+	// 1.0.0 unchanged, 1.1.0 re-uploaded, 1.2.0 deleted out of band
+	reuploaded := pkg("1.1.0", 0)
+	reuploaded.Sha256Sum = "sha-new"
+	live := []pc.PackageDetail{pkg("1.0.0", 0), reuploaded, pkg("2.0.0", 0)}
+
+	matched, rejected := VerifyPlan(plan, live)
+	require.Len(t, matched, 1)
+	assert.Equal(t, "1.0.0", matched[0].Version)
+	require.Len(t, rejected, 2)
+	assert.Equal(t, OutcomeMismatch, rejected[0].Outcome)
+	assert.Equal(t, "1.1.0", rejected[0].Version)
+	assert.Equal(t, OutcomeMissing, rejected[1].Outcome)
+	assert.Equal(t, "1.2.0", rejected[1].Version)
+}
+
+func TestPlanCheckAge(t *testing.T) {
+	plan := Plan{Repo: "tyk-test", GeneratedAt: planNow}
+	assert.NoError(t, plan.CheckAge(24*time.Hour, planNow.Add(time.Hour)))
+	assert.Error(t, plan.CheckAge(24*time.Hour, planNow.Add(25*time.Hour)))
+	assert.NoError(t, plan.CheckAge(0, planNow.Add(1000*time.Hour)), "zero max age accepts any plan")
+	assert.Error(t, Plan{Repo: "tyk-test"}.CheckAge(0, planNow), "plans must be dated")
+}
+
+// localPlan makes a repo in a new dir and plans to prune the two
+// packages of 1.6.9 from it
+func localPlan(t *testing.T) (*Client, string, Plan) {
+	t.Helper()
+	root := t.TempDir()
+	writeLocalRepo(t, root, "tyk-test", "1.6.9", "1.7.0")
+	c := NewStoreClient(NewLocalStore(root))
+	items, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	plan, err := BuildPlan("tyk-test", pkgConfig{VersionCutoff: "v1.7"}, nil, Protections{}, items, planNow)
+	require.NoError(t, err)
+	require.Len(t, plan.Packages, 2)
+	return c, root, plan
+}
+
+// TestLocalApply executes plans end to end without packagecloud
+func TestLocalApply(t *testing.T) {
+	ac := func(savedir string) ApplyConfig {
+		return ApplyConfig{Concurrency: 2, Savedir: savedir, Backup: true, Delete: true, MaxAge: 24 * time.Hour}
+	}
+	pkgFile := func(root string, pp PlanPackage) string {
+		if filepath.Ext(pp.Filename) == ".deb" {
+			return filepath.Join(root, "tyk-test", filepath.FromSlash(pp.DistroVersion), "pool", "main", "t", pp.Filename)
+		}
+		return filepath.Join(root, "tyk-test", filepath.FromSlash(pp.DistroVersion), "x86_64", pp.Filename)
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		c, root, plan := localPlan(t)
+		savedir := t.TempDir()
+		report, err := c.Apply(plan, ac(savedir), planNow.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{OutcomeDeleted: 2}, report.Outcomes)
+		require.Len(t, report.Results, 2)
+		for _, pp := range plan.Packages {
+			assert.NoFileExists(t, pkgFile(root, pp))
+			assert.FileExists(t, filepath.Join(savedir, pp.Name, pp.DistroVersion, pp.Filename))
+		}
+		left, err := c.ListPackages("tyk-test")
+		require.NoError(t, err)
+		assert.Len(t, left, 2)
+
+		idx, err := OpenBackupIndex(savedir)
+		require.NoError(t, err)
+		assert.Len(t, idx.Entries(), 2)
+		assert.Empty(t, idx.Verify())
+		require.NoError(t, idx.Close())
+	})
+	t.Run("stale", func(t *testing.T) {
+		c, root, plan := localPlan(t)
+		savedir := t.TempDir()
+		_, err := c.Apply(plan, ac(savedir), planNow.Add(25*time.Hour))
+		assert.ErrorContains(t, err, "older than the maximum")
+		for _, pp := range plan.Packages {
+			assert.FileExists(t, pkgFile(root, pp))
+		}
+		entries, err := os.ReadDir(savedir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "nothing is backed up")
+	})
+	t.Run("tampered", func(t *testing.T) {
+		c, root, plan := localPlan(t)
+		savedir := t.TempDir()
+		// one package is re-uploaded after the plan and the checksum
+		// of the other is changed in the plan
+		require.NoError(t, os.WriteFile(pkgFile(root, plan.Packages[0]), []byte("rebuilt"), 0644))
+		plan.Packages[1].Sha256Sum = "0000"
+
+		report, err := c.Apply(plan, ac(savedir), planNow.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{OutcomeMismatch: 2}, report.Outcomes)
+		for _, pp := range plan.Packages {
+			assert.FileExists(t, pkgFile(root, pp))
+			assert.NoFileExists(t, filepath.Join(savedir, pp.Name, pp.DistroVersion, pp.Filename))
+		}
+	})
+}
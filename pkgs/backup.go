@@ -0,0 +1,302 @@
+package pkgs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+// BackupIndexFile is the name of the index in the root of a backup dir
+const BackupIndexFile = "index.json"
+
+// backupJournalFile holds the entries recorded since the index was last
+// saved, one JSON object per line
+const backupJournalFile = "index.journal"
+
+// journalCompact is the number of entries in the journal after which
+// they are folded into the index
+const journalCompact = 1000
+
+// BackupEntry records a package that has been saved and verified
+type BackupEntry struct {
+	Name          string `json:"name"`
+	Version       string `json:"version"`
+	Arch          string `json:"arch"`
+	DistroVersion string `json:"distro_version"`
+	Filename      string `json:"filename"`
+	Sha256Sum     string `json:"sha256sum"`
+	SourceURL     string `json:"source_url"`
+	// Path is relative to the backup dir
+	Path       string    `json:"path"`
+	BackedUpAt time.Time `json:"backed_up_at"`
+	// SigningKeyID is set when the signature was checked on backup
+	SigningKeyID string `json:"signing_key_id,omitempty"`
+}
+
+// BackupProblem is an entry in the index that failed verification
+type BackupProblem struct {
+	BackupEntry
+	Problem string `json:"problem"`
+}
+
+// BackupIndex is the record of the packages in a backup dir. It is
+// safe for concurrent use. Every change is appended to a journal which
+// is folded into the index periodically and on Close, so that an
+// interrupted backup can be resumed.
+type BackupIndex struct {
+	savedir string
+	mu      sync.Mutex
+	entries map[string]BackupEntry
+	journal *os.File
+	// journalled is the number of entries in the journal
+	journalled int
+}
+
+// OpenBackupIndex loads the index in savedir, an absent index is empty
+func OpenBackupIndex(savedir string) (*BackupIndex, error) {
+	idx := &BackupIndex{
+		savedir: savedir,
+		entries: make(map[string]BackupEntry),
+	}
+	data, err := os.ReadFile(filepath.Join(savedir, BackupIndexFile))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		var entries []BackupEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("parsing backup index in %s: %w", savedir, err)
+		}
+		for _, e := range entries {
+			idx.entries[planKey(e.DistroVersion, e.Filename)] = e
+		}
+	}
+	if err := idx.replay(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// replay adds the entries in the journal to the index. A last line
+// without a newline was cut short by an interruption and is removed,
+// so that new entries start on a line of their own.
+func (idx *BackupIndex) replay() error {
+	fname := filepath.Join(idx.savedir, backupJournalFile)
+	data, err := os.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n := bytes.LastIndexByte(data, '\n') + 1; n < len(data) {
+		data = data[:n]
+		if err := os.Truncate(fname, int64(n)); err != nil {
+			return err
+		}
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	// the last element is empty
+	for i, line := range lines[:len(lines)-1] {
+		var e BackupEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("parsing line %d of %s: %w", i+1, fname, err)
+		}
+		idx.entries[planKey(e.DistroVersion, e.Filename)] = e
+		idx.journalled++
+	}
+	return nil
+}
+
+// Entries returns all the entries in the index, sorted by distro and filename
+func (idx *BackupIndex) Entries() []BackupEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entries := make([]BackupEntry, 0, len(idx.entries))
+	for _, k := range slices.Sorted(maps.Keys(idx.entries)) {
+		entries = append(entries, idx.entries[k])
+	}
+	return entries
+}
+
+// Record adds or replaces e in the index and appends it to the journal
+func (idx *BackupIndex) Record(e BackupEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.journal == nil {
+		if err := os.MkdirAll(idx.savedir, 0755); err != nil {
+			return err
+		}
+		idx.journal, err = os.OpenFile(filepath.Join(idx.savedir, backupJournalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	// a single write, so that an interruption leaves at most one
+	// incomplete line
+	if _, err := idx.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	idx.entries[planKey(e.DistroVersion, e.Filename)] = e
+	idx.journalled++
+	if idx.journalled >= journalCompact {
+		return idx.compact()
+	}
+	return nil
+}
+
+// Close folds the journal into the index. It is safe to call on a nil
+// index and more than once.
+func (idx *BackupIndex) Close() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var err error
+	if idx.journalled > 0 {
+		err = idx.compact()
+	}
+	if idx.journal != nil {
+		err = errors.Join(err, idx.journal.Close())
+		idx.journal = nil
+	}
+	return err
+}
+
+// Verified returns an error unless item has a backup in the index with
+// the same checksum as the repo
+func (idx *BackupIndex) Verified(item pc.PackageDetail) error {
+	idx.mu.Lock()
+	e, found := idx.entries[planKey(item.DistroVersion, item.Filename)]
+	idx.mu.Unlock()
+	switch {
+	case !found:
+		return fmt.Errorf("%s/%s has no backup", item.DistroVersion, item.Filename)
+	case e.Sha256Sum != item.Sha256Sum:
+		return fmt.Errorf("backup of %s/%s has sha256 %s, repo has %s", item.DistroVersion, item.Filename, e.Sha256Sum, item.Sha256Sum)
+	}
+	return nil
+}
+
+// Verify checksums every file in the index and returns the entries
+// whose file is missing or does not match
+func (idx *BackupIndex) Verify() []BackupProblem {
+	var problems []BackupProblem
+	for _, e := range idx.Entries() {
+		sum, err := fileSha256(filepath.Join(idx.savedir, filepath.FromSlash(e.Path)))
+		switch {
+		case err != nil:
+			problems = append(problems, BackupProblem{e, err.Error()})
+		case sum != e.Sha256Sum:
+			problems = append(problems, BackupProblem{e, fmt.Sprintf("sha256 is %s", sum)})
+		}
+	}
+	return problems
+}
+
+// compact saves the index and then empties the journal. Entries that
+// are replayed from a journal that was not emptied are already in the
+// index, so there is no harm if it is interrupted. Call with mu held.
+func (idx *BackupIndex) compact() error {
+	if err := idx.save(); err != nil {
+		return err
+	}
+	var err error
+	if idx.journal != nil {
+		err = idx.journal.Truncate(0)
+	} else {
+		err = os.Truncate(filepath.Join(idx.savedir, backupJournalFile), 0)
+	}
+	if err != nil {
+		return err
+	}
+	idx.journalled = 0
+	return nil
+}
+
+// save writes the index to a temp file and renames it into place. Call
+// with mu held.
+func (idx *BackupIndex) save() error {
+	entries := make([]BackupEntry, 0, len(idx.entries))
+	for _, k := range slices.Sorted(maps.Keys(idx.entries)) {
+		entries = append(entries, idx.entries[k])
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(idx.savedir, 0755); err != nil {
+		return err
+	}
+	fname := filepath.Join(idx.savedir, BackupIndexFile)
+	if err := os.WriteFile(fname+".part", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fname+".part", fname)
+}
+
+// fileSha256 returns the hex encoded sha256 of the file at fpath
+func fileSha256(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// backupPath is where item is saved, relative to the backup dir
+func backupPath(item pc.PackageDetail) (string, error) {
+	rel := path.Join(item.Name, item.DistroVersion, item.Filename)
+	if item.Filename == "" || path.Base(rel) != item.Filename || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("refusing to save %q as %q", item.Filename, rel)
+	}
+	return rel, nil
+}
+
+// backup downloads item into the backup dir if needed and records it
+// in the index. If kr is not nil, the signature of the saved package is
+// checked against it too. A nil error means that the backup is
+// verified, fetched reports whether the package had to be downloaded.
+func (c *Client) backup(item pc.PackageDetail, idx *BackupIndex, kr openpgp.EntityList) (fetched bool, err error) {
+	e, fetched, err := c.download(item, idx.savedir)
+	if err != nil {
+		return fetched, err
+	}
+	var sc SignatureCheck
+	if kr != nil {
+		sc = CheckSignature(kr, filepath.Join(idx.savedir, filepath.FromSlash(e.Path)))
+		e.SigningKeyID = sc.KeyID
+	}
+	if err := idx.Record(e); err != nil {
+		return fetched, fmt.Errorf("recording backup of %s: %w", e.Path, err)
+	}
+	if kr != nil && sc.Status != SigValid {
+		return fetched, fmt.Errorf("signature of %s is %s %s", e.Path, sc.Status, sc.Err)
+	}
+	return fetched, idx.Verified(item)
+}
@@ -0,0 +1,182 @@
+package pkgs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+// faultyStore wraps a store, counting downloads and failing them on demand
+type faultyStore struct {
+	PackageStore
+	downloads int
+	// truncate writes half the package and then fails
+	truncate bool
+	// corrupt writes different contents
+	corrupt bool
+}
+
+func (s *faultyStore) Download(item pc.PackageDetail, w io.Writer) error {
+	s.downloads++
+	switch {
+	case s.truncate:
+		w.Write([]byte("half"))
+		return errors.New("connection reset")
+	case s.corrupt:
+		_, err := w.Write([]byte("not the package"))
+		return err
+	}
+	return s.PackageStore.Download(item, w)
+}
+
+func listLocal(t *testing.T, versions ...string) (*faultyStore, []pc.PackageDetail) {
+	t.Helper()
+	root := t.TempDir()
+	writeLocalRepo(t, root, "tyk-test", versions...)
+	fs := &faultyStore{PackageStore: NewLocalStore(root)}
+	items, err := NewStoreClient(fs).ListPackages("tyk-test")
+	require.NoError(t, err)
+	return fs, items
+}
+
+func TestBackupResumesAndVerifies(t *testing.T) {
+	fs, items := listLocal(t, "1.0.0")
+	c := NewStoreClient(fs)
+	idx, err := OpenBackupIndex(t.TempDir())
+	require.NoError(t, err)
+
+	for _, item := range items {
+		_, err := c.backup(item, idx, nil)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, len(items), fs.downloads)
+
+	// a second run finds the files already saved
+	idx, err = OpenBackupIndex(idx.savedir)
+	require.NoError(t, err)
+	require.Len(t, idx.Entries(), len(items))
+	for _, item := range items {
+		_, err := c.backup(item, idx, nil)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, len(items), fs.downloads)
+	assert.Empty(t, idx.Verify())
+
+	e := idx.Entries()[0]
+	assert.Equal(t, "tyk-test", e.Name)
+	assert.NotEmpty(t, e.SourceURL)
+	require.NoError(t, os.WriteFile(filepath.Join(idx.savedir, e.Path), []byte("bitrot"), 0644))
+	problems := idx.Verify()
+	require.Len(t, problems, 1)
+	assert.Equal(t, e.Path, problems[0].Path)
+}
+
+func TestBackupIndexJournal(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := OpenBackupIndex(dir)
+	require.NoError(t, err)
+	entry := func(i int) BackupEntry {
+		return BackupEntry{DistroVersion: "el/9", Filename: fmt.Sprintf("tyk-%d.rpm", i)}
+	}
+	for i := range 3 {
+		require.NoError(t, idx.Record(entry(i)))
+	}
+	assert.NoFileExists(t, filepath.Join(dir, BackupIndexFile), "the index is not rewritten for every entry")
+
+	// an interrupted run leaves the journal with an incomplete line
+	f, err := os.OpenFile(filepath.Join(dir, backupJournalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"distro_version":"el/9","filen`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	resumed, err := OpenBackupIndex(dir)
+	require.NoError(t, err)
+	assert.Equal(t, idx.Entries(), resumed.Entries())
+	require.NoError(t, resumed.Record(entry(3)))
+	reopened, err := OpenBackupIndex(dir)
+	require.NoError(t, err)
+	assert.Len(t, reopened.Entries(), 4, "a new entry follows the incomplete line")
+
+	// the journal is folded into the index once it is long enough
+	for i := 4; i < journalCompact; i++ {
+		require.NoError(t, resumed.Record(entry(i)))
+	}
+	journal, err := os.ReadFile(filepath.Join(dir, backupJournalFile))
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+	require.FileExists(t, filepath.Join(dir, BackupIndexFile))
+
+	require.NoError(t, resumed.Record(entry(journalCompact)))
+	require.NoError(t, resumed.Close())
+	require.NoError(t, resumed.Close())
+	journal, err = os.ReadFile(filepath.Join(dir, backupJournalFile))
+	require.NoError(t, err)
+	assert.Empty(t, journal)
+	reopened, err = OpenBackupIndex(dir)
+	require.NoError(t, err)
+	assert.Len(t, reopened.Entries(), journalCompact+1)
+}
+
+func TestBackupIsAtomic(t *testing.T) {
+	for name, fs := range map[string]func(*faultyStore){
+		"truncated": func(fs *faultyStore) { fs.truncate = true },
+		"corrupt":   func(fs *faultyStore) { fs.corrupt = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			store, items := listLocal(t, "1.0.0")
+			fs(store)
+			c := NewStoreClient(store)
+			idx, err := OpenBackupIndex(t.TempDir())
+			require.NoError(t, err)
+
+			item := items[0]
+			_, err = c.backup(item, idx, nil)
+			require.Error(t, err)
+			rel, err := backupPath(item)
+			require.NoError(t, err)
+			fpath := filepath.Join(idx.savedir, rel)
+			assert.NoFileExists(t, fpath)
+			assert.NoFileExists(t, fpath+".part")
+			assert.Empty(t, idx.Entries())
+			assert.Error(t, idx.Verified(item))
+		})
+	}
+}
+
+func TestCleanRefusesUnverified(t *testing.T) {
+	store, items := listLocal(t, "1.0.0", "2.0.0")
+	store.corrupt = true
+	c := NewStoreClient(store)
+	err := c.Clean(items, CleanConfig{
+		Concurrency: 1,
+		Savedir:     t.TempDir(),
+		Backup:      true,
+		Delete:      true,
+	})
+	require.NoError(t, err)
+
+	left, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	assert.Len(t, left, len(items))
+}
+
+func TestBackupPath(t *testing.T) {
+	for _, bad := range []pc.PackageDetail{
+		{Name: "tyk", DistroVersion: "el/9", Filename: "../../etc/passwd"},
+		{Name: "..", DistroVersion: "../..", Filename: "x.rpm"},
+		{Name: "tyk", DistroVersion: "el/9"},
+	} {
+		_, err := backupPath(bad)
+		assert.Error(t, err, bad.Filename)
+	}
+	rel, err := backupPath(pc.PackageDetail{Name: "tyk", DistroVersion: "el/9", Filename: "tyk-1.0-1.x86_64.rpm"})
+	require.NoError(t, err)
+	assert.Equal(t, "tyk/el/9/tyk-1.0-1.x86_64.rpm", rel)
+}
@@ -1,36 +1,38 @@
 package pkgs
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
-	"github.com/TykTechnologies/gromit/util"
-	"github.com/peterhellberg/link"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/rs/zerolog/log"
 	bar "github.com/schollz/progressbar/v3"
 	"github.com/spf13/viper"
 	pc "github.com/tyklabs/packagecloud/api/v1"
 	"golang.org/x/sync/errgroup"
-	"golang.org/x/time/rate"
 )
 
+// Client performs maintenance on the repos in a PackageStore
 type Client struct {
-	token   string
-	owner   string
-	limiter *rate.Limiter
-	ctx     context.Context
+	store PackageStore
 }
 
-func NewClient(authToken, owner string, rps float64, burst int) *Client {
-	limiter := rate.NewLimiter(rate.Limit(rps), burst)
-	return &Client{authToken, owner, limiter, context.TODO()}
+// NewClient returns a client for the packagecloud.io repos of owner,
+// whose requests are cancelled with ctx
+func NewClient(ctx context.Context, authToken, owner string, rps float64, burst int) *Client {
+	return NewStoreClient(NewPackagecloudStore(ctx, authToken, owner, rps, burst))
+}
+
+// NewStoreClient returns a client for the repos in store
+func NewStoreClient(store PackageStore) *Client {
+	return &Client{store}
 }
 
 type pkgConfig struct {
@@ -53,6 +55,10 @@ type CleanConfig struct {
 	Backup      bool
 	RepoName    string
 	Progress    bool
+	// Keyring, if set, must have signed every package that is backed up
+	Keyring openpgp.EntityList
+	// Events records every action taken, it can be nil
+	Events *EventLog
 }
 
 // Repos models the config file
@@ -60,8 +66,6 @@ type Repos map[string]pkgConfig
 
 type pkgList chan pc.PackageDetail
 
-const pcPrefix = "https://packagecloud.io"
-
 // LoadPkgs returns a map of repos→config from the embedded or
 // supplied config file
 func LoadConfig() (*Repos, error) {
@@ -69,176 +73,128 @@ func LoadConfig() (*Repos, error) {
 	return &pkgs, viper.UnmarshalKey("pkgs", &pkgs)
 }
 
-// get makes a GET request to a packagecloud API and returns the next
-// page link. Requests are limited by the rate limiter set when the
-// client is initialised.
-func (c *Client) get(url string) (*http.Response, error, string) {
-	var buf bytes.Buffer
-	req, err := http.NewRequestWithContext(c.ctx, "GET", url, &buf)
-	if err != nil {
-		return nil, fmt.Errorf("http newrequest err: %v", err), ""
-	}
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Accept", "application/json")
-
-	req.SetBasicAuth(c.token, "")
-	err = c.limiter.Wait(c.ctx)
-	if err != nil {
-		return nil, err, ""
+func (r Repos) ShouldBackup(repoName string) bool {
+	repo, found := r[repoName]
+	if !found {
+		log.Warn().Msgf("%s not known among %v but assuming it needs to be backed up. Add %s to the config file to avoid this warning.", repoName, r, repoName)
+		return true
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return resp, fmt.Errorf("invalid response: %s err: %q", resp.Status, b), ""
-	}
-	webLink := link.ParseResponse(resp)
-	if n, ok := webLink["next"]; ok {
-		return resp, nil, n.URI
-	}
-	return resp, nil, ""
+	return !repo.NotBackup
 }
 
-// AllPackages returns an errgroup that can be used by the caller to
-// collect errors and a channel to read PackageDetails from. Only
-// items that satisy the supplied filter are written to the channel.
-func (c *Client) AllPackages(repo string, filter *Filter) (pkgList, *errgroup.Group) {
-	ch := make(pkgList)
-	url := fmt.Sprintf("%s/api/v1/repos/%s/%s/packages.json", pcPrefix, c.owner, repo)
-	pkgs := new(errgroup.Group)
-	pkgs.Go(func() error {
-		defer close(ch)
-		// do until next is ""
-		for {
-			resp, err, next := c.get(url)
-			if err != nil {
-				return fmt.Errorf("http get err: %v", err)
-			}
-			var items []pc.PackageDetail
-			err = json.NewDecoder(resp.Body).Decode(&items)
-			if err != nil {
-				return fmt.Errorf("json parse err: %v", err)
-			}
-			for _, item := range items {
-				filter.IncTotal()
-				if filter.Satisfies(item, time.Now()) {
-					ch <- item
-					filter.IncFiltered()
-				}
-
-			}
-			resp.Body.Close()
-			if next == "" {
-				break
-			}
-			url = next
-		}
-		return nil
-	})
-	return ch, pkgs
-}
-
-// download a package into savedir/name/distro/ if not already downloaded
-func (c *Client) download(item pc.PackageDetail, savedir string) error {
-	dirpath := fmt.Sprintf("%s/%s/%s", savedir, item.Name, item.DistroVersion)
-	err := os.MkdirAll(dirpath, 0755)
+// download a package into savedir/name/distro/ if not already
+// downloaded. The package is written to a temp file which is renamed
+// into place only after its sha256 matches the repo. fetched is false
+// if the file was already saved.
+func (c *Client) download(item pc.PackageDetail, savedir string) (e BackupEntry, fetched bool, err error) {
+	rel, err := backupPath(item)
 	if err != nil {
-		return fmt.Errorf("could not create %s: %v", dirpath, err)
-	}
-	dir, err := os.OpenRoot(dirpath)
+		return e, false, err
+	}
+	e = BackupEntry{
+		Name:          item.Name,
+		Version:       item.Version,
+		Arch:          item.Arch,
+		DistroVersion: item.DistroVersion,
+		Filename:      item.Filename,
+		Sha256Sum:     item.Sha256Sum,
+		SourceURL:     item.DownloadURL,
+		Path:          rel,
+		BackedUpAt:    time.Now(),
+	}
+	if item.Sha256Sum == "" {
+		return e, false, fmt.Errorf("%s has no sha256 in the repo to verify against", rel)
+	}
+	fpath := filepath.Join(savedir, filepath.FromSlash(rel))
+	if sum, err := fileSha256(fpath); err == nil && sum == item.Sha256Sum {
+		log.Debug().Msgf("not downloading %s as it is already downloaded", fpath)
+		return e, false, nil
+	}
+	log.Debug().Msgf("downloading %s", fpath)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return e, false, fmt.Errorf("could not create %s: %v", filepath.Dir(fpath), err)
+	}
+	tmp := fpath + ".part"
+	f, err := os.Create(tmp)
 	if err != nil {
-		return fmt.Errorf("could not open %s: %v", dirpath, err)
+		return e, false, fmt.Errorf("could not create %s: %v", tmp, err)
 	}
-	var sha256sum string
-	f, err := dir.Open(item.Filename)
-	if err != nil && !os.IsNotExist(err) {
-		log.Warn().Err(err).Msgf("open %s/%s", dirpath, item.Filename)
+	hash := sha256.New()
+	err = c.store.Download(item, io.MultiWriter(f, hash))
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	defer f.Close()
 	if err == nil {
-		sha256sum = util.Sha256Sum(f)
-	}
-	if sha256sum != item.Sha256Sum {
-		log.Debug().Msgf("downloading %s/%s as it's hash %s does not match repo hash %s", dirpath, item.Filename, sha256sum, item.Sha256Sum)
-		f, err := dir.Create(item.Filename)
-		if err != nil {
-			return fmt.Errorf("could not create %s/%s: %v", dirpath, item.Filename, err)
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != item.Sha256Sum {
+			err = fmt.Errorf("downloaded sha256 %s does not match repo sha256 %s", sum, item.Sha256Sum)
 		}
-		resp, err := http.Get(item.DownloadURL)
-		if err != nil {
-			return fmt.Errorf("failed to download %s: %v", item.DownloadURL, err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("bad status fetching %s: %s", item.DownloadURL, resp.Status)
-		}
-
-		_, err = io.Copy(f, resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to write %s/%s: %v", dirpath, item.Filename, err)
-		}
-	} else {
-		log.Debug().Msgf("not downloading %s/%s as it is already downloaded", dirpath, item.Filename)
 	}
-
-	return nil
+	if err != nil {
+		os.Remove(tmp)
+		return e, false, fmt.Errorf("failed to write %s: %v", fpath, err)
+	}
+	if err := os.Rename(tmp, fpath); err != nil {
+		return e, false, fmt.Errorf("could not move %s into place: %v", fpath, err)
+	}
+	return e, true, nil
 }
 
 // delete deletes the given package from the repo permanently
 func (c *Client) delete(item pc.PackageDetail) error {
-	var buf bytes.Buffer
-	purl, err := url.JoinPath(pcPrefix, item.DestroyURL)
-	if err != nil {
-		return fmt.Errorf("creating URL: %v", err)
-	}
-	req, err := http.NewRequestWithContext(c.ctx, "DELETE", purl, &buf)
-	if err != nil {
-		return fmt.Errorf("http newrequest err: %v", err)
-	}
-	req.SetBasicAuth(c.token, "")
-	err = c.limiter.Wait(c.ctx)
-	if err != nil {
-		return err
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("http err %s", purl)
-	}
-	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("invalid response: %s err: %q for %s", resp.Status, b, purl)
-	}
-	log.Debug().Msgf("deleted %s", purl)
-	return nil
+	return c.store.Delete(item)
 }
 
-// Clean optionally backs up and then removes the packages from packagecloud
-func (c *Client) Clean(pList pkgList, cc CleanConfig) error {
+// Clean optionally backs up and then removes the packages from
+// packagecloud. The packages to remove are the ones pruned by Retain.
+// When backing up, a package is only deleted once its backup has been
+// verified and recorded in the index in Savedir.
+func (c *Client) Clean(items []pc.PackageDetail, cc CleanConfig) error {
+	var idx *BackupIndex
+	if cc.Backup {
+		var err error
+		idx, err = OpenBackupIndex(cc.Savedir)
+		if err != nil {
+			return err
+		}
+	}
+	pList := make(pkgList)
+	go func() {
+		defer close(pList)
+		for _, item := range items {
+			pList <- item
+		}
+	}()
 	var progress *bar.ProgressBar
 	if cc.Progress {
-		progress = bar.Default(-1, cc.RepoName)
+		progress = bar.Default(int64(len(items)), cc.RepoName)
 	} else {
-		progress = bar.DefaultSilent(-1, cc.RepoName)
+		progress = bar.DefaultSilent(int64(len(items)), cc.RepoName)
 	}
 	defer progress.Finish()
 	pkgs := new(errgroup.Group)
 	for range cc.Concurrency {
 		pkgs.Go(func() error {
 			for item := range pList {
-				//fmt.Println(item.Name, item.DistroVersion, item.Filename, item.Sha256Sum)
 				if cc.Backup {
-					err := c.download(item, cc.Savedir)
+					fetched, err := c.backup(item, idx, cc.Keyring)
+					if fetched {
+						cc.Events.Emit(cc.RepoName, EventDownloaded, item, "")
+					}
 					if err != nil {
-						log.Error().Err(err).Msgf("downloading %s", item.DownloadURL)
+						log.Error().Err(err).Msgf("not deleting %s/%s as the backup could not be verified", item.DistroVersion, item.Filename)
+						cc.Events.Emit(cc.RepoName, EventFailed, item, fmt.Sprintf("backup: %v", err))
 						continue
 					}
+					cc.Events.Emit(cc.RepoName, EventVerified, item, "")
 				}
 				if cc.Delete {
 					err := c.delete(item)
 					if err != nil {
 						log.Error().Err(err).Msgf("while deleting %s %s %s", item.Name, item.Version, item.DistroVersion)
+						cc.Events.Emit(cc.RepoName, EventFailed, item, fmt.Sprintf("delete: %v", err))
 						continue
 					}
+					cc.Events.Emit(cc.RepoName, EventDeleted, item, "")
 				}
 				// no errors
 				progress.Add(1)
@@ -247,8 +203,6 @@ func (c *Client) Clean(pList pkgList, cc CleanConfig) error {
 		})
 	}
 
-	if err := pkgs.Wait(); err != nil {
-		return err
-	}
-	return nil
+	// the index is saved even if a worker failed, to keep its progress
+	return errors.Join(pkgs.Wait(), idx.Close())
 }
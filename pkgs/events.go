@@ -0,0 +1,178 @@
+package pkgs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/gromit/util"
+	"github.com/rs/zerolog/log"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+// Actions recorded in the event log of a clean
+const (
+	EventListed           = "listed"
+	EventSkippedProtected = "skipped_protected"
+	EventDownloaded       = "downloaded"
+	EventVerified         = "verified"
+	EventDeleted          = "deleted"
+	EventFailed           = "failed"
+	EventSummary          = "summary"
+)
+
+// Event is one line of the event log, recording an action on a package
+type Event struct {
+	Time          time.Time `json:"time"`
+	Repo          string    `json:"repo"`
+	Action        string    `json:"action"`
+	Name          string    `json:"name"`
+	Version       string    `json:"version"`
+	DistroVersion string    `json:"distro_version"`
+	Filename      string    `json:"filename"`
+	Size          int64     `json:"size,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+// CleanSummary is the total of each action for a repo. It is the last
+// line written to the event log for the repo.
+type CleanSummary struct {
+	Time   time.Time      `json:"time"`
+	Repo   string         `json:"repo"`
+	Action string         `json:"action"`
+	Counts map[string]int `json:"counts"`
+	// DeletedBytes is the size of the packages deleted from the repo
+	DeletedBytes int64 `json:"deleted_bytes"`
+}
+
+// EventLog writes events as JSON lines and keeps totals for each repo.
+// It is safe for concurrent use and a nil *EventLog discards events.
+type EventLog struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	err     error
+	now     func() time.Time
+	counts  map[string]map[string]int
+	deleted map[string]int64
+}
+
+// NewEventLog returns a log that writes to w, which can be nil to only
+// keep totals
+func NewEventLog(w io.Writer) *EventLog {
+	l := &EventLog{
+		now:     time.Now,
+		counts:  make(map[string]map[string]int),
+		deleted: make(map[string]int64),
+	}
+	if w != nil {
+		l.enc = json.NewEncoder(w)
+	}
+	return l
+}
+
+// write encodes v, keeping the first error. l.mu must be held.
+func (l *EventLog) write(v any) {
+	if l.enc == nil || l.err != nil {
+		return
+	}
+	if err := l.enc.Encode(v); err != nil {
+		l.err = fmt.Errorf("writing event log: %w", err)
+	}
+}
+
+// Emit records action on item in repo
+func (l *EventLog) Emit(repo, action string, item pc.PackageDetail, reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[repo] == nil {
+		l.counts[repo] = make(map[string]int)
+	}
+	l.counts[repo][action]++
+	size, _ := strconv.ParseInt(item.Size, 10, 64)
+	if action == EventDeleted {
+		l.deleted[repo] += size
+	}
+	l.write(Event{
+		Time:          l.now(),
+		Repo:          repo,
+		Action:        action,
+		Name:          item.Name,
+		Version:       item.Version,
+		DistroVersion: item.DistroVersion,
+		Filename:      item.Filename,
+		Size:          size,
+		Reason:        reason,
+	})
+}
+
+// Plan records every package in items as listed, and the ones that
+// plan protects as skipped with the reasons for protecting them
+func (l *EventLog) Plan(plan Plan, items []pc.PackageDetail) {
+	for _, item := range items {
+		l.Emit(plan.Repo, EventListed, item, "")
+	}
+	for _, item := range items {
+		if reasons, found := plan.ProtectedBy[semverOf(item.Version)]; found {
+			l.Emit(plan.Repo, EventSkippedProtected, item, strings.Join(reasons, ", "))
+		}
+	}
+}
+
+// Summary writes and returns the totals for repo
+func (l *EventLog) Summary(repo string) CleanSummary {
+	if l == nil {
+		return CleanSummary{Repo: repo, Action: EventSummary}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := CleanSummary{
+		Time:         l.now(),
+		Repo:         repo,
+		Action:       EventSummary,
+		Counts:       maps.Clone(l.counts[repo]),
+		DeletedBytes: l.deleted[repo],
+	}
+	if s.Counts == nil {
+		s.Counts = make(map[string]int)
+	}
+	l.write(s)
+	return s
+}
+
+// Err returns the first error writing the log
+func (l *EventLog) Err() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// statsFlushTimeout bounds the wait for statsd in SendStats
+const statsFlushTimeout = 5 * time.Second
+
+// SendStats sends the totals in s to statsd as pkgs.clean.<repo>.<action>
+// counters, with the number of failures and the bytes deleted as gauges
+// so that a run without failures resets the alert. It returns once they
+// have been sent, as pkgs clean exits soon after.
+func (s CleanSummary) SendStats() {
+	prefix := "pkgs.clean." + s.Repo
+	for _, action := range slices.Sorted(maps.Keys(s.Counts)) {
+		util.StatCount(prefix+"."+action, s.Counts[action])
+	}
+	util.StatGauge(prefix+".failures", s.Counts[EventFailed])
+	util.StatGauge(prefix+".deleted_bytes", int(s.DeletedBytes))
+	if !util.StatFlush(statsFlushTimeout) {
+		log.Warn().Str("repo", s.Repo).Msgf("metrics not sent to statsd within %s", statsFlushTimeout)
+	}
+}
@@ -0,0 +1,114 @@
+package pkgs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanEvents(t *testing.T) {
+	store, items := listLocal(t, "1.0.0", "2.0.0", "3.0.0")
+	c := NewStoreClient(store)
+	cfg := pkgConfig{VersionCutoff: "v3.0.0", Exceptions: []string{"v1.0.0"}}
+	plan, pruned, err := Retain("tyk-test", cfg, nil, Protections{}, items, planNow)
+	require.NoError(t, err)
+	require.Len(t, pruned, 2)
+
+	var buf bytes.Buffer
+	events := NewEventLog(&buf)
+	events.Plan(plan, items)
+	cc := CleanConfig{
+		Concurrency: 2,
+		Savedir:     t.TempDir(),
+		Backup:      true,
+		Delete:      true,
+		RepoName:    "tyk-test",
+		Events:      events,
+	}
+	require.NoError(t, c.Clean(pruned, cc))
+	// the second run finds the backups and has nothing to delete
+	store.corrupt = true
+	require.NoError(t, c.Clean(pruned, cc))
+	summary := events.Summary("tyk-test")
+	require.NoError(t, events.Err())
+
+	assert.Equal(t, map[string]int{
+		EventListed:           6,
+		EventSkippedProtected: 2,
+		EventDownloaded:       2,
+		EventVerified:         4,
+		EventDeleted:          2,
+		EventFailed:           2,
+	}, summary.Counts)
+	assert.Positive(t, summary.DeletedBytes)
+
+	var lines []map[string]any
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &line), sc.Text())
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 19)
+	for _, line := range lines {
+		assert.Equal(t, "tyk-test", line["repo"])
+		if line["action"] == EventSkippedProtected {
+			assert.Equal(t, "1.0.0", line["version"])
+			assert.Equal(t, ReasonException, line["reason"])
+		}
+		if line["action"] == EventFailed {
+			assert.Contains(t, line["reason"], "delete:")
+		}
+	}
+	last := lines[len(lines)-1]
+	assert.Equal(t, EventSummary, last["action"])
+	assert.EqualValues(t, 2, last["counts"].(map[string]any)[EventDeleted])
+}
+
+func TestNilEventLog(t *testing.T) {
+	var events *EventLog
+	events.Emit("tyk-test", EventListed, pkg("1.0.0", 0), "")
+	events.Plan(Plan{Repo: "tyk-test"}, nil)
+	assert.Equal(t, "tyk-test", events.Summary("tyk-test").Repo)
+	assert.NoError(t, events.Err())
+}
+
+// TestSendStats checks that the metrics have reached statsd by the time
+// SendStats returns
+func TestSendStats(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("STATS_SERVER", conn.LocalAddr().String())
+	t.Setenv("STATS_API_KEY", "key")
+
+	CleanSummary{
+		Repo:         "tyk-test",
+		Counts:       map[string]int{EventDeleted: 2, EventFailed: 1},
+		DeletedBytes: 2048,
+	}.SendStats()
+
+	// the datagrams are already queued on the socket
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	var got []string
+	buf := make([]byte, 512)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		got = append(got, string(buf[:n]))
+	}
+	assert.ElementsMatch(t, []string{
+		"key.pkgs.clean.tyk-test.deleted:2|c",
+		"key.pkgs.clean.tyk-test.failed:1|c",
+		"key.pkgs.clean.tyk-test.failures:1|g",
+		"key.pkgs.clean.tyk-test.deleted_bytes:2048|g",
+	}, got)
+}
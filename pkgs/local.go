@@ -0,0 +1,224 @@
+package pkgs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/TykTechnologies/gromit/util"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+// localPageSize is the number of packages returned by each ListPage
+const localPageSize = 100
+
+// localStore is a PackageStore backed by apt and yum repo trees on the
+// local filesystem. The layout is root/<repo>/<distro>/<version>/...
+// so that the first two directories below a repo form the
+// packagecloud style distro version, eg. ubuntu/jammy or el/9. Any
+// directories below that, like pool/main/t/ for apt or x86_64/ for
+// yum, are ignored. Only .deb and .rpm files are considered packages.
+type localStore struct {
+	root     string
+	pageSize int
+}
+
+// NewLocalStore returns a store for the repo trees in root
+func NewLocalStore(root string) PackageStore {
+	return &localStore{root, localPageSize}
+}
+
+// ListPage walks the repo in lexical order, the page token is the
+// offset of the first package in the page
+func (s *localStore) ListPage(repo, page string) ([]pc.PackageDetail, string, error) {
+	offset := 0
+	if page != "" {
+		var err error
+		offset, err = strconv.Atoi(page)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad page token %q: %w", page, err)
+		}
+	}
+	repoDir := filepath.Join(s.root, repo)
+	var files []string
+	err := filepath.WalkDir(repoDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ext := filepath.Ext(p); ext == ".deb" || ext == ".rpm" {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("walking %s: %w", repoDir, err)
+	}
+	if offset > len(files) {
+		offset = len(files)
+	}
+	end := min(offset+s.pageSize, len(files))
+	var items []pc.PackageDetail
+	for _, f := range files[offset:end] {
+		item, err := s.detail(repo, f)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+	}
+	next := ""
+	if end < len(files) {
+		next = strconv.Itoa(end)
+	}
+	return items, next, nil
+}
+
+// detail describes the package at fpath in repo
+func (s *localStore) detail(repo, fpath string) (pc.PackageDetail, error) {
+	var item pc.PackageDetail
+	rel, err := filepath.Rel(s.root, fpath)
+	if err != nil {
+		return item, err
+	}
+	rel = filepath.ToSlash(rel)
+	parts := strings.Split(rel, "/")
+	if len(parts) < 4 {
+		return item, fmt.Errorf("%s is not under <repo>/<distro>/<version>/", rel)
+	}
+	item.DistroVersion = path.Join(parts[1], parts[2])
+	item.Filename = path.Base(rel)
+	item.Name, item.Version, item.Release, item.Arch, item.Type, err = parsePackageFilename(item.Filename)
+	if err != nil {
+		return item, err
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return item, err
+	}
+	item.Size = strconv.FormatInt(fi.Size(), 10)
+	item.CreateTime = fi.ModTime()
+	f, err := os.Open(fpath)
+	if err != nil {
+		return item, err
+	}
+	defer f.Close()
+	item.Sha256Sum = util.Sha256Sum(f)
+	item.PackageURL = rel
+	item.DestroyURL = rel
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return item, err
+	}
+	item.DownloadURL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+	return item, nil
+}
+
+// parsePackageFilename decodes the conventional names of packages,
+// name_version_arch.deb and name-version-release.arch.rpm
+func parsePackageFilename(fname string) (name, version, release, arch, ptype string, err error) {
+	switch {
+	case strings.HasSuffix(fname, ".deb"):
+		parts := strings.Split(strings.TrimSuffix(fname, ".deb"), "_")
+		if len(parts) != 3 {
+			return "", "", "", "", "", fmt.Errorf("%s is not name_version_arch.deb", fname)
+		}
+		return parts[0], parts[1], "", parts[2], "deb", nil
+	case strings.HasSuffix(fname, ".rpm"):
+		base := strings.TrimSuffix(fname, ".rpm")
+		dot := strings.LastIndex(base, ".")
+		if dot < 0 {
+			return "", "", "", "", "", fmt.Errorf("%s is not name-version-release.arch.rpm", fname)
+		}
+		arch, base = base[dot+1:], base[:dot]
+		rdash := strings.LastIndex(base, "-")
+		if rdash < 0 {
+			return "", "", "", "", "", fmt.Errorf("%s is not name-version-release.arch.rpm", fname)
+		}
+		release, base = base[rdash+1:], base[:rdash]
+		vdash := strings.LastIndex(base, "-")
+		if vdash < 0 {
+			return "", "", "", "", "", fmt.Errorf("%s is not name-version-release.arch.rpm", fname)
+		}
+		return base[:vdash], base[vdash+1:], release, arch, "rpm", nil
+	}
+	return "", "", "", "", "", fmt.Errorf("%s is not a deb or rpm", fname)
+}
+
+// Download copies the package file to w
+func (s *localStore) Download(item pc.PackageDetail, w io.Writer) error {
+	root, err := os.OpenRoot(s.root)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	f, err := root.Open(item.PackageURL)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Upload writes the package to <repo>/<distro>/<version>/ in root
+func (s *localStore) Upload(repo string, item pc.PackageDetail, r io.Reader) error {
+	rel := path.Join(repo, item.DistroVersion, item.Filename)
+	if len(strings.Split(rel, "/")) != 4 || path.Base(rel) != item.Filename || !filepath.IsLocal(rel) {
+		return fmt.Errorf("refusing to upload %q to %q", item.Filename, rel)
+	}
+	fpath := filepath.Join(s.root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(fpath + ".part")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fpath + ".part")
+		return err
+	}
+	return os.Rename(fpath+".part", fpath)
+}
+
+// Delete removes the package file
+func (s *localStore) Delete(item pc.PackageDetail) error {
+	root, err := os.OpenRoot(s.root)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(item.DestroyURL)
+}
+
+// Size is the size of the file on disk
+func (s *localStore) Size(item pc.PackageDetail) (int64, error) {
+	fi, err := os.Stat(filepath.Join(s.root, filepath.FromSlash(item.PackageURL)))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Checksum computes the sha256 of the file on disk
+func (s *localStore) Checksum(item pc.PackageDetail) (string, error) {
+	f, err := os.Open(filepath.Join(s.root, filepath.FromSlash(item.PackageURL)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := util.Sha256Sum(f)
+	if sum == "" {
+		return "", fmt.Errorf("could not compute sha256 of %s", item.PackageURL)
+	}
+	return sum, nil
+}
@@ -0,0 +1,122 @@
+package pkgs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLocalRepo lays out a repo tree with one deb and one rpm per version
+func writeLocalRepo(t *testing.T, root, repo string, versions ...string) {
+	t.Helper()
+	for _, v := range versions {
+		for _, f := range []string{
+			filepath.Join(root, repo, "ubuntu", "jammy", "pool", "main", "t", "tyk-test_"+v+"_amd64.deb"),
+			filepath.Join(root, repo, "el", "9", "x86_64", "tyk-test-"+v+"-1.x86_64.rpm"),
+		} {
+			require.NoError(t, os.MkdirAll(filepath.Dir(f), 0755))
+			require.NoError(t, os.WriteFile(f, []byte("contents of "+filepath.Base(f)), 0644))
+		}
+	}
+}
+
+func TestParsePackageFilename(t *testing.T) {
+	cases := []struct {
+		fname                               string
+		name, version, release, arch, ptype string
+	}{
+		{"tyk-gateway_5.3.0_amd64.deb", "tyk-gateway", "5.3.0", "", "amd64", "deb"},
+		{"tyk-gateway_5.3.0~rc1_arm64.deb", "tyk-gateway", "5.3.0~rc1", "", "arm64", "deb"},
+		{"tyk-gateway-5.3.0-1.x86_64.rpm", "tyk-gateway", "5.3.0", "1", "x86_64", "rpm"},
+		{"tyk-gateway-fips-5.3.0~rc1-1.aarch64.rpm", "tyk-gateway-fips", "5.3.0~rc1", "1", "aarch64", "rpm"},
+	}
+	for _, tc := range cases {
+		name, version, release, arch, ptype, err := parsePackageFilename(tc.fname)
+		require.NoError(t, err, tc.fname)
+		assert.Equal(t, []string{tc.name, tc.version, tc.release, tc.arch, tc.ptype},
+			[]string{name, version, release, arch, ptype}, tc.fname)
+	}
+	for _, bad := range []string{"tyk.tar.gz", "tyk_5.3.0.deb", "tyk.rpm", "tyk-1.x86_64.rpm"} {
+		_, _, _, _, _, err := parsePackageFilename(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	root := t.TempDir()
+	writeLocalRepo(t, root, "tyk-test", "1.0.0", "2.0.0", "3.0.0")
+	s := &localStore{root: root, pageSize: 2}
+
+	c := NewStoreClient(s)
+	items, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.Len(t, items, 6)
+
+	distros := make(map[string]int)
+	for _, item := range items {
+		distros[item.DistroVersion]++
+		assert.Equal(t, "tyk-test", item.Name)
+		size, err := s.Size(item)
+		require.NoError(t, err)
+		assert.Equal(t, item.Size, strconv.FormatInt(size, 10))
+		sum, err := s.Checksum(item)
+		require.NoError(t, err)
+		assert.Equal(t, item.Sha256Sum, sum)
+
+		var buf bytes.Buffer
+		require.NoError(t, s.Download(item, &buf))
+		assert.Equal(t, "contents of "+item.Filename, buf.String())
+	}
+	assert.Equal(t, map[string]int{"ubuntu/jammy": 3, "el/9": 3}, distros)
+
+	require.NoError(t, s.Delete(items[0]))
+	items, err = c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	assert.Len(t, items, 5)
+
+	_, _, err = s.ListPage("tyk-test", "not-a-number")
+	assert.Error(t, err)
+}
+
+// TestLocalClean exercises plan and clean end to end without packagecloud
+func TestLocalClean(t *testing.T) {
+	root := t.TempDir()
+	savedir := t.TempDir()
+	writeLocalRepo(t, root, "tyk-test", "1.6.9", "1.7.0", "1.8.2")
+	c := NewStoreClient(NewLocalStore(root))
+
+	items, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	cfg := pkgConfig{VersionCutoff: "v1.7"}
+	plan, pruned, err := Retain("tyk-test", cfg, nil, Protections{}, items, planNow)
+	require.NoError(t, err)
+	assert.Equal(t, 2, plan.Pruned)
+	assert.Equal(t, 4, plan.Retained)
+
+	err = c.Clean(pruned, CleanConfig{
+		Concurrency: 2,
+		Savedir:     savedir,
+		Backup:      true,
+		Delete:      true,
+		RepoName:    "tyk-test",
+	})
+	require.NoError(t, err)
+
+	for _, item := range pruned {
+		assert.NoFileExists(t, filepath.Join(root, filepath.FromSlash(item.PackageURL)))
+		assert.FileExists(t, filepath.Join(savedir, item.Name, item.DistroVersion, item.Filename))
+	}
+	left, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	assert.Len(t, left, 4)
+
+	idx, err := OpenBackupIndex(savedir)
+	require.NoError(t, err)
+	assert.Len(t, idx.Entries(), 2)
+	assert.Empty(t, idx.Verify())
+}
@@ -0,0 +1,244 @@
+package pkgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/peterhellberg/link"
+	"github.com/rs/zerolog/log"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/time/rate"
+)
+
+const pcPrefix = "https://packagecloud.io"
+
+// packagecloudStore is a PackageStore backed by the packagecloud.io API
+type packagecloudStore struct {
+	token  string
+	owner  string
+	prefix string
+	client *http.Client
+	ctx    context.Context
+
+	distrosOnce sync.Once
+	distros     pc.Distributions
+	distrosErr  error
+}
+
+// NewPackagecloudStore returns a store for the repos belonging to
+// owner. Requests are limited to rps with bursts of up to burst and
+// are retried as described by retryTransport. Cancelling ctx stops
+// requests in flight and the waits between retries.
+func NewPackagecloudStore(ctx context.Context, authToken, owner string, rps float64, burst int) PackageStore {
+	limiter := rate.NewLimiter(rate.Limit(rps), burst)
+	return newPackagecloudStore(ctx, pcPrefix, authToken, owner, newRetryTransport(http.DefaultTransport, limiter))
+}
+
+func newPackagecloudStore(ctx context.Context, prefix, authToken, owner string, transport http.RoundTripper) *packagecloudStore {
+	return &packagecloudStore{
+		token:  authToken,
+		owner:  owner,
+		prefix: prefix,
+		client: &http.Client{Transport: transport},
+		ctx:    ctx,
+	}
+}
+
+// get makes a GET request to a packagecloud API and returns the next
+// page link. The response is only returned if the status is 200.
+func (s *packagecloudStore) get(url string) (*http.Response, error, string) {
+	var buf bytes.Buffer
+	req, err := http.NewRequestWithContext(s.ctx, "GET", url, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("http newrequest err: %v", err), ""
+	}
+	req.Header.Set("Pragma", "no-cache")
+	req.Header.Set("Accept", "application/json")
+
+	req.SetBasicAuth(s.token, "")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err, ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("invalid response: %s err: %q", resp.Status, b), ""
+	}
+	webLink := link.ParseResponse(resp)
+	if n, ok := webLink["next"]; ok {
+		return resp, nil, n.URI
+	}
+	return resp, nil, ""
+}
+
+// ListPage fetches the page at the URL in page, starting with the
+// first page of the repo. The next page is taken from the Link header.
+func (s *packagecloudStore) ListPage(repo, page string) ([]pc.PackageDetail, string, error) {
+	if page == "" {
+		page = fmt.Sprintf("%s/api/v1/repos/%s/%s/packages.json", s.prefix, s.owner, repo)
+	}
+	resp, err, next := s.get(page)
+	if err != nil {
+		return nil, "", fmt.Errorf("http get err: %v", err)
+	}
+	defer resp.Body.Close()
+	var items []pc.PackageDetail
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, "", fmt.Errorf("json parse err: %v", err)
+	}
+	return items, next, nil
+}
+
+// Download fetches the package from its download URL
+func (s *packagecloudStore) Download(item pc.PackageDetail, w io.Writer) error {
+	req, err := http.NewRequestWithContext(s.ctx, "GET", item.DownloadURL, nil)
+	if err != nil {
+		return fmt.Errorf("http newrequest err: %v", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", item.DownloadURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status fetching %s: %s", item.DownloadURL, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Delete deletes the given package from the repo permanently
+func (s *packagecloudStore) Delete(item pc.PackageDetail) error {
+	purl, err := url.JoinPath(s.prefix, item.DestroyURL)
+	if err != nil {
+		return fmt.Errorf("creating URL: %v", err)
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "DELETE", purl, nil)
+	if err != nil {
+		return fmt.Errorf("http newrequest err: %v", err)
+	}
+	req.SetBasicAuth(s.token, "")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http err %s: %v", purl, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("invalid response: %s err: %q for %s", resp.Status, b, purl)
+	}
+	log.Debug().Msgf("deleted %s", purl)
+	return nil
+}
+
+// Size is reported by the API as a string
+func (s *packagecloudStore) Size(item pc.PackageDetail) (int64, error) {
+	return strconv.ParseInt(item.Size, 10, 64)
+}
+
+// Checksum is the sha256 reported by the API
+func (s *packagecloudStore) Checksum(item pc.PackageDetail) (string, error) {
+	if item.Sha256Sum == "" {
+		return "", fmt.Errorf("no sha256 for %s/%s", item.DistroVersion, item.Filename)
+	}
+	return item.Sha256Sum, nil
+}
+
+// distroVersionID finds the packagecloud id for a distro version like
+// ubuntu/jammy or el/9. The list of distributions is fetched once.
+func (s *packagecloudStore) distroVersionID(distroVersion, filename string) (string, error) {
+	s.distrosOnce.Do(func() {
+		var resp *http.Response
+		resp, s.distrosErr, _ = s.get(s.prefix + "/api/v1/distributions.json")
+		if s.distrosErr != nil {
+			return
+		}
+		defer resp.Body.Close()
+		s.distrosErr = json.NewDecoder(resp.Body).Decode(&s.distros)
+	})
+	if s.distrosErr != nil {
+		return "", fmt.Errorf("fetching distributions: %w", s.distrosErr)
+	}
+	var dists []pc.Distribution
+	switch path.Ext(filename) {
+	case ".deb":
+		dists = s.distros.Deb
+	case ".rpm":
+		dists = s.distros.Rpm
+	default:
+		return "", fmt.Errorf("cannot upload %s, only debs and rpms are supported", filename)
+	}
+	distro, version, _ := strings.Cut(distroVersion, "/")
+	for _, d := range dists {
+		if d.IndexName != distro {
+			continue
+		}
+		for _, v := range d.Versions {
+			if v.IndexName == version {
+				return strconv.Itoa(v.ID), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown distribution %s for %s", distroVersion, filename)
+}
+
+// Upload pushes the package to the repo with the packagecloud push
+// API. The body is streamed so that large packages are not held in
+// memory. Uploads are limited by the same rate limiter as other
+// requests but are never retried.
+func (s *packagecloudStore) Upload(repo string, item pc.PackageDetail, r io.Reader) error {
+	id, err := s.distroVersionID(item.DistroVersion, item.Filename)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("package[distro_version_id]", id)
+		if err == nil {
+			var fw io.Writer
+			fw, err = mw.CreateFormFile("package[package_file]", item.Filename)
+			if err == nil {
+				_, err = io.Copy(fw, r)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	purl := fmt.Sprintf("%s/api/v1/repos/%s/%s/packages.json", s.prefix, s.owner, repo)
+	req, err := http.NewRequestWithContext(s.ctx, "POST", purl, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("http newrequest err: %v", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(s.token, "")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("uploading %s: %v", item.Filename, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("invalid response: %s err: %q for %s", resp.Status, b, item.Filename)
+	}
+	log.Debug().Msgf("uploaded %s/%s to %s", item.DistroVersion, item.Filename, repo)
+	return nil
+}
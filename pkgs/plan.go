@@ -1,7 +1,6 @@
 package pkgs
 
 import (
-	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
@@ -31,8 +30,11 @@ type Plan struct {
 	PrunedBytes int64 `json:"pruned_bytes"`
 
 	PrunedSeries map[string]int `json:"pruned_series,omitempty"`
-	Protected    map[string]int `json:"protected,omitempty"`
-	NonSemver    int            `json:"non_semver"`
+	// Protected counts the packages held for each version and
+	// ProtectedBy gives the reasons
+	Protected   map[string]int      `json:"protected,omitempty"`
+	ProtectedBy map[string][]string `json:"protected_by,omitempty"`
+	NonSemver   int                 `json:"non_semver"`
 
 	Packages []PlanPackage `json:"packages,omitempty"`
 }
@@ -51,32 +53,42 @@ type PlanPackage struct {
 
 // ListPackages fetches every package in a repo, unfiltered. Read-only.
 func (c *Client) ListPackages(repo string) ([]pc.PackageDetail, error) {
+	return listAll(c.store, repo)
+}
+
+// listAll fetches every page of repo from store
+func listAll(store PackageStore, repo string) ([]pc.PackageDetail, error) {
 	var all []pc.PackageDetail
-	url := fmt.Sprintf("%s/api/v1/repos/%s/%s/packages.json", pcPrefix, c.owner, repo)
+	page := ""
 	for {
-		resp, err, next := c.get(url)
+		items, next, err := store.ListPage(repo, page)
 		if err != nil {
-			return nil, fmt.Errorf("http get err: %v", err)
-		}
-		var items []pc.PackageDetail
-		err = json.NewDecoder(resp.Body).Decode(&items)
-		resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("json parse err: %v", err)
+			return nil, err
 		}
 		all = append(all, items...)
 		if next == "" {
 			break
 		}
-		url = next
+		page = next
 	}
 	return all, nil
 }
 
 // BuildPlan classifies every package in a repo against the retention
-// policy. Repos without a track use their static cutoffs, making the
-// plan a preview of what `pkgs clean` would do today.
-func BuildPlan(repoName string, cfg pkgConfig, tracks Tracks, items []pc.PackageDetail, now time.Time) (Plan, error) {
+// policy. Repos without a track use their static cutoffs. The plan is
+// exactly what `pkgs clean` would do today as both use Retain.
+func BuildPlan(repoName string, cfg pkgConfig, tracks Tracks, prot Protections, items []pc.PackageDetail, now time.Time) (Plan, error) {
+	p, _, err := Retain(repoName, cfg, tracks, prot, items, now)
+	return p, err
+}
+
+// Retain is the retention engine shared by `pkgs plan` and `pkgs clean`.
+// It returns the plan for the repo along with the packages from items
+// that the plan prunes, in the same order as plan.Packages. Versions
+// in the exceptions of cfg or in prot are always retained; non-semver
+// versions are only pruned by agecutoff.
+func Retain(repoName string, cfg pkgConfig, tracks Tracks, prot Protections, items []pc.PackageDetail, now time.Time) (Plan, []pc.PackageDetail, error) {
+	var pruned []pc.PackageDetail
 	p := Plan{
 		Repo:         repoName,
 		GeneratedAt:  now,
@@ -84,6 +96,7 @@ func BuildPlan(repoName string, cfg pkgConfig, tracks Tracks, items []pc.Package
 		Editions:     cfg.Editions,
 		PrunedSeries: make(map[string]int),
 		Protected:    make(map[string]int),
+		ProtectedBy:  make(map[string][]string),
 	}
 	vtrans := strings.NewReplacer("~", "-")
 
@@ -94,46 +107,51 @@ func BuildPlan(repoName string, cfg pkgConfig, tracks Tracks, items []pc.Package
 	p.Series = MinorSeries(versions)
 
 	// A track cutoff is compared by minor series; a static cutoff
-	// keeps Filter.Satisfies' full-semver comparison.
+	// uses a full-semver comparison.
 	cutoff := semver.Canonical(cfg.VersionCutoff)
 	bySeries := false
 	if cfg.Track != "" {
 		track, found := tracks[cfg.Track]
 		if !found {
-			return p, fmt.Errorf("track %q is not in the tracks config", cfg.Track)
+			return p, nil, fmt.Errorf("track %q is not in the tracks config", cfg.Track)
 		}
 		anchor, depth, err := track.Anchor(cfg.Editions)
 		if err != nil {
-			return p, fmt.Errorf("track %q: %w", cfg.Track, err)
+			return p, nil, fmt.Errorf("track %q: %w", cfg.Track, err)
 		}
 		p.Anchor = anchor
 		cutoff, err = DeriveCutoff(p.Series, anchor, depth)
 		if err != nil {
-			return p, err
+			return p, nil, err
 		}
 		bySeries = true
 	}
 	p.Cutoff = cutoff
 
-	exceptions := make(map[string]bool)
+	protected := make(map[string][]string)
 	for _, e := range cfg.Exceptions {
-		exceptions[e] = true
+		addReason(protected, e, ReasonException)
+	}
+	for v, reasons := range prot.resolve(versions) {
+		for _, r := range reasons {
+			addReason(protected, v, r)
+		}
 	}
 
 	for _, item := range items {
 		v := "v" + vtrans.Replace(item.Version)
-		if exceptions[v] {
+		if reasons, found := protected[v]; found {
 			p.Protected[v]++
+			p.ProtectedBy[v] = reasons
 			p.Retained++
 			continue
 		}
+		// Version cutoffs only apply to semver versions but, as with
+		// the static filter, agecutoff applies to every version.
+		prune := false
 		if !semver.IsValid(v) {
 			p.NonSemver++
-			p.Retained++
-			continue
-		}
-		prune := false
-		if cutoff != "" {
+		} else if cutoff != "" {
 			if bySeries {
 				prune = semver.Compare(semver.MajorMinor(v), cutoff) < 0
 			} else {
@@ -145,24 +163,19 @@ func BuildPlan(repoName string, cfg pkgConfig, tracks Tracks, items []pc.Package
 		}
 		if prune {
 			p.Pruned++
-			p.PrunedSeries[semver.MajorMinor(v)]++
+			if mm := semver.MajorMinor(v); mm != "" {
+				p.PrunedSeries[mm]++
+			}
 			if sz, err := strconv.ParseInt(item.Size, 10, 64); err == nil {
 				p.PrunedBytes += sz
 			}
-			p.Packages = append(p.Packages, PlanPackage{
-				Name:          item.Name,
-				Version:       item.Version,
-				Arch:          item.Arch,
-				DistroVersion: item.DistroVersion,
-				Filename:      item.Filename,
-				Sha256Sum:     item.Sha256Sum,
-				CreateTime:    item.CreateTime,
-			})
+			p.Packages = append(p.Packages, planPackage(item))
+			pruned = append(pruned, item)
 		} else {
 			p.Retained++
 		}
 	}
-	return p, nil
+	return p, pruned, nil
 }
 
 // Render returns a human-readable summary of the plan
@@ -194,14 +207,19 @@ func (p Plan) Render() string {
 			keys = append(keys, k)
 		}
 		sort.Strings(keys)
-		fmt.Fprintf(&b, "  exceptions held:")
+		fmt.Fprintf(&b, "  protected:")
 		for _, k := range keys {
 			fmt.Fprintf(&b, " %s(%d)", k, p.Protected[k])
 		}
 		fmt.Fprintln(&b)
+		for _, k := range keys {
+			if reasons := p.ProtectedBy[k]; len(reasons) > 0 {
+				fmt.Fprintf(&b, "    %s: %s\n", k, strings.Join(reasons, ", "))
+			}
+		}
 	}
 	if p.NonSemver > 0 {
-		fmt.Fprintf(&b, "  %d non-semver packages always retained\n", p.NonSemver)
+		fmt.Fprintf(&b, "  %d non-semver packages, pruned only by agecutoff\n", p.NonSemver)
 	}
 	return b.String()
 }
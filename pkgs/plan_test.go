@@ -1,12 +1,19 @@
 package pkgs
 
 import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/mod/semver"
 )
 
 var planNow = time.Date(2026, 8, 17, 0, 0, 0, 0, time.UTC)
@@ -47,7 +54,7 @@ func TestBuildPlanTrackDriven(t *testing.T) {
 	}
 	// EE window: anchor 5.8, retaining three shipped series below it
 	// (5.3, 5.2, 3.0), so the cutoff is v3.0
-	plan, err := BuildPlan("tyk-test", cfg, testTracks, items, planNow)
+	plan, err := BuildPlan("tyk-test", cfg, testTracks, Protections{}, items, planNow)
 	require.NoError(t, err)
 
 	assert.Equal(t, "5.8", plan.Anchor)
@@ -75,34 +82,189 @@ func TestBuildPlanStatic(t *testing.T) {
 		Exceptions:    []string{"v1.8.2"},
 	}
 	items := []pc.PackageDetail{
-		pkg("1.6.9", 24*time.Hour),       // below cutoff: pruned
-		pkg("1.7.0", 24*time.Hour),       // at cutoff: retained
-		pkg("1.8.2", 5*365*24*time.Hour), // old but protected
-		pkg("1.9.0", 4*365*24*time.Hour), // above cutoff but too old: pruned
-		pkg("2.0.0", 24*time.Hour),       // fresh and above cutoff: retained
+		pkg("1.6.9", 24*time.Hour),          // below cutoff: pruned
+		pkg("1.7.0", 24*time.Hour),          // at cutoff: retained
+		pkg("1.8.2", 5*365*24*time.Hour),    // old but protected
+		pkg("1.9.0", 4*365*24*time.Hour),    // above cutoff but too old: pruned
+		pkg("2.0.0", 24*time.Hour),          // fresh and above cutoff: retained
+		pkg("0nightly", 24*time.Hour),       // non-semver and fresh: retained
+		pkg("1nightly", 4*365*24*time.Hour), // non-semver but too old: pruned
 	}
-	plan, err := BuildPlan("tyk-mdcb", cfg, testTracks, items, planNow)
+	plan, err := BuildPlan("tyk-mdcb", cfg, testTracks, Protections{}, items, planNow)
 	require.NoError(t, err)
 
 	assert.Empty(t, plan.Anchor)
 	assert.Equal(t, "v1.7.0", plan.Cutoff)
-	assert.Equal(t, 2, plan.Pruned)
-	assert.Equal(t, 3, plan.Retained)
+	assert.Equal(t, 3, plan.Pruned)
+	assert.Equal(t, 4, plan.Retained)
+	assert.Equal(t, 2, plan.NonSemver)
 	assert.Equal(t, map[string]int{"v1.8.2": 1}, plan.Protected)
+	assert.Equal(t, map[string]int{"v1.6": 1, "v1.9": 1}, plan.PrunedSeries)
 }
 
 func TestBuildPlanBadTrack(t *testing.T) {
-	_, err := BuildPlan("x", pkgConfig{Track: "nonesuch", Editions: []string{"ce"}}, testTracks, nil, planNow)
+	_, err := BuildPlan("x", pkgConfig{Track: "nonesuch", Editions: []string{"ce"}}, testTracks, Protections{}, nil, planNow)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "not in the tracks config")
 
-	_, err = BuildPlan("x", pkgConfig{Track: "gateway"}, testTracks, nil, planNow)
+	_, err = BuildPlan("x", pkgConfig{Track: "gateway"}, testTracks, Protections{}, nil, planNow)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "no editions")
 
 	// anchor with no shipped packages: loud failure
 	_, err = BuildPlan("x", pkgConfig{Track: "gateway", Editions: []string{"ce"}},
-		testTracks, []pc.PackageDetail{pkg("1.0.0", 0)}, planNow)
+		testTracks, Protections{}, []pc.PackageDetail{pkg("1.0.0", 0)}, planNow)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "no released packages")
 }
+
+// randomPackages makes a package list with a mix of series, ages,
+// non-semver versions and exceptions
+func randomPackages(r *rand.Rand) []pc.PackageDetail {
+	var items []pc.PackageDetail
+	for range r.Intn(60) {
+		var version string
+		switch r.Intn(10) {
+		case 0:
+			version = fmt.Sprintf("%dnightly", r.Intn(3))
+		case 1:
+			version = fmt.Sprintf("5.%d.%d~rc%d", r.Intn(15), r.Intn(4), r.Intn(3))
+		default:
+			version = fmt.Sprintf("%d.%d.%d", 2+r.Intn(4), r.Intn(15), r.Intn(4))
+		}
+		item := pkg(version, time.Duration(r.Intn(6*365))*24*time.Hour)
+		item.DistroVersion = []string{"ubuntu/jammy", "el/9"}[r.Intn(2)]
+		items = append(items, item)
+	}
+	return items
+}
+
+// memStore is a PackageStore that lists its packages a few at a time
+// and records what is deleted
+type memStore struct {
+	PackageStore
+	items   []pc.PackageDetail
+	mu      sync.Mutex
+	deleted []PlanPackage
+}
+
+func (s *memStore) ListPage(repo, page string) ([]pc.PackageDetail, string, error) {
+	offset := 0
+	if page != "" {
+		offset, _ = strconv.Atoi(page)
+	}
+	end := min(offset+7, len(s.items))
+	next := ""
+	if end < len(s.items) {
+		next = strconv.Itoa(end)
+	}
+	return s.items[offset:end], next, nil
+}
+
+func (s *memStore) Delete(item pc.PackageDetail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, planPackage(item))
+	return nil
+}
+
+func sortPlanPackages(pkgs []PlanPackage) []PlanPackage {
+	sorted := slices.Clone(pkgs)
+	slices.SortFunc(sorted, func(a, b PlanPackage) int {
+		return strings.Compare(a.DistroVersion+"/"+a.Filename+a.CreateTime.String(), b.DistroVersion+"/"+b.Filename+b.CreateTime.String())
+	})
+	return sorted
+}
+
+// staticPrune is the retention that pkgs clean applied before it went
+// through the plan: exceptions, then a full-semver versioncutoff for
+// semver versions, then agecutoff for every version
+func staticPrune(cfg pkgConfig, item pc.PackageDetail, now time.Time) bool {
+	v := "v" + strings.ReplaceAll(item.Version, "~", "-")
+	if slices.Contains(cfg.Exceptions, v) {
+		return false
+	}
+	if cutoff := semver.Canonical(cfg.VersionCutoff); cutoff != "" && semver.IsValid(v) && semver.Compare(v, cutoff) < 0 {
+		return true
+	}
+	return cfg.AgeCutoff != 0 && now.Sub(item.CreateTime) > cfg.AgeCutoff
+}
+
+// TestCleanStatic checks what clean deletes for a static config against
+// hand-written expectations
+func TestCleanStatic(t *testing.T) {
+	cfg := pkgConfig{
+		VersionCutoff: "v3",
+		AgeCutoff:     2 * 365 * 24 * time.Hour,
+		Exceptions:    []string{"v2.9.4", "v5.0.0-rc1"},
+	}
+	items := []pc.PackageDetail{
+		pkg("2.8.3", 24*time.Hour),           // below cutoff
+		pkg("2.9.4", 5*365*24*time.Hour),     // exception
+		pkg("3.0.0", 24*time.Hour),           // at cutoff
+		pkg("4.1.2", 3*365*24*time.Hour),     // too old
+		pkg("5.0.0~rc1", 3*365*24*time.Hour), // exception after translation
+		pkg("5.1.0~rc2", 24*time.Hour),       // fresh prerelease
+		pkg("0nightly", 3*365*24*time.Hour),  // non-semver, too old
+		pkg("1nightly", 24*time.Hour),        // non-semver, fresh
+	}
+	store := &memStore{items: items}
+	c := NewStoreClient(store)
+	listed, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	_, pruned, err := Retain("tyk-test", cfg, testTracks, Protections{}, listed, planNow)
+	require.NoError(t, err)
+	require.NoError(t, c.Clean(pruned, CleanConfig{Concurrency: 2, Delete: true, RepoName: "tyk-test"}))
+
+	var deleted []string
+	for _, d := range store.deleted {
+		deleted = append(deleted, d.Version)
+	}
+	assert.ElementsMatch(t, []string{"2.8.3", "4.1.2", "0nightly"}, deleted)
+}
+
+// TestCleanMatchesPlan proves that for any package list, the packages
+// that clean deletes from the store are exactly plan.Packages and, for
+// static configs, exactly what the pre-plan retention deleted
+func TestCleanMatchesPlan(t *testing.T) {
+	tracks := Tracks{"gateway": {CurrentFeature: "5.3", CurrentLTS: "5.2", LTSMinus1: "5.1"}}
+	cfgs := []pkgConfig{
+		{VersionCutoff: "v4.2", Exceptions: []string{"v3.1.1"}},
+		{AgeCutoff: 2 * 365 * 24 * time.Hour},
+		{VersionCutoff: "v5.0", AgeCutoff: 4 * 365 * 24 * time.Hour},
+		{Track: "gateway", Editions: []string{"ce"}, Exceptions: []string{"v2.0.0"}},
+		{Track: "gateway", Editions: []string{"ce", "ee"}},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := range 500 {
+		items := randomPackages(r)
+		// track anchors need released packages
+		items = append(items, pkg("5.1.0", 0), pkg("5.3.0", 0))
+		cfg := cfgs[i%len(cfgs)]
+		store := &memStore{items: items}
+		c := NewStoreClient(store)
+
+		listed, err := c.ListPackages("tyk-test")
+		require.NoError(t, err)
+		plan, err := BuildPlan("tyk-test", cfg, tracks, Protections{}, listed, planNow)
+		require.NoError(t, err)
+		// as pkgs clean does
+		_, pruned, err := Retain("tyk-test", cfg, tracks, Protections{}, listed, planNow)
+		require.NoError(t, err)
+		require.NoError(t, c.Clean(pruned, CleanConfig{Concurrency: 4, Delete: true, RepoName: "tyk-test"}))
+
+		assert.Equal(t, sortPlanPackages(plan.Packages), sortPlanPackages(store.deleted), "iteration %d, config %+v", i, cfg)
+		assert.Equal(t, len(items), plan.Retained+plan.Pruned)
+		assert.Len(t, store.deleted, plan.Pruned)
+
+		if cfg.Track == "" {
+			var want []PlanPackage
+			for _, item := range items {
+				if staticPrune(cfg, item, planNow) {
+					want = append(want, planPackage(item))
+				}
+			}
+			assert.Equal(t, sortPlanPackages(want), sortPlanPackages(store.deleted), "iteration %d, config %+v", i, cfg)
+		}
+	}
+}
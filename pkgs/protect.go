@@ -0,0 +1,146 @@
+package pkgs
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/TykTechnologies/gromit/policy"
+	"golang.org/x/mod/semver"
+)
+
+// ReasonException is the reason given for versions in the exceptions
+// list of the pkgs config
+const ReasonException = "exception in pkgs config"
+
+// pkgsAlias maps a policy repo to its packagecloud repo where neither
+// the repo name nor its packagename matches: tyk-sink publishes its
+// packages as tyk-mdcb.
+var pkgsAlias = map[string]string{
+	"tyk-sink": "tyk-mdcb",
+}
+
+// Protections are the versions in a repo that must never be pruned,
+// along with the reasons for protecting them. A protected series
+// protects the newest release in that series, whatever it is when the
+// plan is made. The zero value protects nothing.
+type Protections struct {
+	versions map[string][]string
+	series   map[string][]string
+}
+
+func addReason(m map[string][]string, key, reason string) {
+	if !slices.Contains(m[key], reason) {
+		m[key] = append(m[key], reason)
+	}
+}
+
+// Version protects exactly version, which need not have a v prefix
+func (p *Protections) Version(version, reason string) {
+	if p.versions == nil {
+		p.versions = make(map[string][]string)
+	}
+	addReason(p.versions, semverOf(version), reason)
+}
+
+// LatestPatch protects the newest release in series, like v5.3
+func (p *Protections) LatestPatch(series, reason string) {
+	if p.series == nil {
+		p.series = make(map[string][]string)
+	}
+	addReason(p.series, semverOf(series), reason)
+}
+
+// resolve returns the protected versions among versions, which are in
+// the form that Retain compares, with the reasons for each. Versions
+// that are protected explicitly are returned even if they are absent.
+func (p Protections) resolve(versions []string) map[string][]string {
+	protected := make(map[string][]string)
+	for v, reasons := range p.versions {
+		for _, r := range reasons {
+			addReason(protected, v, r)
+		}
+	}
+	latest := make(map[string]string)
+	for _, v := range versions {
+		if !semver.IsValid(v) || semver.Prerelease(v) != "" {
+			continue
+		}
+		s := semver.MajorMinor(v)
+		if cur, found := latest[s]; !found || semver.Compare(v, cur) > 0 {
+			latest[s] = v
+		}
+	}
+	for s, reasons := range p.series {
+		v, found := latest[s]
+		if !found {
+			continue
+		}
+		for _, r := range reasons {
+			addReason(protected, v, r)
+		}
+	}
+	return protected
+}
+
+// packagesRepo is the packagecloud repo that rp publishes to
+func packagesRepo(rp policy.RepoPolicy) string {
+	if alias, found := pkgsAlias[rp.Name]; found {
+		return alias
+	}
+	if rp.PackageName != "" {
+		return rp.PackageName
+	}
+	return rp.Name
+}
+
+// PolicyProtections derives the protections for the packagecloud repo
+// pkgsRepo from the policy config and the tracks. For every policy
+// repo that publishes to pkgsRepo, its upgradefromver at the repo and
+// branch levels is protected along with the newest patch of each
+// release branch series. If cfg uses a track, the series or versions
+// pinned in the track are protected too.
+func PolicyProtections(pol *policy.Policies, pkgsRepo string, cfg pkgConfig, tracks Tracks) (Protections, error) {
+	var prot Protections
+	for _, repo := range pol.GetAllRepos() {
+		rp, err := pol.GetRepoPolicy(repo)
+		if err != nil {
+			return prot, err
+		}
+		if packagesRepo(rp) != pkgsRepo {
+			continue
+		}
+		if rp.UpgradeFromVer != "" {
+			prot.Version(rp.UpgradeFromVer, fmt.Sprintf("upgradefromver of %s", repo))
+		}
+		for _, branch := range rp.GetAllBranches() {
+			if v := rp.Branches[branch].UpgradeFromVer; v != "" && v != rp.UpgradeFromVer {
+				prot.Version(v, fmt.Sprintf("upgradefromver of %s/%s", repo, branch))
+			}
+			if v, isRelease := strings.CutPrefix(branch, "release-"); isRelease {
+				if s := semver.MajorMinor(semverOf(v)); s != "" {
+					prot.LatestPatch(s, fmt.Sprintf("latest patch of %s/%s", repo, branch))
+				}
+			}
+		}
+	}
+	if cfg.Track != "" {
+		track, found := tracks[cfg.Track]
+		if !found {
+			return prot, fmt.Errorf("track %q is not in the tracks config", cfg.Track)
+		}
+		for _, pin := range []struct{ name, val string }{
+			{"current_feature", track.CurrentFeature},
+			{"current_lts", track.CurrentLTS},
+			{"lts_minus_1", track.LTSMinus1},
+		} {
+			reason := fmt.Sprintf("tracks.%s.%s", cfg.Track, pin.name)
+			if v := semverOf(pin.val); semver.MajorMinor(v) == v {
+				prot.LatestPatch(v, reason)
+			} else {
+				prot.Version(v, reason)
+			}
+		}
+	}
+	return prot, nil
+}
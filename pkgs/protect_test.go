@@ -0,0 +1,87 @@
+package pkgs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/gromit/policy"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+const protectPolicy = `
+policy:
+  groups:
+    oss:
+      repos:
+        tyk:
+          packagename: tyk-test
+          upgradefromver: 3.0.8
+          branches:
+            master: {}
+            release-5.8:
+              upgradefromver: 4.0.1
+            release-5.3: {}
+        tyk-sink:
+          upgradefromver: 2.0.0
+          branches:
+            master: {}
+`
+
+// loadProtectPolicy reads protectPolicy as LoadRepoPolicies would,
+// without replacing the global config that other tests use
+func loadProtectPolicy(t *testing.T) *policy.Policies {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(protectPolicy)))
+	var pol policy.Policies
+	require.NoError(t, v.UnmarshalKey("policy", &pol))
+	return &pol
+}
+
+func TestPolicyProtections(t *testing.T) {
+	pol := loadProtectPolicy(t)
+	cfg := pkgConfig{Track: "gateway", Editions: []string{"ee"}, Exceptions: []string{"v3.0.8"}}
+	prot, err := PolicyProtections(pol, "tyk-test", cfg, testTracks)
+	require.NoError(t, err)
+
+	items := []pc.PackageDetail{
+		pkg("3.0.8", 0),
+		pkg("3.0.9", 0),
+		pkg("4.0.1", 0),
+		pkg("5.2.0", 0),
+		pkg("5.3.0", 0),
+		pkg("5.3.4", 0),
+		pkg("5.3.5~rc1", 0),
+		pkg("5.8.1", 0),
+		pkg("5.8.2", 0),
+		pkg("5.13.0", 0),
+		pkg("5.14.0", 0),
+	}
+	plan, err := BuildPlan("tyk-test", cfg, testTracks, prot, items, planNow)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"v3.0.8":  {ReasonException, "upgradefromver of tyk"},
+		"v4.0.1":  {"upgradefromver of tyk/release-5.8"},
+		"v5.3.4":  {"latest patch of tyk/release-5.3"},
+		"v5.8.2":  {"latest patch of tyk/release-5.8", "tracks.gateway.lts_minus_1"},
+		"v5.13.0": {"tracks.gateway.current_lts"},
+		"v5.14.0": {"tracks.gateway.current_feature"},
+	}, plan.ProtectedBy)
+	// the cutoff would otherwise prune these
+	for _, pp := range plan.Packages {
+		assert.NotContains(t, []string{"3.0.8", "4.0.1", "5.3.4"}, pp.Version)
+	}
+	assert.Contains(t, plan.Render(), "v5.3.4: latest patch of tyk/release-5.3")
+
+	// tyk-sink publishes to tyk-mdcb
+	prot, err = PolicyProtections(pol, "tyk-mdcb", pkgConfig{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"v2.0.0": {"upgradefromver of tyk-sink"}}, prot.resolve(nil))
+
+	_, err = PolicyProtections(pol, "tyk-test", pkgConfig{Track: "nonesuch"}, testTracks)
+	assert.Error(t, err)
+}
@@ -0,0 +1,273 @@
+package pkgs
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/mod/semver"
+)
+
+// Dimensions that an inventory is grouped by
+const (
+	DimSeries  = "series"
+	DimDistro  = "distro"
+	DimArch    = "arch"
+	DimEdition = "edition"
+)
+
+// nonSemverSeries is the series that packages without a semver version are counted under
+const nonSemverSeries = "non-semver"
+
+// Usage is the number of packages and the storage they take
+type Usage struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (u *Usage) add(size int64) {
+	u.Count++
+	u.Bytes += size
+}
+
+// Duplicate is the same version of a package uploaded more than once
+// for the same distro and arch, under different filenames
+type Duplicate struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	DistroVersion string   `json:"distro_version"`
+	Arch          string   `json:"arch"`
+	Filenames     []string `json:"filenames"`
+	Bytes         int64    `json:"bytes"`
+}
+
+// Inventory is the storage used by a repo, grouped by each dimension
+type Inventory struct {
+	Repo       string                      `json:"repo"`
+	Total      Usage                       `json:"total"`
+	Usage      map[string]map[string]Usage `json:"usage"`
+	Duplicates []Duplicate                 `json:"duplicates,omitempty"`
+}
+
+// Report is the output of `pkgs report --format json` and can be
+// compared against a later report
+type Report struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Inventories []Inventory  `json:"inventories"`
+	Growth      []UsageDelta `json:"growth,omitempty"`
+}
+
+// editionOf derives the edition from the package name
+func editionOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, "-ee"):
+		return "ee"
+	case strings.HasSuffix(name, "-fips"):
+		return "fips"
+	}
+	return "ce"
+}
+
+// BuildInventory groups items by series, distro, arch and edition.
+// Sizes that cannot be parsed are counted as zero bytes.
+func BuildInventory(repo string, items []pc.PackageDetail) Inventory {
+	inv := Inventory{
+		Repo:  repo,
+		Usage: make(map[string]map[string]Usage),
+	}
+	for _, dim := range []string{DimSeries, DimDistro, DimArch, DimEdition} {
+		inv.Usage[dim] = make(map[string]Usage)
+	}
+	type dupKey struct{ name, version, distro, arch string }
+	seen := make(map[dupKey][]pc.PackageDetail)
+	for _, item := range items {
+		size, _ := strconv.ParseInt(item.Size, 10, 64)
+		inv.Total.add(size)
+		series := nonSemverSeries
+		if v := semverOf(item.Version); semver.IsValid(v) {
+			series = semver.MajorMinor(v)
+		}
+		for dim, key := range map[string]string{
+			DimSeries:  series,
+			DimDistro:  item.DistroVersion,
+			DimArch:    item.Arch,
+			DimEdition: editionOf(item.Name),
+		} {
+			u := inv.Usage[dim][key]
+			u.add(size)
+			inv.Usage[dim][key] = u
+		}
+		k := dupKey{item.Name, semverOf(item.Version), item.DistroVersion, item.Arch}
+		seen[k] = append(seen[k], item)
+	}
+	for _, dups := range seen {
+		if len(dups) < 2 {
+			continue
+		}
+		d := Duplicate{
+			Name:          dups[0].Name,
+			Version:       dups[0].Version,
+			DistroVersion: dups[0].DistroVersion,
+			Arch:          dups[0].Arch,
+		}
+		for _, item := range dups {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			d.Filenames = append(d.Filenames, item.Filename)
+			d.Bytes += size
+		}
+		slices.Sort(d.Filenames)
+		inv.Duplicates = append(inv.Duplicates, d)
+	}
+	slices.SortFunc(inv.Duplicates, func(a, b Duplicate) int {
+		return strings.Compare(a.DistroVersion+"/"+a.Filenames[0], b.DistroVersion+"/"+b.Filenames[0])
+	})
+	return inv
+}
+
+// sortedKeys orders series by semver and everything else lexically
+func sortedKeys(dim string, usage map[string]Usage) []string {
+	keys := slices.Sorted(maps.Keys(usage))
+	if dim == DimSeries {
+		slices.SortStableFunc(keys, func(a, b string) int {
+			return semver.Compare(a, b)
+		})
+	}
+	return keys
+}
+
+// Render returns a human-readable summary of the inventory
+func (inv Inventory) Render() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d packages (%.2f GiB)\n", inv.Repo, inv.Total.Count, gib(inv.Total.Bytes))
+	for _, dim := range []string{DimSeries, DimDistro, DimArch, DimEdition} {
+		fmt.Fprintf(&b, "  by %s:\n", dim)
+		for _, k := range sortedKeys(dim, inv.Usage[dim]) {
+			u := inv.Usage[dim][k]
+			fmt.Fprintf(&b, "    %-20s %6d %10.2f GiB\n", k, u.Count, gib(u.Bytes))
+		}
+	}
+	if len(inv.Duplicates) > 0 {
+		fmt.Fprintf(&b, "  %d duplicate uploads:\n", len(inv.Duplicates))
+		for _, d := range inv.Duplicates {
+			fmt.Fprintf(&b, "    %s %s %s %s: %s\n", d.DistroVersion, d.Arch, d.Name, d.Version, strings.Join(d.Filenames, ", "))
+		}
+	}
+	return b.String()
+}
+
+func gib(bytes int64) float64 {
+	return float64(bytes) / (1 << 30)
+}
+
+// UsageDelta is the change in usage for one key of a dimension
+// between two reports
+type UsageDelta struct {
+	Repo      string `json:"repo"`
+	Dimension string `json:"dimension"`
+	Key       string `json:"key"`
+	Old       Usage  `json:"old"`
+	New       Usage  `json:"new"`
+}
+
+// LoadReport reads the output of `pkgs report --format json`
+func LoadReport(reportFile string) (Report, error) {
+	var r Report
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("parsing %s: %w", reportFile, err)
+	}
+	return r, nil
+}
+
+// Compare returns the growth since old for every repo in r and every
+// key in either report. Keys whose usage has not changed are omitted
+// but the total for each repo is always included.
+func (r Report) Compare(old Report) []UsageDelta {
+	oldInvs := make(map[string]Inventory)
+	for _, inv := range old.Inventories {
+		oldInvs[inv.Repo] = inv
+	}
+	var deltas []UsageDelta
+	for _, inv := range r.Inventories {
+		prev := oldInvs[inv.Repo]
+		deltas = append(deltas, UsageDelta{inv.Repo, "total", "", prev.Total, inv.Total})
+		for _, dim := range []string{DimSeries, DimDistro, DimArch, DimEdition} {
+			all := maps.Clone(inv.Usage[dim])
+			if all == nil {
+				all = make(map[string]Usage)
+			}
+			maps.Copy(all, prev.Usage[dim])
+			for _, k := range sortedKeys(dim, all) {
+				o, n := prev.Usage[dim][k], inv.Usage[dim][k]
+				if o != n {
+					deltas = append(deltas, UsageDelta{inv.Repo, dim, k, o, n})
+				}
+			}
+		}
+	}
+	return deltas
+}
+
+// RenderGrowth returns a human-readable summary of deltas
+func RenderGrowth(deltas []UsageDelta) string {
+	var b strings.Builder
+	for _, d := range deltas {
+		key := d.Dimension
+		if d.Key != "" {
+			key += " " + d.Key
+		}
+		fmt.Fprintf(&b, "%s %-28s %+6d packages %+10.2f GiB\n", d.Repo, key, d.New.Count-d.Old.Count, gib(d.New.Bytes-d.Old.Bytes))
+	}
+	return b.String()
+}
+
+// WriteCSV writes one row per repo, dimension and key. If the report
+// has been compared, the rows are the growth instead, with the
+// previous usage in extra columns.
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"repo", "dimension", "key", "count", "bytes"}
+	if r.Growth != nil {
+		header = append(header, "prev_count", "prev_bytes")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	row := func(repo, dim, key string, u Usage) []string {
+		return []string{repo, dim, key, strconv.Itoa(u.Count), strconv.FormatInt(u.Bytes, 10)}
+	}
+	if r.Growth != nil {
+		for _, d := range r.Growth {
+			rec := append(row(d.Repo, d.Dimension, d.Key, d.New), strconv.Itoa(d.Old.Count), strconv.FormatInt(d.Old.Bytes, 10))
+			if err := cw.Write(rec); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, inv := range r.Inventories {
+			if err := cw.Write(row(inv.Repo, "total", "", inv.Total)); err != nil {
+				return err
+			}
+			for _, dim := range []string{DimSeries, DimDistro, DimArch, DimEdition} {
+				for _, k := range sortedKeys(dim, inv.Usage[dim]) {
+					if err := cw.Write(row(inv.Repo, dim, k, inv.Usage[dim][k])); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,85 @@
+package pkgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+func reportPkg(name, version, distro, arch, filename, size string) pc.PackageDetail {
+	return pc.PackageDetail{
+		Name:          name,
+		Version:       version,
+		DistroVersion: distro,
+		Arch:          arch,
+		Filename:      filename,
+		Size:          size,
+	}
+}
+
+func TestBuildInventory(t *testing.T) {
+	items := []pc.PackageDetail{
+		reportPkg("tyk-gateway", "5.3.0", "ubuntu/jammy", "amd64", "tyk-gateway_5.3.0_amd64.deb", "100"),
+		reportPkg("tyk-gateway", "5.3.0", "el/9", "x86_64", "tyk-gateway-5.3.0-1.x86_64.rpm", "200"),
+		reportPkg("tyk-gateway", "5.3.0", "el/9", "x86_64", "tyk-gateway-5.3.0-2.x86_64.rpm", "200"),
+		reportPkg("tyk-gateway-ee", "5.4.0~rc1", "el/9", "x86_64", "tyk-gateway-ee-5.4.0~rc1-1.x86_64.rpm", "300"),
+		reportPkg("tyk-gateway-fips", "nightly", "ubuntu/jammy", "arm64", "tyk-gateway-fips_nightly_arm64.deb", "bad"),
+	}
+	inv := BuildInventory("tyk-gateway", items)
+
+	assert.Equal(t, Usage{5, 800}, inv.Total)
+	assert.Equal(t, map[string]Usage{"v5.3": {3, 500}, "v5.4": {1, 300}, nonSemverSeries: {1, 0}}, inv.Usage[DimSeries])
+	assert.Equal(t, map[string]Usage{"ubuntu/jammy": {2, 100}, "el/9": {3, 700}}, inv.Usage[DimDistro])
+	assert.Equal(t, map[string]Usage{"amd64": {1, 100}, "x86_64": {3, 700}, "arm64": {1, 0}}, inv.Usage[DimArch])
+	assert.Equal(t, map[string]Usage{"ce": {3, 500}, "ee": {1, 300}, "fips": {1, 0}}, inv.Usage[DimEdition])
+
+	require.Len(t, inv.Duplicates, 1)
+	d := inv.Duplicates[0]
+	assert.Equal(t, "el/9", d.DistroVersion)
+	assert.Equal(t, int64(400), d.Bytes)
+	assert.Equal(t, []string{"tyk-gateway-5.3.0-1.x86_64.rpm", "tyk-gateway-5.3.0-2.x86_64.rpm"}, d.Filenames)
+
+	assert.Contains(t, inv.Render(), "1 duplicate uploads")
+}
+
+func TestReportCompare(t *testing.T) {
+	old := Report{Inventories: []Inventory{BuildInventory("tyk-gateway", []pc.PackageDetail{
+		reportPkg("tyk-gateway", "5.2.0", "el/9", "x86_64", "tyk-gateway-5.2.0-1.x86_64.rpm", "100"),
+		reportPkg("tyk-gateway", "5.3.0", "el/9", "x86_64", "tyk-gateway-5.3.0-1.x86_64.rpm", "100"),
+	})}}
+	// round trip through the saved form
+	data, err := json.Marshal(old)
+	require.NoError(t, err)
+	old = Report{}
+	require.NoError(t, json.Unmarshal(data, &old))
+
+	cur := Report{Inventories: []Inventory{BuildInventory("tyk-gateway", []pc.PackageDetail{
+		reportPkg("tyk-gateway", "5.3.0", "el/9", "x86_64", "tyk-gateway-5.3.0-1.x86_64.rpm", "100"),
+		reportPkg("tyk-gateway", "5.4.0", "el/9", "x86_64", "tyk-gateway-5.4.0-1.x86_64.rpm", "300"),
+	})}}
+	cur.Growth = cur.Compare(old)
+
+	got := make(map[string][2]Usage)
+	for _, d := range cur.Growth {
+		got[d.Dimension+" "+d.Key] = [2]Usage{d.Old, d.New}
+	}
+	assert.Equal(t, map[string][2]Usage{
+		"total ":      {{2, 200}, {2, 400}},
+		"series v5.2": {{1, 100}, {0, 0}},
+		"series v5.4": {{0, 0}, {1, 300}},
+		"distro el/9": {{2, 200}, {2, 400}},
+		"arch x86_64": {{2, 200}, {2, 400}},
+		"edition ce":  {{2, 200}, {2, 400}},
+	}, got)
+
+	var buf bytes.Buffer
+	require.NoError(t, cur.WriteCSV(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, "repo,dimension,key,count,bytes,prev_count,prev_bytes", lines[0])
+	assert.Contains(t, lines, "tyk-gateway,series,v5.2,0,0,1,100")
+}
@@ -0,0 +1,230 @@
+package pkgs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/mod/semver"
+)
+
+// Actions recorded for each package considered for a restore
+const (
+	RestoreUpload   = "upload"
+	RestoreExists   = "exists"
+	RestoreConflict = "conflict"
+	RestoreCorrupt  = "corrupt"
+	RestoreUploaded = "uploaded"
+	RestoreFailed   = "failed"
+)
+
+// RestoreItem is a package in the backup dir and what restore does with it
+type RestoreItem struct {
+	pc.PackageDetail
+	Action string
+	Reason string
+}
+
+// versionConstraint is a comparison like >=5.0 against a package version
+type versionConstraint struct {
+	op      string
+	version string
+}
+
+// RestoreFilter selects the packages in a backup dir to restore. Terms
+// for the same key are alternatives, all the keys must match.
+type RestoreFilter struct {
+	names       []string
+	distros     []string
+	versions    []string
+	constraints []versionConstraint
+}
+
+// ParseRestoreFilter parses terms of the form name=<glob>,
+// distro=<glob>, version=<glob> or version<op><version> where op is
+// one of >=, <=, > or <. Versions are compared as semver, so
+//
+//	version>=5.0 version<5.3 distro=el/*
+//
+// selects the rpms for the 5.0, 5.1 and 5.2 series.
+func ParseRestoreFilter(terms []string) (RestoreFilter, error) {
+	var f RestoreFilter
+	for _, term := range terms {
+		switch {
+		case strings.HasPrefix(term, "name="):
+			f.names = append(f.names, strings.TrimPrefix(term, "name="))
+		case strings.HasPrefix(term, "distro="):
+			f.distros = append(f.distros, strings.TrimPrefix(term, "distro="))
+		case strings.HasPrefix(term, "version="):
+			f.versions = append(f.versions, strings.TrimPrefix(term, "version="))
+		case strings.HasPrefix(term, "version"):
+			rest := strings.TrimPrefix(term, "version")
+			var c versionConstraint
+			for _, op := range []string{">=", "<=", ">", "<"} {
+				if strings.HasPrefix(rest, op) {
+					c = versionConstraint{op, semverOf(strings.TrimPrefix(rest, op))}
+					break
+				}
+			}
+			if c.op == "" || !semver.IsValid(c.version) {
+				return f, fmt.Errorf("bad version constraint %q", term)
+			}
+			f.constraints = append(f.constraints, c)
+		default:
+			return f, fmt.Errorf("unknown filter %q, expected name=, distro= or version", term)
+		}
+	}
+	for _, glob := range append(append(f.names, f.distros...), f.versions...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return f, fmt.Errorf("bad glob %q: %w", glob, err)
+		}
+	}
+	return f, nil
+}
+
+// semverOf translates a package version to semver
+func semverOf(version string) string {
+	return "v" + strings.NewReplacer("~", "-").Replace(strings.TrimPrefix(version, "v"))
+}
+
+func matchAny(globs []string, s string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether item is selected by the filter. Packages
+// with versions that are not semver never match a version constraint.
+func (f RestoreFilter) Match(item pc.PackageDetail) bool {
+	if !matchAny(f.names, item.Name) || !matchAny(f.distros, item.DistroVersion) || !matchAny(f.versions, item.Version) {
+		return false
+	}
+	v := semverOf(item.Version)
+	for _, c := range f.constraints {
+		if !semver.IsValid(v) {
+			return false
+		}
+		cmp := semver.Compare(v, c.version)
+		ok := false
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case "<=":
+			ok = cmp <= 0
+		case ">":
+			ok = cmp > 0
+		case "<":
+			ok = cmp < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// PlanRestore finds the packages in savedir that match f and decides
+// what to do with each of them by comparing against the live listing
+// of repo. Packages that are already in the repo with the same sha256
+// are skipped, as are packages whose file no longer matches the backup
+// index. Nothing is uploaded.
+func (c *Client) PlanRestore(repo, savedir string, f RestoreFilter) ([]RestoreItem, error) {
+	idx, err := OpenBackupIndex(savedir)
+	if err != nil {
+		return nil, err
+	}
+	indexed := make(map[string]BackupEntry)
+	for _, e := range idx.Entries() {
+		indexed[planKey(e.DistroVersion, e.Filename)] = e
+	}
+
+	live, err := c.ListPackages(repo)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", repo, err)
+	}
+	inRepo := make(map[string]pc.PackageDetail, len(live))
+	for _, item := range live {
+		inRepo[planKey(item.DistroVersion, item.Filename)] = item
+	}
+
+	// the backup dir is laid out as a local store with a repo per package name
+	names, err := os.ReadDir(savedir)
+	if err != nil {
+		return nil, err
+	}
+	src := NewLocalStore(savedir)
+	var items []RestoreItem
+	for _, name := range names {
+		if !name.IsDir() || !matchAny(f.names, name.Name()) {
+			continue
+		}
+		saved, err := listAll(src, name.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range saved {
+			if !f.Match(item) {
+				continue
+			}
+			key := planKey(item.DistroVersion, item.Filename)
+			ri := RestoreItem{PackageDetail: item, Action: RestoreUpload}
+			if e, found := indexed[key]; found && e.Sha256Sum != item.Sha256Sum {
+				ri.Action, ri.Reason = RestoreCorrupt, fmt.Sprintf("index has sha256 %s", e.Sha256Sum)
+			} else if existing, found := inRepo[key]; found {
+				if existing.Sha256Sum == item.Sha256Sum {
+					ri.Action = RestoreExists
+				} else {
+					ri.Action, ri.Reason = RestoreConflict, fmt.Sprintf("repo has sha256 %s", existing.Sha256Sum)
+				}
+			}
+			items = append(items, ri)
+		}
+	}
+	return items, nil
+}
+
+// Restore uploads the items from PlanRestore whose action is upload,
+// one at a time so that the rate limit of the store applies. The
+// returned items record the outcome of each upload.
+func (c *Client) Restore(repo, savedir string, items []RestoreItem) ([]RestoreItem, error) {
+	var failed int
+	done := make([]RestoreItem, len(items))
+	for i, ri := range items {
+		done[i] = ri
+		if ri.Action != RestoreUpload {
+			continue
+		}
+		err := c.upload(repo, savedir, ri.PackageDetail)
+		if err != nil {
+			failed++
+			done[i].Action, done[i].Reason = RestoreFailed, err.Error()
+			log.Error().Err(err).Msgf("restoring %s/%s", ri.DistroVersion, ri.Filename)
+			continue
+		}
+		done[i].Action = RestoreUploaded
+	}
+	if failed > 0 {
+		return done, fmt.Errorf("%d packages could not be restored to %s", failed, repo)
+	}
+	return done, nil
+}
+
+// upload pushes a package from savedir to repo
+func (c *Client) upload(repo, savedir string, item pc.PackageDetail) error {
+	f, err := os.Open(filepath.Join(savedir, filepath.FromSlash(item.PackageURL)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.store.Upload(repo, item, f)
+}
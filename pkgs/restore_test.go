@@ -0,0 +1,114 @@
+package pkgs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/time/rate"
+)
+
+func TestRestoreFilter(t *testing.T) {
+	f, err := ParseRestoreFilter([]string{"name=tyk-*", "version>=5.0", "version<5.3", "distro=el/*", "distro=amazon/*"})
+	require.NoError(t, err)
+	cases := []struct {
+		name, version, distro string
+		match                 bool
+	}{
+		{"tyk-gateway", "5.0.0", "el/9", true},
+		{"tyk-gateway", "5.2.9", "amazon/2", true},
+		{"tyk-gateway", "5.3.0~rc1", "el/9", true}, // prereleases sort before 5.3
+		{"tyk-gateway", "5.3.1", "el/9", false},
+		{"tyk-gateway", "4.9.0", "el/9", false},
+		{"tyk-gateway", "5.1.0", "ubuntu/jammy", false},
+		{"portal", "5.1.0", "el/9", false},
+		{"tyk-gateway", "nightly", "el/9", false},
+	}
+	for _, tc := range cases {
+		item := pc.PackageDetail{Name: tc.name, Version: tc.version, DistroVersion: tc.distro}
+		assert.Equal(t, tc.match, f.Match(item), "%+v", tc)
+	}
+
+	for _, bad := range []string{"arch=amd64", "version~5", "version>=five", "distro=[el"} {
+		_, err := ParseRestoreFilter([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+// TestCleanThenRestore deletes with backups and then restores half of them
+func TestCleanThenRestore(t *testing.T) {
+	root := t.TempDir()
+	savedir := t.TempDir()
+	writeLocalRepo(t, root, "tyk-test", "1.0.0", "2.0.0")
+	c := NewStoreClient(NewLocalStore(root))
+	items, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.NoError(t, c.Clean(items, CleanConfig{Concurrency: 2, Savedir: savedir, Backup: true, Delete: true}))
+	left, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.Empty(t, left)
+
+	f, err := ParseRestoreFilter([]string{"version<2.0"})
+	require.NoError(t, err)
+	plan, err := c.PlanRestore("tyk-test", savedir, f)
+	require.NoError(t, err)
+	require.Len(t, plan, 2)
+	for _, ri := range plan {
+		assert.Equal(t, RestoreUpload, ri.Action)
+		assert.Equal(t, "1.0.0", ri.Version)
+	}
+	done, err := c.Restore("tyk-test", savedir, plan)
+	require.NoError(t, err)
+	for _, ri := range done {
+		assert.Equal(t, RestoreUploaded, ri.Action)
+	}
+
+	restored, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.Len(t, restored, 2)
+	distros := []string{restored[0].DistroVersion, restored[1].DistroVersion}
+	assert.ElementsMatch(t, []string{"el/9", "ubuntu/jammy"}, distros)
+
+	// restoring again finds them in the repo
+	plan, err = c.PlanRestore("tyk-test", savedir, f)
+	require.NoError(t, err)
+	for _, ri := range plan {
+		assert.Equal(t, RestoreExists, ri.Action)
+	}
+}
+
+func TestPackagecloudUpload(t *testing.T) {
+	var uploaded []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/distributions.json":
+			json.NewEncoder(w).Encode(pc.Distributions{
+				Deb: []pc.Distribution{{IndexName: "ubuntu", Versions: []pc.Versions{{ID: 237, IndexName: "jammy"}}}},
+				Rpm: []pc.Distribution{{IndexName: "el", Versions: []pc.Versions{{ID: 240, IndexName: "9"}}}},
+			})
+		case r.Method == "POST" && r.URL.Path == "/api/v1/repos/tyk/tyk-test/packages.json":
+			f, fh, err := r.FormFile("package[package_file]")
+			require.NoError(t, err)
+			body, _ := io.ReadAll(f)
+			uploaded = append(uploaded, strings.Join([]string{r.FormValue("package[distro_version_id]"), fh.Filename, string(body)}, " "))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	s := newPackagecloudStore(context.Background(), srv.URL, "token", "tyk", newRetryTransport(http.DefaultTransport, rate.NewLimiter(rate.Inf, 1)))
+
+	require.NoError(t, s.Upload("tyk-test", pc.PackageDetail{DistroVersion: "el/9", Filename: "tyk-1.0-1.x86_64.rpm"}, strings.NewReader("rpm")))
+	require.NoError(t, s.Upload("tyk-test", pc.PackageDetail{DistroVersion: "ubuntu/jammy", Filename: "tyk_1.0_amd64.deb"}, strings.NewReader("deb")))
+	assert.Error(t, s.Upload("tyk-test", pc.PackageDetail{DistroVersion: "ubuntu/warty", Filename: "tyk_1.0_amd64.deb"}, strings.NewReader("deb")))
+	assert.Error(t, s.Upload("tyk-test", pc.PackageDetail{DistroVersion: "el/9", Filename: "tyk.tar.gz"}, strings.NewReader("tgz")))
+	assert.Equal(t, []string{"240 tyk-1.0-1.x86_64.rpm rpm", "237 tyk_1.0_amd64.deb deb"}, uploaded)
+}
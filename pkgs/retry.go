@@ -0,0 +1,147 @@
+package pkgs
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Defaults for retryTransport
+const (
+	defaultMaxRetries = 5
+	defaultBaseDelay  = 500 * time.Millisecond
+	defaultMaxDelay   = 30 * time.Second
+	// maxRetryAfter caps how long a Retry-After header can make us wait
+	maxRetryAfter = 5 * time.Minute
+)
+
+// retryTransport is an http.RoundTripper that rate limits every
+// attempt and retries idempotent requests that fail with a transport
+// error or a status that is likely to be transient. Waits use
+// exponential backoff with full jitter, unless the server asks for a
+// longer wait with Retry-After. Requests that are not idempotent, like
+// uploads, are attempted exactly once.
+type retryTransport struct {
+	base       http.RoundTripper
+	limiter    *rate.Limiter
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	// sleep waits for d or until ctx is done
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(base http.RoundTripper, limiter *rate.Limiter) *retryTransport {
+	return &retryTransport{
+		base:       base,
+		limiter:    limiter,
+		maxRetries: defaultMaxRetries,
+		baseDelay:  defaultBaseDelay,
+		maxDelay:   defaultMaxDelay,
+		sleep:      sleepCtx,
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// idempotent requests can be sent again without changing the outcome
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// retryable statuses are the ones packagecloud and its proxies return
+// under load
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff is the wait before retry number attempt, starting at 0
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := t.maxDelay
+	if attempt < 32 {
+		ceiling = min(t.baseDelay<<attempt, t.maxDelay)
+	}
+	return rand.N(ceiling) + 1
+}
+
+// retryAfter parses the Retry-After header, which is either a number
+// of seconds or an http date
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		d = at.Sub(now)
+	}
+	return max(0, min(d, maxRetryAfter))
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retries := 0
+	if idempotent(req) {
+		retries = t.maxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		if err := t.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		var wait time.Duration
+		switch {
+		case err != nil:
+			log.Debug().Err(err).Msgf("%s %s attempt %d", req.Method, req.URL, attempt+1)
+			wait = t.backoff(attempt)
+		case retryable(resp.StatusCode):
+			log.Debug().Msgf("%s %s attempt %d: %s", req.Method, req.URL, attempt+1, resp.Status)
+			wait = max(t.backoff(attempt), retryAfter(resp, time.Now()))
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		if err := t.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package pkgs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pc "github.com/tyklabs/packagecloud/api/v1"
+	"golang.org/x/time/rate"
+)
+
+// flakyServer fails the first failures requests to each path with status
+type flakyServer struct {
+	mu         sync.Mutex
+	failures   int
+	status     int
+	retryAfter string
+	hits       map[string]int
+}
+
+func (f *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	key := r.Method + " " + r.URL.Path
+	f.hits[key]++
+	n := f.hits[key]
+	f.mu.Unlock()
+	if n <= f.failures {
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		http.Error(w, "try later", f.status)
+		return
+	}
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/packages.json"):
+		io.WriteString(w, `[{"name":"tyk","filename":"tyk_1.0_amd64.deb"}]`)
+	case r.Method == "GET":
+		io.WriteString(w, "package contents")
+	case r.Method == "DELETE":
+		io.WriteString(w, "{}")
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// testStore returns a store for srv whose transport records the waits
+// instead of sleeping
+func testStore(srv *httptest.Server) (*packagecloudStore, *[]time.Duration) {
+	var waits []time.Duration
+	rt := newRetryTransport(http.DefaultTransport, rate.NewLimiter(rate.Inf, 1))
+	rt.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return newPackagecloudStore(context.Background(), srv.URL, "token", "tyk", rt), &waits
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		fs := &flakyServer{failures: 3, status: status, hits: make(map[string]int)}
+		srv := httptest.NewServer(fs)
+		s, waits := testStore(srv)
+
+		items, _, err := s.ListPage("tyk-test", "")
+		require.NoError(t, err, status)
+		assert.Len(t, items, 1)
+
+		item := pc.PackageDetail{DownloadURL: srv.URL + "/tyk_1.0_amd64.deb", DestroyURL: "/api/v1/repos/tyk/tyk-test/tyk_1.0_amd64.deb"}
+		var buf strings.Builder
+		require.NoError(t, s.Download(item, &buf), status)
+		assert.Equal(t, "package contents", buf.String())
+		require.NoError(t, s.Delete(item), status)
+
+		assert.Equal(t, map[string]int{
+			"GET /api/v1/repos/tyk/tyk-test/packages.json":        4,
+			"GET /tyk_1.0_amd64.deb":                              4,
+			"DELETE /api/v1/repos/tyk/tyk-test/tyk_1.0_amd64.deb": 4,
+		}, fs.hits, status)
+		assert.Len(t, *waits, 9)
+		srv.Close()
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	fs := &flakyServer{failures: 100, status: http.StatusBadGateway, hits: make(map[string]int)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	s, waits := testStore(srv)
+
+	_, _, err := s.ListPage("tyk-test", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "502")
+	assert.Equal(t, defaultMaxRetries+1, fs.hits["GET /api/v1/repos/tyk/tyk-test/packages.json"])
+	// backoff grows but stays within the ceiling for each attempt
+	require.Len(t, *waits, defaultMaxRetries)
+	for i, w := range *waits {
+		assert.LessOrEqual(t, w, min(defaultBaseDelay<<i, defaultMaxDelay))
+		assert.Positive(t, w)
+	}
+}
+
+func TestUploadNotRetried(t *testing.T) {
+	fs := &flakyServer{failures: 1, status: http.StatusServiceUnavailable, hits: make(map[string]int)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	s, waits := testStore(srv)
+	s.distrosOnce.Do(func() {
+		s.distros.Deb = []pc.Distribution{{IndexName: "ubuntu", Versions: []pc.Versions{{ID: 1, IndexName: "jammy"}}}}
+	})
+
+	err := s.Upload("tyk-test", pc.PackageDetail{DistroVersion: "ubuntu/jammy", Filename: "tyk_1.0_amd64.deb"}, strings.NewReader("deb"))
+	require.Error(t, err)
+	assert.Equal(t, 1, fs.hits["POST /api/v1/repos/tyk/tyk-test/packages.json"])
+	assert.Empty(t, *waits)
+}
+
+func TestRetryAfter(t *testing.T) {
+	fs := &flakyServer{failures: 1, status: http.StatusTooManyRequests, retryAfter: "120", hits: make(map[string]int)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	s, waits := testStore(srv)
+
+	_, _, err := s.ListPage("tyk-test", "")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{120 * time.Second}, *waits)
+
+	now := time.Date(2026, 8, 17, 0, 0, 0, 0, time.UTC)
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", now.Add(time.Minute).Format(http.TimeFormat))
+	assert.Equal(t, time.Minute, retryAfter(resp, now))
+	resp.Header.Set("Retry-After", "86400")
+	assert.Equal(t, maxRetryAfter, retryAfter(resp, now))
+	resp.Header.Set("Retry-After", "soon")
+	assert.Zero(t, retryAfter(resp, now))
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	fs := &flakyServer{failures: 100, status: http.StatusServiceUnavailable, hits: make(map[string]int)}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+	s, _ := testStore(srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	s.client.Transport.(*retryTransport).sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return sleepCtx(ctx, d)
+	}
+
+	_, _, err := s.ListPage("tyk-test", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+	assert.Equal(t, 1, fs.hits["GET /api/v1/repos/tyk/tyk-test/packages.json"])
+}
+
+// TestGetTransportError used to panic on the nil response
+func TestGetTransportError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	s, waits := testStore(srv)
+	srv.Close()
+
+	_, _, err := s.ListPage("tyk-test", "")
+	require.Error(t, err)
+	assert.Len(t, *waits, defaultMaxRetries)
+}
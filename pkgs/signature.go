@@ -0,0 +1,243 @@
+package pkgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/TykTechnologies/gromit/util"
+)
+
+// Outcomes of a signature check
+const (
+	SigValid      = "valid"
+	SigUnsigned   = "unsigned"
+	SigUnknownKey = "unknown_key"
+	SigBad        = "bad"
+)
+
+// Kinds of signature that CheckSignature understands
+const (
+	SigDetached = "detached"
+	SigDeb      = "deb"
+	SigRPM      = "rpm"
+)
+
+// SignatureCheck is the outcome of checking the signature of a package
+type SignatureCheck struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// KeyID is the issuer of the signature, in hex, even if it did not verify
+	KeyID string `json:"key_id,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+	Err   string `json:"error,omitempty"`
+}
+
+// errUnsigned is returned by the signature extractors when the package
+// has no signature of their kind
+var errUnsigned = errors.New("no signature found")
+
+// CheckSignature verifies the signature of the package at fpath against
+// kr. A detached signature in fpath.asc or fpath.sig is preferred,
+// otherwise the signature embedded in the package is used: the
+// _gpgorigin member that debsigs adds to debs, or the header or
+// header+payload signature in the signature header of rpms.
+func CheckSignature(kr openpgp.KeyRing, fpath string) SignatureCheck {
+	sc := SignatureCheck{Path: fpath}
+	f, err := os.Open(fpath)
+	if err != nil {
+		sc.Status, sc.Err = SigBad, err.Error()
+		return sc
+	}
+	defer f.Close()
+
+	var signed io.Reader
+	var sig []byte
+	for _, ext := range []string{".asc", ".sig"} {
+		if sig, err = os.ReadFile(fpath + ext); err == nil {
+			sc.Kind, signed = SigDetached, f
+			break
+		}
+	}
+	if sc.Kind == "" {
+		switch {
+		case strings.HasSuffix(fpath, ".deb"):
+			sc.Kind = SigDeb
+			signed, sig, err = debSignature(f)
+		case strings.HasSuffix(fpath, ".rpm"):
+			sc.Kind = SigRPM
+			signed, sig, err = rpmSignature(f)
+		default:
+			err = errUnsigned
+		}
+		switch {
+		case errors.Is(err, errUnsigned):
+			sc.Status = SigUnsigned
+			return sc
+		case err != nil:
+			sc.Status, sc.Err = SigBad, err.Error()
+			return sc
+		}
+	}
+
+	keyID, err := util.VerifyDetachedSignature(kr, signed, sig)
+	if keyID != 0 {
+		sc.KeyID = fmt.Sprintf("%016X", keyID)
+	}
+	switch {
+	case err == nil:
+		sc.Status = SigValid
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		sc.Status, sc.Err = SigUnknownKey, err.Error()
+	default:
+		sc.Status, sc.Err = SigBad, err.Error()
+	}
+	return sc
+}
+
+// arMember is a file in an ar archive
+type arMember struct {
+	name   string
+	offset int64
+	size   int64
+}
+
+// arMembers lists the files in the ar archive r, which is how debs are packaged
+func arMembers(r io.ReaderAt) ([]arMember, error) {
+	magic := make([]byte, 8)
+	if _, err := r.ReadAt(magic, 0); err != nil || string(magic) != "!<arch>\n" {
+		return nil, errors.New("not an ar archive")
+	}
+	var members []arMember
+	hdr := make([]byte, 60)
+	for off := int64(8); ; {
+		_, err := r.ReadAt(hdr, off)
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading ar header at %d: %w", off, err)
+		}
+		if string(hdr[58:60]) != "`\n" {
+			return nil, fmt.Errorf("bad ar header at %d", off)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad ar member size at %d: %w", off, err)
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[:16])), "/")
+		members = append(members, arMember{name, off + 60, size})
+		// members are aligned on even offsets
+		off += 60 + size + size%2
+	}
+}
+
+// debSignature returns the data signed by debsigs, which is the
+// concatenation of debian-binary, control.tar.* and data.tar.*, and
+// the _gpgorigin signature over it
+func debSignature(f *os.File) (io.Reader, []byte, error) {
+	members, err := arMembers(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	var parts []io.Reader
+	var sig []byte
+	for _, m := range members {
+		switch {
+		case m.name == "_gpgorigin":
+			sig = make([]byte, m.size)
+			if _, err := f.ReadAt(sig, m.offset); err != nil {
+				return nil, nil, fmt.Errorf("reading _gpgorigin: %w", err)
+			}
+		case m.name == "debian-binary", strings.HasPrefix(m.name, "control.tar"), strings.HasPrefix(m.name, "data.tar"):
+			parts = append(parts, io.NewSectionReader(f, m.offset, m.size))
+		}
+	}
+	if sig == nil {
+		return nil, nil, errUnsigned
+	}
+	return io.MultiReader(parts...), sig, nil
+}
+
+// rpm layout, see https://rpm-software-management.github.io/rpm/manual/format.html
+const (
+	rpmLeadSize = 96
+	// rpmSigTagRSA and rpmSigTagDSA sign the main header
+	rpmSigTagDSA = 267
+	rpmSigTagRSA = 268
+	// rpmSigTagPGP and rpmSigTagGPG sign the main header and the payload
+	rpmSigTagPGP = 1002
+	rpmSigTagGPG = 1005
+)
+
+var rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+
+// rpmHeader reads the header structure at off in f, returning its raw
+// bytes and its tags
+func rpmHeader(f io.ReaderAt, off int64) ([]byte, map[uint32][]byte, error) {
+	intro := make([]byte, 16)
+	if _, err := f.ReadAt(intro, off); err != nil {
+		return nil, nil, fmt.Errorf("reading rpm header at %d: %w", off, err)
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, nil, fmt.Errorf("bad rpm header magic at %d", off)
+	}
+	nindex := int64(binary.BigEndian.Uint32(intro[8:12]))
+	hsize := int64(binary.BigEndian.Uint32(intro[12:16]))
+	if nindex > 1<<16 || hsize > 1<<28 {
+		return nil, nil, fmt.Errorf("rpm header at %d is too large", off)
+	}
+	raw := make([]byte, 16+nindex*16+hsize)
+	if _, err := f.ReadAt(raw, off); err != nil {
+		return nil, nil, fmt.Errorf("reading rpm header at %d: %w", off, err)
+	}
+	store := raw[16+nindex*16:]
+	tags := make(map[uint32][]byte)
+	for i := range nindex {
+		entry := raw[16+i*16 : 32+i*16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		offset := int64(binary.BigEndian.Uint32(entry[8:12]))
+		count := int64(binary.BigEndian.Uint32(entry[12:16]))
+		// signatures are BIN entries, where count is the length
+		if offset+count <= hsize {
+			tags[tag] = store[offset : offset+count]
+		}
+	}
+	return raw, tags, nil
+}
+
+// rpmSignature returns the data signed by the OpenPGP signature in the
+// signature header of the rpm in f and the signature. Header-only
+// signatures are preferred as rpm >= 4.14 does not add the others.
+func rpmSignature(f *os.File) (io.Reader, []byte, error) {
+	sigHdr, sigTags, err := rpmHeader(f, rpmLeadSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the main header is aligned on 8 bytes
+	hdrOff := int64(rpmLeadSize + len(sigHdr))
+	hdrOff += (8 - hdrOff%8) % 8
+	hdr, _, err := rpmHeader(f, hdrOff)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, tag := range []uint32{rpmSigTagRSA, rpmSigTagDSA} {
+		if sig, found := sigTags[tag]; found {
+			return bytes.NewReader(hdr), sig, nil
+		}
+	}
+	for _, tag := range []uint32{rpmSigTagPGP, rpmSigTagGPG} {
+		if sig, found := sigTags[tag]; found {
+			payload := io.NewSectionReader(f, hdrOff+int64(len(hdr)), 1<<62)
+			return io.MultiReader(bytes.NewReader(hdr), payload), sig, nil
+		}
+	}
+	return nil, nil, errUnsigned
+}
@@ -0,0 +1,178 @@
+package pkgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	require.NoError(t, err)
+	return e
+}
+
+func detachSign(t *testing.T, e *openpgp.Entity, data []byte) []byte {
+	t.Helper()
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.DetachSign(&sig, e, bytes.NewReader(data), nil))
+	return sig.Bytes()
+}
+
+// buildDeb returns an ar archive like a deb, signed by e with debsigs
+// if e is not nil
+func buildDeb(t *testing.T, e *openpgp.Entity, data string) []byte {
+	t.Helper()
+	members := []struct{ name, body string }{
+		{"debian-binary", "2.0\n"},
+		{"control.tar.gz", "control"},
+		{"data.tar.xz", data},
+	}
+	var signed []byte
+	for _, m := range members {
+		signed = append(signed, m.body...)
+	}
+	if e != nil {
+		members = append(members, struct{ name, body string }{"_gpgorigin", string(detachSign(t, e, signed))})
+	}
+	deb := bytes.NewBufferString("!<arch>\n")
+	for _, m := range members {
+		fmt.Fprintf(deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name, 0, 0, 0, "100644", len(m.body))
+		deb.WriteString(m.body)
+		if len(m.body)%2 == 1 {
+			deb.WriteByte('\n')
+		}
+	}
+	return deb.Bytes()
+}
+
+// rpmHeaderBytes encodes one BIN entry for tag as an rpm header structure
+func rpmHeaderBytes(tag uint32, value []byte) []byte {
+	var h bytes.Buffer
+	h.Write(rpmHeaderMagic)
+	binary.Write(&h, binary.BigEndian, []uint32{0, 1, uint32(len(value))})
+	binary.Write(&h, binary.BigEndian, []uint32{tag, 7, 0, uint32(len(value))})
+	h.Write(value)
+	return h.Bytes()
+}
+
+// buildRPM returns a minimal rpm whose signature header carries a
+// signature by e under sigTag, unless e is nil
+func buildRPM(t *testing.T, e *openpgp.Entity, sigTag uint32, payload string) []byte {
+	t.Helper()
+	hdr := rpmHeaderBytes(1000, []byte("tyk-test\x00"))
+	var sigHdr []byte
+	switch {
+	case e == nil:
+		sigHdr = rpmHeaderBytes(1004, []byte("md5sum"))
+	case sigTag == rpmSigTagPGP:
+		sigHdr = rpmHeaderBytes(sigTag, detachSign(t, e, append(bytes.Clone(hdr), payload...)))
+	default:
+		sigHdr = rpmHeaderBytes(sigTag, detachSign(t, e, hdr))
+	}
+	rpm := make([]byte, rpmLeadSize)
+	rpm = append(rpm, sigHdr...)
+	for len(rpm)%8 != 0 {
+		rpm = append(rpm, 0)
+	}
+	rpm = append(rpm, hdr...)
+	return append(rpm, payload...)
+}
+
+func TestCheckSignature(t *testing.T) {
+	signer := testEntity(t, "release")
+	stranger := testEntity(t, "stranger")
+	kr := openpgp.EntityList{signer}
+	keyID := fmt.Sprintf("%016X", signer.PrimaryKey.KeyId)
+	strangerID := fmt.Sprintf("%016X", stranger.PrimaryKey.KeyId)
+
+	goodDeb := buildDeb(t, signer, "contents")
+	tamperedDeb := bytes.Replace(bytes.Clone(goodDeb), []byte("contents"), []byte("c0ntents"), 1)
+	goodRPM := buildRPM(t, signer, rpmSigTagRSA, "payload")
+	tamperedRPM := bytes.Replace(bytes.Clone(goodRPM), []byte("tyk-test\x00"), []byte("tyk-evil\x00"), 1)
+	goodPGP := buildRPM(t, signer, rpmSigTagPGP, "payload")
+	tamperedPGP := bytes.Replace(bytes.Clone(goodPGP), []byte("payload"), []byte("payl0ad"), 1)
+
+	cases := []struct {
+		fname    string
+		contents []byte
+		detached []byte
+		status   string
+		kind     string
+		keyID    string
+	}{
+		{"good.deb", goodDeb, nil, SigValid, SigDeb, keyID},
+		{"tampered.deb", tamperedDeb, nil, SigBad, SigDeb, keyID},
+		{"unsigned.deb", buildDeb(t, nil, "data"), nil, SigUnsigned, SigDeb, ""},
+		{"stranger.deb", buildDeb(t, stranger, "data"), nil, SigUnknownKey, SigDeb, strangerID},
+		{"good.rpm", goodRPM, nil, SigValid, SigRPM, keyID},
+		{"tampered.rpm", tamperedRPM, nil, SigBad, SigRPM, keyID},
+		{"good-pgp.rpm", goodPGP, nil, SigValid, SigRPM, keyID},
+		{"tampered-pgp.rpm", tamperedPGP, nil, SigBad, SigRPM, keyID},
+		{"unsigned.rpm", buildRPM(t, nil, 0, "payload"), nil, SigUnsigned, SigRPM, ""},
+		{"detached.rpm", []byte("not an rpm"), detachSign(t, signer, []byte("not an rpm")), SigValid, SigDetached, keyID},
+		{"detached-bad.deb", []byte("not a deb"), detachSign(t, signer, []byte("not a dab")), SigBad, SigDetached, keyID},
+		{"garbage.deb", []byte("not a deb"), nil, SigBad, SigDeb, ""},
+	}
+	dir := t.TempDir()
+	for _, tc := range cases {
+		fpath := filepath.Join(dir, tc.fname)
+		require.NoError(t, os.WriteFile(fpath, tc.contents, 0644))
+		if tc.detached != nil {
+			require.NoError(t, os.WriteFile(fpath+".sig", tc.detached, 0644))
+		}
+		sc := CheckSignature(kr, fpath)
+		assert.Equal(t, tc.status, sc.Status, tc.fname)
+		assert.Equal(t, tc.kind, sc.Kind, tc.fname)
+		assert.Equal(t, tc.keyID, sc.KeyID, tc.fname)
+		if tc.status != SigValid && tc.status != SigUnsigned {
+			assert.NotEmpty(t, sc.Err, tc.fname)
+		}
+	}
+}
+
+func TestCleanChecksSignatures(t *testing.T) {
+	signer := testEntity(t, "release")
+	root := t.TempDir()
+	dir := filepath.Join(root, "tyk-test", "ubuntu", "jammy")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tyk-test_1.0.0_amd64.deb"), buildDeb(t, signer, "data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tyk-test_1.0.1_amd64.deb"), buildDeb(t, nil, "data"), 0644))
+
+	c := NewStoreClient(NewLocalStore(root))
+	items, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	savedir := t.TempDir()
+	require.NoError(t, c.Clean(items, CleanConfig{
+		Concurrency: 1,
+		Savedir:     savedir,
+		Backup:      true,
+		Delete:      true,
+		Keyring:     openpgp.EntityList{signer},
+	}))
+
+	left, err := c.ListPackages("tyk-test")
+	require.NoError(t, err)
+	require.Len(t, left, 1)
+	assert.Equal(t, "1.0.1", left[0].Version)
+
+	idx, err := OpenBackupIndex(savedir)
+	require.NoError(t, err)
+	keyIDs := make(map[string]string)
+	for _, e := range idx.Entries() {
+		keyIDs[e.Version] = e.SigningKeyID
+	}
+	assert.Equal(t, map[string]string{
+		"1.0.0": fmt.Sprintf("%016X", signer.PrimaryKey.KeyId),
+		"1.0.1": "",
+	}, keyIDs)
+}
@@ -0,0 +1,30 @@
+package pkgs
+
+import (
+	"io"
+
+	pc "github.com/tyklabs/packagecloud/api/v1"
+)
+
+// PackageStore is a repository of binary packages. Packages are
+// described by pc.PackageDetail whatever the backend, each
+// implementation fills in the fields that it can. Name, Version,
+// Arch, DistroVersion, Filename, Size, Sha256Sum and CreateTime must
+// always be set as retention and backups depend on them.
+type PackageStore interface {
+	// ListPage returns one page of the packages in repo. The first
+	// page is fetched with an empty page token and an empty next
+	// token means there are no more pages.
+	ListPage(repo, page string) (items []pc.PackageDetail, next string, err error)
+	// Download writes the contents of item to w
+	Download(item pc.PackageDetail, w io.Writer) error
+	// Upload adds a package to repo, reading its contents from r.
+	// Only the DistroVersion and Filename of item are used.
+	Upload(repo string, item pc.PackageDetail, r io.Reader) error
+	// Delete removes item from its repo permanently
+	Delete(item pc.PackageDetail) error
+	// Size returns the size of item in bytes
+	Size(item pc.PackageDetail) (int64, error)
+	// Checksum returns the hex encoded sha256 of item
+	Checksum(item pc.PackageDetail) (string, error)
+}
@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// MaxMatrixJobs is the limit github imposes on the number of jobs a
+// matrix can generate
+const MaxMatrixJobs = 256
+
+// testExclusions mirrors the exclude block of strategy.matrix in
+// subtemplates/auto/auto-test.gotmpl. It only applies when both the
+// pump and sink dimensions are present.
+var testExclusions = []map[string]string{
+	{"pump": "tykio/tyk-pump-docker-pub:v1.8", "sink": "$ECR/tyk-sink:master"},
+	{"pump": "$ECR/tyk-pump:master", "sink": "tykio/tyk-mdcb-docker:v2.4"},
+}
+
+// matrixJob is one combination from the expansion of a ghMatrix
+type matrixJob struct {
+	EnvFiles envFile `json:"envfiles"`
+	Pump     string  `json:"pump,omitempty"`
+	Sink     string  `json:"sink,omitempty"`
+}
+
+// value returns the value of the matrix dimension named key
+func (j matrixJob) value(key string) (string, bool) {
+	switch key {
+	case "pump":
+		return j.Pump, true
+	case "sink":
+		return j.Sink, true
+	}
+	return "", false
+}
+
+// excludedBy implements the github semantics for exclude: a job is
+// excluded if every key in an exclusion matches
+func (j matrixJob) excludedBy(exclusion map[string]string) bool {
+	for k, v := range exclusion {
+		jv, found := j.value(k)
+		if !found || jv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matrixExpansion is the concrete set of jobs that github will run for a strategy.matrix
+type matrixExpansion struct {
+	Path       variationPath
+	Rule       string
+	Jobs       []matrixJob
+	Excluded   []matrixJob
+	Duplicates []matrixJob
+	// Empty are the dimensions used for the repo that have no values,
+	// any one of them leaves the matrix without jobs
+	Empty []string
+}
+
+// Warnings returns the problems with the expansion that should be
+// fixed before it reaches CI
+func (e matrixExpansion) Warnings() []string {
+	var warnings []string
+	for _, dim := range e.Empty {
+		warnings = append(warnings, fmt.Sprintf("%s has no values, so there are no jobs", dim))
+	}
+	if len(e.Jobs) > MaxMatrixJobs {
+		warnings = append(warnings, fmt.Sprintf("%d jobs exceeds the github limit of %d", len(e.Jobs), MaxMatrixJobs))
+	}
+	for _, d := range e.Duplicates {
+		warnings = append(warnings, fmt.Sprintf("duplicate combination %+v", d))
+	}
+	return warnings
+}
+
+// expand computes the cartesian product of the dimensions in m that are
+// used by the test job for repo, in the order github generates them,
+// and then applies the exclusions. The pump dimension is not used for
+// tyk-pump and the sink dimension is not used for tyk-sink.
+func (m ghMatrix) expand(repo string) matrixExpansion {
+	var e matrixExpansion
+	pumps := []string{""}
+	if repo != "tyk-pump" {
+		pumps = m.Pump
+	}
+	sinks := []string{""}
+	if repo != "tyk-sink" {
+		sinks = m.Sink
+	}
+	for dim, values := range map[string][]string{"pump": pumps, "sink": sinks} {
+		if len(values) == 0 {
+			e.Empty = append(e.Empty, dim)
+		}
+	}
+	if len(m.EnvFiles) == 0 {
+		e.Empty = append(e.Empty, "envfiles")
+	}
+	slices.Sort(e.Empty)
+	var exclusions []map[string]string
+	if repo != "tyk-pump" && repo != "tyk-sink" {
+		exclusions = testExclusions
+	}
+
+	seen := make(map[matrixJob]bool)
+	for _, ef := range m.EnvFiles {
+		for _, pump := range pumps {
+			for _, sink := range sinks {
+				job := matrixJob{EnvFiles: ef, Pump: pump, Sink: sink}
+				excluded := false
+				for _, x := range exclusions {
+					if job.excludedBy(x) {
+						excluded = true
+						break
+					}
+				}
+				if excluded {
+					e.Excluded = append(e.Excluded, job)
+					continue
+				}
+				if seen[job] {
+					e.Duplicates = append(e.Duplicates, job)
+				}
+				seen[job] = true
+				e.Jobs = append(e.Jobs, job)
+			}
+		}
+	}
+	return e
+}
+
+// ExpandMatrix loads the test variation tsv from configDir and returns
+// the jobs that github would run for the given path
+func ExpandMatrix(configDir, tsv, repo, branch, trigger, testsuite string) (*matrixExpansion, error) {
+	tvFile := filepath.Join(configDir, tsv+"s.yml")
+	v, err := loadVariation(tvFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", tvFile, err)
+	}
+	res, err := v.Resolve(repo, branch, trigger, testsuite)
+	if err != nil {
+		return nil, err
+	}
+	e := res.Matrix.expand(repo)
+	e.Path = res.Path
+	e.Rule = res.Rule
+	return &e, nil
+}
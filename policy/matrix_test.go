@@ -0,0 +1,51 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatrixExpand(t *testing.T) {
+	m := ghMatrix{
+		EnvFiles: []envFile{{Cache: "redis7"}, {Cache: "valkey8"}, {Cache: "redis7"}},
+		Pump:     []string{"tykio/tyk-pump-docker-pub:v1.8", "$ECR/tyk-pump:master"},
+		Sink:     []string{"tykio/tyk-mdcb-docker:v2.4", "$ECR/tyk-sink:master"},
+	}
+
+	e := m.expand("tyk")
+	assert.Len(t, e.Jobs, 6, "3 envfiles × 2 pumps × 2 sinks minus 2 exclusions per envfile")
+	assert.Len(t, e.Excluded, 6)
+	for _, job := range e.Jobs {
+		for _, x := range testExclusions {
+			assert.False(t, job.excludedBy(x), "%+v should have been excluded", job)
+		}
+	}
+	require.Len(t, e.Duplicates, 2)
+	assert.Equal(t, "redis7", e.Duplicates[0].EnvFiles.Cache)
+	assert.Len(t, e.Warnings(), 2)
+
+	e = m.expand("tyk-pump")
+	assert.Len(t, e.Jobs, 6, "pump dimension and exclusions are not used for tyk-pump")
+	assert.Empty(t, e.Excluded)
+	for _, job := range e.Jobs {
+		assert.Empty(t, job.Pump)
+	}
+
+	noSinks := ghMatrix{EnvFiles: m.EnvFiles, Pump: m.Pump}
+	e = noSinks.expand("tyk")
+	assert.Empty(t, e.Jobs)
+	assert.Equal(t, []string{"sink has no values, so there are no jobs"}, e.Warnings())
+	e = noSinks.expand("tyk-sink")
+	assert.Len(t, e.Jobs, 6, "the sink dimension is not used for tyk-sink")
+	assert.Empty(t, e.Empty)
+
+	big := ghMatrix{Pump: []string{"p"}, Sink: []string{"s"}}
+	for i := 0; i < MaxMatrixJobs+1; i++ {
+		big.EnvFiles = append(big.EnvFiles, envFile{Cache: "redis", DB: string(rune('a' + i%26)), Config: string(rune('a' + i/26))})
+	}
+	e = big.expand("tyk")
+	assert.Empty(t, e.Duplicates)
+	assert.Equal(t, []string{"257 jobs exceeds the github limit of 256"}, e.Warnings())
+}
@@ -250,6 +250,16 @@ func (rp *RepoPolicy) GetAllBranches() []string {
 	return slices.Sorted(maps.Keys(rp.Branches))
 }
 
+// GetAllRepos returns all the repos that are managed, across all groups
+func (p *Policies) GetAllRepos() []string {
+	var repos []string
+	for _, grp := range p.Groups {
+		repos = append(repos, slices.Collect(maps.Keys(grp.Repos))...)
+	}
+	slices.Sort(repos)
+	return repos
+}
+
 // GetRepoPolicy will fetch the RepoPolicy for the supplied repo with
 // all overrides (group, repo, branch levels) processed. This is the
 // constructor for RepoPolicy.
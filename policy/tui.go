@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -20,14 +21,23 @@ var indexTemplateFS embed.FS
 //go:embed app/static/*
 var staticFS embed.FS
 
-// GenerateStatic generates static files for the TUI
-func GenerateStatic(configDir, outDir string) error {
+// GenerateStatic generates static files for the TUI. If fallbacks is
+// not empty, it replaces the default fallback chain for lookups. With
+// pol, the branches managed for each repo that have no variation of
+// their own are also generated from the rule that resolves them.
+func GenerateStatic(pol *Policies, configDir, outDir string, fallbacks []string) error {
 	av, err := loadAllVariations(configDir)
 	if err != nil {
 		return fmt.Errorf("loading variations from %s: %w", configDir, err)
 	}
 
 	for filename, v := range av {
+		if len(fallbacks) > 0 {
+			if err := v.SetFallbacks(fallbacks); err != nil {
+				return err
+			}
+			av[filename] = v
+		}
 		// Determine tsv name: strip .yml/.yaml and trailing s
 		tsv := strings.TrimSuffix(filename, ".yaml")
 		tsv = strings.TrimSuffix(tsv, ".yml")
@@ -39,71 +49,129 @@ func GenerateStatic(configDir, outDir string) error {
 			return err
 		}
 
-		for _, path := range v.Paths {
-			repo := path.Repo
-			branch := path.Branch
-			trigger := path.Trigger
-			ts := path.Testsuite
-
-			m := v.Lookup(repo, branch, trigger, ts)
-			if m == nil {
+		for _, path := range v.Paths() {
+			res, err := v.Resolve(path.Repo, path.Branch, path.Trigger, path.Testsuite)
+			if err != nil {
+				return err
+			}
+			if err := writeResolution(outDir, tsv, path, res); err != nil {
+				return err
+			}
+		}
+		for _, path := range managedPaths(v, pol) {
+			res, err := v.Resolve(path.Repo, path.Branch, path.Trigger, path.Testsuite)
+			if errors.Is(err, ErrNoVariation) {
 				continue
 			}
-
-			// Generate v2/{tsv}/{repo}/{branch}/{trigger}/{ts}.gho
-			ghoPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts+".gho")
-			if err := writeGHO(ghoPath, *m); err != nil {
+			if err != nil {
 				return err
 			}
+			if err := writeResolution(outDir, tsv, path, res); err != nil {
+				return err
+			}
+		}
+	}
 
-			// Iterate over fields of ghMatrix
-			val := reflect.ValueOf(*m)
-			typ := val.Type()
-
-			for i := 0; i < typ.NumField(); i++ {
-				field := typ.Field(i)
-				fieldValue := val.Field(i)
-				jsonTag := field.Tag.Get("json")
-				if jsonTag == "" || jsonTag == "-" {
-					continue
-				}
-				fieldJSONPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, jsonTag+".json")
-				if err := writeJSON(fieldJSONPath, fieldValue.Interface()); err != nil {
-					return err
-				}
-				fieldJSONPathStruct := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, field.Name+".json")
-				if err := writeJSON(fieldJSONPathStruct, fieldValue.Interface()); err != nil {
-					return err
-				}
-
-				// Generate v2/{tsv}/{repo}/{branch}/{trigger}/{ts}/{field}.gho
-				fieldGHOPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, jsonTag+".gho")
-				if err := writeFieldGHO(fieldGHOPath, jsonTag, fieldValue.Interface()); err != nil {
-					return err
-				}
-				fieldGHOPathStruct := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, field.Name+".gho")
-				if err := writeFieldGHO(fieldGHOPathStruct, jsonTag, fieldValue.Interface()); err != nil {
-					return err
-				}
+	if err := generateIndex(av, outDir); err != nil {
+		return err
+	}
+	return copyStaticAssets(outDir)
+}
 
-				// Legacy v1 endpoint, only for prod-variation
-				if tsv == "prod-variation" {
-					// The legacy endpoint uses capitalized field names in the URL in some cases, but the instructions say {field}.
-					// Wait, the test says: /api/repo1/br0/tr0/ts0/EnvFiles
-					// Let's use the struct field name for legacy v1
-					legacyPath := filepath.Join(outDir, "api", repo, branch, trigger, ts, field.Name)
-					if err := writeJSON(legacyPath, fieldValue.Interface()); err != nil {
-						return err
+// managedPaths returns the paths for the branches managed in pol for
+// each repo in v, with the triggers and testsuites that v has for that
+// repo, which are not already paths in v. These can only be resolved
+// through the fallback chain.
+func managedPaths(v variations, pol *Policies) []variationPath {
+	if pol == nil {
+		return nil
+	}
+	known := make(map[variationPath]bool)
+	for _, p := range v.Paths() {
+		known[p] = true
+	}
+	var paths []variationPath
+	for _, repo := range v.Repos() {
+		rp, err := pol.GetRepoPolicy(repo)
+		if err != nil {
+			continue
+		}
+		for _, branch := range rp.GetAllBranches() {
+			for _, trigger := range v.Triggers(repo, "") {
+				for _, ts := range v.Testsuites(repo, "", trigger) {
+					p := variationPath{Repo: repo, Branch: branch, Trigger: trigger, Testsuite: ts}
+					if !known[p] {
+						paths = append(paths, p)
 					}
 				}
 			}
 		}
 	}
+	return paths
+}
 
-	if err := generateIndex(av, outDir); err != nil {
+// writeResolution writes the files for the resolution of path
+func writeResolution(outDir, tsv string, path variationPath, res *resolution) error {
+	repo := path.Repo
+	branch := path.Branch
+	trigger := path.Trigger
+	ts := path.Testsuite
+	m := &res.Matrix
+
+	// Record the rule that resolved this path
+	resPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, "resolution.json")
+	if err := writeJSON(resPath, res); err != nil {
 		return err
 	}
-	return copyStaticAssets(outDir)
+
+	// Generate v2/{tsv}/{repo}/{branch}/{trigger}/{ts}.gho
+	ghoPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts+".gho")
+	if err := writeGHO(ghoPath, *m); err != nil {
+		return err
+	}
+
+	// Iterate over fields of ghMatrix
+	val := reflect.ValueOf(*m)
+	typ := val.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		fieldValue := val.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "" || jsonTag == "-" {
+			continue
+		}
+		fieldJSONPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, jsonTag+".json")
+		if err := writeJSON(fieldJSONPath, fieldValue.Interface()); err != nil {
+			return err
+		}
+		fieldJSONPathStruct := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, field.Name+".json")
+		if err := writeJSON(fieldJSONPathStruct, fieldValue.Interface()); err != nil {
+			return err
+		}
+
+		// Generate v2/{tsv}/{repo}/{branch}/{trigger}/{ts}/{field}.gho
+		fieldGHOPath := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, jsonTag+".gho")
+		if err := writeFieldGHO(fieldGHOPath, jsonTag, fieldValue.Interface()); err != nil {
+			return err
+		}
+		fieldGHOPathStruct := filepath.Join(outDir, "v2", tsv, repo, branch, trigger, ts, field.Name+".gho")
+		if err := writeFieldGHO(fieldGHOPathStruct, jsonTag, fieldValue.Interface()); err != nil {
+			return err
+		}
+
+		// Legacy v1 endpoint, only for prod-variation
+		if tsv == "prod-variation" {
+			// The legacy endpoint uses capitalized field names in the URL in some cases, but the instructions say {field}.
+			// Wait, the test says: /api/repo1/br0/tr0/ts0/EnvFiles
+			// Let's use the struct field name for legacy v1
+			legacyPath := filepath.Join(outDir, "api", repo, branch, trigger, ts, field.Name)
+			if err := writeJSON(legacyPath, fieldValue.Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func generateIndex(av AllTestsuiteVariations, outDir string) error {
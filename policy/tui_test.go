@@ -0,0 +1,44 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TykTechnologies/gromit/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGenerateStaticFallbacks checks that managed branches without a
+// variation of their own are generated from the rule that resolves them
+func TestGenerateStaticFallbacks(t *testing.T) {
+	config.LoadConfig("../testdata/config-test.yaml")
+	var pol Policies
+	require.NoError(t, LoadRepoPolicies(&pol))
+
+	configDir, outDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(configDir, "test-variations.yml"), []byte(lintTest), 0644))
+	require.NoError(t, GenerateStatic(&pol, configDir, outDir, nil))
+
+	rule := func(repo, branch string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(outDir, "v2", "test-variation", repo, branch, "push", "api", "resolution.json"))
+		require.NoError(t, err, "%s/%s", repo, branch)
+		var res struct {
+			Rule string
+			Path string
+		}
+		require.NoError(t, json.Unmarshal(data, &res))
+		return res.Rule + " " + res.Path
+	}
+	assert.Equal(t, "exact repo0/main/push/api", rule("repo0", "main"))
+	assert.Equal(t, "master repo0/master/push/api", rule("repo0", "dev"))
+	assert.Equal(t, "default repo1/default/push/api", rule("repo1", "main"))
+
+	// without a policy, only the variations are generated
+	outDir = t.TempDir()
+	require.NoError(t, GenerateStatic(nil, configDir, outDir, nil))
+	assert.NoDirExists(t, filepath.Join(outDir, "v2", "test-variation", "repo0", "dev"))
+}
@@ -1,10 +1,15 @@
 package policy
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/TykTechnologies/gromit/util"
 	"github.com/jinzhu/copier"
@@ -15,25 +20,28 @@ import (
 // ghMatrix models the github action matrix structure
 // recursion allows it to compactly represent the save state
 type ghMatrix struct {
-	EnvFiles []struct {
-		Cache      string `json:"cache"`
-		DB         string `json:"db"`
-		Config     string `json:"config"`
-		APIMarkers string `json:"apimarkers"`
-		UIMarkers  string `json:"uimarkers"`
-		GwDash     string `json:"gwdash"`
-		Pump       string `json:"pump,omitempty"`
-		Sink       string `json:"sink,omitempty"`
-	} `json:"envfiles"`
-	Pump    []string `json:"pump"`
-	Sink    []string `json:"sink"`
-	Distros struct {
+	EnvFiles []envFile `json:"envfiles"`
+	Pump     []string  `json:"pump"`
+	Sink     []string  `json:"sink"`
+	Distros  struct {
 		Deb []string `json:"deb"`
 		Rpm []string `json:"rpm"`
 	} `json:"distros"`
 	Level map[string]ghMatrix `copier:"-"` // map testsuite→ghMatrix
 }
 
+// envFile is one element of the envfiles dimension of the matrix
+type envFile struct {
+	Cache      string `json:"cache"`
+	DB         string `json:"db"`
+	Config     string `json:"config"`
+	APIMarkers string `json:"apimarkers"`
+	UIMarkers  string `json:"uimarkers"`
+	GwDash     string `json:"gwdash"`
+	Pump       string `json:"pump,omitempty"`
+	Sink       string `json:"sink,omitempty"`
+}
+
 // Tree depth of ghMatrix
 const (
 	Testsuite = 0
@@ -42,26 +50,131 @@ const (
 	Repo      = 3
 )
 
+// Rules that can be used in the fallback chain of Lookup. Each rule
+// only varies the branch, the repo, trigger and testsuite must always
+// match.
+const (
+	// RuleExact matches the branch as given
+	RuleExact = "exact"
+	// RuleGlob matches branch levels that are globs, like release-5.*
+	RuleGlob = "glob"
+	// RuleDefault uses the branch level named default
+	RuleDefault = "default"
+	// RuleMaster uses the branch level named master
+	RuleMaster = "master"
+)
+
+// DefaultFallbacks is the fallback chain used by Lookup unless
+// overridden with SetFallbacks
+var DefaultFallbacks = []string{RuleExact, RuleGlob, RuleDefault, RuleMaster}
+
+// ErrNoVariation is returned when no rule in the fallback chain resolves a path
+var ErrNoVariation = errors.New("no variation matches")
+
 // variations flattens the saved matrix form so that it can be looked up in any order
 // The template are in repo→branch→trigger→testsuite
 // API calls use testsuite→branch→trigger→repo
 // The ghMatrix used here is not recursive.
 type variations struct {
-	Leaves map[string]ghMatrix
-	Paths  []variationPath
+	Leaves    map[variationPath]ghMatrix
+	Fallbacks []string
 }
 
+// resolution is the result of a lookup. Path is the variation that
+// supplied Matrix and Rule is the rule in the fallback chain that
+// matched it.
+type resolution struct {
+	Matrix ghMatrix
+	Rule   string
+	Path   variationPath
+}
+
+// variationPath is the key for a leaf in variations. When used as a
+// query, each element is a glob and an empty element matches anything.
 type variationPath struct {
 	Testsuite, Trigger, Branch, Repo string
 }
 
+// String encodes the path as repo/branch/trigger/testsuite. Each
+// element is escaped so that the encoding is unambiguous even when
+// branch names contain /.
+func (p variationPath) String() string {
+	return strings.Join([]string{
+		url.PathEscape(p.Repo),
+		url.PathEscape(p.Branch),
+		url.PathEscape(p.Trigger),
+		url.PathEscape(p.Testsuite),
+	}, "/")
+}
+
+// MarshalText allows variationPath to be used as a map key in JSON
+func (p variationPath) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes the output of MarshalText
+func (p *variationPath) UnmarshalText(text []byte) error {
+	elems := strings.Split(string(text), "/")
+	if len(elems) != 4 {
+		return fmt.Errorf("variation path %q does not have 4 elements", text)
+	}
+	var err error
+	for i, dst := range []*string{&p.Repo, &p.Branch, &p.Trigger, &p.Testsuite} {
+		*dst, err = url.PathUnescape(elems[i])
+		if err != nil {
+			return fmt.Errorf("variation path %q: %w", text, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether every non-empty element of the query q
+// matches the corresponding element of p as a glob
+func (p variationPath) matches(q variationPath) bool {
+	for _, pair := range [][2]string{
+		{q.Repo, p.Repo},
+		{q.Branch, p.Branch},
+		{q.Trigger, p.Trigger},
+		{q.Testsuite, p.Testsuite},
+	} {
+		if pair[0] == "" {
+			continue
+		}
+		matched, err := path.Match(pair[0], pair[1])
+		if err != nil {
+			log.Warn().Err(err).Msgf("bad glob %s in query", pair[0])
+			return false
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
 func NewVariations() *variations {
 	var v variations
-	v.Leaves = make(map[string]ghMatrix)
+	v.Leaves = make(map[variationPath]ghMatrix)
+	v.Fallbacks = DefaultFallbacks
 
 	return &v
 }
 
+// SetFallbacks replaces the fallback chain used by Lookup. The rules
+// are tried in the order given.
+func (v *variations) SetFallbacks(rules []string) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("empty fallback chain")
+	}
+	for _, r := range rules {
+		if !slices.Contains(DefaultFallbacks, r) {
+			return fmt.Errorf("unknown fallback rule %s, known rules are %v", r, DefaultFallbacks)
+		}
+	}
+	v.Fallbacks = rules
+	return nil
+}
+
 // RepoTestsuiteVariations maps file→variations
 type AllTestsuiteVariations map[string]variations
 
@@ -73,9 +186,30 @@ func (av AllTestsuiteVariations) Files() []string {
 	return keys
 }
 
+// Query returns the known paths that match q, sorted by repo, branch,
+// trigger and testsuite. Query elements are globs and empty elements
+// match anything.
+func (v variations) Query(q variationPath) []variationPath {
+	var paths []variationPath
+	for p := range v.Leaves {
+		if p.matches(q) {
+			paths = append(paths, p)
+		}
+	}
+	slices.SortFunc(paths, func(a, b variationPath) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return paths
+}
+
+// Paths returns all the known paths
+func (v variations) Paths() []variationPath {
+	return v.Query(variationPath{})
+}
+
 func (v variations) Repos() []string {
 	var rvals []string
-	for _, path := range v.Paths {
+	for _, path := range v.Paths() {
 		rvals = append(rvals, path.Repo)
 	}
 	return util.NewSetFromSlices(rvals).Members()
@@ -83,49 +217,110 @@ func (v variations) Repos() []string {
 
 func (v variations) Branches(repo string) []string {
 	var rvals []string
-	for _, path := range v.Paths {
-		if path.Repo == repo {
-			rvals = append(rvals, path.Branch)
-		}
+	for _, path := range v.Query(variationPath{Repo: literal(repo)}) {
+		rvals = append(rvals, path.Branch)
 	}
 	return util.NewSetFromSlices(rvals).Members()
 }
 
 func (v variations) Triggers(repo, branch string) []string {
 	var rvals []string
-	for _, path := range v.Paths {
-		if path.Repo == repo && path.Branch == branch {
-			rvals = append(rvals, path.Trigger)
-		}
+	for _, path := range v.Query(variationPath{Repo: literal(repo), Branch: literal(branch)}) {
+		rvals = append(rvals, path.Trigger)
 	}
 	return util.NewSetFromSlices(rvals).Members()
 }
 
 func (v variations) Testsuites(repo, branch, trigger string) []string {
 	var rvals []string
-	for _, path := range v.Paths {
-		if path.Repo == repo && path.Branch == branch && path.Trigger == trigger {
-			rvals = append(rvals, path.Testsuite)
-		}
+	for _, path := range v.Query(variationPath{Repo: literal(repo), Branch: literal(branch), Trigger: literal(trigger)}) {
+		rvals = append(rvals, path.Testsuite)
 	}
 	return util.NewSetFromSlices(rvals).Members()
 }
 
-func (v variations) Lookup(repo, branch, trigger, testsuite string) *ghMatrix {
-	m, found := v.Leaves[createVariationKey(repo, branch, trigger, testsuite)]
-	if !found {
-		log.Info().Msgf("(%s, %s, %s, %s) not known, using (%s, master, %s, %s)", repo, branch, trigger, testsuite, repo, trigger, testsuite)
-		m = v.Leaves[createVariationKey(repo, "master", trigger, testsuite)]
+// literal escapes glob metacharacters in s so that it only matches itself in a query
+func literal(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Lookup returns the matrix for the given path, walking the fallback
+// chain if the path is not known. It is an error if no rule matches.
+func (v variations) Lookup(repo, branch, trigger, testsuite string) (*ghMatrix, error) {
+	r, err := v.Resolve(repo, branch, trigger, testsuite)
+	if err != nil {
+		return nil, err
+	}
+	return &r.Matrix, nil
+}
+
+// Resolve is Lookup but also reports which rule and path supplied the matrix
+func (v variations) Resolve(repo, branch, trigger, testsuite string) (*resolution, error) {
+	r, err := v.resolve(repo, branch, trigger, testsuite)
+	if err == nil && r.Rule != RuleExact {
+		log.Info().Msgf("(%s, %s, %s, %s) not known, using %s from rule %s", repo, branch, trigger, testsuite, r.Path, r.Rule)
 	}
-	return &m
+	return r, err
 }
 
-func createVariationKey(keys ...string) string {
-	var vkey string
-	for _, key := range keys {
-		vkey += key
+// resolve walks the fallback chain for Resolve without logging
+func (v variations) resolve(repo, branch, trigger, testsuite string) (*resolution, error) {
+	for _, rule := range v.Fallbacks {
+		var candidate string
+		switch rule {
+		case RuleExact:
+			candidate = branch
+		case RuleGlob:
+			candidate = v.matchBranchGlob(repo, branch, trigger, testsuite)
+		case RuleDefault:
+			candidate = "default"
+		case RuleMaster:
+			candidate = "master"
+		}
+		if candidate == "" {
+			continue
+		}
+		vp := variationPath{Testsuite: testsuite, Trigger: trigger, Branch: candidate, Repo: repo}
+		m, found := v.Leaves[vp]
+		if !found {
+			log.Trace().Msgf("(%s, %s, %s, %s) not matched by rule %s", repo, branch, trigger, testsuite, rule)
+			continue
+		}
+		return &resolution{
+			Matrix: m,
+			Rule:   rule,
+			Path:   vp,
+		}, nil
+	}
+	return nil, fmt.Errorf("(%s, %s, %s, %s) with fallbacks %v: %w", repo, branch, trigger, testsuite, v.Fallbacks, ErrNoVariation)
+}
+
+// matchBranchGlob returns the most specific branch level that is a
+// glob matching branch. The longest pattern is taken to be the most
+// specific. An empty string is returned if there is no match.
+func (v variations) matchBranchGlob(repo, branch, trigger, testsuite string) string {
+	var best string
+	for _, p := range v.Query(variationPath{Repo: literal(repo), Trigger: literal(trigger), Testsuite: literal(testsuite)}) {
+		if !strings.ContainsAny(p.Branch, "*?[") {
+			continue
+		}
+		matched, err := path.Match(p.Branch, branch)
+		if err != nil {
+			log.Warn().Err(err).Msgf("bad branch glob %s for %s", p.Branch, repo)
+			continue
+		}
+		if matched && (len(p.Branch) > len(best) || (len(p.Branch) == len(best) && p.Branch < best)) {
+			best = p.Branch
+		}
 	}
-	return vkey
+	return best
 }
 
 func removeDuplicates(s []string) []string {
@@ -170,21 +365,30 @@ func loadAllVariations(tvDir string) (AllTestsuiteVariations, error) {
 	return av, nil
 }
 
+// readVariationTree reads the compact saved representation from a file
+func readVariationTree(tvFile string) (ghMatrix, error) {
+	var saved ghMatrix
+	data, err := os.ReadFile(tvFile)
+	if err != nil {
+		return saved, err
+	}
+	err = yaml.Unmarshal(data, &saved)
+	if err != nil {
+		return saved, fmt.Errorf("could not unmarshal data from %s: %s: %w", tvFile, string(data), err)
+	}
+	return saved, nil
+}
+
 // loadVariation unrolls the compact saved representation from a file
 // it also sets up handlers for the loaded variations
 func loadVariation(tvFile string) (*variations, error) {
 	v := NewVariations()
 	var vp variationPath
 
-	data, err := os.ReadFile(tvFile)
+	saved, err := readVariationTree(tvFile)
 	if err != nil {
 		return v, err
 	}
-	var saved ghMatrix
-	err = yaml.Unmarshal(data, &saved)
-	if err != nil {
-		return v, fmt.Errorf("could not unmarshal data from %s: %s: %w", tvFile, string(data), err)
-	}
 	// top level variations
 	var global ghMatrix
 	err = copier.CopyWithOption(&global, &saved, copier.Option{IgnoreEmpty: true})
@@ -212,10 +416,7 @@ func parseVariations(sv ghMatrix, depth int, v *variations, path variationPath)
 			path.Trigger = level
 		case Repo:
 			path.Repo = level
-			key := createVariationKey(path.Repo, path.Branch, path.Trigger, path.Testsuite)
-			var tsPath = path // make a copy
-			v.Leaves[key] = levelMatrix
-			v.Paths = append(v.Paths, tsPath)
+			v.Leaves[path] = levelMatrix
 		}
 		if depth > Repo {
 			log.Warn().Fields(sv).Msgf("cannot parse test variation levels > %d", Repo)
@@ -0,0 +1,177 @@
+package policy
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/TykTechnologies/gromit/util"
+)
+
+// String renders the non-empty fields of an envfile on one line
+func (ef envFile) String() string {
+	var fields []string
+	for _, f := range [][2]string{
+		{"cache", ef.Cache},
+		{"db", ef.DB},
+		{"config", ef.Config},
+		{"apimarkers", ef.APIMarkers},
+		{"uimarkers", ef.UIMarkers},
+		{"gwdash", ef.GwDash},
+		{"pump", ef.Pump},
+		{"sink", ef.Sink},
+	} {
+		if f[1] != "" {
+			fields = append(fields, fmt.Sprintf("%s=%q", f[0], f[1]))
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// listDelta is the difference between two lists, ignoring order
+type listDelta struct {
+	Added, Removed []string
+}
+
+func newListDelta(before, after []string) listDelta {
+	var d listDelta
+	beforeSet := util.NewSetFromSlices(before)
+	afterSet := util.NewSetFromSlices(after)
+	for _, v := range afterSet.Members() {
+		if !beforeSet.Has(v) {
+			d.Added = append(d.Added, v)
+		}
+	}
+	for _, v := range beforeSet.Members() {
+		if !afterSet.Has(v) {
+			d.Removed = append(d.Removed, v)
+		}
+	}
+	return d
+}
+
+// variationDelta is the change in the matrix for a path, after inheritance
+type variationDelta struct {
+	Path     variationPath
+	Status   string // added, removed or changed
+	EnvFiles listDelta
+	Pump     listDelta
+	Sink     listDelta
+	Deb      listDelta
+	Rpm      listDelta
+}
+
+type namedDelta struct {
+	name string
+	listDelta
+}
+
+// fields returns the deltas in the order that they are displayed
+func (d variationDelta) fields() []namedDelta {
+	return []namedDelta{
+		{"envfiles", d.EnvFiles},
+		{"pump", d.Pump},
+		{"sink", d.Sink},
+		{"deb", d.Deb},
+		{"rpm", d.Rpm},
+	}
+}
+
+func (d variationDelta) empty() bool {
+	for _, f := range d.fields() {
+		if len(f.Added) > 0 || len(f.Removed) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func envFileStrings(efs []envFile) []string {
+	s := make([]string, len(efs))
+	for i, ef := range efs {
+		s[i] = ef.String()
+	}
+	return s
+}
+
+func newVariationDelta(p variationPath, before, after ghMatrix) variationDelta {
+	return variationDelta{
+		Path:     p,
+		Status:   "changed",
+		EnvFiles: newListDelta(envFileStrings(before.EnvFiles), envFileStrings(after.EnvFiles)),
+		Pump:     newListDelta(before.Pump, after.Pump),
+		Sink:     newListDelta(before.Sink, after.Sink),
+		Deb:      newListDelta(before.Distros.Deb, after.Distros.Deb),
+		Rpm:      newListDelta(before.Distros.Rpm, after.Distros.Rpm),
+	}
+}
+
+// DiffVariations loads both files and returns the paths whose matrix
+// differs once inheritance is resolved, sorted by path
+func DiffVariations(oldFile, newFile string) ([]variationDelta, error) {
+	before, err := loadVariation(oldFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", oldFile, err)
+	}
+	after, err := loadVariation(newFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", newFile, err)
+	}
+	all := make(map[string]variationPath)
+	for _, p := range append(before.Paths(), after.Paths()...) {
+		all[p.String()] = p
+	}
+	var deltas []variationDelta
+	for _, key := range slices.Sorted(maps.Keys(all)) {
+		p := all[key]
+		om, inOld := before.Leaves[p]
+		nm, inNew := after.Leaves[p]
+		d := newVariationDelta(p, om, nm)
+		switch {
+		case !inOld:
+			d.Status = "added"
+		case !inNew:
+			d.Status = "removed"
+		case d.empty():
+			continue
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas, nil
+}
+
+// WriteVariationsDiff writes deltas to w as a unified diff style
+// listing. With markdown, each path is a heading followed by a diff
+// block so that it can be pasted into a PR comment.
+func WriteVariationsDiff(w io.Writer, deltas []variationDelta, markdown bool) error {
+	if len(deltas) == 0 {
+		_, err := fmt.Fprintln(w, "No changes to any variation")
+		return err
+	}
+	for _, d := range deltas {
+		var b strings.Builder
+		if markdown {
+			fmt.Fprintf(&b, "#### `%s` (%s)\n```diff\n", d.Path, d.Status)
+		} else {
+			fmt.Fprintf(&b, "%s (%s)\n", d.Path, d.Status)
+		}
+		for _, f := range d.fields() {
+			for _, v := range f.Removed {
+				fmt.Fprintf(&b, "- %s: %s\n", f.name, v)
+			}
+			for _, v := range f.Added {
+				fmt.Fprintf(&b, "+ %s: %s\n", f.name, v)
+			}
+		}
+		if markdown {
+			b.WriteString("```\n")
+		}
+		b.WriteString("\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
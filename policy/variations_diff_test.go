@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const diffOld = `
+envfiles:
+  - cache: redis7
+pump:
+  - pump:v1
+level: # testsuites
+  api:
+    level: # branches
+      master:
+        level: # triggers
+          push:
+            level: # repos
+              tyk:
+              tyk-pump:
+`
+
+const diffNew = `
+envfiles:
+  - cache: redis8
+pump:
+  - pump:v1
+level: # testsuites
+  api:
+    level: # branches
+      master:
+        level: # triggers
+          push:
+            level: # repos
+              tyk:
+                pump:
+                  - pump:v2
+              tyk-sink:
+`
+
+func TestDiffVariations(t *testing.T) {
+	dir := t.TempDir()
+	oldFile := filepath.Join(dir, "old.yml")
+	newFile := filepath.Join(dir, "new.yml")
+	require.NoError(t, os.WriteFile(oldFile, []byte(diffOld), 0644))
+	require.NoError(t, os.WriteFile(newFile, []byte(diffNew), 0644))
+
+	deltas, err := DiffVariations(oldFile, newFile)
+	require.NoError(t, err)
+	require.Len(t, deltas, 3)
+
+	// sorted by the encoded path, so tyk-pump comes before tyk
+	assert.Equal(t, "tyk-pump", deltas[0].Path.Repo)
+	assert.Equal(t, "removed", deltas[0].Status)
+	assert.Equal(t, "tyk-sink", deltas[1].Path.Repo)
+	assert.Equal(t, "added", deltas[1].Status)
+	assert.Equal(t, "tyk", deltas[2].Path.Repo)
+	assert.Equal(t, "changed", deltas[2].Status)
+	assert.Equal(t, listDelta{Added: []string{`cache="redis8"`}, Removed: []string{`cache="redis7"`}}, deltas[2].EnvFiles, "inherited envfiles are compared")
+	assert.Equal(t, []string{"pump:v2"}, deltas[2].Pump.Added)
+	assert.Empty(t, deltas[2].Pump.Removed)
+
+	var b bytes.Buffer
+	require.NoError(t, WriteVariationsDiff(&b, deltas[2:], true))
+	assert.Equal(t, "#### `tyk/master/push/api` (changed)\n```diff\n- envfiles: cache=\"redis7\"\n+ envfiles: cache=\"redis8\"\n+ pump: pump:v2\n```\n\n", b.String())
+
+	deltas, err = DiffVariations(oldFile, oldFile)
+	require.NoError(t, err)
+	assert.Empty(t, deltas)
+}
@@ -0,0 +1,157 @@
+package policy
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// levelNames are the names of the levels in a variation file, indexed by depth
+var levelNames = []string{"testsuite", "branch", "trigger", "repo"}
+
+// lintFinding is a problem in a variation file
+type lintFinding struct {
+	File string
+	Path string
+	Msg  string
+}
+
+func (f lintFinding) String() string {
+	if f.Path == "" {
+		return fmt.Sprintf("%s: %s", f.File, f.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.File, f.Path, f.Msg)
+}
+
+// LintVariations checks the variation files against each other and
+// against the repos and branches in pol. Each file is checked for
+// levels that can never be looked up, duplicate envfiles, repos that
+// are not in the policy config and branches that are not managed for
+// that repo. A path in one file must be resolvable in all the others,
+// directly or through the fallback chain. Findings whose path matches
+// a glob in allow are left out.
+func LintVariations(pol *Policies, allow []string, tvFiles ...string) ([]lintFinding, error) {
+	var findings []lintFinding
+	loaded := make(map[string]*variations)
+	for _, tvFile := range tvFiles {
+		fname := filepath.Base(tvFile)
+		tree, err := readVariationTree(tvFile)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, lintTree(fname, tree, 0, nil)...)
+
+		v, err := loadVariation(tvFile)
+		if err != nil {
+			return nil, err
+		}
+		loaded[fname] = v
+		findings = append(findings, lintLeaves(fname, v)...)
+		if pol != nil {
+			findings = append(findings, lintAgainstPolicy(fname, v, pol)...)
+		}
+	}
+
+	files := slices.Sorted(maps.Keys(loaded))
+	for i := 1; i < len(files); i++ {
+		findings = append(findings, lintCoverage(files[0], loaded[files[0]], files[i], loaded[files[i]])...)
+	}
+	return slices.DeleteFunc(findings, func(f lintFinding) bool {
+		return slices.ContainsFunc(allow, func(glob string) bool {
+			matched, _ := path.Match(glob, f.Path)
+			return matched
+		})
+	}), nil
+}
+
+// lintTree walks the saved form, finding levels that cannot produce a
+// leaf. Levels below the repo level are ignored by parseVariations and
+// levels above it with no children never reach the repo level.
+func lintTree(fname string, sv ghMatrix, depth int, prefix []string) []lintFinding {
+	var findings []lintFinding
+	for _, level := range slices.Sorted(maps.Keys(sv.Level)) {
+		lm := sv.Level[level]
+		p := append(slices.Clone(prefix), level)
+		switch {
+		case depth == Repo && len(lm.Level) > 0:
+			findings = append(findings, lintFinding{fname, strings.Join(p, "."), "has levels below the repo level which can never be looked up"})
+		case depth < Repo && len(lm.Level) == 0:
+			findings = append(findings, lintFinding{fname, strings.Join(p, "."), fmt.Sprintf("%s level has no %s levels so it can never be looked up", levelNames[depth], levelNames[depth+1])})
+		case depth < Repo:
+			findings = append(findings, lintTree(fname, lm, depth+1, p)...)
+		}
+	}
+	return findings
+}
+
+// lintLeaves finds envfiles that occur more than once in a leaf after inheritance
+func lintLeaves(fname string, v *variations) []lintFinding {
+	var findings []lintFinding
+	for _, p := range v.Paths() {
+		seen := make(map[envFile]bool)
+		for _, ef := range v.Leaves[p].EnvFiles {
+			if seen[ef] {
+				findings = append(findings, lintFinding{fname, p.String(), fmt.Sprintf("duplicate envfile %s", ef)})
+			}
+			seen[ef] = true
+		}
+	}
+	return findings
+}
+
+// lintAgainstPolicy finds repos and branches that are not in the policy config.
+// The default and master branch levels are reached by the fallback chain
+// and by fallback_ref, so they are allowed for any repo, as are globs
+// that match at least one branch.
+func lintAgainstPolicy(fname string, v *variations, pol *Policies) []lintFinding {
+	var findings []lintFinding
+	for _, repo := range v.Repos() {
+		rp, err := pol.GetRepoPolicy(repo)
+		if err != nil {
+			findings = append(findings, lintFinding{fname, repo, "repo is not in the policy config"})
+			continue
+		}
+		for _, branch := range v.Branches(repo) {
+			if branch == RuleDefault || branch == RuleMaster {
+				continue
+			}
+			if strings.ContainsAny(branch, "*?[") {
+				matched := false
+				for _, b := range rp.GetAllBranches() {
+					if ok, _ := path.Match(branch, b); ok {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					findings = append(findings, lintFinding{fname, repo + "/" + branch, "branch glob matches no branch in the policy config"})
+				}
+				continue
+			}
+			if err := rp.SetBranch(branch); err != nil {
+				findings = append(findings, lintFinding{fname, repo + "/" + branch, "branch is not in the policy config"})
+			}
+		}
+	}
+	return findings
+}
+
+// lintCoverage finds paths in one file that the other cannot resolve,
+// even through its fallback chain
+func lintCoverage(aName string, a *variations, bName string, b *variations) []lintFinding {
+	var findings []lintFinding
+	for _, p := range a.Paths() {
+		if _, err := b.resolve(p.Repo, p.Branch, p.Trigger, p.Testsuite); err != nil {
+			findings = append(findings, lintFinding{bName, p.String(), "path cannot be resolved, present in " + aName})
+		}
+	}
+	for _, p := range b.Paths() {
+		if _, err := a.resolve(p.Repo, p.Branch, p.Trigger, p.Testsuite); err != nil {
+			findings = append(findings, lintFinding{aName, p.String(), "path cannot be resolved, present in " + bName})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TykTechnologies/gromit/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const lintProd = `
+envfiles:
+  - cache: redis7
+level: # testsuites
+  api:
+    level: # branches
+      main:
+        level: # triggers
+          push:
+            level: # repos
+              repo0:
+                envfiles:
+                  - cache: redis7
+              repo9:
+          pull_request:
+      rel-*:
+        level: # triggers
+          push:
+            level: # repos
+              repo1:
+                level:
+                  deeper:
+      dev:
+        level: # triggers
+          push:
+            level: # repos
+              repo0:
+`
+
+const lintTest = `
+level: # testsuites
+  api:
+    level: # branches
+      main:
+        level: # triggers
+          push:
+            level: # repos
+              repo0:
+              repo9:
+      default:
+        level: # triggers
+          push:
+            level: # repos
+              repo1:
+      master: # a fallback, so not checked against the policy
+        level: # triggers
+          push:
+            level: # repos
+              repo0:
+`
+
+func TestLintVariations(t *testing.T) {
+	config.LoadConfig("../testdata/config-test.yaml")
+	var pol Policies
+	require.NoError(t, LoadRepoPolicies(&pol))
+
+	dir := t.TempDir()
+	prod := filepath.Join(dir, "prod-variations.yml")
+	test := filepath.Join(dir, "test-variations.yml")
+	require.NoError(t, os.WriteFile(prod, []byte(lintProd), 0644))
+	require.NoError(t, os.WriteFile(test, []byte(lintTest), 0644))
+
+	findings, err := LintVariations(&pol, nil, prod, test)
+	require.NoError(t, err)
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	assert.ElementsMatch(t, []string{
+		"prod-variations.yml: api.main.pull_request: trigger level has no repo levels so it can never be looked up",
+		"prod-variations.yml: api.rel-*.push.repo1: has levels below the repo level which can never be looked up",
+		"prod-variations.yml: repo0/main/push/api: duplicate envfile cache=\"redis7\"",
+		"prod-variations.yml: repo1/rel-*: branch glob matches no branch in the policy config",
+		"prod-variations.yml: repo9: repo is not in the policy config",
+		"test-variations.yml: repo9: repo is not in the policy config",
+		"prod-variations.yml: repo1/default/push/api: path cannot be resolved, present in test-variations.yml",
+		"prod-variations.yml: repo0/master/push/api: path cannot be resolved, present in test-variations.yml",
+	}, got, "repo0/dev and repo1/rel-* resolve in test-variations.yml through master and default")
+
+	findings, err = LintVariations(&pol, []string{"repo0/master/*/*", "repo9"}, prod, test)
+	require.NoError(t, err)
+	assert.Len(t, findings, len(got)-3, "allowed paths are left out")
+
+	findings, err = LintVariations(&pol, nil, test)
+	require.NoError(t, err)
+	assert.Len(t, findings, 1, "only the unknown repo when there is nothing to compare against")
+}
+
+// TestLintShippedVariations keeps the variation files in config/tui
+// consistent with the policy config that is embedded. LoadConfig("")
+// would keep the file set by an earlier test, so it is named here.
+func TestLintShippedVariations(t *testing.T) {
+	config.LoadConfig("../config/config.yaml")
+	allow := viper.GetStringSlice("variations.lintallow")
+	require.NotEmpty(t, allow)
+	var pol Policies
+	require.NoError(t, LoadRepoPolicies(&pol))
+
+	files, err := filepath.Glob("../config/tui/*.yml")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	findings, err := LintVariations(&pol, allow, files...)
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+}
@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVariationFallbacks(t *testing.T) {
+	v, err := loadVariation("testdata/variations/test-variations.yml")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name, repo, branch, trigger string
+		rule, resolved, cache       string
+	}{
+		{"exact", "tyk", "master", "pull_request", RuleExact, "master", "valkey9"},
+		{"glob", "tyk", "release-5.8", "pull_request", RuleGlob, "release-5.*", "redis6"},
+		{"longest glob", "tyk", "release-5.3-lts", "pull_request", RuleGlob, "release-5.3*", "redis5"},
+		{"default", "tyk-analytics", "release-5.8", "pull_request", RuleDefault, "default", "valkey8"},
+		{"master", "tyk-analytics", "release-5.8", "schedule", RuleMaster, "master", "valkey9"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := v.Resolve(tc.repo, tc.branch, tc.trigger, "api")
+			require.NoError(t, err)
+			assert.Equal(t, tc.rule, res.Rule)
+			assert.Equal(t, tc.resolved, res.Path.Branch)
+			require.NotEmpty(t, res.Matrix.EnvFiles)
+			assert.Equal(t, tc.cache, res.Matrix.EnvFiles[0].Cache)
+		})
+	}
+
+	_, err = v.Lookup("tyk-pump", "master", "pull_request", "api")
+	assert.ErrorIs(t, err, ErrNoVariation, "unknown repo must not resolve")
+
+	require.NoError(t, v.SetFallbacks([]string{RuleExact}))
+	_, err = v.Lookup("tyk", "release-5.8", "pull_request", "api")
+	assert.ErrorIs(t, err, ErrNoVariation, "glob must not be used when not in the chain")
+
+	assert.Error(t, v.SetFallbacks([]string{"nearest"}), "unknown rules are rejected")
+}
+
+func TestVariationPathRoundTrip(t *testing.T) {
+	roundTrip := func(repo, branch, trigger, testsuite string) bool {
+		p := variationPath{Repo: repo, Branch: branch, Trigger: trigger, Testsuite: testsuite}
+		text, err := p.MarshalText()
+		if err != nil {
+			return false
+		}
+		var got variationPath
+		if err := got.UnmarshalText(text); err != nil {
+			return false
+		}
+		return got == p
+	}
+	require.NoError(t, quick.Check(roundTrip, nil))
+
+	unique := func(a, b [4]string) bool {
+		pa := variationPath{Repo: a[0], Branch: a[1], Trigger: a[2], Testsuite: a[3]}
+		pb := variationPath{Repo: b[0], Branch: b[1], Trigger: b[2], Testsuite: b[3]}
+		return (pa == pb) == (pa.String() == pb.String())
+	}
+	require.NoError(t, quick.Check(unique, nil))
+
+	// The concatenated keys used to collide for these
+	a := variationPath{Repo: "tyk", Branch: "-analyticsmaster"}
+	b := variationPath{Repo: "tyk-analytics", Branch: "master"}
+	assert.NotEqual(t, a.String(), b.String())
+	c := variationPath{Repo: "tyk", Branch: "release/5.3", Trigger: "push", Testsuite: "api"}
+	assert.Equal(t, "tyk/release%2F5.3/push/api", c.String())
+}
+
+func TestVariationQuery(t *testing.T) {
+	v, err := loadVariation("testdata/variations/test-variations.yml")
+	require.NoError(t, err)
+
+	assert.Len(t, v.Paths(), 7)
+	assert.Equal(t, []variationPath{
+		{Repo: "tyk", Branch: "release-5.*", Trigger: "pull_request", Testsuite: "api"},
+		{Repo: "tyk", Branch: "release-5.3*", Trigger: "pull_request", Testsuite: "api"},
+	}, v.Query(variationPath{Repo: "tyk", Branch: "release-*"}))
+	assert.Equal(t, []variationPath{
+		{Repo: "tyk-analytics", Branch: "master", Trigger: "schedule", Testsuite: "api"},
+	}, v.Query(variationPath{Trigger: "sch*"}))
+	assert.Equal(t, []string{"pull_request", "schedule"}, v.Triggers("tyk-analytics", "master"))
+	assert.Equal(t, []string{"pull_request"}, v.Triggers("tyk", "release-5.*"), "globs in names are literal")
+	assert.Empty(t, v.Triggers("tyk", "release-5.3"))
+	assert.Equal(t, []string{"tyk", "tyk-analytics"}, v.Repos())
+}
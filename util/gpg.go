@@ -1,7 +1,9 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
+	"io"
 	"os"
 	"os/exec"
 
@@ -10,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgppacket "github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/TykTechnologies/gromit/util/gpgagent"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/openpgp/packet"
@@ -26,7 +30,15 @@ func GetSigningEntity(kid uint64) (*openpgp.Entity, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot find keyring, gpg --export-secret-keys %#x > %s", kid, krFile)
 	}
-	entityList, err := openpgp.ReadKeyRing(signkeyReader)
+	defer signkeyReader.Close()
+	return signingEntity(signkeyReader, kid, getPassphrase)
+}
+
+// signingEntity returns the entity in the keyring r with the signing
+// key kid, which may be a subkey. Only that key is decrypted, with the
+// passphrase for its fingerprint.
+func signingEntity(r io.Reader, kid uint64, passphrase func(fp string) ([]byte, error)) (*openpgp.Entity, error) {
+	entityList, err := openpgp.ReadKeyRing(r)
 	if err != nil {
 		return nil, err
 	}
@@ -38,18 +50,21 @@ func GetSigningEntity(kid uint64) (*openpgp.Entity, error) {
 	if len(keys) < 1 {
 		return nil, fmt.Errorf("No signing key for keyid %d (%#x)", kid, kid)
 	}
-	key := entityList[0]
-	if key.PrivateKey.Encrypted {
-		passphrase, err := getPassphrase(hex.EncodeToString(key.PrivateKey.Fingerprint[:]))
+	key := keys[0].PrivateKey
+	if key == nil {
+		return nil, fmt.Errorf("no private key for keyid %#x in the keyring", kid)
+	}
+	if key.Encrypted {
+		pass, err := passphrase(hex.EncodeToString(key.Fingerprint[:]))
 		if err != nil {
 			return nil, fmt.Errorf("getting passphrase from agent: %w", err)
 		}
-		err = key.PrivateKey.Decrypt(passphrase)
+		err = key.Decrypt(pass)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return key, nil
+	return keys[0].Entity, nil
 }
 
 func getPassphrase(fp string) ([]byte, error) {
@@ -88,3 +103,70 @@ func keyringFile(path string) (*os.File, error) {
 	}
 	return krFile, nil
 }
+
+// ReadKeyRing reads an armored or binary keyring from path, as exported
+// by gpg --export [--armor] or gpg --export-secret-keys [--armor]
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(5); string(head) == "-----" {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+// VerifyDetachedSignature checks the armored or binary signature sig
+// over signed against the keys in kr. The key ID of the issuer is
+// returned whenever the signature can be parsed, even if it does not
+// verify, so that callers can report who signed it.
+func VerifyDetachedSignature(kr openpgp.KeyRing, signed io.Reader, sig []byte) (uint64, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----")) {
+		block, err := armor.Decode(bytes.NewReader(sig))
+		if err != nil {
+			return 0, fmt.Errorf("decoding armored signature: %w", err)
+		}
+		if sig, err = io.ReadAll(block.Body); err != nil {
+			return 0, fmt.Errorf("decoding armored signature: %w", err)
+		}
+	}
+	var keyID uint64
+	p, err := pgppacket.Read(bytes.NewReader(sig))
+	if err != nil {
+		return 0, fmt.Errorf("parsing signature: %w", err)
+	}
+	s, ok := p.(*pgppacket.Signature)
+	if !ok {
+		return 0, fmt.Errorf("expected a signature packet, found %T", p)
+	}
+	if s.IssuerKeyId != nil {
+		keyID = *s.IssuerKeyId
+	}
+	_, err = openpgp.CheckDetachedSignature(kr, signed, bytes.NewReader(sig), nil)
+	return keyID, err
+}
+
+// AgentPrompt is an openpgp.PromptFunction that decrypts the private
+// keys offered by openpgp.ReadMessage with passphrases from gpg-agent
+func AgentPrompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	if symmetric {
+		return nil, fmt.Errorf("symmetrically encrypted messages are not supported")
+	}
+	for _, k := range keys {
+		if k.PrivateKey == nil || !k.PrivateKey.Encrypted {
+			continue
+		}
+		passphrase, err := getPassphrase(hex.EncodeToString(k.PrivateKey.Fingerprint[:]))
+		if err != nil {
+			log.Debug().Err(err).Uint64("keyid", k.PrivateKey.KeyId).Msg("no passphrase")
+			continue
+		}
+		if err := k.PrivateKey.Decrypt(passphrase); err == nil {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("gpg-agent has no passphrase for any of the %d decryption keys", len(keys))
+}
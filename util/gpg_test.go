@@ -0,0 +1,44 @@
+package util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSigningSubkey signs with a subkey of a keyring whose keys are all
+// encrypted, as gpg --export-secret-keys writes them
+func TestSigningSubkey(t *testing.T) {
+	e, err := openpgp.NewEntity("release", "", "release@example.com", nil)
+	require.NoError(t, err)
+	require.NoError(t, e.AddSigningSubkey(nil))
+	sub := e.Subkeys[len(e.Subkeys)-1].PrivateKey
+	require.NoError(t, e.EncryptPrivateKeys([]byte("sekrit"), nil))
+	var kr bytes.Buffer
+	require.NoError(t, e.SerializePrivateWithoutSigning(&kr, nil))
+
+	var asked []string
+	passphrase := func(fp string) ([]byte, error) {
+		asked = append(asked, fp)
+		return []byte("sekrit"), nil
+	}
+	signer, err := signingEntity(bytes.NewReader(kr.Bytes()), sub.KeyId, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, []string{hex.EncodeToString(sub.Fingerprint)}, asked, "only the subkey is decrypted")
+	assert.True(t, signer.PrivateKey.Encrypted)
+
+	var sig bytes.Buffer
+	require.NoError(t, openpgp.DetachSign(&sig, signer, strings.NewReader("manifest"), &packet.Config{SigningKeyId: sub.KeyId}))
+	keyID, err := VerifyDetachedSignature(openpgp.EntityList{signer}, strings.NewReader("manifest"), sig.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, sub.KeyId, keyID)
+
+	_, err = signingEntity(bytes.NewReader(kr.Bytes()), 42, passphrase)
+	assert.Error(t, err)
+}
@@ -7,25 +7,51 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
 var queue = make(chan string, 100)
 
+// pending counts the metrics queued but not yet sent
+var pending sync.WaitGroup
+
 func init() {
 	go statsdSender()
 }
 
 func StatCount(metric string, value int) {
-	queue <- fmt.Sprintf("%s.%s:%d|c", os.Getenv("STATS_API_KEY"), metric, value)
+	enqueue(fmt.Sprintf("%s.%s:%d|c", os.Getenv("STATS_API_KEY"), metric, value))
 }
 
 func StatTime(metric string, took time.Duration) {
-	queue <- fmt.Sprintf("%s.%s:%d|ms", os.Getenv("STATS_API_KEY"), metric, took.Milliseconds())
+	enqueue(fmt.Sprintf("%s.%s:%d|ms", os.Getenv("STATS_API_KEY"), metric, took.Milliseconds()))
 }
 
 func StatGauge(metric string, value int) {
-	queue <- fmt.Sprintf("%s.%s:%d|g", os.Getenv("STATS_API_KEY"), metric, value)
+	enqueue(fmt.Sprintf("%s.%s:%d|g", os.Getenv("STATS_API_KEY"), metric, value))
+}
+
+func enqueue(s string) {
+	pending.Add(1)
+	queue <- s
+}
+
+// StatFlush waits up to timeout for the queued metrics to be sent, so
+// that a command can send its final metrics just before it exits. It
+// reports whether they were all sent.
+func StatFlush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func statsdSender() {
@@ -34,5 +60,6 @@ func statsdSender() {
 			io.WriteString(conn, s)
 			conn.Close()
 		}
+		pending.Done()
 	}
 }